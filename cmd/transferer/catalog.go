@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"pmm-transferer/pkg/dump"
+	"pmm-transferer/pkg/s3"
+	"pmm-transferer/pkg/transferer"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	catalogFormatTable = "table"
+	catalogFormatJSON  = "json"
+)
+
+type catalogEntry struct {
+	Path  string     `json:"path"`
+	Size  int64      `json:"size"`
+	Meta  *dump.Meta `json:"meta,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+// buildCatalog reads meta of all dumps in the directory and its subdirectories.
+// Meta is the last entry of the dump, so each dump is read in full
+func buildCatalog(dir string) ([]catalogEntry, error) {
+	if strings.Contains(dir, "://") {
+		return nil, errors.New("only local directories are supported, sync remote storage to a local directory first")
+	}
+
+	var entries []catalogEntry
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".tar.gz") {
+			return nil
+		}
+
+		log.Debug().Msgf("Reading meta of %s...", path)
+
+		entry := catalogEntry{
+			Path: path,
+			Size: info.Size(),
+		}
+		meta, err := transferer.ReadMetaFromDump(path, false)
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		entry.Meta = meta
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to scan directory")
+	}
+
+	sortCatalog(entries)
+	return entries, nil
+}
+
+// buildS3Catalog reads meta of all dumps by s3://bucket/prefix URL.
+// Each dump is downloaded in full as a stream, without saving it to disk
+func buildS3Catalog(ctx context.Context, client *http.Client, cfg s3.Config, prefixURL string) ([]catalogEntry, error) {
+	objects, err := cfg.List(ctx, client, prefixURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []catalogEntry
+	for _, o := range objects {
+		if !strings.HasSuffix(o.URL, ".tar.gz") {
+			continue
+		}
+
+		log.Debug().Msgf("Reading meta of %s...", o.URL)
+
+		entry := catalogEntry{
+			Path: o.URL,
+			Size: o.Size,
+		}
+		meta, err := readS3Meta(ctx, client, cfg, o.URL)
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		entry.Meta = meta
+		entries = append(entries, entry)
+	}
+
+	sortCatalog(entries)
+	return entries, nil
+}
+
+func readS3Meta(ctx context.Context, client *http.Client, cfg s3.Config, objectURL string) (*dump.Meta, error) {
+	body, err := cfg.Open(ctx, client, objectURL)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return transferer.ReadMetaFromReader(body)
+}
+
+func sortCatalog(entries []catalogEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+}
+
+func printCatalog(entries []catalogEntry, format string) error {
+	if format == catalogFormatJSON {
+		data, err := json.MarshalIndent(entries, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "DUMP\tID\tSIZE\tPMM SERVER\tPMM VERSION\tSOURCES\tSTART\tEND\tNOTES")
+	for _, e := range entries {
+		if e.Meta == nil {
+			_, _ = fmt.Fprintf(w, "%s\t-\t%s\t-\t-\t-\t-\t-\t%s\n", e.Path, ByteCountBinary(e.Size), e.Error)
+			continue
+		}
+		m := e.Meta
+
+		sources := make([]string, 0, len(m.Sources))
+		for _, s := range m.Sources {
+			sources = append(sources, s.Type)
+		}
+
+		start, end := "-", "-"
+		r := m.Range
+		if m.Partial && m.CoveredRange != nil {
+			r = m.CoveredRange
+		}
+		if r != nil {
+			start, end = r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339)
+		}
+
+		var notes []string
+		if m.Partial {
+			notes = append(notes, "partial")
+		}
+		if m.Volumes > 0 {
+			notes = append(notes, fmt.Sprintf("volume %d/%d", m.Volume, m.Volumes))
+		}
+		if m.ParentID != "" {
+			notes = append(notes, "parent "+m.ParentID)
+		}
+
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Path, orDash(m.ID), ByteCountBinary(e.Size),
+			orDash(m.PMMServer), orDash(m.PMMServerVersion), orDash(strings.Join(sources, ",")),
+			start, end, orDash(strings.Join(notes, ", ")))
+	}
+	return w.Flush()
+}
+
+func orDash(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
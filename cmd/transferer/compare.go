@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"pmm-transferer/pkg/clickhouse"
+	"pmm-transferer/pkg/dump"
+	"pmm-transferer/pkg/encryption"
+	"pmm-transferer/pkg/transferer"
+	"pmm-transferer/pkg/victoriametrics"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+)
+
+// seriesSample is a series of the dump chunk to be looked up in the target
+type seriesSample struct {
+	series     victoriametrics.ChunkSeries
+	start, end time.Time
+}
+
+// reservoir keeps a uniformly random sample of fixed size from the stream of items
+type reservoir struct {
+	rnd   *rand.Rand
+	size  int
+	seen  int
+	items []interface{}
+}
+
+func newReservoir(rnd *rand.Rand, size int) *reservoir {
+	return &reservoir{rnd: rnd, size: size}
+}
+
+func (r *reservoir) add(item interface{}) {
+	r.seen++
+	if len(r.items) < r.size {
+		r.items = append(r.items, item)
+		return
+	}
+	if i := r.rnd.Intn(r.seen); i < r.size {
+		r.items[i] = item
+	}
+}
+
+type compareResult struct {
+	source  dump.SourceType
+	total   int
+	sampled int
+	covered int
+	partial int
+	missing int
+	// coverage is the sum of coverage ratios of the samples
+	coverage float64
+	notes    []string
+}
+
+func (r compareResult) percent() float64 {
+	if r.sampled == 0 {
+		return 100
+	}
+	return r.coverage / float64(r.sampled) * 100
+}
+
+type compareOptions struct {
+	sampleSize int
+	seed       int64
+	core, qan  bool
+}
+
+// compareDump checks random samples of the dump series and QAN rows in the target
+func compareDump(ctx context.Context, httpC *fasthttp.Client, cfg PMMConfig, dumpPath string, opts compareOptions) ([]compareResult, error) {
+	seed := opts.seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	log.Debug().Msgf("Sampling dump with seed %d", seed)
+	rnd := rand.New(rand.NewSource(seed))
+
+	seriesSamples := newReservoir(rnd, opts.sampleSize)
+	rowSamples := newReservoir(rnd, opts.sampleSize)
+	var encrypted, downsampled, noKeys int
+
+	err := transferer.WalkDump(dumpPath, func(st dump.SourceType, filename string, r io.Reader) error {
+		if strings.HasSuffix(filename, encryption.FileSuffix) {
+			encrypted++
+			return nil
+		}
+		switch {
+		case st == dump.VictoriaMetrics && opts.core:
+			start, end, ok := victoriametrics.NativeChunkRange(filename)
+			if !ok {
+				downsampled++
+				return nil
+			}
+			content, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			series, err := victoriametrics.NativeChunkSeries(content)
+			if err != nil {
+				return err
+			}
+			for _, s := range series {
+				seriesSamples.add(seriesSample{series: s, start: start, end: end})
+			}
+		case st == dump.ClickHouse && opts.qan:
+			keys, err := clickhouse.ChunkRowKeys(filename, r)
+			if err != nil {
+				return err
+			}
+			if keys == nil {
+				noKeys++
+			}
+			for _, k := range keys {
+				rowSamples.add(k)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []compareResult
+	if opts.core {
+		r, err := compareSeries(httpC, cfg.VictoriaMetricsURL, seriesSamples)
+		if err != nil {
+			return nil, err
+		}
+		if downsampled != 0 {
+			r.notes = append(r.notes, fmt.Sprintf("%d downsampled chunks are not compared", downsampled))
+		}
+		results = append(results, r)
+	}
+	if opts.qan {
+		r, err := compareRows(ctx, cfg.ClickHouseURL, rowSamples)
+		if err != nil {
+			return nil, err
+		}
+		if noKeys != 0 {
+			r.notes = append(r.notes, fmt.Sprintf("%d chunks without %s key columns are not compared", noKeys, clickhouse.MetricsTable))
+		}
+		results = append(results, r)
+	}
+	if encrypted != 0 {
+		for i := range results {
+			results[i].notes = append(results[i].notes, fmt.Sprintf("%d encrypted entries of the dump are not compared", encrypted))
+		}
+	}
+	return results, nil
+}
+
+// compareSeries compares samples count of each sampled series with the target within the chunk range
+func compareSeries(httpC *fasthttp.Client, vmURL string, samples *reservoir) (compareResult, error) {
+	result := compareResult{source: dump.VictoriaMetrics, total: samples.seen}
+	vm := victoriametrics.NewSource(httpC, victoriametrics.Config{ConnectionURL: vmURL})
+
+	for _, item := range samples.items {
+		s := item.(seriesSample)
+		count, err := vm.CountSeriesSamples(s.series.Selector, s.start, s.end)
+		if err != nil {
+			return result, errors.Wrapf(err, "failed to count samples of %s", s.series.Selector)
+		}
+
+		ratio := 1.0
+		if s.series.Samples > 0 && count < s.series.Samples {
+			ratio = float64(count) / float64(s.series.Samples)
+		}
+		result.add(ratio)
+		if ratio < 1 {
+			log.Debug().Msgf("Series %s has %d of %d samples in %s - %s", s.series.Selector, count, s.series.Samples,
+				s.start.Format(time.RFC3339), s.end.Format(time.RFC3339))
+		}
+	}
+	return result, nil
+}
+
+// compareRows checks that each sampled QAN metrics row exists in the target
+func compareRows(ctx context.Context, chURL string, samples *reservoir) (compareResult, error) {
+	result := compareResult{source: dump.ClickHouse, total: samples.seen}
+	if len(samples.items) == 0 {
+		return result, nil
+	}
+
+	ch, err := clickhouse.NewSource(ctx, clickhouse.Config{ConnectionURL: chURL})
+	if err != nil {
+		return result, errors.Wrap(err, "failed to connect to ClickHouse")
+	}
+
+	for _, item := range samples.items {
+		k := item.(clickhouse.RowKey)
+		exists, err := ch.RowExists(k)
+		if err != nil {
+			return result, errors.Wrapf(err, "failed to look up row %s", k)
+		}
+		ratio := 0.0
+		if exists {
+			ratio = 1
+		} else {
+			log.Debug().Msgf("QAN row %s is missing", k)
+		}
+		result.add(ratio)
+	}
+	return result, nil
+}
+
+func (r *compareResult) add(ratio float64) {
+	r.sampled++
+	r.coverage += ratio
+	switch {
+	case ratio >= 1:
+		r.covered++
+	case ratio > 0:
+		r.partial++
+	default:
+		r.missing++
+	}
+}
+
+// printCompareReport prints the report and returns false if coverage of any source is below the minimum
+func printCompareReport(results []compareResult, minCoverage float64) bool {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "SOURCE\tTOTAL\tSAMPLED\tCOVERED\tPARTIAL\tMISSING\tCOVERAGE")
+
+	ok := true
+	var notes []string
+	for _, r := range results {
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%.1f%%\n", r.source, r.total, r.sampled,
+			r.covered, r.partial, r.missing, r.percent())
+		if r.percent() < minCoverage {
+			ok = false
+		}
+		for _, n := range r.notes {
+			notes = append(notes, fmt.Sprintf("%s: %s", r.source, n))
+		}
+	}
+	_ = w.Flush()
+
+	for _, n := range notes {
+		fmt.Printf("  - %s\n", n)
+	}
+
+	if ok {
+		fmt.Println("\nDump data is found in the target, import doesn't need to be re-run")
+	} else {
+		fmt.Printf("\nCoverage is below %.1f%%, import should be re-run\n", minCoverage)
+	}
+	return ok
+}
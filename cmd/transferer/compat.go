@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"pmm-transferer/pkg/clickhouse"
+	"pmm-transferer/pkg/dump"
+	"pmm-transferer/pkg/encryption"
+	"pmm-transferer/pkg/transferer"
+	"pmm-transferer/pkg/victoriametrics"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+type compatStatus string
+
+const (
+	compatPass compatStatus = "PASS"
+	compatWarn compatStatus = "WARN"
+	compatFail compatStatus = "FAIL"
+)
+
+type compatResult struct {
+	check   string
+	status  compatStatus
+	details string
+	hint    string
+}
+
+// dumpSummary is what is compared against the target
+type dumpSummary struct {
+	meta *dump.Meta
+	// columns by table, nil for chunks without header
+	chTables   map[string][]string
+	namespaces map[string]struct{}
+	// encrypted is set if some entries are encrypted and were not checked
+	encrypted bool
+}
+
+func summarizeDump(dumpPath string) (*dumpSummary, error) {
+	summary := &dumpSummary{
+		chTables:   make(map[string][]string),
+		namespaces: make(map[string]struct{}),
+	}
+
+	err := transferer.WalkDump(dumpPath, func(st dump.SourceType, filename string, r io.Reader) error {
+		if strings.HasSuffix(filename, encryption.FileSuffix) {
+			// content of encrypted entries is not checked, as decryption keys may be held by other people
+			summary.encrypted = true
+			return nil
+		}
+		switch st {
+		case dump.UndefinedSource:
+			if filename != dump.MetaFilename {
+				return nil
+			}
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			summary.meta, _, err = dump.ParseMeta(data)
+			return err
+		case dump.VictoriaMetrics:
+			content, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			names, err := victoriametrics.ChunkMetricNames(filename, content)
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				summary.namespaces[metricNamespace(name)] = struct{}{}
+			}
+		case dump.ClickHouse:
+			table, columns, err := clickhouse.ChunkColumns(filename, r)
+			if err != nil {
+				return err
+			}
+			if _, ok := summary.chTables[table]; !ok || columns != nil {
+				summary.chTables[table] = columns
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+func metricNamespace(name string) string {
+	if i := strings.Index(name, "_"); i > 0 {
+		return name[:i]
+	}
+	return name
+}
+
+func checkCompat(ctx context.Context, httpC *fasthttp.Client, cfg PMMConfig, dumpPath string) ([]compatResult, error) {
+	summary, err := summarizeDump(dumpPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read dump")
+	}
+
+	var results []compatResult
+
+	if summary.meta == nil {
+		results = append(results, compatResult{
+			check:   "Dump meta",
+			status:  compatWarn,
+			details: "no meta file found in dump",
+			hint:    "Dump is truncated or was not created by pmm-transferer, no version checks could be performed",
+		})
+	} else {
+		results = append(results, checkPMMVersion(httpC, cfg.PMMURL, summary.meta.PMMServerVersion))
+		results = append(results, checkTransfererVersion(summary.meta.Version))
+		if summary.meta.Partial {
+			results = append(results, compatResult{
+				check:   "Dump completeness",
+				status:  compatWarn,
+				details: "dump is partial",
+				hint:    "Export was aborted, only part of the requested time range would be imported",
+			})
+		}
+	}
+
+	if summary.encrypted {
+		results = append(results, compatResult{
+			check:   "Encrypted entries",
+			status:  compatWarn,
+			details: "some dump entries are encrypted",
+			hint:    "Schema and metric namespaces of encrypted entries are not checked",
+		})
+	}
+
+	if len(summary.chTables) != 0 {
+		results = append(results, checkClickHouseSchema(ctx, cfg.ClickHouseURL, summary.chTables)...)
+	}
+
+	if len(summary.namespaces) != 0 {
+		results = append(results, checkNamespaces(httpC, cfg.VictoriaMetricsURL, summary.namespaces))
+	}
+
+	return results, nil
+}
+
+func checkPMMVersion(httpC *fasthttp.Client, pmmURL, dumpVersion string) compatResult {
+	r := compatResult{check: "PMM version"}
+
+	targetVersion, err := getPMMVersion(pmmURL, httpC)
+	if err != nil {
+		r.status, r.details = compatFail, fmt.Sprintf("failed to get target PMM version: %v", err)
+		r.hint = "Check PMM URL and credentials, see ping command"
+		return r
+	}
+
+	r.details = fmt.Sprintf("dump %s, target %s", dumpVersion, targetVersion)
+	dumpMajor, dumpMinor := majorMinor(dumpVersion)
+	targetMajor, targetMinor := majorMinor(targetVersion)
+	switch {
+	case dumpMajor != targetMajor:
+		r.status = compatFail
+		r.hint = "Metrics and QAN schemas differ between PMM major versions, upgrade target PMM to the version of exported one"
+	case dumpMinor != targetMinor:
+		r.status = compatWarn
+		r.hint = "QAN schema may differ between PMM minor versions, use the same PMM version if import fails"
+	default:
+		r.status = compatPass
+	}
+	return r
+}
+
+// majorMinor returns major and minor parts of the version, e.g. "2" and "21" for 2.21.0-HEAD
+func majorMinor(version string) (string, string) {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return version, ""
+	}
+	return parts[0], parts[1]
+}
+
+func checkTransfererVersion(v dump.TransfererVersion) compatResult {
+	r := compatResult{
+		check:   "Transferer version",
+		details: fmt.Sprintf("dump %s, current %s", v.GitCommit, GitCommit),
+		status:  compatPass,
+	}
+	if v.GitCommit != GitCommit {
+		r.status = compatWarn
+		r.hint = "Dump was created by a different build, use the same pmm-transferer version if import fails"
+	}
+	return r
+}
+
+func checkClickHouseSchema(ctx context.Context, chURL string, dumpTables map[string][]string) []compatResult {
+	tables := make([]string, 0, len(dumpTables))
+	for table := range dumpTables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	var results []compatResult
+	for _, table := range tables {
+		r := compatResult{check: "QAN table " + table}
+
+		chSource, err := clickhouse.NewSource(ctx, clickhouse.Config{
+			ConnectionURL: chURL,
+			Tables:        []string{table},
+		})
+		if err != nil {
+			r.status, r.details = compatFail, err.Error()
+			r.hint = "Table is missing on the target or ClickHouse is not reachable, skip it with --ch-table"
+			results = append(results, r)
+			continue
+		}
+
+		targetColumns, _ := chSource.Columns(table)
+		var missing []string
+		for _, c := range dumpTables[table] {
+			if !containsString(targetColumns, c) {
+				missing = append(missing, c)
+			}
+		}
+
+		switch {
+		case len(missing) != 0:
+			r.status = compatFail
+			r.details = "columns missing on target: " + strings.Join(missing, ", ")
+			r.hint = "Target QAN schema is older than the exported one, upgrade target PMM"
+		case dumpTables[table] == nil:
+			r.status = compatWarn
+			r.details = "dump chunks have no header"
+			r.hint = "Dump was created by an older version, columns are expected to match the target table exactly"
+		default:
+			r.status = compatPass
+			r.details = fmt.Sprintf("%d columns", len(dumpTables[table]))
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+func checkNamespaces(httpC *fasthttp.Client, vmURL string, dumpNamespaces map[string]struct{}) compatResult {
+	r := compatResult{check: "Metric namespaces"}
+
+	names, err := victoriametrics.NewSource(httpC, victoriametrics.Config{ConnectionURL: vmURL}).MetricNames()
+	if err != nil {
+		r.status, r.details = compatFail, fmt.Sprintf("failed to get target metric names: %v", err)
+		r.hint = "Check VictoriaMetrics URL, see ping command"
+		return r
+	}
+
+	targetNamespaces := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		targetNamespaces[metricNamespace(name)] = struct{}{}
+	}
+
+	var missing []string
+	for ns := range dumpNamespaces {
+		if _, ok := targetNamespaces[ns]; !ok {
+			missing = append(missing, ns)
+		}
+	}
+	sort.Strings(missing)
+
+	if len(missing) != 0 {
+		r.status = compatWarn
+		r.details = "not present on target: " + strings.Join(missing, ", ")
+		r.hint = "Target doesn't monitor such services, their dashboards may be not installed"
+		return r
+	}
+	r.status = compatPass
+	r.details = fmt.Sprintf("%d namespaces", len(dumpNamespaces))
+	return r
+}
+
+func containsString(list []string, v string) bool {
+	for _, e := range list {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// printCompatReport prints the report and returns false if any check failed
+func printCompatReport(results []compatResult) bool {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "CHECK\tSTATUS\tDETAILS")
+
+	ok := true
+	var hints []string
+	for _, r := range results {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", r.check, r.status, r.details)
+		if r.status == compatFail {
+			ok = false
+		}
+		if r.hint != "" && r.status != compatPass {
+			hints = append(hints, fmt.Sprintf("%s: %s", r.check, r.hint))
+		}
+	}
+	_ = w.Flush()
+
+	if len(hints) != 0 {
+		fmt.Println("\nRemediation hints:")
+		for _, h := range hints {
+			fmt.Printf("  - %s\n", h)
+		}
+	}
+
+	return ok
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+)
+
+// backendDialer resolves hosts of the HTTP backends with its own DNS cache. With pinning hosts are resolved
+// once per run, so all requests go to the same backend, even if the hostname flips between load balancer backends
+type backendDialer struct {
+	refresh time.Duration
+	pin     bool
+	dialer  net.Dialer
+
+	mu    sync.Mutex
+	hosts map[string]resolvedHost
+}
+
+type resolvedHost struct {
+	ips      []net.IP
+	resolved time.Time
+}
+
+func newBackendDialer(refresh time.Duration, pin bool) *backendDialer {
+	return &backendDialer{
+		refresh: refresh,
+		pin:     pin,
+		dialer:  net.Dialer{Timeout: fasthttp.DefaultDialTimeout},
+		hosts:   make(map[string]resolvedHost),
+	}
+}
+
+// Dial connects to the first reachable address of the host, or to the pinned one
+func (d *backendDialer) Dial(addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := d.resolve(host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = d.dialer.Dial("tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (d *backendDialer) resolve(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	cached, ok := d.hosts[host]
+	if ok && (d.pin || time.Since(cached.resolved) < d.refresh) {
+		return cached.ips, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fasthttp.DefaultDialTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		if ok {
+			log.Warn().Err(err).Msgf("Failed to refresh addresses of %s, using the previous ones", host)
+			return cached.ips, nil
+		}
+		return nil, errors.Wrapf(err, "failed to resolve %s", host)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.Errorf("no addresses of %s", host)
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	// IPv4 addresses are preferred, as by the default dialer
+	sort.SliceStable(ips, func(i, j int) bool {
+		return ips[i].To4() != nil && ips[j].To4() == nil
+	})
+
+	if d.pin {
+		ips = ips[:1]
+		log.Info().Msgf("Pinned %s to %s for the whole run", host, ips[0])
+	} else if ok && !sameIPs(cached.ips, ips) {
+		log.Info().Msgf("Addresses of %s changed from %v to %v", host, cached.ips, ips)
+	}
+	d.hosts[host] = resolvedHost{ips: ips, resolved: time.Now()}
+	return ips, nil
+}
+
+func sameIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"pmm-transferer/pkg/transferer"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	doctorMinOpenFiles = 1024
+	doctorMinMemory    = 512 << 20
+)
+
+type doctorOptions struct {
+	// pmmConfig is nil if PMM URL isn't set, then only local environment is checked
+	pmmConfig *PMMConfig
+	chTables  []string
+	dir       string
+	minFree   uint64
+	// nodeLabel and node select PMM Server host in load checker queries
+	nodeLabel string
+	node      string
+}
+
+// doctorHints explain the failed connectivity checks
+var doctorHints = map[string]string{
+	pmmAuthCheck:   "Check PMM URL and credentials, e.g. open PMM_URL/v1/version in the browser",
+	"VM export":    "Check victoria-metrics-url or that PMM Server exposes /prometheus",
+	"VM import":    "Check that the user has Admin role in PMM",
+	"CH read":      "Check click-house-url: ClickHouse port 9000 is usually not published by PMM Server container",
+	"CH write":     "Check that the ClickHouse user may insert into the tables",
+	"Load checker": "Use --ignore-load on export or --load-checker-datasource if VictoriaMetrics isn't reachable directly",
+}
+
+// runDoctor checks local environment, connectivity and versions, and prints the report to be attached to the support request.
+// It returns false if any check failed
+func runDoctor(ctx context.Context, httpC *fasthttp.Client, opts doctorOptions) bool {
+	fmt.Println("pmm-transferer doctor report")
+	fmt.Printf("Time:       %s\n", time.Now().UTC().Format(time.RFC3339))
+	fmt.Printf("Version:    %s (branch %s)\n", GitCommit, GitBranch)
+	fmt.Printf("Platform:   %s/%s, %s\n", runtime.GOOS, runtime.GOARCH, runtime.Version())
+	fmt.Printf("CPUs:       %d available, %d on host\n", transferer.AvailableCPUs(), runtime.NumCPU())
+	if opts.pmmConfig != nil {
+		fmt.Printf("PMM URL:    %s\n", redactURL(opts.pmmConfig.PMMURL))
+		fmt.Printf("VM URL:     %s\n", redactURL(opts.pmmConfig.VictoriaMetricsURL))
+		fmt.Printf("CH URL:     %s\n", redactURL(opts.pmmConfig.ClickHouseURL))
+	}
+	fmt.Println()
+
+	results := []compatResult{
+		checkLocalDisk(opts.dir, opts.minFree),
+		checkOpenFiles(),
+		checkMemory(),
+	}
+
+	if opts.pmmConfig == nil {
+		results = append(results, compatResult{
+			check:   "Connectivity",
+			status:  compatWarn,
+			details: "PMM URL is not set",
+			hint:    "Set --pmm-url or --profile to check connectivity, auth and versions",
+		})
+	} else {
+		results = append(results, checkPMMServerVersion(httpC, opts.pmmConfig.PMMURL))
+		lc := transferer.LoadCheckerConfig{
+			ConnectionURL: opts.pmmConfig.VictoriaMetricsURL,
+			NodeLabel:     opts.nodeLabel,
+			NodeValue:     opts.node,
+		}
+		for _, c := range pingChecks(ctx, httpC, *opts.pmmConfig, opts.chTables, lc) {
+			if c.name == pmmAuthCheck {
+				// replaced by the version check
+				continue
+			}
+			start := time.Now()
+			err := c.fn()
+			latency := time.Since(start).Round(time.Millisecond)
+			if err != nil {
+				results = append(results, compatResult{
+					check:   c.name,
+					status:  compatFail,
+					details: err.Error(),
+					hint:    doctorHints[c.name],
+				})
+				continue
+			}
+			results = append(results, compatResult{
+				check:   c.name,
+				status:  compatPass,
+				details: fmt.Sprintf("reachable in %v", latency),
+			})
+		}
+	}
+
+	return printCompatReport(results)
+}
+
+func checkPMMServerVersion(httpC *fasthttp.Client, pmmURL string) compatResult {
+	r := compatResult{check: pmmAuthCheck}
+	version, err := getPMMVersion(pmmURL, httpC)
+	if err != nil {
+		r.status, r.details = compatFail, err.Error()
+		r.hint = doctorHints[pmmAuthCheck]
+		return r
+	}
+	r.status, r.details = compatPass, "PMM Server "+version
+	return r
+}
+
+func checkLocalDisk(dir string, minFree uint64) compatResult {
+	r := compatResult{check: "Local disk space"}
+	free, err := freeDiskSpace(dir)
+	if err != nil {
+		r.status, r.details = compatWarn, fmt.Sprintf("unknown for %s: %v", dir, err)
+		return r
+	}
+	r.details = fmt.Sprintf("%s free in %s", ByteCountBinary(int64(free)), dir)
+	if free < minFree {
+		r.status = compatWarn
+		r.hint = "Dump may not fit: use --dump-path on a larger volume, --stdout or upload the dump by parts"
+		return r
+	}
+	r.status = compatPass
+	return r
+}
+
+func checkOpenFiles() compatResult {
+	r := compatResult{check: "Open files limit"}
+	limit, err := openFilesLimit()
+	if err != nil {
+		r.status, r.details = compatPass, fmt.Sprintf("unknown: %v", err)
+		return r
+	}
+	r.details = strconv.FormatUint(limit, 10)
+	if limit < doctorMinOpenFiles {
+		r.status = compatWarn
+		r.hint = fmt.Sprintf("Many workers may run out of file descriptors, raise the limit with `ulimit -n %d`", doctorMinOpenFiles)
+		return r
+	}
+	r.status = compatPass
+	return r
+}
+
+func checkMemory() compatResult {
+	r := compatResult{check: "Available memory"}
+	available, err := availableMemory()
+	if err != nil {
+		r.status, r.details = compatPass, fmt.Sprintf("unknown: %v", err)
+		return r
+	}
+	r.details = ByteCountBinary(int64(available))
+	if available < doctorMinMemory {
+		r.status = compatWarn
+		r.hint = "Chunks are kept in memory while they are read and written, reduce --workers and --chunk-time-range"
+		return r
+	}
+	r.status = compatPass
+	return r
+}
+
+// availableMemory returns available memory on Linux, limited by the cgroup memory limit of the container
+func availableMemory() (uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, errors.New("not supported on the platform")
+	}
+	defer f.Close()
+
+	var available uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, errors.Wrap(err, "failed to parse /proc/meminfo")
+			}
+			available = kb << 10
+			break
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+	if available == 0 {
+		return 0, errors.New("MemAvailable is not found in /proc/meminfo")
+	}
+
+	// cgroup v2 and v1 limits, unlimited cgroup v1 limit is a huge number
+	for _, path := range []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"} {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		limit, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			// "max" is no limit
+			break
+		}
+		if limit < available {
+			available = limit
+		}
+		break
+	}
+	return available, nil
+}
+
+// redactURL hides password of the URL, so the report can be shared
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<invalid URL>"
+	}
+	q := u.Query()
+	if q.Get("password") != "" {
+		q.Set("password", "xxxxx")
+		u.RawQuery = q.Encode()
+	}
+	return u.Redacted()
+}
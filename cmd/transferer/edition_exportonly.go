@@ -0,0 +1,8 @@
+//go:build exportonly
+// +build exportonly
+
+package main
+
+// exportOnly build runs export to STDOUT only. Other commands are behind the constant checks,
+// so their code isn't linked into the binary, while all flags are parsed as by the full build
+const exportOnly = true
@@ -0,0 +1,7 @@
+//go:build !exportonly
+// +build !exportonly
+
+package main
+
+// exportOnly is set in the export-only build, see edition_exportonly.go
+const exportOnly = false
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// errLocked is returned by tryLockFile if the file is locked by another process
+var errLocked = errors.New("locked")
+
+// targetLock is the advisory lock of PMM Server, so concurrent transferer runs don't load the same server.
+// The lock file is locked while the process runs, so locks of killed processes are released by the OS
+// and their files are reused
+type targetLock struct {
+	f *os.File
+}
+
+const (
+	// lockDirMode lets runs of all users of the group share the directory, setgid keeps the group of its files
+	lockDirMode  = 0775 | os.ModeSetgid
+	lockFileMode = 0664
+)
+
+// lockKey returns the lock key of the server: its host, so connection strings with different credentials,
+// schemes or paths of the same server share the lock
+func lockKey(pmmURL string) string {
+	host := pmmURL
+	if u, err := url.Parse(pmmURL); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	return strings.ToLower(host)
+}
+
+// acquireTargetLock locks the server for the command. Errors other than the server being locked by another run
+// are logged only, so a shared lock directory without access doesn't block transfers
+func acquireTargetLock(dir, pmmURL, command string) (*targetLock, error) {
+	key := lockKey(pmmURL)
+	sum := sha256.Sum256([]byte(key))
+	path := filepath.Join(dir, hex.EncodeToString(sum[:8])+".lock")
+
+	l, err := lockFile(dir, path)
+	if err == errLocked {
+		holder, _ := ioutil.ReadFile(path)
+		return nil, errors.Errorf("PMM Server %s is used by another transferer run (%s). "+
+			"Wait for it to finish or use --no-lock to run concurrently", key, strings.TrimSpace(string(holder)))
+	}
+	if err != nil {
+		log.Warn().Msgf("Failed to lock PMM Server %s, concurrent runs are not prevented: %v", key, err)
+		return nil, nil
+	}
+
+	// holder info is for the message of the runs waiting for the lock
+	info := fmt.Sprintf("pid %d, %s, started %s", os.Getpid(), command, time.Now().Format(time.RFC3339))
+	if err = l.f.Truncate(0); err == nil {
+		_, err = l.f.WriteAt([]byte(info+"\n"), 0)
+	}
+	if err != nil {
+		log.Debug().Msgf("Failed to write lock holder info: %v", err)
+	}
+	log.Debug().Msgf("Locked PMM Server %s with %s", key, path)
+	return l, nil
+}
+
+func lockFile(dir, path string) (*targetLock, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err = os.MkdirAll(dir, 0775); err != nil {
+			return nil, err
+		}
+		// mode of the created directory is limited by umask
+		if err = os.Chmod(dir, lockDirMode); err != nil {
+			log.Debug().Msgf("Failed to make lock directory group-writable: %v", err)
+		}
+	}
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, lockFileMode)
+		if err != nil {
+			return nil, err
+		}
+		// the file may be created by this run, it's reused by runs of other users of the group
+		_ = f.Chmod(lockFileMode)
+		if err = tryLockFile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		// the file may be removed by the previous holder after it was opened, then the lock is taken again
+		fi, ferr := f.Stat()
+		pi, perr := os.Stat(path)
+		if ferr == nil && perr == nil && os.SameFile(fi, pi) {
+			return &targetLock{f: f}, nil
+		}
+		f.Close()
+		if perr != nil && !os.IsNotExist(perr) {
+			return nil, perr
+		}
+	}
+}
+
+// release removes the lock file and unlocks it, it's safe to call on nil lock
+func (l *targetLock) release() {
+	if l == nil {
+		return
+	}
+	if err := os.Remove(l.f.Name()); err != nil {
+		log.Debug().Msgf("Failed to remove lock file: %v", err)
+	}
+	l.f.Close()
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// defaultLockDir is shared by runs of all users, unlike the temporary directory, which may be set per user
+func defaultLockDir() string {
+	return "/var/lock/pmm-transferer"
+}
+
+// tryLockFile locks the file without waiting, the lock is released when the file is closed or the process exits
+func tryLockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLocked
+	}
+	return err
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+func defaultLockDir() string {
+	return filepath.Join(os.TempDir(), "pmm-transferer-locks")
+}
+
+func tryLockFile(f *os.File) error {
+	return errors.New("not supported on Windows")
+}
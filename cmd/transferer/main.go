@@ -5,15 +5,29 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/valyala/fasthttp"
+	"io"
 	"os"
+	"path/filepath"
 	"pmm-transferer/pkg/clickhouse"
+	"pmm-transferer/pkg/download"
 	"pmm-transferer/pkg/dump"
+	"pmm-transferer/pkg/encryption"
 	"pmm-transferer/pkg/grafana"
+	"pmm-transferer/pkg/planner"
+	"pmm-transferer/pkg/plugin"
+	"pmm-transferer/pkg/remap"
+	"pmm-transferer/pkg/requestid"
+	"pmm-transferer/pkg/s3"
 	"pmm-transferer/pkg/transferer"
+	"pmm-transferer/pkg/transform"
+	"pmm-transferer/pkg/upload"
 	"pmm-transferer/pkg/victoriametrics"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/alecthomas/kingpin"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -28,52 +42,396 @@ func main() {
 		cli = kingpin.New("pmm-transferer", "Percona PMM Transferer")
 
 		// general options
+		configPath = cli.Flag(configFlag, "YAML config file with named connection profiles").Default(defaultConfigPath()).String()
+		profile    = cli.Flag(profileFlag, "Connection profile from the config file, its settings are used for flags "+
+			"not set on the command line or by environment variables").String()
+
 		pmmURL = cli.Flag("pmm-url", "PMM connection string").String()
 
 		victoriaMetricsURL = cli.Flag("victoria-metrics-url", "VictoriaMetrics connection string").String()
 		clickHouseURL      = cli.Flag("click-house-url", "ClickHouse connection string").String()
 
+		clickHouseTables = cli.Flag("ch-table", "ClickHouse table to export/import. Use multiple times to process multiple tables").
+					Default(clickhouse.MetricsTable).Strings()
+
 		dumpCore = cli.Flag("dump-core", "Specify to export/import core metrics").Default("true").Bool()
 		dumpQAN  = cli.Flag("dump-qan", "Specify to export/import QAN metrics").Bool()
 
 		enableVerboseMode  = cli.Flag("verbose", "Enable verbose mode").Short('v').Bool()
 		allowInsecureCerts = cli.Flag("allow-insecure-certs",
 			"Accept any certificate presented by the server and any host name in that certificate").Bool()
+		userAgent = cli.Flag("user-agent", "User-Agent of HTTP requests, allows server-side logs and rate limits "+
+			"to distinguish transferer traffic").Default(defaultUserAgent()).String()
+		tagRequests = cli.Flag("request-id", "Tag each chunk request with unique ID: X-Request-ID header for VictoriaMetrics, "+
+			"query ID for ClickHouse. IDs are logged on failures to find requests in the server logs").Bool()
+		httpKeepAlive = cli.Flag("http-keep-alive", "Reuse HTTP connections between requests, "+
+			"use --no-http-keep-alive to open a new connection for each request").Default("true").Bool()
+		httpMaxConnDuration = cli.Flag("http-max-conn-duration", "Reconnect reused HTTP connections after the duration, "+
+			"so refreshed DNS addresses take effect. 0 for no limit").Default("0").Duration()
+		dnsRefreshInterval = cli.Flag("dns-refresh-interval", "Period of resolving HTTP backend hosts again").Default("1m").Duration()
+		pinBackendIP       = cli.Flag("pin-backend-ip", "Resolve each HTTP backend host once per run, so all requests go "+
+			"to the same backend behind the load balancer").Bool()
 
 		dumpPath = cli.Flag("dump-path", "Path to dump file").Short('d').String()
 
+		// S3-compatible storage options
+		s3Endpoint  = cli.Flag("s3-endpoint", "S3-compatible storage endpoint, e.g. MinIO or Ceph. AWS S3 is used if not set").String()
+		s3Region    = cli.Flag("s3-region", "S3 region used to sign requests").Default("us-east-1").String()
+		s3PathStyle = cli.Flag("s3-path-style", "Use path-style addressing (endpoint/bucket/key), usually required by MinIO").Bool()
+
+		errorReportPath = cli.Flag("error-report", "Path to write error report to on failed export/import. "+
+			"Set to empty string to disable").Default(transferer.DefaultErrorReportPath).String()
+		heartbeatInterval = cli.Flag("heartbeat-interval", "Period of logging export/import pipeline statistics, 0 to disable").
+					Default("5m").Duration()
+		loadCheckerNodeLabel = cli.Flag("load-checker-node-label", "Label identifying PMM Server host "+
+			"in load checker CPU and RAM queries").Default(transferer.DefaultNodeLabel).String()
+		loadCheckerNode = cli.Flag("load-checker-node", "Value of load-checker-node-label of PMM Server host, "+
+			"'auto' to detect the node reporting CPU metrics").Default(transferer.DefaultNodeValue).String()
+		runTimeout = cli.Flag("timeout", "Time limit of the whole run, export is finalized as partial dump at the deadline "+
+			"(kept as DUMP.partial.tar.gz) and import is failed. 0 for no limit").Default("0").Duration()
+		stallTimeout = cli.Flag("stall-timeout", "Time without any chunk progress export/import is considered stalled after, "+
+			"0 to disable stall detection").Default("30m").Duration()
+		stallAction = cli.Flag("stall-action", "Action on stall: warn logs the blocked stage, abort also fails export/import").
+				Default(stallActionWarn).Enum(stallActionWarn, stallActionAbort)
+		auditLogPath = cli.Flag("audit-log", "Path to append-only audit log of export/import operations. "+
+			"Audit is disabled if not set").String()
+		noLock = cli.Flag("no-lock", "Don't lock PMM Server, so export/import can run concurrently "+
+			"with other runs against the same server").Bool()
+		lockDir = cli.Flag("lock-dir", "Directory of PMM Server lock files, shared by all runs on the host").
+			Default(defaultLockDir()).String()
+		assumeYes = cli.Flag("yes", "Don't ask for confirmations, e.g. before import into PMM Server. "+
+			"Prompts are shown only when run in a terminal").Bool()
+
+		// dump entries encryption options
+		metricsKeyFile = cli.Flag("metrics-encryption-key-file", "Encrypt/decrypt VictoriaMetrics entries of the dump "+
+			"with 256-bit key from the file (raw or hex)").ExistingFile()
+		qanKeyFile = cli.Flag("qan-encryption-key-file", "Encrypt/decrypt ClickHouse (QAN) entries of the dump "+
+			"with 256-bit key from the file (raw or hex)").ExistingFile()
+
+		// external sources options
+		plugins = cli.Flag("plugin", "External executable exporting/importing its own data as dump source NAME, "+
+			"use multiple times to add multiple plugins, e.g. --plugin=inventory=/usr/local/bin/inventory-plugin").StringMap()
+		pluginTimeout = cli.Flag("plugin-timeout", "Time limit of a single plugin run, 0 for no limit").Default("10m").Duration()
+
+		// chunk transformation options
+		transforms = cli.Flag("transform", "Command transforming each chunk between read and write: it gets chunk content on stdin "+
+			"and prints transformed content, empty output drops the chunk. Use multiple times to chain commands").Strings()
+		transformTimeout = cli.Flag("transform-timeout", "Time limit of a single chunk transformation, 0 for no limit").Default("1m").Duration()
+
+		// backend protection options
+		maxVMRequests = cli.Flag("max-vm-requests", "Max concurrent chunk requests to VictoriaMetrics, independent of the number of workers "+
+			"holding chunks in memory. 0 for no limit").Default("0").Int()
+		maxCHRequests = cli.Flag("max-ch-requests", "Max concurrent chunk queries to ClickHouse, independent of the number of workers "+
+			"holding chunks in memory. 0 for no limit").Default("0").Int()
+
+		// upload options
+		uploadURL = cli.Flag("upload-url", "Percona support file upload endpoint (tus protocol) or S3 URL s3://bucket/key, "+
+			"dump file name is appended to the key ending with slash").String()
+		uploadChunkSize = cli.Flag("upload-chunk-size", "Size of a single upload request body or S3 part, at least 5MB for S3").Default("8MB").Bytes()
+		uploadMinChunk  = cli.Flag("upload-min-chunk-size", "Minimal size upload request body is reduced to when the endpoint throttles uploads").Default("1MB").Bytes()
+		uploadParallel  = cli.Flag("upload-concurrency", "Number of S3 parts uploaded at once").Default("4").Int()
+		uploadKeyFile   = cli.Flag("upload-encryption-key-file", "Encrypt dump on the client before upload with a random data key, "+
+			"wrapped by 256-bit key from the file (raw or hex)").ExistingFile()
+		uploadBandwidth = cli.Flag("upload-bandwidth", "Upload bandwidth limit per second, 0 for no limit").Default("0").Bytes()
+
 		// export command options
-		exportCmd = cli.Command("export", "Export PMM Server metrics to dump file."+
-			"By default only the 4 last hours are exported, but it can be configured via start-ts/end-ts options")
+		exportCmd = cli.Command("export", "Export PMM Server metrics to dump file. "+
+			"By default all available data is exported, but it can be configured via start-ts/end-ts options")
 
 		start = exportCmd.Flag("start-ts",
 			"Start date-time to filter exported metrics, ex. "+time.RFC3339).String()
 		end = exportCmd.Flag("end-ts",
 			"End date-time to filter exported metrics, ex. "+time.RFC3339).String()
+		chReplicaURL = exportCmd.Flag("ch-replica-url", "ClickHouse read-only replica connection string to export QAN metrics from, "+
+			"so export doesn't compete with live QAN ingestion on the primary").String()
+		consistent = exportCmd.Flag("consistent", "Read all chunks up to the same read point, "+
+			"so data ingested during long export doesn't get into some chunks only. It's best-effort, not a snapshot").Bool()
+		consistentLag = exportCmd.Flag("consistent-lag", "Ingestion delay: read point of consistent export "+
+			"is at most current time minus the lag").Default("2m").Duration()
+		maxAutoRange = exportCmd.Flag("max-auto-range", "Max time range to export when start-ts is not specified "+
+			"and start is detected by the oldest available data").Default("720h").Duration()
 
 		tsSelector = exportCmd.Flag("ts-selector", "Time series selector to pass to VM").String()
 		where      = exportCmd.Flag("where", "ClickHouse only. WHERE statement").Short('w').String()
 
+		noQueryExamples = exportCmd.Flag("no-query-examples", "Exclude query examples and fingerprints from QAN metrics").Bool()
+		qanAggregate    = exportCmd.Flag("qan-aggregate", "Aggregate QAN metrics rows by query and service into periods "+
+			"of the duration, e.g. 1h for long-term trends. Raw per-minute rows are exported by default").Default("0").Duration()
+		chColumns = exportCmd.Flag("ch-columns", "Comma-separated QAN metrics table columns to export, "+
+			"e.g. to export aggregate query metrics only. All columns by default").String()
+
 		instances  = exportCmd.Flag("instance", "Service name to filter instances. Use multiple times to filter by multiple instances").Strings()
 		dashboards = exportCmd.Flag("dashboard", "Dashboard name to filter. Use multiple times to filter by multiple dashboards").Strings()
 
+		maxSeriesPerMetric = exportCmd.Flag("max-series-per-metric", "Skip core metrics having more series than specified").Int()
+		dropMetricsRegex   = exportCmd.Flag("drop-metrics-regex", "Skip core metrics with names matching the regex").String()
+		includeMetrics     = exportCmd.Flag("include-metrics", "File with core metric name globs, one per line: "+
+			"only matching metrics are exported").PlaceHolder("FILE").String()
+		excludeMetrics = exportCmd.Flag("exclude-metrics", "File with core metric name globs, one per line: "+
+			"matching metrics are not exported").PlaceHolder("FILE").String()
+		recordingRulesOnly = exportCmd.Flag("recording-rules-only", "Export only core metrics produced by recording rules, "+
+			"for small dumps of KPIs without raw data").Bool()
+		recordingRulePrefixes = exportCmd.Flag("recording-rule-prefix", "Name prefix of recording rule metrics, implies recording-rules-only. "+
+			"Names with ':' by default. Use multiple times to set multiple prefixes").Strings()
+
 		chunkTimeRange = exportCmd.Flag("chunk-time-range", "Time range to be fit into a single chunk (core metrics). "+
 			"5 minutes by default, example '45s', '5m', '1h'").Default("5m").Duration()
+		alignChunks = exportCmd.Flag("align-chunks", "Align core metrics chunk boundaries to multiples of the interval, "+
+			"start time is moved back to the boundary. Chunk time range should be a multiple of it").Duration()
+		withDownsampled = exportCmd.Flag("with-downsampled", "Additionally export core metrics downsampled to the specified "+
+			"resolution by taking the last sample of each step, example '5m'").Duration()
 		chunkRows = exportCmd.Flag("chunk-rows", "Amount of rows to fit into a single chunk (qan metrics)").Default("1000").Int()
-
-		ignoreLoad = exportCmd.Flag("ignore-load", "Disable checking for load threshold values").Bool()
-		maxLoad    = exportCmd.Flag("max-load", "Max load threshold values").
-				Default(fmt.Sprintf("%v=50,%v=50", transferer.ThresholdCPU, transferer.ThresholdRAM)).String()
+		chunkBy   = exportCmd.Flag("chunk-by", "Split each core metrics chunk into chunks of series with the same value "+
+			"of the label, e.g. service_name or __name__").String()
+		chunkPlanners = exportCmd.Flag("chunk-planner", "Command rewriting the list of chunks: it gets JSON array of chunks on stdin "+
+			"and prints JSON array of chunks to be exported. Use multiple times to chain commands").Strings()
+		chunkPlannerTimeout = exportCmd.Flag("chunk-planner-timeout", "Time limit of a single chunk planner run, 0 for no limit").Default("1m").Duration()
+
+		ignoreLoad    = exportCmd.Flag("ignore-load", "Disable checking for load threshold values, same as --load-check-mode=off").Bool()
+		loadCheckMode = exportCmd.Flag("load-check-mode", "Load check mode: enforce pauses, paces and aborts export by thresholds, "+
+			"warn only logs threshold breaches, off disables checking").
+			Default(loadCheckEnforce).Enum(loadCheckEnforce, loadCheckWarn, loadCheckOff)
+		maxLoad = exportCmd.Flag("max-load", "Max load threshold values").
+			Default(fmt.Sprintf("%v=50,%v=50", transferer.ThresholdCPU, transferer.ThresholdRAM)).String()
 		criticalLoad = exportCmd.Flag("critical-load", "Critical load threshold values").
 				Default(fmt.Sprintf("%v=70,%v=70", transferer.ThresholdCPU, transferer.ThresholdRAM)).String()
 
+		maxPacingDelay = exportCmd.Flag("max-pacing-delay", "Max delay between chunk reads, applied proportionally "+
+			"when load is above half of max load threshold. Set to 0 to disable pacing").Default("5s").Duration()
+		useSchedule = exportCmd.Flag("schedule", "Apply load thresholds and pacing of the config file schedule by time of day, "+
+			"use --no-schedule to disable").Default("true").Bool()
+
+		loadCheckerDatasource = exportCmd.Flag("load-checker-datasource", "Grafana datasource name to query load thresholds "+
+			"through Grafana datasource proxy, when VM is not reachable directly").String()
+		grafanaAPIKey = exportCmd.Flag("grafana-api-key", "Grafana API key to authorize datasource proxy requests").String()
+
 		stdout = exportCmd.Flag("stdout", "Redirect output to STDOUT").Bool()
 
-		workersCount = exportCmd.Flag("workers", "Set the number of reading workers").Int()
+		metaOnly = exportCmd.Flag("meta-only", "Print only the dump meta to STDOUT without exporting data, "+
+			"e.g. for cataloging systems").Bool()
+
+		parentDumpID = exportCmd.Flag("parent-dump-id", "ID of the dump the new one is derived from, "+
+			"e.g. the previous dump of incremental exports").String()
+		userMeta = exportCmd.Flag("meta", "User metadata to store in the dump meta, e.g. --meta=ticket=12345. "+
+			"Use multiple times to set multiple keys").PlaceHolder("KEY=VALUE").StringMap()
+
+		workersCount = exportCmd.Flag("workers", "Set the number of reading workers. "+
+			"By default equals to the number of available CPUs, respecting container CPU limits").Int()
+		workerRampUp = exportCmd.Flag("worker-ramp-up", "Start export with one reading worker and add one more every interval "+
+			"while load status is OK and chunk read latency doesn't double, 0 to start all workers at once").Default("0").Duration()
+		writeWorkersCount = exportCmd.Flag("write-workers", "Set the number of workers compressing chunks into the dump. "+
+			"Each worker writes to its own temporary file next to the dump, which are concatenated in the end").Default("1").Int()
+		metricsCodec = exportCmd.Flag("metrics-codec", "Codec of core metrics chunk payloads: zstd, gzip or none "+
+			"with optional level, ex. zstd:3. Payloads are stored as read from VictoriaMetrics (gzip) by default").String()
+		qanCodec = exportCmd.Flag("qan-codec", "Codec of QAN chunk payloads: zstd, gzip or none with optional level, "+
+			"ex. zstd:9. Payloads are stored as read from ClickHouse (plain TSV) by default").String()
+
+		archivePerms = exportCmd.Flag("archive-perms", "File mode of the dump archive entries (octal)").
+				Default(fmt.Sprintf("%04o", transferer.DefaultEntryMode)).String()
+		archiveOwner = exportCmd.Flag("archive-owner", "Owner user and group names of the dump archive entries, "+
+			"ex. 'pmm:pmm'").String()
+		preserveTimes = exportCmd.Flag("preserve-times", "Set dump archive entries modification time to the time they're written. "+
+			"By default Unix epoch is used to get reproducible archives").Bool()
+
+		chunksOrder = exportCmd.Flag("order", "Order of chunks export: oldest-first or newest-first. "+
+			"With newest-first aborted export still contains the most recent data").
+			Default(orderOldestFirst).Enum(orderOldestFirst, orderNewestFirst)
+
+		shards = exportCmd.Flag("shards", "Split export into the number of volumes written concurrently by independent pipelines. "+
+			"Volumes are named like DUMP.volN.tar.gz, import takes DUMP.tar.gz path to process all of them").Default("1").Int()
+
+		vmExportParams = exportCmd.Flag("vm-export-param", "Parameter passed to VictoriaMetrics native export API, "+
+			"e.g. extra_filters[]={env=\"prod\"}. Use multiple times to set multiple params").PlaceHolder("KEY=VALUE").StringMap()
+
+		chunkAttempts = exportCmd.Flag("chunk-attempts", "Number of attempts to read a core metrics chunk, "+
+			"when the export stream breaks or server fails").Default("3").Int()
+		chunkSampleCheck = exportCmd.Flag("chunk-sample-check", "Compare samples of a core metrics chunk with their amount counted by "+
+			"VictoriaMetrics before reading it: fail, warn after all chunk-attempts, or off").
+			Default(victoriametrics.SampleCheckFail).Enum(victoriametrics.SampleCheckFail, victoriametrics.SampleCheckWarn, victoriametrics.SampleCheckOff)
+
+		checksumFile = exportCmd.Flag("checksum-file", "Write SHA-256 sum of the dump to DUMP.sha256 file next to it, "+
+			"use --no-checksum-file to disable").Default("true").Bool()
+
+		keepPartial = exportCmd.Flag("keep-partial", "Keep DUMP.part file of the export failed before the dump was finalized, "+
+			"it's removed by default. Dumps of aborted export are always kept as DUMP.partial.tar.gz").Bool()
+		exportIgnoreErrors = exportCmd.Flag("ignore-errors", "Continue export when a chunk fails to be read, "+
+			"failed chunks are recorded in the dump meta").Bool()
+		readCacheDir = exportCmd.Flag("read-cache", "Directory to cache chunks read from PMM Server in, "+
+			"so exports of overlapping ranges reuse them").PlaceHolder("DIR").String()
+		readCacheTTL = exportCmd.Flag("read-cache-ttl", "Time cached chunks are reused for, 0 for no limit").Default("24h").Duration()
+		journalPath  = exportCmd.Flag("journal", "Append export progress and written chunks as JSON lines to the file, "+
+			"or to STDERR if set to 'stderr', so piped export can be monitored").PlaceHolder("PATH").String()
+		splitRuns = exportCmd.Flag("split-runs", "Split the time range into sequential export runs of the interval (e.g. 24h), "+
+			"each writing its own dump and journal to dump-path directory. Runs with existing dumps are skipped").Duration()
+
+		uploadToSupport = exportCmd.Flag("upload-to-support", "Upload finished dump to Percona support for the specified ticket").
+				PlaceHolder("TICKET").String()
+
 		// import command options
 		importCmd = cli.Command("import", "Import PMM Server metrics from dump file")
 
-		// show meta command options
+		// upload command options
+		uploadCmd    = cli.Command("upload", "Upload dump file to Percona support")
+		uploadTicket = uploadCmd.Flag("ticket", "Percona support ticket the dump belongs to").Required().String()
+
+		remapFile = importCmd.Flag("remap-file", "YAML file mapping old label/column values to new ones, "+
+			"applied to both core and QAN metrics").ExistingFile()
+		routeFile = importCmd.Flag("route-file", "YAML file routing origins of fan-in dump to import targets, "+
+			"dump is imported into each target in turn, see README").ExistingFile()
+		routeTarget = importCmd.Flag("route-target", "Route file target to import into, set for each target "+
+			"when route-file is used").Hidden().String()
+		importDownsampled   = importCmd.Flag("import-downsampled", "Import downsampled core metrics instead of raw ones").Bool()
+		importChunkAttempts = importCmd.Flag("chunk-attempts", "Number of attempts to write a chunk, "+
+			"when it fails because of transient server errors").Default("3").Int()
+		ignoreErrors = importCmd.Flag("ignore-errors", "Continue import when a chunk fails to be written, "+
+			"failed chunks are listed in the error report").Bool()
+		retryQueueFile = importCmd.Flag("retry-queue-file", "Persist chunks failed to be written to the file and continue import, "+
+			"so they can be imported again with --retry-queue").String()
+		retryQueue = importCmd.Flag("retry-queue", "Import only the chunks of --retry-queue-file instead of the dump, "+
+			"chunks failing again are kept in the queue").Bool()
+		importFlushInterval = importCmd.Flag("import-flush-interval", "Max time a partially filled core metrics import batch "+
+			"waits for more chunks, see import-batch-size").Default("0").Duration()
+		chInsertBatchRows = importCmd.Flag("ch-insert-batch-rows", "Commit QAN rows every N rows, "+
+			"0 to insert all rows in a single batch at the end of import").Default("0").Int()
+		chInsertFlushInterval = importCmd.Flag("ch-insert-flush-interval", "Commit QAN rows when the insert batch "+
+			"is older than the interval").Default("0").Duration()
+		chPartitionOrder = importCmd.Flag("ch-partition-order", "Insert QAN rows of each batch partition by partition (period_start day), "+
+			"so inserts create fewer parts to merge. Rows are kept in memory until flushed, every 100000 rows if "+
+			"ch-insert-batch-rows is not set. Use --no-ch-partition-order to insert rows in the dump order").Default("true").Bool()
+		chBootstrapSchema = importCmd.Flag("ch-bootstrap-schema", "Create the QAN database, tables and materialized views "+
+			"missing in ClickHouse from the schema of the dump meta, e.g. on restore into a fresh ClickHouse").Bool()
+		importEncoding = importCmd.Flag("import-encoding", "Content-Encoding of core metrics import requests: gzip sends dump content as is, "+
+			"zstd is smaller but requires VictoriaMetrics supporting it, identity saves CPU on fast networks").
+			Default(victoriametrics.EncodingGzip).Enum(victoriametrics.EncodingGzip, victoriametrics.EncodingZstd, victoriametrics.EncodingIdentity)
+		importWorkers = importCmd.Flag("import-workers", "Number of concurrent chunk writers for sources accepting chunks in any order "+
+			"(core metrics). QAN chunks are always written one by one").Default("1").Int()
+		vmagentURL = importCmd.Flag("vmagent-url", "Send core metrics to vmagent instead of PMM VictoriaMetrics, "+
+			"vmagent replays them to its remote write targets").String()
+		importBatchSize = importCmd.Flag("import-batch-size", "Number of series blocks in a single core metrics import request: big chunks are split, small ones are merged, "+
+			"0 to send chunks as is").Default("0").Int()
+		downloadDir = importCmd.Flag("download-dir", "Directory to download dump to, when dump path is HTTP(S) URL").
+				Default(".").String()
+		annotate            = importCmd.Flag("annotate", "Create Grafana annotation marking the imported time range").Bool()
+		importGrafanaAPIKey = importCmd.Flag("grafana-api-key", "Grafana API key to authorize annotation requests").String()
+		priorityDashboards  = importCmd.Flag("priority-dashboard", "UID of Grafana dashboard whose core metrics are imported "+
+			"before the rest of the dump. Use multiple times to prioritize multiple dashboards").Strings()
+		diskCheck = importCmd.Flag("disk-check", "Check that PMM Server has enough free disk space before import: "+
+			"enforce, warn or off. Required space is roughly estimated by the dump size").Default(diskCheckWarn).Enum(diskCheckEnforce, diskCheckWarn, diskCheckOff)
+		inputFormat = importCmd.Flag("input-format", "Format of the imported file: dump, vm-native (/api/v1/export/native or vmctl output) "+
+			"or vm-jsonl (/api/v1/export output)").Default(inputFormatDump).
+			Enum(inputFormatDump, victoriametrics.ExportFormatNative, victoriametrics.ExportFormatJSONLines)
+		forceImport           = importCmd.Flag("force", "Import the dump even if it was already imported to the PMM Server").Bool()
+		createMissingServices = importCmd.Flag("create-missing-services", "Create inventory stubs of the dump services missing "+
+			"on PMM Server, so imported data is navigable in the UI. Data is remapped to the stub IDs").Bool()
+		verifyChecksum = importCmd.Flag("verify-checksum", "Check the dump against its DUMP.sha256 file before import").Bool()
+		silenceAlerts  = importCmd.Flag("silence-alerts", "Silence alerts of the dump services in PMM Alertmanager during import "+
+			"and for the given time after it, so backfilled data doesn't fire stale alerts").PlaceHolder("DURATION").Duration()
+		sandboxPrefix = importCmd.Flag("sandbox-prefix", "Import into sandbox: prepend the prefix to metric names and insert QAN rows "+
+			"into the database with the prefix, so the dump can be inspected on the live server. See sandbox-cleanup").String()
+
+		// purge-import command options
+		purgeImportCmd = cli.Command("purge-import", "Deletes data written by a previous import: "+
+			"series and QAN rows of the dump services (see dump-id), or of the time range with the labels")
+		purgeDumpID = purgeImportCmd.Flag("dump-id", "ID of the imported dump, the dump is read from dump-path "+
+			"to find its services and time range").String()
+		purgeStart  = purgeImportCmd.Flag("start-ts", "Start date-time of the imported range, ex. "+time.RFC3339).String()
+		purgeEnd    = purgeImportCmd.Flag("end-ts", "End date-time of the imported range, ex. "+time.RFC3339).String()
+		purgeLabels = purgeImportCmd.Flag("label", "Label (QAN column) value of the imported data, "+
+			"use multiple times to match multiple labels").PlaceHolder("NAME=VALUE").StringMap()
+		purgeAllTime = purgeImportCmd.Flag("all-time", "Delete core metrics series matching the labels for the whole "+
+			"retention, VictoriaMetrics can't delete samples of the range only. Required with label and dump-core").Bool()
+
+		// sandbox-cleanup command options
+		sandboxCleanupCmd    = cli.Command("sandbox-cleanup", "Deletes core metrics and QAN data imported with the sandbox prefix")
+		sandboxCleanupPrefix = sandboxCleanupCmd.Flag("prefix", "Sandbox prefix the data was imported with").Required().String()
+
+		// series command options
+		seriesCmd      = cli.Command("series", "Shows amount of core metrics series matching selector to preview export volume")
+		seriesSelector = seriesCmd.Flag("ts-selector", "Time series selector to pass to VM").String()
+		seriesStart    = seriesCmd.Flag("start-ts", "Start date-time, ex. "+time.RFC3339).String()
+		seriesEnd      = seriesCmd.Flag("end-ts", "End date-time, ex. "+time.RFC3339).String()
+		seriesTop      = seriesCmd.Flag("top", "Number of top metrics by series count to show").Default("10").Int()
+
+		// ping command options
+		pingCmd           = cli.Command("ping", "Checks that all endpoints used for export/import are reachable")
+		pingDatasource    = pingCmd.Flag("load-checker-datasource", "Grafana datasource name to query load thresholds through").String()
+		pingGrafanaAPIKey = pingCmd.Flag("grafana-api-key", "Grafana API key to authorize datasource proxy requests").String()
+
+		// doctor command options
+		doctorCmd     = cli.Command("doctor", "Checks local environment, connectivity, auth and versions, and prints the report for support requests")
+		doctorMinFree = doctorCmd.Flag("min-free-disk", "Free disk space in the dump directory below which export may not fit").
+				Default("1GB").Bytes()
+
+		// verify command options
+		verifyCmd = cli.Command("verify", "Checks the dump against its DUMP.sha256 checksum file, see dump-path")
+
+		// check-compat command options
+		checkCompatCmd = cli.Command("check-compat", "Checks that the dump is compatible with PMM Server before import")
+
+		// compare command options
+		compareCmd         = cli.Command("compare", "Checks random samples of the dump series and QAN rows in the target to estimate import coverage")
+		compareSampleSize  = compareCmd.Flag("sample-size", "Number of series and QAN rows to sample for each source").Default("100").Int()
+		compareSeed        = compareCmd.Flag("seed", "Random seed to get the same sample again, random by default").Int64()
+		compareMinCoverage = compareCmd.Flag("min-coverage", "Minimal coverage percentage of each source to consider the import complete").Default("100").Float64()
+
+		// verify-queries command options
+		verifyQueriesCmd = cli.Command("verify-queries", "Runs PromQL and ClickHouse queries against source and target PMM "+
+			"for the migrated range and compares results, see pmm-url")
+		verifyQueriesFile      = verifyQueriesCmd.Flag("queries", "YAML file with the queries to compare").Required().ExistingFile()
+		verifyQueriesSourceURL = verifyQueriesCmd.Flag("source-pmm-url", "Source PMM connection string").Required().String()
+		verifyQueriesSourceVM  = verifyQueriesCmd.Flag("source-victoria-metrics-url", "Source VictoriaMetrics connection string").String()
+		verifyQueriesSourceCH  = verifyQueriesCmd.Flag("source-click-house-url", "Source ClickHouse connection string").String()
+		verifyQueriesStart     = verifyQueriesCmd.Flag("start-ts", "Start date-time of the compared range, ex. "+time.RFC3339+
+			". Range of the dump is used if dump-path is set").String()
+		verifyQueriesEnd       = verifyQueriesCmd.Flag("end-ts", "End date-time of the compared range, ex. "+time.RFC3339).String()
+		verifyQueriesStep      = verifyQueriesCmd.Flag("step", "Step of PromQL range queries").Default("1m").Duration()
+		verifyQueriesTolerance = verifyQueriesCmd.Flag("tolerance", "Relative difference of values still considered a match, "+
+			"unless set for the query").Default("0.01").Float64()
+
+		// install-service command options
+		installServiceCmd = cli.Command("install-service", "Writes systemd service and timer running export with the flags "+
+			"following --, credentials are written to the environment file")
+		serviceName     = installServiceCmd.Flag("name", "Name of the service and timer units").Default("pmm-transferer-export").String()
+		serviceCalendar = installServiceCmd.Flag("on-calendar", "systemd OnCalendar expression of the export schedule").
+				Default("daily").String()
+		serviceRandomizedDelay = installServiceCmd.Flag("randomized-delay", "Random delay of each run, so exports of many hosts "+
+			"don't start at once").Default("0").Duration()
+		serviceUser    = installServiceCmd.Flag("user", "User to run export as, root by default").String()
+		serviceUnitDir = installServiceCmd.Flag("unit-dir", "Directory to write units to").Default("/etc/systemd/system").String()
+		serviceEnvFile = installServiceCmd.Flag("env-file", "Environment file with credentials, "+
+			"/etc/pmm-transferer/NAME.env by default").String()
+		servicePrint  = installServiceCmd.Flag("print", "Print the units and environment file instead of writing them").Bool()
+		serviceEnable = installServiceCmd.Flag("enable", "Reload systemd and enable the timer after writing the units").Bool()
+		serviceArgs   = installServiceCmd.Arg("args", "export command and its flags, after --").Strings()
+
+		// catalog command options
+		catalogCmd    = cli.Command("catalog", "Shows source server, time coverage and size of all dumps in the directory")
+		catalogDir    = catalogCmd.Flag("dir", "Directory with dumps or S3 prefix URL s3://bucket/prefix").Required().String()
+		catalogFormat = catalogCmd.Flag("format", "Output format: table or json").
+				Default(catalogFormatTable).Enum(catalogFormatTable, catalogFormatJSON)
+
+		// plan-restore command options
+		planRestoreCmd     = cli.Command("plan-restore", "Selects dumps in the directory covering the requested time range")
+		planRestoreDir     = planRestoreCmd.Flag("dir", "Directory with dumps").Required().ExistingDir()
+		planRestoreRange   = planRestoreCmd.Flag("range", "Time range to restore, ex. 2021-06-01T00:00:00Z..2021-06-02T00:00:00Z").Required().String()
+		planRestoreExecute = planRestoreCmd.Flag("execute", "Import the selected dumps in order, "+
+			"global flags (e.g. pmm-url, dump-qan) are passed to each import").Bool()
+
+		// decrypt command options
+		decryptCmd     = cli.Command("decrypt", "Decrypt dump encrypted before upload")
+		decryptKeyFile = decryptCmd.Flag("key-file", "File with 256-bit key the dump was encrypted with (raw or hex)").Required().ExistingFile()
+		decryptOutput  = decryptCmd.Flag("output", "Path to write decrypted dump to. Dump path without .enc suffix by default").String()
+
+		// reencrypt command options
+		reencryptCmd = cli.Command("reencrypt", "Re-encrypt dump with new keys. Entries are re-encrypted with the new "+
+			"metrics/QAN keys, old keys are read from metrics-encryption-key-file and qan-encryption-key-file")
+		reencryptKeyFile = reencryptCmd.Flag("key-file", "File with the key the dump was encrypted with before upload, "+
+			"the whole dump is re-encrypted with new-key-file").ExistingFile()
+		reencryptNewKeyFile        = reencryptCmd.Flag("new-key-file", "File with the new 256-bit key of the dump encrypted before upload (raw or hex)").ExistingFile()
+		reencryptNewMetricsKeyFile = reencryptCmd.Flag("new-metrics-key-file", "File with the new 256-bit key of VictoriaMetrics entries (raw or hex)").ExistingFile()
+		reencryptNewQANKeyFile     = reencryptCmd.Flag("new-qan-key-file", "File with the new 256-bit key of ClickHouse (QAN) entries (raw or hex)").ExistingFile()
+		reencryptOutput            = reencryptCmd.Flag("output", "Path to write re-encrypted dump to. Dump is replaced by default").String()
+
 		showMetaCmd  = cli.Command("show-meta", "Shows metadata from the specified dump file")
 		prettifyMeta = showMetaCmd.Flag("prettify", "Print meta in human readable format").Default("true").Bool()
 
@@ -89,11 +447,21 @@ func main() {
 		TimeFormat: time.RFC3339,
 	})
 
-	cmd, err := cli.DefaultEnvars().Parse(os.Args[1:])
+	if err := applyProfile(cli.DefaultEnvars(), os.Args[1:]); err != nil {
+		log.Fatal().Msgf("Failed to apply profile: %v", err)
+	}
+
+	cmd, err := cli.Parse(os.Args[1:])
 	if err != nil {
 		log.Fatal().Msgf("Error parsing parameters: %s", err.Error())
 	}
 
+	if *runTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *runTimeout)
+		defer cancel()
+	}
+
 	if *enableVerboseMode {
 		log.Logger = log.Logger.
 			With().Caller().Logger().
@@ -104,18 +472,96 @@ func main() {
 			Level(zerolog.InfoLevel)
 	}
 
-	httpC := newClientHTTP(*allowInsecureCerts)
+	if *profile != "" {
+		log.Info().Msgf("Using profile %s from %s", *profile, *configPath)
+	}
+
+	httpC := newClientHTTP(httpOptions{
+		insecureSkipVerify: *allowInsecureCerts,
+		userAgent:          *userAgent,
+		keepAlive:          *httpKeepAlive,
+		maxConnDuration:    *httpMaxConnDuration,
+		dnsRefresh:         *dnsRefreshInterval,
+		pinIP:              *pinBackendIP,
+	})
+
+	if *tagRequests {
+		if err = requestid.Enable(); err != nil {
+			log.Fatal().Msgf("Failed to enable request IDs: %v", err)
+		}
+	}
+
+	if exportOnly {
+		if cmd != exportCmd.FullCommand() && cmd != versionCmd.FullCommand() {
+			log.Fatal().Msgf("Command %s is not available in export-only build", cmd)
+		}
+		if *dumpPath != "" {
+			log.Fatal().Msg("Export-only build writes the dump to STDOUT, dump-path can't be set")
+		}
+		*stdout = true
+	}
 
-	switch cmd {
-	case exportCmd.FullCommand():
+	switch {
+	case cmd == exportCmd.FullCommand():
+		prompt := newPrompter()
+		if *pmmURL, err = completePMMURL(prompt, *pmmURL); err != nil {
+			log.Fatal().Msgf("Failed to prompt: %v", err)
+		}
+		prompt.close()
 		if *pmmURL == "" {
 			log.Fatal().Msg("Please, specify PMM URL")
 		}
 
-		if !(*dumpQAN || *dumpCore) {
+		if !(*dumpQAN || *dumpCore || len(*plugins) != 0) {
 			log.Fatal().Msg("Please, specify at least one data source")
 		}
 
+		if *parentDumpID != "" && !dump.ValidID(*parentDumpID) {
+			log.Fatal().Msgf("Invalid parent dump ID %q: UUID is expected", *parentDumpID)
+		}
+
+		if *splitRuns > 0 {
+			if *stdout {
+				log.Fatal().Msg("split-runs writes a dump per run, it can't be used with STDOUT output")
+			}
+			if *start == "" {
+				log.Fatal().Msg("Please, specify start-ts of the time range to split into runs")
+			}
+			if *journalPath != "" && *journalPath != journalStderr {
+				log.Fatal().Msg("journal can only be set to stderr with split-runs: journal of each run is written next to its dump")
+			}
+			startTime, endTime, err := parseTimeRange(*start, *end)
+			if err != nil {
+				log.Fatal().Msgf("Invalid time range: %v", err)
+			}
+			if *dumpPath != "" {
+				if err = os.MkdirAll(*dumpPath, 0755); err != nil {
+					log.Fatal().Msgf("Failed to create dumps directory: %v", err)
+				}
+			}
+			args, env, err := splitRunArgs(cli, os.Args[1:])
+			if err != nil {
+				log.Fatal().Msgf("Failed to parse arguments: %v", err)
+			}
+			// the URL may be completed by prompts
+			env[flagEnvar("pmm-url")] = *pmmURL
+
+			runs := planSplitRuns(startTime, endTime, *splitRuns, *dumpPath)
+			if err = executeSplitRuns(runs, args, env, *journalPath == journalStderr); err != nil {
+				log.Fatal().Msgf("Failed to export: %v", err)
+			}
+			log.Info().Msgf("Exported %d runs into %s", len(runs), filepath.Join(*dumpPath, "."))
+			break
+		}
+
+		if !*noLock {
+			lock, err := acquireTargetLock(*lockDir, *pmmURL, cmd)
+			if err != nil {
+				log.Fatal().Msgf("Failed to lock PMM Server: %v", err)
+			}
+			defer lock.release()
+		}
+
 		if *dumpQAN && *dumpCore && len(*instances) == 0 {
 			if *where == "" && (*tsSelector != "" || len(*dashboards) > 0) {
 				log.Warn().Msg("Filter for QAN found, but not for core dump. Core metrics for all metrics would be exported")
@@ -142,7 +588,17 @@ func main() {
 				selectors = append(selectors, fmt.Sprintf(`{service_name="%s"}`, serviceName))
 			}
 		}
-		vmSource, ok := prepareVictoriaMetricsSource(httpC, *dumpCore, pmmConfig.VictoriaMetricsURL, selectors)
+		if err = victoriametrics.ValidateExportParams(*vmExportParams); err != nil {
+			log.Fatal().Msgf("Invalid VictoriaMetrics export params: %v", err)
+		}
+
+		vmSource, ok := prepareVictoriaMetricsSource(httpC, *dumpCore, victoriametrics.Config{
+			ConnectionURL:       pmmConfig.VictoriaMetricsURL,
+			TimeSeriesSelectors: selectors,
+			ExportAttempts:      *chunkAttempts,
+			SampleCheck:         *chunkSampleCheck,
+			ExportParams:        *vmExportParams,
+		})
 		if ok {
 			sources = append(sources, vmSource)
 		}
@@ -156,33 +612,83 @@ func main() {
 			}
 		}
 
-		chSource, ok := prepareClickHouseSource(ctx, *dumpQAN, pmmConfig.ClickHouseURL, *where)
+		var excludedColumns []string
+		if *noQueryExamples {
+			excludedColumns = clickhouse.QueryExampleColumns
+		}
+
+		if *qanAggregate != 0 && *qanAggregate < time.Minute {
+			log.Fatal().Msg("QAN aggregation period should be at least 1m, as raw QAN rows are per-minute")
+		}
+
+		chReadURL := pmmConfig.ClickHouseURL
+		if *chReplicaURL != "" {
+			log.Info().Msg("Exporting QAN metrics from ClickHouse replica")
+			chReadURL = *chReplicaURL
+		}
+
+		chSource, ok := prepareClickHouseSource(ctx, *dumpQAN, clickhouse.Config{
+			ConnectionURL:   chReadURL,
+			Where:           *where,
+			ExcludedColumns: excludedColumns,
+			Columns:         splitList(*chColumns),
+			Aggregate:       *qanAggregate,
+			Tables:          *clickHouseTables,
+			Schema:          true,
+		})
 		if ok {
 			sources = append(sources, chSource)
 		}
 
-		var startTime, endTime time.Time
+		pluginSources := preparePluginSources(*plugins, *pluginTimeout)
+		for _, p := range pluginSources {
+			sources = append(sources, p)
+		}
 
-		if *end != "" {
-			endTime, err = time.ParseInLocation(time.RFC3339, *end, time.UTC)
-			if err != nil {
-				log.Fatal().Msgf("Error parsing end date-time: %v", err)
+		startTime, endTime, err := parseTimeRange(*start, *end)
+		if err != nil {
+			log.Fatal().Msgf("Invalid time range: %v", err)
+		}
+
+		if *consistent {
+			readPoint := consistentEnd(endTime, time.Now().UTC(), *consistentLag)
+			if readPoint.Before(endTime) {
+				log.Info().Msgf("Consistent export: end time is moved to the read point %s", readPoint.Format(time.RFC3339))
+				endTime = readPoint
+			}
+			if startTime.After(endTime) {
+				log.Fatal().Msg("Invalid time range: start is after the consistent read point")
 			}
-		} else {
-			endTime = time.Now().UTC()
 		}
 
-		if *start != "" {
-			startTime, err = time.ParseInLocation(time.RFC3339, *start, time.UTC)
+		if *start == "" {
+			startTime, err = detectStartTime(endTime, *maxAutoRange, startTime, vmSource, chSource)
 			if err != nil {
-				log.Fatal().Msgf("Error parsing start date-time: %v", err)
+				log.Fatal().Msgf("Failed to detect start time: %v", err)
 			}
-		} else {
-			startTime = endTime.Add(-1 * time.Hour * 4)
+			log.Info().Msgf("Detected start time: %s", startTime.Format(time.RFC3339))
+		}
+
+		if *alignChunks > 0 {
+			if startTime, err = alignChunksStart(startTime, *alignChunks, *chunkTimeRange); err != nil {
+				log.Fatal().Msgf("Invalid chunks alignment: %v", err)
+			}
+			log.Info().Msgf("Chunks are aligned to %s, start time is %s", *alignChunks, startTime.Format(time.RFC3339))
 		}
 
-		if startTime.After(endTime) {
-			log.Fatal().Msg("Invalid time range: start > end")
+		if *shards > 1 && *stdout {
+			log.Fatal().Msg("Multi-volume dump is not available when output is redirected to STDOUT")
+		}
+
+		if *uploadToSupport != "" && *stdout {
+			log.Fatal().Msg("Upload to support is not available when output is redirected to STDOUT")
+		}
+
+		if !*stdout {
+			*dumpPath, err = transferer.GetDumpFilepath(*dumpPath, time.Now().UTC())
+			if err != nil {
+				log.Fatal().Msgf("Failed to determine dump path: %v", err)
+			}
 		}
 
 		t, err := transferer.New(*dumpPath, *stdout, sources, *workersCount)
@@ -190,12 +696,54 @@ func main() {
 			log.Fatal().Msgf("Failed to transfer: %v", err)
 		}
 
+		entryAttrs, err := parseEntryAttributes(*archivePerms, *archiveOwner, *preserveTimes)
+		if err != nil {
+			log.Fatal().Msgf("Invalid archive entry attributes: %v", err)
+		}
+		t.SetEntryAttributes(entryAttrs)
+		t.SetWriteWorkers(*writeWorkersCount)
+		t.SetWorkerRampUp(*workerRampUp)
+
+		entryKeys, err := readEntryKeys(*metricsKeyFile, *qanKeyFile)
+		if err != nil {
+			log.Fatal().Msgf("Failed to read encryption keys: %v", err)
+		}
+		t.SetEntryKeys(entryKeys)
+		codecs, err := parseChunkCodecs(*metricsCodec, *qanCodec)
+		if err != nil {
+			log.Fatal().Msgf("Invalid chunk codec: %v", err)
+		}
+		t.SetChunkCodecs(codecs)
+		t.SetTransforms(prepareTransforms(*transforms, *transformTimeout))
+		t.SetRequestLimits(map[dump.SourceType]int{
+			dump.VictoriaMetrics: *maxVMRequests,
+			dump.ClickHouse:      *maxCHRequests,
+		})
+		t.SetKeepPartial(*keepPartial)
+		t.SetIgnoreReadErrors(*exportIgnoreErrors)
+
+		var cache *transferer.ChunkCache
+		if *readCacheDir != "" {
+			// chunks of different servers are told apart by the connection strings
+			namespace := strings.Join([]string{pmmConfig.VictoriaMetricsURL, pmmConfig.ClickHouseURL, *chReplicaURL}, "\n")
+			if cache, err = transferer.NewChunkCache(*readCacheDir, namespace, *readCacheTTL); err != nil {
+				log.Fatal().Msgf("Failed to open read cache: %v", err)
+			}
+			t.SetChunkCache(cache)
+		}
+
 		var chunks []dump.ChunkMeta
 
 		if *dumpCore {
 			chunks = append(chunks, victoriametrics.SplitTimeRangeIntoChunks(startTime, endTime, *chunkTimeRange)...)
+			if *withDownsampled > 0 {
+				chunks = append(chunks, victoriametrics.SplitTimeRangeIntoDownsampledChunks(startTime, endTime, *withDownsampled)...)
+			}
 		}
 
+		// the last chunk of the split ends at the chunk size boundary, so it's cut at end-ts or the consistent read point
+		chunks = clampChunkEnds(chunks, endTime)
+
 		if *dumpQAN {
 			chChunks, err := chSource.SplitIntoChunks(startTime, endTime, *chunkRows)
 			if err != nil {
@@ -204,38 +752,337 @@ func main() {
 			chunks = append(chunks, chChunks...)
 		}
 
+		for _, p := range pluginSources {
+			pChunks, err := p.ListChunks(startTime, endTime)
+			if err != nil {
+				log.Fatal().Msgf("Failed to create plugin chunks: %s", err.Error())
+			}
+			chunks = append(chunks, pChunks...)
+		}
+
 		meta, err := composeMeta(*pmmURL, httpC)
 		if err != nil {
 			log.Fatal().Err(err).Msg("Failed to compose meta")
 		}
+		meta.Range = &dump.TimeRange{Start: startTime, End: endTime}
+		meta.Consistent = *consistent
+		meta.ParentID = *parentDumpID
+		if len(*userMeta) > 0 {
+			meta.UserMeta = *userMeta
+		}
+		if meta.ID, err = dump.NewID(); err != nil {
+			log.Fatal().Msgf("Failed to generate dump ID: %v", err)
+		}
+
+		if *dumpCore {
+			include, err := readMetricGlobs(*includeMetrics)
+			if err != nil {
+				log.Fatal().Msgf("Failed to read include metrics list: %v", err)
+			}
+			exclude, err := readMetricGlobs(*excludeMetrics)
+			if err != nil {
+				log.Fatal().Msgf("Failed to read exclude metrics list: %v", err)
+			}
+			excluded, err := vmSource.ApplyMetricLists(include, exclude)
+			if err != nil {
+				log.Fatal().Msgf("Failed to apply metrics lists: %v", err)
+			}
+			if len(include) != 0 || len(exclude) != 0 {
+				log.Info().Msgf("Applied metrics lists: %d included and %d excluded globs", len(include), len(exclude))
+			}
+			if *recordingRulesOnly || len(*recordingRulePrefixes) != 0 {
+				if *dumpQAN {
+					log.Warn().Msg("Recording rules filter applies to core metrics only, QAN rows are exported as is")
+				}
+				globs, err := victoriametrics.RecordingRuleGlobs(*recordingRulePrefixes)
+				if err != nil {
+					log.Fatal().Msgf("Invalid recording rule prefix: %v", err)
+				}
+				if _, err = vmSource.ApplyMetricLists(globs, nil); err != nil {
+					log.Fatal().Msgf("Failed to apply recording rule filter: %v", err)
+				}
+				log.Info().Msgf("Exporting only recording rule metrics matching %s", strings.Join(globs, ", "))
+			}
+
+			coveredSelectors, err := vmSource.DropCoveredSelectors(startTime, endTime)
+			if err != nil {
+				log.Fatal().Msgf("Failed to drop covered time series selectors: %v", err)
+			}
+			if len(coveredSelectors) != 0 {
+				log.Info().Msgf("Skipped %d selectors, all series of which are matched by other selectors", len(coveredSelectors))
+			}
+
+			meta.DroppedMetrics, err = vmSource.ApplyCardinalityLimits(startTime, endTime, victoriametrics.CardinalityLimits{
+				MaxSeriesPerMetric: *maxSeriesPerMetric,
+				DropMetricsRegex:   *dropMetricsRegex,
+			})
+			if err != nil {
+				log.Fatal().Msgf("Failed to apply cardinality limits: %v", err)
+			}
+			meta.DroppedMetrics = append(meta.DroppedMetrics, excluded...)
+		}
+
+		if *chunkBy != "" && !*dumpCore {
+			log.Fatal().Msg("Chunk splitting by label applies to core metrics only, --dump-core is required")
+		}
+		if chunks, err = preparePlanners(vmSource, *chunkBy, *chunkPlanners, *chunkPlannerTimeout).Plan(chunks); err != nil {
+			log.Fatal().Msgf("Failed to plan chunks: %v", err)
+		}
 
-		pool, err := dump.NewChunkPool(chunks)
+		meta.Sources = composeSourcesMeta(sources, chunks)
+
+		if *metaOnly {
+			jsonMeta, err := json.MarshalIndent(meta, "", "\t")
+			if err != nil {
+				log.Fatal().Msgf("Failed to format meta as json: %v", err)
+			}
+			fmt.Printf("%v\n", string(jsonMeta))
+			break
+		}
+
+		limitFlags := limitFlags{
+			maxLoad:        *maxLoad,
+			criticalLoad:   *criticalLoad,
+			maxPacingDelay: *maxPacingDelay,
+			maxVMRequests:  *maxVMRequests,
+			maxCHRequests:  *maxCHRequests,
+			checkLoad:      !*ignoreLoad && *loadCheckMode != loadCheckOff,
+			useSchedule:    *useSchedule,
+		}
+		limits, err := readExportLimits(*configPath, limitFlags)
 		if err != nil {
-			log.Fatal().Msgf("Failed to generate chunk pool: %v", err)
+			log.Fatal().Msgf("Failed to read limits: %v", err)
+		}
+		thresholds, schedule := limits.thresholds, limits.schedule
+		for _, w := range schedule {
+			log.Info().Msgf("Using load schedule %s from %s", w.Name, *configPath)
 		}
+		t.UpdateRequestLimits(limits.requests)
+		t.SetActiveWorkers(limits.workers)
 
-		var thresholds []transferer.Threshold
-		if !*ignoreLoad {
-			thresholds, err = transferer.ParseThresholdList(*maxLoad, *criticalLoad)
+		loadCheckerURL := pmmConfig.VictoriaMetricsURL
+		if *loadCheckerDatasource != "" {
+			loadCheckerURL, err = grafana.GetDatasourceProxyURL(*pmmURL, *loadCheckerDatasource, *grafanaAPIKey, httpC)
 			if err != nil {
-				log.Fatal().Err(err).Msgf("Failed to parse max/critical load args")
+				log.Fatal().Msgf("Failed to get Grafana datasource proxy URL: %v", err)
+			}
+			log.Debug().Msgf("Got load checker datasource proxy URL: %s", loadCheckerURL)
+		}
+
+		lcConfig := transferer.LoadCheckerConfig{
+			ConnectionURL:  loadCheckerURL,
+			APIKey:         *grafanaAPIKey,
+			Thresholds:     thresholds,
+			MaxPacingDelay: limits.maxPacingDelay,
+			Schedule:       schedule,
+			NodeLabel:      *loadCheckerNodeLabel,
+			NodeValue:      *loadCheckerNode,
+			WarnOnly:       *loadCheckMode == loadCheckWarn,
+		}
+		if len(thresholds) != 0 || len(schedule) != 0 {
+			if err = resolveLoadCheckerNode(httpC, &lcConfig); err != nil {
+				log.Fatal().Msgf("Failed to set up load checker: %v", err)
 			}
 		}
+		lc := transferer.NewLoadChecker(ctx, httpC, lcConfig)
+		stopReload := reloadLimitsOnHangup(ctx, *configPath, limitFlags, t, lc)
+		defer stopReload()
 
-		lc := transferer.NewLoadChecker(ctx, httpC, pmmConfig.VictoriaMetricsURL, thresholds)
+		if *chunksOrder == orderNewestFirst {
+			dump.SortNewestFirst(chunks)
+		}
 
-		if err = t.Export(ctx, lc, *meta, pool); err != nil {
+		journal, closeJournal, err := openJournal(*journalPath, meta.ID)
+		if err != nil {
+			log.Fatal().Msgf("Failed to open journal: %v", err)
+		}
+		defer closeJournal()
+		t.SetJournal(journal)
+		journal.Record(transferer.JournalRecord{Event: transferer.JournalStart, ChunksTotal: len(chunks)})
+
+		abortExport := func(err error) {
+			recordJournalEnd(journal, t.Progress(), err)
+			writeErrorReport(*errorReportPath, cmd, err, t, lc)
+			writeAuditRecord(*auditLogPath, transferer.AuditRecord{
+				Command:   cmd,
+				PMMServer: *pmmURL,
+				Sources:   sourceTypes(sources),
+				DumpIDs:   []string{meta.ID},
+			}, err)
+			log.Fatal().Msgf("Failed to export: %v", err)
+		}
+		stopHeartbeat := t.StartHeartbeat(transferer.HeartbeatConfig{
+			Interval:     *heartbeatInterval,
+			StallTimeout: *stallTimeout,
+			OnStall:      stallHandler(*stallAction, abortExport),
+		})
+		// at the deadline export finalizes partial dump by itself, the watch only stops export stuck on finalization
+		stopDeadline := watchDeadline(ctx, exportFinalizeTimeout, abortExport)
+
+		dumpPaths := []string{*dumpPath}
+		if *shards > 1 {
+			dumpPaths, err = t.ExportVolumes(ctx, lc, *meta, chunks, *shards)
+		} else {
+			var pool *dump.ChunkPool
+			pool, err = dump.NewChunkPool(chunks)
+			if err != nil {
+				log.Fatal().Msgf("Failed to generate chunk pool: %v", err)
+			}
+			err = t.Export(ctx, lc, *meta, pool)
+		}
+		stopDeadline()
+		stopHeartbeat()
+		logLimitAdaptations(vmSource)
+		logChunkTimings(t)
+		if cache != nil {
+			hits, misses := cache.Stats()
+			log.Info().Msgf("Read cache: %d chunks reused, %d read from PMM Server", hits, misses)
+		}
+		audit := transferer.AuditRecord{
+			Command:   cmd,
+			PMMServer: *pmmURL,
+			Sources:   sourceTypes(sources),
+			Range:     &dump.TimeRange{Start: startTime, End: endTime},
+			DumpIDs:   []string{meta.ID},
+		}
+		if !*stdout {
+			audit.Dumps = dumpPaths
+		}
+		if err != nil {
+			// dumps of the aborted export are kept as partial ones, the others are either kept as .part files or removed
+			audit.Dumps = nil
+			if !*stdout {
+				audit.Dumps = keptDumps(*dumpPath, *shards)
+			}
+			recordJournalEnd(journal, t.Progress(), err)
+			writeErrorReport(*errorReportPath, cmd, err, t, lc)
+			writeAuditRecord(*auditLogPath, audit, err)
 			log.Fatal().Msgf("Failed to export: %v", err)
 		}
-	case importCmd.FullCommand():
+		recordJournalEnd(journal, t.Progress(), nil)
+		log.Info().Msgf("Exported dump %s", meta.ID)
+		if failed := len(t.Progress().FailedChunks); failed != 0 {
+			log.Warn().Msgf("%d chunks failed to be read and were skipped, they are listed in the dump meta", failed)
+			audit.Status = transferer.AuditStatusPartial
+			audit.Error = fmt.Sprintf("%d chunks are skipped", failed)
+		}
+
+		if *checksumFile && !*stdout {
+			audit.Checksums = make(map[string]string, len(dumpPaths))
+			for _, p := range dumpPaths {
+				sum, err := dump.WriteChecksumFile(p)
+				if err != nil {
+					writeAuditRecord(*auditLogPath, audit, err)
+					log.Fatal().Msgf("Failed to write dump checksum: %v", err)
+				}
+				audit.Checksums[p] = sum
+				log.Info().Msgf("SHA-256 of %s is written to %s: %s", p, p+dump.ChecksumSuffix, sum)
+			}
+		}
+
+		if *uploadToSupport != "" {
+			audit.URLs = append(audit.URLs, transferer.AuditURL(*uploadURL))
+			for _, p := range dumpPaths {
+				if err = uploadDump(ctx, httpC, upload.Config{
+					URL:          *uploadURL,
+					Ticket:       *uploadToSupport,
+					ChunkSize:    int64(*uploadChunkSize),
+					MinChunkSize: int64(*uploadMinChunk),
+					MaxBandwidth: int64(*uploadBandwidth),
+					Concurrency:  *uploadParallel,
+				}, *allowInsecureCerts, newS3Config(*s3Endpoint, *s3Region, *s3PathStyle), *uploadKeyFile, p); err != nil {
+					writeAuditRecord(*auditLogPath, audit, errors.Wrap(err, "failed to upload dump"))
+					log.Fatal().Msgf("Failed to upload dump: %v", err)
+				}
+			}
+		}
+		writeAuditRecord(*auditLogPath, audit, nil)
+	case !exportOnly && cmd == importCmd.FullCommand():
+		if *retryQueue {
+			switch {
+			case *retryQueueFile == "":
+				log.Fatal().Msg("Please, specify retry queue file with --retry-queue-file")
+			case *inputFormat != inputFormatDump, *verifyChecksum, *createMissingServices:
+				log.Fatal().Msg("input-format, verify-checksum and create-missing-services can't be used with retry-queue: " +
+					"the queue keeps chunks as they were sent to PMM Server")
+			}
+		}
+		if *retryQueueFile != "" && *routeFile != "" {
+			log.Fatal().Msg("retry-queue-file can't be used with route-file: chunks of the targets would share the queue")
+		}
+
+		var routeFilter *remap.Filter
+		if *routeFile != "" {
+			routes, err := remap.LoadRoutes(*routeFile)
+			if err != nil {
+				log.Fatal().Msgf("Failed to load routes: %v", err)
+			}
+			if *routeTarget == "" {
+				if *dumpPath == "" {
+					log.Fatal().Msg("Please, specify path to dump file: piped dump can't be imported into several targets")
+				}
+				if *vmagentURL != "" {
+					log.Fatal().Msg("vmagent-url can't be used with route-file, set target URLs in the routes file")
+				}
+				prompt := newPrompter()
+				if !confirmAction(prompt, *assumeYes, fmt.Sprintf("Import dump %s into route targets %s?",
+					*dumpPath, strings.Join(routeTargetNames(routes), ", "))) {
+					log.Fatal().Msg("Import is cancelled")
+				}
+				prompt.close()
+				if err = executeRoutes(routes, os.Args[1:]); err != nil {
+					log.Fatal().Msgf("Failed to import: %v", err)
+				}
+				break
+			}
+			target, ok := routes.Target(*routeTarget)
+			if !ok {
+				log.Fatal().Msgf("Route target %s is not found", *routeTarget)
+			}
+			*pmmURL, *victoriaMetricsURL, *clickHouseURL = target.PMMURL, target.VictoriaMetricsURL, target.ClickHouseURL
+			routeFilter = routes.Filter(target)
+		}
+
+		prompt := newPrompter()
+		if *pmmURL, err = completePMMURL(prompt, *pmmURL); err != nil {
+			log.Fatal().Msgf("Failed to prompt: %v", err)
+		}
 		if *pmmURL == "" {
 			log.Fatal().Msg("Please, specify PMM URL")
 		}
 
-		if !(*dumpQAN || *dumpCore) {
+		if !*noLock {
+			lock, err := acquireTargetLock(*lockDir, *pmmURL, cmd)
+			if err != nil {
+				log.Fatal().Msgf("Failed to lock PMM Server: %v", err)
+			}
+			defer lock.release()
+		}
+
+		// accidental imports into a wrong server can't be undone, so they are confirmed in the terminal
+		if !confirmAction(prompt, *assumeYes, fmt.Sprintf("Import %s into PMM Server %s?",
+			describeImportInput(*dumpPath, *retryQueueFile, *retryQueue), redactURL(*pmmURL))) {
+			log.Fatal().Msg("Import is cancelled")
+		}
+		prompt.close()
+
+		if !(*dumpQAN || *dumpCore || len(*plugins) != 0) {
 			log.Fatal().Msg("Please, specify at least one data source")
 		}
 
+		if *sandboxPrefix != "" {
+			if !validSandboxPrefix(*sandboxPrefix) {
+				log.Fatal().Msgf("Invalid sandbox prefix %q: letters, digits and underscores are expected", *sandboxPrefix)
+			}
+			if *createMissingServices {
+				log.Fatal().Msg("create-missing-services can't be used with sandbox-prefix: stubs are created in the live inventory")
+			}
+		}
+
+		if *inputFormat != inputFormatDump && !*dumpCore {
+			log.Fatal().Msgf("Input format %s contains core metrics only, please, specify --dump-core", *inputFormat)
+		}
+
 		var sources []dump.Source
 
 		pmmConfig, err := getPMMConfig(*pmmURL, *victoriaMetricsURL, *clickHouseURL)
@@ -243,98 +1090,866 @@ func main() {
 			log.Fatal().Err(err)
 		}
 
-		vmSource, ok := prepareVictoriaMetricsSource(httpC, *dumpCore, pmmConfig.VictoriaMetricsURL, nil)
+		var mapping remap.Mapping
+		if *remapFile != "" {
+			mapping, err = remap.Load(*remapFile)
+			if err != nil {
+				log.Fatal().Msgf("Failed to load remapping: %v", err)
+			}
+		}
+		if mapping == nil && *createMissingServices {
+			// filled with stub IDs before import
+			mapping = make(remap.Mapping)
+		}
+
+		vmConfig := victoriametrics.Config{
+			ConnectionURL: pmmConfig.VictoriaMetricsURL,
+			// JSON lines of VM export are imported the same way as downsampled chunks
+			ImportDownsampled:   *importDownsampled || *inputFormat == victoriametrics.ExportFormatJSONLines,
+			Remapping:           mapping,
+			Filter:              routeFilter,
+			ImportBatchSize:     *importBatchSize,
+			ImportFlushInterval: *importFlushInterval,
+			ImportEncoding:      *importEncoding,
+			MetricPrefix:        *sandboxPrefix,
+		}
+		if *vmagentURL != "" {
+			vmConfig.ConnectionURL = strings.TrimSuffix(*vmagentURL, "/")
+			vmConfig.Agent = true
+		}
+
+		var priorityVMSource *victoriametrics.Source
+		if len(*priorityDashboards) != 0 && *dumpCore {
+			if *retryQueue || *inputFormat != inputFormatDump {
+				log.Fatal().Msg("priority-dashboard can be used with dump import only")
+			}
+			names, err := grafana.GetDashboardMetricNames(*pmmURL, *priorityDashboards, httpC)
+			if err != nil {
+				log.Fatal().Msgf("Failed to get metrics of priority dashboards: %v", err)
+			}
+			filter, err := victoriametrics.NewNameFilter(names.Names, names.Regexps)
+			if err != nil {
+				log.Fatal().Msgf("Failed to get metrics of priority dashboards: %v", err)
+			}
+			log.Info().Msgf("Importing %d metrics and %d metric name regexps of priority dashboards first",
+				len(names.Names), len(names.Regexps))
+
+			priorityConfig := vmConfig
+			priorityConfig.NameFilter = filter
+			priorityVMSource = victoriametrics.NewSource(httpC, priorityConfig)
+			vmConfig.NameFilter = filter.Inverted()
+		}
+
+		vmSource, ok := prepareVictoriaMetricsSource(httpC, *dumpCore, vmConfig)
 		if ok {
 			sources = append(sources, vmSource)
 		}
 
-		chSource, ok := prepareClickHouseSource(ctx, *dumpQAN, pmmConfig.ClickHouseURL, *where)
+		chURL := pmmConfig.ClickHouseURL
+		if *chBootstrapSchema && *dumpQAN {
+			if err = bootstrapClickHouseSchema(chURL, *dumpPath); err != nil {
+				log.Fatal().Msgf("Failed to bootstrap ClickHouse schema: %v", err)
+			}
+		}
+		if *sandboxPrefix != "" && *dumpQAN {
+			if chURL, err = clickhouse.PrepareSandbox(chURL, *sandboxPrefix, *clickHouseTables); err != nil {
+				log.Fatal().Msgf("Failed to prepare QAN sandbox: %v", err)
+			}
+		}
+		chSource, ok := prepareClickHouseSource(ctx, *dumpQAN, clickhouse.Config{
+			ConnectionURL:       chURL,
+			Tables:              *clickHouseTables,
+			Remapping:           mapping,
+			Filter:              routeFilter,
+			InsertBatchRows:     *chInsertBatchRows,
+			InsertFlushInterval: *chInsertFlushInterval,
+			PartitionOrder:      *chPartitionOrder,
+		})
 		if ok {
 			sources = append(sources, chSource)
 		}
 
+		for _, p := range preparePluginSources(*plugins, *pluginTimeout) {
+			sources = append(sources, p)
+		}
+
 		piped, err := checkPiped()
 		if err != nil {
 			log.Fatal().Err(err).Msg("Failed to check if a program is piped")
 		}
 
-		if *dumpPath == "" && piped == false {
+		if *dumpPath == "" && piped == false && !*retryQueue {
 			log.Fatal().Msg("Please, specify path to dump file")
 		}
+		if piped && priorityVMSource != nil {
+			log.Fatal().Msg("priority-dashboard can't be used with piped dump: the dump is read twice")
+		}
+
+		audit := transferer.AuditRecord{
+			Command:   cmd,
+			PMMServer: *pmmURL,
+			Sources:   sourceTypes(sources),
+		}
+		if *vmagentURL != "" {
+			audit.URLs = append(audit.URLs, transferer.AuditURL(*vmagentURL))
+		}
+
+		if download.IsURL(*dumpPath) || s3.IsURL(*dumpPath) {
+			audit.URLs = append(audit.URLs, transferer.AuditURL(*dumpPath))
+			s3Cfg := newS3Config(*s3Endpoint, *s3Region, *s3PathStyle)
+
+			*dumpPath, err = downloadDump(ctx, *dumpPath, *downloadDir, *allowInsecureCerts, s3Cfg)
+			if err != nil {
+				writeAuditRecord(*auditLogPath, audit, errors.Wrap(err, "failed to download dump"))
+				log.Fatal().Msgf("Failed to download dump: %v", err)
+			}
+		}
+
+		if *verifyChecksum {
+			if piped || *inputFormat != inputFormatDump {
+				log.Fatal().Msg("Checksum can be verified for dump files only")
+			}
+			if err = verifyDumpChecksums(*dumpPath); err != nil {
+				writeAuditRecord(*auditLogPath, audit, err)
+				log.Fatal().Msgf("Failed to verify dump checksum: %v", err)
+			}
+		}
+
+		if *createMissingServices {
+			if piped || *inputFormat != inputFormatDump {
+				log.Fatal().Msg("Missing services can be created for dump files only: the dump is read twice")
+			}
+			if err = createServiceStubs(httpC, *pmmURL, *dumpPath, mapping); err != nil {
+				writeAuditRecord(*auditLogPath, audit, errors.Wrap(err, "failed to create service stubs"))
+				log.Fatal().Msgf("Failed to create missing services: %v", err)
+			}
+		}
 
 		t, err := transferer.New(*dumpPath, piped, sources, *workersCount)
 		if err != nil {
 			log.Fatal().Msgf("Failed to transfer: %v", err)
 		}
+		entryKeys, err := readEntryKeys(*metricsKeyFile, *qanKeyFile)
+		if err != nil {
+			log.Fatal().Msgf("Failed to read encryption keys: %v", err)
+		}
+		t.SetEntryKeys(entryKeys)
+		t.SetTransforms(prepareTransforms(*transforms, *transformTimeout))
+		t.SetRequestLimits(map[dump.SourceType]int{
+			dump.VictoriaMetrics: *maxVMRequests,
+			dump.ClickHouse:      *maxCHRequests,
+		})
+		t.SetImportOptions(transferer.ImportOptions{
+			Workers:       *importWorkers,
+			ChunkAttempts: *importChunkAttempts,
+			IgnoreErrors:  *ignoreErrors,
+		})
+
+		var queue *transferer.RetryQueue
+		var queueEntries []transferer.RetryQueueEntry
+		switch {
+		case *retryQueue:
+			if queueEntries, err = transferer.ReadRetryQueue(*retryQueueFile); err != nil {
+				log.Fatal().Msgf("Failed to read retry queue: %v", err)
+			}
+			queue = transferer.ReplaceRetryQueue(*retryQueueFile)
+			t.SetRetryQueue(queue)
+		case *retryQueueFile != "":
+			queue = transferer.OpenRetryQueue(*retryQueueFile)
+			t.SetRetryQueue(queue)
+		}
+
+		if *diskCheck != diskCheckOff && !piped && *inputFormat == inputFormatDump && !*retryQueue {
+			freeDiskSource := victoriametrics.NewSource(httpC, victoriametrics.Config{
+				ConnectionURL: pmmConfig.VictoriaMetricsURL,
+			})
+			// PMM Server host is selected as in load checker queries
+			nodeConfig := transferer.LoadCheckerConfig{
+				ConnectionURL: pmmConfig.VictoriaMetricsURL,
+				NodeLabel:     *loadCheckerNodeLabel,
+				NodeValue:     *loadCheckerNode,
+			}
+			if err = resolveLoadCheckerNode(httpC, &nodeConfig); err == nil {
+				err = checkImportDiskSpace(t, freeDiskSource, nodeConfig.NodeFilter())
+			}
+			if err != nil {
+				if *diskCheck == diskCheckEnforce {
+					log.Fatal().Msgf("Import preflight failed: %v. Use --disk-check=warn to import anyway", err)
+				}
+				log.Warn().Msgf("Import preflight failed: %v", err)
+			}
+		}
+
+		markerSource := victoriametrics.NewSource(httpC, victoriametrics.Config{
+			ConnectionURL: pmmConfig.VictoriaMetricsURL,
+			MetricPrefix:  *sandboxPrefix,
+		})
+		switch {
+		case *forceImport, *inputFormat != inputFormatDump, *retryQueue:
+		case piped:
+			log.Warn().Msg("Meta is at the end of the piped dump: skipped check if the dump was already imported")
+		default:
+			id, imported, err := previousImports(markerSource, *dumpPath, sourceTypes(sources))
+			if err != nil {
+				log.Warn().Msgf("Failed to check if the dump was already imported: %v", err)
+			} else if len(imported) != 0 {
+				log.Fatal().Msgf("Dump %s was already imported to this PMM Server (%s). Use --force to import it again",
+					id, strings.Join(imported, ", "))
+			}
+		}
 
 		meta, err := composeMeta(*pmmURL, httpC)
 		if err != nil {
 			log.Fatal().Err(err).Msg("Failed to compose meta")
 		}
 
-		if err = t.Import(*meta); err != nil {
+		switch {
+		case *retryQueue:
+			audit.Dumps = []string{*retryQueueFile}
+		case !piped:
+			audit.Dumps = []string{*dumpPath}
+		}
+
+		var silence *importSilence
+		if *silenceAlerts > 0 {
+			collectServices := !piped && *inputFormat == inputFormatDump && !*retryQueue
+			if silence, err = startImportSilence(httpC, *pmmURL, *dumpPath, collectServices, *silenceAlerts); err != nil {
+				writeAuditRecord(*auditLogPath, audit, errors.Wrap(err, "failed to silence alerts"))
+				log.Fatal().Msgf("Failed to silence alerts: %v", err)
+			}
+		}
+
+		abortImport := func(err error) {
+			writeErrorReport(*errorReportPath, cmd, err, t, nil)
+			writeAuditRecord(*auditLogPath, audit, err)
 			log.Fatal().Msgf("Failed to import: %v", err)
 		}
-	case showMetaCmd.FullCommand():
-		piped, err := checkPiped()
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to check if a program is piped")
+		stopHeartbeat := t.StartHeartbeat(transferer.HeartbeatConfig{
+			Interval:     *heartbeatInterval,
+			StallTimeout: *stallTimeout,
+			OnStall:      stallHandler(*stallAction, abortImport),
+		})
+		stopDeadline := watchDeadline(ctx, 0, abortImport)
+
+		var dumpMetas []dump.Meta
+		switch {
+		case *retryQueue:
+			err = t.ImportRetryQueue(queueEntries)
+		case *inputFormat == inputFormatDump && priorityVMSource != nil:
+			dumpMetas, err = t.ImportPriority(*meta, []dump.Source{priorityVMSource})
+		case *inputFormat == inputFormatDump:
+			dumpMetas, err = t.Import(*meta)
+		default:
+			err = t.ImportConverted(dump.VictoriaMetrics, func(r io.Reader, emit func(string, []byte) error) error {
+				return victoriametrics.ReadExportFile(r, *inputFormat, emit)
+			})
 		}
-		if *dumpPath == "" && piped == false {
-			log.Fatal().Msg("Please, specify path to dump file")
+		stopDeadline()
+		stopHeartbeat()
+		if err == nil {
+			err = queue.Close()
 		}
-
-		meta, err := transferer.ReadMetaFromDump(*dumpPath, piped)
 		if err != nil {
-			log.Fatal().Msgf("Can't show meta: %v", err)
+			writeErrorReport(*errorReportPath, cmd, err, t, nil)
+			writeAuditRecord(*auditLogPath, audit, err)
+			log.Fatal().Msgf("Failed to import: %v", err)
 		}
 
-		if *prettifyMeta {
-			fmt.Printf("Build: %v\n", meta.Version.GitCommit)
-			fmt.Printf("PMM Version: %v\n", meta.PMMServerVersion)
-			fmt.Printf("Max Chunk Size: %v (%v)\n", ByteCountDecimal(meta.MaxChunkSize),
-				ByteCountBinary(meta.MaxChunkSize))
-		} else {
-			jsonMeta, err := json.MarshalIndent(meta, "", "\t")
-			if err != nil {
-				log.Fatal().Msgf("Failed to format meta as json: %v", err)
-			}
+		logChunkTimings(t)
+		progress := t.Progress()
+		log.Info().Msgf("Written %d chunks to PMM Server, %d chunks without data are skipped",
+			progress.ChunksProcessed-progress.ChunksEmpty, progress.ChunksEmpty)
+		if queued := queue.Len(); queued != 0 {
+			log.Warn().Msgf("%d chunks are in retry queue %s, import them with --retry-queue when PMM Server issues are fixed",
+				queued, *retryQueueFile)
+		}
+		if failed := len(t.Progress().FailedChunks); failed != 0 {
+			log.Warn().Msgf("%d chunks failed to be imported and were skipped", failed)
+			writeErrorReport(*errorReportPath, cmd, errors.Errorf("%d chunks are skipped", failed), t, nil)
+			audit.Status = transferer.AuditStatusPartial
+			audit.Error = fmt.Sprintf("%d chunks are skipped", failed)
+		}
+		audit.Range = importedRange(dumpMetas)
+		audit.DumpIDs = dumpIDs(dumpMetas)
+		for _, id := range audit.DumpIDs {
+			log.Info().Msgf("Imported dump %s", id)
+			if err = markerSource.RecordImport(id, audit.Sources, time.Now().UTC()); err != nil {
+				log.Warn().Msgf("Failed to record import of dump %s: %v", id, err)
+			}
+		}
+		writeAuditRecord(*auditLogPath, audit, nil)
+
+		if silence != nil {
+			silence.finish(dumpMetas)
+		}
+		if *annotate {
+			if err = annotateImport(httpC, *pmmURL, *importGrafanaAPIKey, *dumpPath, dumpMetas); err != nil {
+				log.Warn().Msgf("Failed to create Grafana annotation: %v", err)
+			}
+		}
+	case !exportOnly && cmd == purgeImportCmd.FullCommand():
+		if *pmmURL == "" {
+			log.Fatal().Msg("Please, specify PMM URL")
+		}
+		if !(*dumpQAN || *dumpCore) {
+			log.Fatal().Msg("Please, specify at least one data source")
+		}
+
+		var target purgeTarget
+		switch {
+		case *purgeDumpID != "":
+			if *dumpPath == "" || len(*purgeLabels) != 0 {
+				log.Fatal().Msg("Please, specify path to the dump with dump-id, labels are selected by the dump services")
+			}
+			if target, err = dumpPurgeTarget(*dumpPath, *purgeDumpID); err != nil {
+				log.Fatal().Msgf("Failed to select imported data: %v", err)
+			}
+		case len(*purgeLabels) != 0:
+			// the range is required, as default range of other commands is unlikely the imported one
+			if *purgeStart == "" || *purgeEnd == "" {
+				log.Fatal().Msg("Please, specify start-ts and end-ts of the imported range")
+			}
+			if target.start, target.end, err = parseTimeRange(*purgeStart, *purgeEnd); err != nil {
+				log.Fatal().Msgf("Failed to parse time range: %v", err)
+			}
+			if target.labels, err = parsePurgeLabels(*purgeLabels); err != nil {
+				log.Fatal().Msgf("Invalid label: %v", err)
+			}
+			// labels may match live series, which lose all their samples, not only the imported ones
+			if *dumpCore && !*purgeAllTime {
+				log.Fatal().Msg("Please, confirm deleting core metrics series for the whole retention with all-time")
+			}
+		default:
+			log.Fatal().Msg("Please, specify dump-id or labels of the imported data")
+		}
+
+		if !*noLock {
+			lock, err := acquireTargetLock(*lockDir, *pmmURL, cmd)
+			if err != nil {
+				log.Fatal().Msgf("Failed to lock PMM Server: %v", err)
+			}
+			defer lock.release()
+		}
+
+		prompt := newPrompter()
+		confirmed, err := confirmDeletion(prompt, *assumeYes, fmt.Sprintf("Delete %s from PMM Server %s? Core metrics "+
+			"series are deleted completely, not only within the range", target, redactURL(*pmmURL)))
+		if err != nil {
+			log.Fatal().Msgf("Purge is not confirmed: %v", err)
+		}
+		if !confirmed {
+			log.Fatal().Msg("Purge is cancelled")
+		}
+		prompt.close()
+
+		pmmConfig, err := getPMMConfig(*pmmURL, *victoriaMetricsURL, *clickHouseURL)
+		if err != nil {
+			log.Fatal().Msgf("Failed to compose PMM config: %v", err)
+		}
+		vmSource, _ := prepareVictoriaMetricsSource(httpC, *dumpCore, victoriametrics.Config{
+			ConnectionURL: pmmConfig.VictoriaMetricsURL,
+		})
+		chSource, _ := prepareClickHouseSource(ctx, *dumpQAN, clickhouse.Config{
+			ConnectionURL: pmmConfig.ClickHouseURL,
+			Tables:        *clickHouseTables,
+		})
+		var purged []string
+		if vmSource != nil {
+			purged = append(purged, dump.VictoriaMetrics.String())
+		}
+		if chSource != nil {
+			purged = append(purged, dump.ClickHouse.String())
+		}
+		audit := transferer.AuditRecord{
+			Command:   cmd,
+			PMMServer: *pmmURL,
+			Sources:   purged,
+			Range:     &dump.TimeRange{Start: target.start, End: target.end},
+		}
+		if target.dumpID != "" {
+			audit.Dumps, audit.DumpIDs = []string{*dumpPath}, []string{target.dumpID}
+		}
+		err = purgeImport(vmSource, chSource, target)
+		writeAuditRecord(*auditLogPath, audit, err)
+		if err != nil {
+			log.Fatal().Msgf("Failed to purge import: %v", err)
+		}
+	case !exportOnly && cmd == sandboxCleanupCmd.FullCommand():
+		if *pmmURL == "" {
+			log.Fatal().Msg("Please, specify PMM URL")
+		}
+		if !validSandboxPrefix(*sandboxCleanupPrefix) {
+			log.Fatal().Msgf("Invalid sandbox prefix %q: letters, digits and underscores are expected", *sandboxCleanupPrefix)
+		}
+		if !(*dumpQAN || *dumpCore) {
+			log.Fatal().Msg("Please, specify at least one data source")
+		}
+
+		if !*noLock {
+			lock, err := acquireTargetLock(*lockDir, *pmmURL, cmd)
+			if err != nil {
+				log.Fatal().Msgf("Failed to lock PMM Server: %v", err)
+			}
+			defer lock.release()
+		}
+
+		prompt := newPrompter()
+		confirmed, err := confirmDeletion(prompt, *assumeYes, fmt.Sprintf("Delete data imported with prefix %s "+
+			"from PMM Server %s?", *sandboxCleanupPrefix, redactURL(*pmmURL)))
+		if err != nil {
+			log.Fatal().Msgf("Cleanup is not confirmed: %v", err)
+		}
+		if !confirmed {
+			log.Fatal().Msg("Cleanup is cancelled")
+		}
+		prompt.close()
+
+		pmmConfig, err := getPMMConfig(*pmmURL, *victoriaMetricsURL, *clickHouseURL)
+		if err != nil {
+			log.Fatal().Msgf("Failed to compose PMM config: %v", err)
+		}
+		if err = cleanupSandbox(httpC, pmmConfig, *sandboxCleanupPrefix, *dumpCore, *dumpQAN); err != nil {
+			log.Fatal().Msgf("Failed to clean up sandbox: %v", err)
+		}
+	case !exportOnly && cmd == uploadCmd.FullCommand():
+		if *dumpPath == "" {
+			log.Fatal().Msg("Please, specify path to dump file")
+		}
+
+		if err = uploadDump(ctx, httpC, upload.Config{
+			URL:          *uploadURL,
+			Ticket:       *uploadTicket,
+			ChunkSize:    int64(*uploadChunkSize),
+			MinChunkSize: int64(*uploadMinChunk),
+			MaxBandwidth: int64(*uploadBandwidth),
+			Concurrency:  *uploadParallel,
+		}, *allowInsecureCerts, newS3Config(*s3Endpoint, *s3Region, *s3PathStyle), *uploadKeyFile, *dumpPath); err != nil {
+			log.Fatal().Msgf("Failed to upload dump: %v", err)
+		}
+	case !exportOnly && cmd == pingCmd.FullCommand():
+		if *pmmURL == "" {
+			log.Fatal().Msg("Please, specify PMM URL")
+		}
+
+		pmmConfig, err := getPMMConfig(*pmmURL, *victoriaMetricsURL, *clickHouseURL)
+		if err != nil {
+			log.Fatal().Msgf("Failed to compose PMM config: %v", err)
+		}
+
+		loadCheckerURL := pmmConfig.VictoriaMetricsURL
+		if *pingDatasource != "" {
+			loadCheckerURL, err = grafana.GetDatasourceProxyURL(*pmmURL, *pingDatasource, *pingGrafanaAPIKey, httpC)
+			if err != nil {
+				log.Fatal().Msgf("Failed to get Grafana datasource proxy URL: %v", err)
+			}
+		}
+
+		checks := pingChecks(ctx, httpC, pmmConfig, *clickHouseTables, transferer.LoadCheckerConfig{
+			ConnectionURL: loadCheckerURL,
+			APIKey:        *pingGrafanaAPIKey,
+			NodeLabel:     *loadCheckerNodeLabel,
+			NodeValue:     *loadCheckerNode,
+		})
+		if !runPing(checks) {
+			os.Exit(1)
+		}
+	case !exportOnly && cmd == doctorCmd.FullCommand():
+		opts := doctorOptions{
+			chTables:  *clickHouseTables,
+			dir:       ".",
+			minFree:   uint64(*doctorMinFree),
+			nodeLabel: *loadCheckerNodeLabel,
+			node:      *loadCheckerNode,
+		}
+		if *dumpPath != "" && !download.IsURL(*dumpPath) && !s3.IsURL(*dumpPath) {
+			opts.dir = filepath.Dir(*dumpPath)
+		}
+		if *pmmURL != "" {
+			pmmConfig, err := getPMMConfig(*pmmURL, *victoriaMetricsURL, *clickHouseURL)
+			if err != nil {
+				log.Fatal().Msgf("Failed to compose PMM config: %v", err)
+			}
+			opts.pmmConfig = &pmmConfig
+		}
+		if !runDoctor(ctx, httpC, opts) {
+			os.Exit(1)
+		}
+	case !exportOnly && cmd == verifyCmd.FullCommand():
+		if *dumpPath == "" {
+			log.Fatal().Msg("Please, specify path to dump file")
+		}
+		if err = verifyDumpChecksums(*dumpPath); err != nil {
+			log.Fatal().Msgf("Dump verification failed: %v", err)
+		}
+	case !exportOnly && cmd == checkCompatCmd.FullCommand():
+		if *pmmURL == "" {
+			log.Fatal().Msg("Please, specify PMM URL")
+		}
+		if *dumpPath == "" {
+			log.Fatal().Msg("Please, specify path to dump file")
+		}
+
+		pmmConfig, err := getPMMConfig(*pmmURL, *victoriaMetricsURL, *clickHouseURL)
+		if err != nil {
+			log.Fatal().Msgf("Failed to compose PMM config: %v", err)
+		}
+
+		results, err := checkCompat(ctx, httpC, pmmConfig, *dumpPath)
+		if err != nil {
+			log.Fatal().Msgf("Failed to check compatibility: %v", err)
+		}
+		if !printCompatReport(results) {
+			os.Exit(1)
+		}
+	case !exportOnly && cmd == compareCmd.FullCommand():
+		if *pmmURL == "" {
+			log.Fatal().Msg("Please, specify PMM URL")
+		}
+		if *dumpPath == "" {
+			log.Fatal().Msg("Please, specify path to dump file")
+		}
+		if !(*dumpQAN || *dumpCore) {
+			log.Fatal().Msg("Please, specify at least one data source")
+		}
+		if *compareSampleSize <= 0 {
+			log.Fatal().Msg("Sample size should be positive")
+		}
+
+		pmmConfig, err := getPMMConfig(*pmmURL, *victoriaMetricsURL, *clickHouseURL)
+		if err != nil {
+			log.Fatal().Msgf("Failed to compose PMM config: %v", err)
+		}
+
+		results, err := compareDump(ctx, httpC, pmmConfig, *dumpPath, compareOptions{
+			sampleSize: *compareSampleSize,
+			seed:       *compareSeed,
+			core:       *dumpCore,
+			qan:        *dumpQAN,
+		})
+		if err != nil {
+			log.Fatal().Msgf("Failed to compare dump: %v", err)
+		}
+		if !printCompareReport(results, *compareMinCoverage) {
+			os.Exit(1)
+		}
+	case !exportOnly && cmd == installServiceCmd.FullCommand():
+		pc, err := cli.ParseContext(*serviceArgs)
+		if err != nil {
+			log.Fatal().Msgf("Invalid export flags: %v", err)
+		}
+		if pc.SelectedCommand == nil || pc.SelectedCommand.FullCommand() != exportCmd.FullCommand() {
+			log.Fatal().Msg("Please, specify export command and its flags after --, ex. install-service -- export --dump-path=/backups/")
+		}
+		if *servicePrint && *serviceEnable {
+			log.Fatal().Msg("print and enable can't be used together")
+		}
+
+		exe, err := os.Executable()
+		if err != nil {
+			log.Fatal().Msgf("Failed to get executable path: %v", err)
+		}
+		workDir, err := os.Getwd()
+		if err != nil {
+			log.Fatal().Msgf("Failed to get working directory: %v", err)
+		}
+		envFile := *serviceEnvFile
+		if envFile == "" {
+			envFile = filepath.Join("/etc/pmm-transferer", *serviceName+".env")
+		}
+
+		// credentials set before -- are passed to the service as well
+		env := serviceEnv(map[string]string{
+			"pmm-url":              *pmmURL,
+			"victoria-metrics-url": *victoriaMetricsURL,
+			"click-house-url":      *clickHouseURL,
+		})
+		files := composeServiceFiles(exe, workDir, *serviceArgs, env, serviceOptions{
+			name:            *serviceName,
+			onCalendar:      *serviceCalendar,
+			randomizedDelay: *serviceRandomizedDelay,
+			user:            *serviceUser,
+			unitDir:         *serviceUnitDir,
+			envFile:         envFile,
+		})
+		if *servicePrint {
+			printServiceFiles(files)
+			break
+		}
+		if err = installService(files, *serviceName, *serviceEnable); err != nil {
+			log.Fatal().Msgf("Failed to install service: %v", err)
+		}
+	case !exportOnly && cmd == verifyQueriesCmd.FullCommand():
+		if *pmmURL == "" {
+			log.Fatal().Msg("Please, specify PMM URL")
+		}
+		if *verifyQueriesStep <= 0 {
+			log.Fatal().Msg("Step should be positive")
+		}
+
+		queries, err := readVerifyQueries(*verifyQueriesFile)
+		if err != nil {
+			log.Fatal().Msgf("Failed to read queries: %v", err)
+		}
+
+		startTS, endTS := *verifyQueriesStart, *verifyQueriesEnd
+		if startTS == "" && endTS == "" && *dumpPath != "" {
+			meta, err := transferer.ReadMetaFromDump(*dumpPath, false)
+			if err != nil {
+				log.Fatal().Msgf("Failed to read dump meta: %v", err)
+			}
+			if meta.Range == nil {
+				log.Fatal().Msg("Dump has no time range, please specify start-ts and end-ts")
+			}
+			startTS, endTS = meta.Range.Start.Format(time.RFC3339), meta.Range.End.Format(time.RFC3339)
+		}
+		startTime, endTime, err := parseTimeRange(startTS, endTS)
+		if err != nil {
+			log.Fatal().Msgf("Failed to parse time range: %v", err)
+		}
+
+		sourceConfig, err := getPMMConfig(*verifyQueriesSourceURL, *verifyQueriesSourceVM, *verifyQueriesSourceCH)
+		if err != nil {
+			log.Fatal().Msgf("Failed to compose source PMM config: %v", err)
+		}
+		targetConfig, err := getPMMConfig(*pmmURL, *victoriaMetricsURL, *clickHouseURL)
+		if err != nil {
+			log.Fatal().Msgf("Failed to compose target PMM config: %v", err)
+		}
+
+		results, err := verifyQueries(ctx, httpC, sourceConfig, targetConfig, queries, verifyQueriesOptions{
+			start:     startTime,
+			end:       endTime,
+			step:      *verifyQueriesStep,
+			tolerance: *verifyQueriesTolerance,
+		})
+		if err != nil {
+			log.Fatal().Msgf("Failed to verify queries: %v", err)
+		}
+		if !printVerifyQueriesReport(results) {
+			os.Exit(1)
+		}
+	case !exportOnly && cmd == seriesCmd.FullCommand():
+		if *pmmURL == "" && *victoriaMetricsURL == "" {
+			log.Fatal().Msg("Please, specify PMM URL")
+		}
+
+		pmmConfig, err := getPMMConfig(*pmmURL, *victoriaMetricsURL, *clickHouseURL)
+		if err != nil {
+			log.Fatal().Msgf("Failed to compose PMM config: %v", err)
+		}
+
+		startTime, endTime, err := parseTimeRange(*seriesStart, *seriesEnd)
+		if err != nil {
+			log.Fatal().Msgf("Invalid time range: %v", err)
+		}
+
+		var selectors []string
+		if *seriesSelector != "" {
+			selectors = append(selectors, *seriesSelector)
+		}
+		vmSource, _ := prepareVictoriaMetricsSource(httpC, true, victoriametrics.Config{
+			ConnectionURL:       pmmConfig.VictoriaMetricsURL,
+			TimeSeriesSelectors: selectors,
+		})
+
+		if err = printSeriesPreview(vmSource, startTime, endTime, *seriesTop); err != nil {
+			log.Fatal().Msgf("Failed to preview series: %v", err)
+		}
+	case !exportOnly && cmd == catalogCmd.FullCommand():
+		var entries []catalogEntry
+		var err error
+		if s3.IsURL(*catalogDir) {
+			entries, err = buildS3Catalog(ctx, newStorageClientHTTP(*allowInsecureCerts), newS3Config(*s3Endpoint, *s3Region, *s3PathStyle), *catalogDir)
+		} else {
+			entries, err = buildCatalog(*catalogDir)
+		}
+		if err != nil {
+			log.Fatal().Msgf("Failed to build catalog: %v", err)
+		}
+		if err = printCatalog(entries, *catalogFormat); err != nil {
+			log.Fatal().Msgf("Failed to print catalog: %v", err)
+		}
+	case !exportOnly && cmd == planRestoreCmd.FullCommand():
+		want, err := parseRestoreRange(*planRestoreRange)
+		if err != nil {
+			log.Fatal().Msgf("Invalid range: %v", err)
+		}
+
+		entries, err := buildCatalog(*planRestoreDir)
+		if err != nil {
+			log.Fatal().Msgf("Failed to build catalog: %v", err)
+		}
+
+		plan, gaps := planRestore(restoreCandidates(entries), want)
+		printRestorePlan(plan, gaps)
+
+		if *planRestoreExecute && len(plan) != 0 {
+			args, err := globalArgs(cli, os.Args[1:])
+			if err != nil {
+				log.Fatal().Msgf("Failed to parse arguments: %v", err)
+			}
+			if err = executeRestore(plan, args); err != nil {
+				log.Fatal().Msgf("Failed to restore: %v", err)
+			}
+		}
+	case !exportOnly && cmd == decryptCmd.FullCommand():
+		if *dumpPath == "" {
+			log.Fatal().Msg("Please, specify path to dump file")
+		}
+
+		key, err := encryption.ReadKeyFile(*decryptKeyFile)
+		if err != nil {
+			log.Fatal().Msgf("Failed to read key: %v", err)
+		}
+
+		output := *decryptOutput
+		if output == "" {
+			output = strings.TrimSuffix(*dumpPath, encryption.FileSuffix)
+			if output == *dumpPath {
+				log.Fatal().Msg("Please, specify output path")
+			}
+		}
+
+		if err = encryption.DecryptFile(*dumpPath, output, key); err != nil {
+			log.Fatal().Msgf("Failed to decrypt dump: %v", err)
+		}
+		log.Info().Msgf("Decrypted dump is written to %s", output)
+	case !exportOnly && cmd == reencryptCmd.FullCommand():
+		if *dumpPath == "" {
+			log.Fatal().Msg("Please, specify path to dump file")
+		}
+
+		if *reencryptKeyFile != "" || *reencryptNewKeyFile != "" {
+			if *reencryptKeyFile == "" || *reencryptNewKeyFile == "" {
+				log.Fatal().Msg("Please, specify both key-file and new-key-file")
+			}
+			oldKey, err := encryption.ReadKeyFile(*reencryptKeyFile)
+			if err != nil {
+				log.Fatal().Msgf("Failed to read key: %v", err)
+			}
+			newKey, err := encryption.ReadKeyFile(*reencryptNewKeyFile)
+			if err != nil {
+				log.Fatal().Msgf("Failed to read new key: %v", err)
+			}
+			if err = reencryptFile(*dumpPath, *reencryptOutput, oldKey, newKey); err != nil {
+				log.Fatal().Msgf("Failed to re-encrypt dump: %v", err)
+			}
+			log.Info().Msg("Dump is re-encrypted")
+			break
+		}
+
+		oldKeys, err := readEntryKeys(*metricsKeyFile, *qanKeyFile)
+		if err != nil {
+			log.Fatal().Msgf("Failed to read encryption key: %v", err)
+		}
+		newKeys, err := readEntryKeys(*reencryptNewMetricsKeyFile, *reencryptNewQANKeyFile)
+		if err != nil {
+			log.Fatal().Msgf("Failed to read new encryption key: %v", err)
+		}
+		if len(newKeys) == 0 {
+			log.Fatal().Msg("Please, specify new-metrics-key-file, new-qan-key-file or new-key-file")
+		}
+		for st := range newKeys {
+			if _, ok := oldKeys[st]; !ok {
+				log.Fatal().Msgf("Please, specify the current key of %s entries", st)
+			}
+		}
+		if err = reencryptDump(*dumpPath, *reencryptOutput, oldKeys, newKeys); err != nil {
+			log.Fatal().Msgf("Failed to re-encrypt dump: %v", err)
+		}
+		log.Info().Msg("Dump is re-encrypted")
+	case !exportOnly && cmd == showMetaCmd.FullCommand():
+		piped, err := checkPiped()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to check if a program is piped")
+		}
+		if *dumpPath == "" && piped == false {
+			log.Fatal().Msg("Please, specify path to dump file")
+		}
+
+		meta, err := transferer.ReadMetaFromDump(*dumpPath, piped)
+		if err != nil {
+			log.Fatal().Msgf("Can't show meta: %v", err)
+		}
+
+		if *prettifyMeta {
+			fmt.Printf("ID: %v\n", orDash(meta.ID))
+			if meta.ParentID != "" {
+				fmt.Printf("Parent ID: %v\n", meta.ParentID)
+			}
+			fmt.Printf("Build: %v\n", meta.Version.GitCommit)
+			fmt.Printf("PMM Version: %v\n", meta.PMMServerVersion)
+			fmt.Printf("Max Chunk Size: %v (%v)\n", ByteCountDecimal(meta.MaxChunkSize),
+				ByteCountBinary(meta.MaxChunkSize))
+			if meta.Range != nil {
+				fmt.Printf("Range: %v - %v\n", meta.Range.Start.Format(time.RFC3339), meta.Range.End.Format(time.RFC3339))
+			}
+			if meta.Partial {
+				fmt.Printf("Partial: export was aborted\n")
+				if meta.CoveredRange != nil {
+					fmt.Printf("Covered Range: %v - %v\n", meta.CoveredRange.Start.Format(time.RFC3339),
+						meta.CoveredRange.End.Format(time.RFC3339))
+				}
+			}
+			if len(meta.EmptyChunks) > 0 {
+				fmt.Printf("Empty Chunks: %d (not written to the dump)\n", len(meta.EmptyChunks))
+			}
+			if len(meta.SkippedChunks) > 0 {
+				reasons := make(map[string]int)
+				for _, c := range meta.SkippedChunks {
+					reasons[c.Reason]++
+				}
+				fmt.Printf("Skipped Chunks: %d (%s)\n", len(meta.SkippedChunks), formatReasons(reasons))
+			}
+			if len(meta.DroppedMetrics) > 0 {
+				reasons := make(map[string]int)
+				for _, m := range meta.DroppedMetrics {
+					reasons[m.Reason]++
+				}
+				fmt.Printf("Dropped Metrics: %d (%s)\n", len(meta.DroppedMetrics), formatReasons(reasons))
+			}
+			if len(meta.UserMeta) > 0 {
+				fmt.Printf("User Meta:\n")
+				keys := make([]string, 0, len(meta.UserMeta))
+				for k := range meta.UserMeta {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				for _, k := range keys {
+					fmt.Printf("  %s: %s\n", k, meta.UserMeta[k])
+				}
+			}
+		} else {
+			jsonMeta, err := json.MarshalIndent(meta, "", "\t")
+			if err != nil {
+				log.Fatal().Msgf("Failed to format meta as json: %v", err)
+			}
 
 			fmt.Printf("%v\n", string(jsonMeta))
 		}
-	case versionCmd.FullCommand():
+	case cmd == versionCmd.FullCommand():
 		fmt.Printf("Build: %v\n", GitCommit)
 	default:
 		log.Fatal().Msgf("Undefined command found: %s", cmd)
 	}
 }
 
-func prepareVictoriaMetricsSource(httpC *fasthttp.Client, dumpCore bool, url string, selectors []string) (*victoriametrics.Source, bool) {
+func prepareVictoriaMetricsSource(httpC *fasthttp.Client, dumpCore bool, c victoriametrics.Config) (*victoriametrics.Source, bool) {
 	if !dumpCore {
 		return nil, false
 	}
 
-	c := &victoriametrics.Config{
-		ConnectionURL:       url,
-		TimeSeriesSelectors: selectors,
-	}
-
 	log.Debug().Msgf("Got Victoria Metrics URL: %s", c.ConnectionURL)
 
-	return victoriametrics.NewSource(httpC, *c), true
+	return victoriametrics.NewSource(httpC, c), true
 }
 
-func prepareClickHouseSource(ctx context.Context, dumpQAN bool, url, where string) (*clickhouse.Source, bool) {
+func prepareClickHouseSource(ctx context.Context, dumpQAN bool, c clickhouse.Config) (*clickhouse.Source, bool) {
 	if !dumpQAN {
 		return nil, false
 	}
 
-	c := &clickhouse.Config{
-		ConnectionURL: url,
-		Where:         where,
-	}
-
-	clickhouseSource, err := clickhouse.NewSource(ctx, *c)
+	clickhouseSource, err := clickhouse.NewSource(ctx, c)
 	if err != nil {
 		log.Fatal().Msgf("Failed to create ClickHouse source: %s", err.Error())
 	}
@@ -343,3 +1958,266 @@ func prepareClickHouseSource(ctx context.Context, dumpQAN bool, url, where strin
 
 	return clickhouseSource, true
 }
+
+// preparePluginSources creates sources of the plugins ordered by name, so dump content doesn't depend on flags order
+func preparePluginSources(plugins map[string]string, timeout time.Duration) []*plugin.Source {
+	names := make([]string, 0, len(plugins))
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sources := make([]*plugin.Source, 0, len(names))
+	for _, name := range names {
+		s, err := plugin.NewSource(plugin.Config{
+			Name:    name,
+			Path:    plugins[name],
+			Timeout: timeout,
+		})
+		if err != nil {
+			log.Fatal().Msgf("Failed to create plugin source: %s", err.Error())
+		}
+
+		log.Debug().Msgf("Got plugin %s: %s", name, plugins[name])
+
+		sources = append(sources, s)
+	}
+	return sources
+}
+
+// prepareTransforms creates chunk transformation stages in the order of flags
+func prepareTransforms(cmds []string, timeout time.Duration) transform.Pipeline {
+	var p transform.Pipeline
+	for _, c := range cmds {
+		stage, err := transform.NewCommand(c, timeout)
+		if err != nil {
+			log.Fatal().Msgf("Failed to create chunk transformation: %s", err.Error())
+		}
+
+		log.Debug().Msgf("Got chunk transformation: %s", stage.Name())
+
+		p = append(p, stage)
+	}
+	return p
+}
+
+// preparePlanners returns chunk planners: label splitting goes first, so commands get the narrowed chunks
+func preparePlanners(vmSource *victoriametrics.Source, label string, cmds []string, timeout time.Duration) planner.Pipeline {
+	var p planner.Pipeline
+	if label != "" {
+		l, err := planner.NewLabel(label, vmSource)
+		if err != nil {
+			log.Fatal().Msgf("Failed to create chunk planner: %s", err.Error())
+		}
+		p = append(p, l)
+	}
+	for _, c := range cmds {
+		cmd, err := planner.NewCommand(c, timeout)
+		if err != nil {
+			log.Fatal().Msgf("Failed to create chunk planner: %s", err.Error())
+		}
+
+		log.Debug().Msgf("Got chunk planner: %s", cmd.Name())
+
+		p = append(p, cmd)
+	}
+	return p
+}
+
+const inputFormatDump = "dump"
+
+// exportFinalizeTimeout is how long export may finalize partial dump after the run timeout
+const exportFinalizeTimeout = 5 * time.Minute
+
+const (
+	loadCheckEnforce = "enforce"
+	loadCheckWarn    = "warn"
+	loadCheckOff     = "off"
+)
+
+const (
+	stallActionWarn  = "warn"
+	stallActionAbort = "abort"
+)
+
+const (
+	orderOldestFirst = "oldest-first"
+	orderNewestFirst = "newest-first"
+)
+
+const (
+	diskCheckEnforce = "enforce"
+	diskCheckWarn    = "warn"
+	diskCheckOff     = "off"
+)
+
+func checkImportDiskSpace(t *transferer.Transferer, s *victoriametrics.Source, nodeFilter string) error {
+	free, err := s.FreeDiskSpace(nodeFilter)
+	if err != nil {
+		return errors.Wrap(err, "failed to get PMM Server free disk space")
+	}
+	if free == 0 {
+		log.Warn().Msg("PMM Server free disk space is unknown: skipped disk space check")
+		return nil
+	}
+
+	required, err := t.EstimateImportDiskUsage()
+	if err != nil {
+		return errors.Wrap(err, "failed to estimate required disk space")
+	}
+
+	log.Info().Msgf("Import requires about %s, PMM Server has %s free",
+		ByteCountBinary(required), ByteCountBinary(int64(free)))
+
+	if float64(required) > free {
+		return errors.Errorf("not enough free disk space on PMM Server: %s required, %s available",
+			ByteCountBinary(required), ByteCountBinary(int64(free)))
+	}
+	return nil
+}
+
+func newS3Config(endpoint, region string, pathStyle bool) s3.Config {
+	cfg := s3.Config{
+		Endpoint:  endpoint,
+		Region:    region,
+		PathStyle: pathStyle,
+	}
+	cfg.CredentialsFromEnv()
+	return cfg
+}
+
+// downloadDump downloads the dump by URL and returns the path of the downloaded file
+func downloadDump(ctx context.Context, rawURL, dir string, insecureSkipVerify bool, s3Cfg s3.Config) (string, error) {
+	name, err := download.Filename(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	var sign download.RequestSigner
+	if s3.IsURL(rawURL) {
+		if rawURL, err = s3Cfg.ObjectURL(rawURL); err != nil {
+			return "", err
+		}
+		sign = s3Cfg.Sign
+	}
+	dst := filepath.Join(dir, name)
+
+	if _, err = os.Stat(dst); err == nil {
+		log.Info().Msgf("Dump is already downloaded to %s", dst)
+		return dst, nil
+	}
+
+	log.Info().Msgf("Downloading dump to %s...", dst)
+	if err = download.New(insecureSkipVerify, sign).Download(ctx, rawURL, dst); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// dumpUploader uploads the dump file
+type dumpUploader interface {
+	Upload(ctx context.Context, path string) error
+}
+
+// uploadDump uploads the dump with S3 multipart upload for s3:// URL and tus protocol otherwise,
+// encrypting it first if the key file is specified
+func uploadDump(ctx context.Context, httpC *fasthttp.Client, cfg upload.Config, insecureSkipVerify bool, s3Cfg s3.Config, keyFile, path string) error {
+	var u dumpUploader
+	var err error
+	if s3.IsURL(cfg.URL) {
+		u, err = upload.NewS3(newStorageClientHTTP(insecureSkipVerify), s3Cfg, cfg)
+	} else {
+		u, err = upload.New(httpC, cfg)
+	}
+	if err != nil {
+		return err
+	}
+
+	if keyFile != "" {
+		key, err := encryption.ReadKeyFile(keyFile)
+		if err != nil {
+			return err
+		}
+
+		encrypted := path + encryption.FileSuffix
+		// encrypted copy is reused, so interrupted upload is resumed instead of uploading a new ciphertext.
+		// It's verified against the dump, as the dump may be exported again or the key may be changed since then
+		reuse := false
+		if _, err = os.Stat(encrypted); err == nil {
+			if err = encryption.VerifyFile(encrypted, path, key); err != nil {
+				log.Warn().Msgf("Already encrypted dump %s can't be reused, encrypting again: %v", encrypted, err)
+			} else {
+				log.Info().Msgf("Using already encrypted dump %s", encrypted)
+				reuse = true
+			}
+		}
+		if !reuse {
+			// upload state of the previous ciphertext would resume upload of different content
+			if err = os.Remove(encrypted + upload.StateFileSuffix); err != nil && !os.IsNotExist(err) {
+				return errors.Wrap(err, "failed to remove upload state")
+			}
+			log.Info().Msgf("Encrypting %s...", path)
+			if err = encryption.EncryptFile(path, encrypted, key); err != nil {
+				return errors.Wrap(err, "failed to encrypt dump")
+			}
+		}
+
+		log.Info().Msgf("Uploading %s to %s...", encrypted, uploadDestination(cfg.URL))
+		if err = u.Upload(ctx, encrypted); err != nil {
+			return err
+		}
+		if err = os.Remove(encrypted); err != nil {
+			log.Warn().Err(err).Msg("Failed to remove encrypted dump")
+		}
+		return nil
+	}
+
+	log.Info().Msgf("Uploading %s to %s...", path, uploadDestination(cfg.URL))
+
+	return u.Upload(ctx, path)
+}
+
+func uploadDestination(uploadURL string) string {
+	if s3.IsURL(uploadURL) {
+		return uploadURL
+	}
+	return "Percona support"
+}
+
+func printSeriesPreview(s *victoriametrics.Source, start, end time.Time, top int) error {
+	series, err := s.Series(start, end)
+	if err != nil {
+		return err
+	}
+
+	samples, err := s.SamplesCount(start, end)
+	if err != nil {
+		return err
+	}
+
+	counts := victoriametrics.SeriesCountByMetric(series)
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] == counts[names[j]] {
+			return names[i] < names[j]
+		}
+		return counts[names[i]] > counts[names[j]]
+	})
+	if top > 0 && len(names) > top {
+		names = names[:top]
+	}
+
+	fmt.Printf("Time range: %v - %v\n", start.Format(time.RFC3339), end.Format(time.RFC3339))
+	fmt.Printf("Series: %d\n", len(series))
+	fmt.Printf("Metrics: %d\n", len(counts))
+	fmt.Printf("Samples (approx.): %d\n", samples)
+	fmt.Printf("\nTop metrics by series count:\n")
+	for _, name := range names {
+		fmt.Printf("%10d  %s\n", counts[name], name)
+	}
+
+	return nil
+}
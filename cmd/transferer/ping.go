@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"pmm-transferer/pkg/clickhouse"
+	"pmm-transferer/pkg/transferer"
+	"pmm-transferer/pkg/victoriametrics"
+	"text/tabwriter"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const pmmAuthCheck = "PMM API (auth)"
+
+type pingCheck struct {
+	name string
+	fn   func() error
+}
+
+func pingChecks(ctx context.Context, httpC *fasthttp.Client, cfg PMMConfig, chTables []string, lc transferer.LoadCheckerConfig) []pingCheck {
+	vmSource := victoriametrics.NewSource(httpC, victoriametrics.Config{
+		ConnectionURL: cfg.VictoriaMetricsURL,
+	})
+
+	var chSource *clickhouse.Source
+	chConnect := func() error {
+		var err error
+		chSource, err = clickhouse.NewSource(ctx, clickhouse.Config{
+			ConnectionURL: cfg.ClickHouseURL,
+			Tables:        chTables,
+		})
+		return err
+	}
+
+	return []pingCheck{
+		{name: pmmAuthCheck, fn: func() error {
+			_, err := getPMMVersion(cfg.PMMURL, httpC)
+			return err
+		}},
+		{name: "VM export", fn: vmSource.PingExport},
+		{name: "VM import", fn: vmSource.PingImport},
+		{name: "CH read", fn: chConnect},
+		{name: "CH write", fn: func() error {
+			if chSource == nil {
+				return fmt.Errorf("not connected")
+			}
+			return chSource.PingWrite()
+		}},
+		{name: "Load checker", fn: func() error {
+			if err := resolveLoadCheckerNode(httpC, &lc); err != nil {
+				return err
+			}
+			return transferer.PingLoadChecker(httpC, lc)
+		}},
+	}
+}
+
+// runPing prints reachability table of all checks and returns false if any of them failed
+func runPing(checks []pingCheck) bool {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "ENDPOINT\tSTATUS\tLATENCY\tERROR")
+
+	ok := true
+	for _, c := range checks {
+		start := time.Now()
+		err := c.fn()
+		latency := time.Since(start).Round(time.Millisecond)
+
+		status, errMsg := "reachable", "-"
+		if err != nil {
+			status, errMsg = "unreachable", err.Error()
+			ok = false
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%v\t%s\n", c.name, status, latency, errMsg)
+	}
+	_ = w.Flush()
+
+	return ok
+}
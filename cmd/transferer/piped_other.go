@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "os"
+
+func checkPiped() (bool, error) {
+	stat, err := os.Stdin.Stat()
+	if err != nil {
+		return false, err
+	}
+	if (stat.Mode() & os.ModeCharDevice) == 0 {
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,17 @@
+package main
+
+import "os"
+
+// checkPiped reports whether stdin is a pipe or a redirected file. Unlike unix, some Windows
+// terminals don't report console as char device, so only the explicit cases are treated as piped.
+func checkPiped() (bool, error) {
+	stat, err := os.Stdin.Stat()
+	if err != nil {
+		return false, err
+	}
+	mode := stat.Mode()
+	if mode&os.ModeNamedPipe != 0 || mode.IsRegular() {
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var errNoTerminal = errors.New("not attached to a terminal")
+
+// prompter asks for missing values and confirmations in the controlling terminal, so prompts work
+// with the dump piped to STDIN. It's nil when run without a terminal, e.g. by cron, systemd or CI
+type prompter struct {
+	tty *os.File
+	r   *bufio.Reader
+}
+
+func newPrompter() *prompter {
+	tty, err := openTerminal()
+	if err != nil {
+		return nil
+	}
+	return &prompter{tty: tty, r: bufio.NewReader(tty)}
+}
+
+func (p *prompter) close() {
+	if p != nil {
+		_ = p.tty.Close()
+	}
+}
+
+func (p *prompter) ask(question string) (string, error) {
+	if p == nil {
+		return "", errNoTerminal
+	}
+	fmt.Fprint(p.tty, question)
+	line, err := p.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// askSecret asks for the value without echoing it, echo is restored if the prompt is interrupted
+func (p *prompter) askSecret(question string) (string, error) {
+	if p == nil {
+		return "", errNoTerminal
+	}
+	if err := setEcho(p.tty, false); err != nil {
+		return "", errors.Wrap(err, "failed to disable terminal echo")
+	}
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-interrupted:
+			_ = setEcho(p.tty, true)
+			fmt.Fprintln(p.tty)
+			os.Exit(130)
+		case <-done:
+		}
+	}()
+	defer func() {
+		signal.Stop(interrupted)
+		close(done)
+		_ = setEcho(p.tty, true)
+		fmt.Fprintln(p.tty)
+	}()
+
+	fmt.Fprint(p.tty, question)
+	line, err := p.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// confirm asks the yes/no question, the answer is no unless it's explicitly yes
+func (p *prompter) confirm(question string) bool {
+	answer, err := p.ask(question + " [y/N]: ")
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(answer)
+	return answer == "y" || answer == "yes"
+}
+
+// confirmAction asks to confirm the action, it's confirmed without asking with --yes or without a terminal
+func confirmAction(p *prompter, assumeYes bool, question string) bool {
+	if assumeYes || p == nil {
+		return true
+	}
+	return p.confirm(question)
+}
+
+// confirmDeletion asks to confirm deleting data. Unlike confirmAction, it's not confirmed without a terminal,
+// so unattended runs have to pass --yes explicitly
+func confirmDeletion(p *prompter, assumeYes bool, question string) (bool, error) {
+	if assumeYes {
+		return true, nil
+	}
+	if p == nil {
+		return false, errors.Wrap(errNoTerminal, "please, confirm deletion with --yes")
+	}
+	return p.confirm(question), nil
+}
+
+// completePMMURL asks for PMM URL if it's not set, and for the password if the URL has user only
+func completePMMURL(p *prompter, pmmURL string) (string, error) {
+	if p == nil {
+		return pmmURL, nil
+	}
+	if pmmURL == "" {
+		v, err := p.ask("PMM URL (e.g. https://admin@pmm.example.com): ")
+		if err != nil {
+			return "", errors.Wrap(err, "failed to read PMM URL")
+		}
+		if pmmURL = v; pmmURL == "" {
+			return "", nil
+		}
+	}
+
+	u, err := url.Parse(pmmURL)
+	if err != nil || u.User == nil || u.User.Username() == "" {
+		return pmmURL, nil
+	}
+	if _, ok := u.User.Password(); ok {
+		return pmmURL, nil
+	}
+	password, err := p.askSecret(fmt.Sprintf("Password of %s at %s: ", u.User.Username(), u.Host))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read password")
+	}
+	u.User = url.UserPassword(u.User.Username(), password)
+	return u.String(), nil
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"os"
+)
+
+func openTerminal() (*os.File, error) {
+	return nil, errors.New("prompts are not supported on Windows")
+}
+
+func setEcho(*os.File, bool) error {
+	return errors.New("prompts are not supported on Windows")
+}
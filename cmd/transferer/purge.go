@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"pmm-transferer/pkg/clickhouse"
+	"pmm-transferer/pkg/transferer"
+	"pmm-transferer/pkg/victoriametrics"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// purgeTarget is the data written by an import: core metrics series and QAN rows of the time range with the labels
+type purgeTarget struct {
+	dumpID     string
+	start, end time.Time
+	labels     map[string][]string
+}
+
+// dumpPurgeTarget selects data of the dump services within the dump time range
+func dumpPurgeTarget(dumpPath, dumpID string) (purgeTarget, error) {
+	meta, err := transferer.ReadMetaFromDump(dumpPath, false)
+	if err != nil {
+		return purgeTarget{}, errors.Wrap(err, "failed to read dump meta")
+	}
+	if meta.ID != dumpID {
+		return purgeTarget{}, errors.Errorf("dump %s has ID %q, not %s", dumpPath, meta.ID, dumpID)
+	}
+	r := meta.CoveredRange
+	if r == nil {
+		r = meta.Range
+	}
+	if r == nil {
+		return purgeTarget{}, errors.New("dump has no time range, please specify start-ts and end-ts")
+	}
+
+	_, services, err := dumpServices(dumpPath)
+	if err != nil {
+		return purgeTarget{}, errors.Wrap(err, "failed to collect dump services")
+	}
+	if len(services) == 0 {
+		return purgeTarget{}, errors.New("dump has no services to select imported data")
+	}
+	names := make([]string, 0, len(services))
+	for _, s := range services {
+		names = append(names, s.Name)
+	}
+	sort.Strings(names)
+
+	return purgeTarget{
+		dumpID: dumpID,
+		start:  r.Start,
+		end:    r.End,
+		labels: map[string][]string{"service_name": names},
+	}, nil
+}
+
+// seriesSelector returns selector of the core metrics series with the labels
+func (p purgeTarget) seriesSelector() string {
+	names := make([]string, 0, len(p.labels))
+	for name := range p.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	matchers := make([]string, 0, len(names))
+	for _, name := range names {
+		values := p.labels[name]
+		if len(values) == 1 {
+			matchers = append(matchers, fmt.Sprintf("%s=%s", name, strconv.Quote(values[0])))
+			continue
+		}
+		quoted := make([]string, 0, len(values))
+		for _, v := range values {
+			quoted = append(quoted, regexp.QuoteMeta(v))
+		}
+		matchers = append(matchers, fmt.Sprintf("%s=~%s", name, strconv.Quote(strings.Join(quoted, "|"))))
+	}
+	return "{" + strings.Join(matchers, ",") + "}"
+}
+
+func (p purgeTarget) String() string {
+	return fmt.Sprintf("%s in %s - %s", p.seriesSelector(), p.start.Format(time.RFC3339), p.end.Format(time.RFC3339))
+}
+
+// purgeImport deletes the target data from the sources. VictoriaMetrics can't delete samples of the time range,
+// so the matching series are deleted completely
+func purgeImport(vm *victoriametrics.Source, ch *clickhouse.Source, p purgeTarget) error {
+	if vm != nil {
+		selectors := []string{p.seriesSelector()}
+		if p.dumpID != "" {
+			// import markers are deleted too, so the dump can be imported again without --force
+			selectors = append(selectors, fmt.Sprintf("%s{dump_id=%s}", victoriametrics.ImportMarkerMetric, strconv.Quote(p.dumpID)))
+		}
+		if err := vm.DeleteSeries(selectors); err != nil {
+			return errors.Wrap(err, "failed to delete core metrics series")
+		}
+		log.Info().Msgf("Deleted core metrics series %s", strings.Join(selectors, ", "))
+	}
+
+	if ch != nil {
+		results, err := ch.Purge(clickhouse.PurgeFilter{Start: p.start, End: p.end, Columns: p.labels})
+		if err != nil {
+			return errors.Wrap(err, "failed to delete QAN rows")
+		}
+		for _, r := range results {
+			log.Info().Msgf("Deleted %d rows of %s: %d partitions dropped, other rows are deleted by mutation in background",
+				r.Rows, r.Table, r.DroppedPartitions)
+		}
+	}
+	return nil
+}
+
+// labelNameRegex matches names valid for both core metrics labels and QAN columns
+var labelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// parsePurgeLabels converts label flags into purge target labels
+func parsePurgeLabels(labels map[string]string) (map[string][]string, error) {
+	result := make(map[string][]string, len(labels))
+	for name, value := range labels {
+		if !labelNameRegex.MatchString(name) {
+			return nil, errors.Errorf("invalid label name %q", name)
+		}
+		result[name] = []string{value}
+	}
+	return result, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"pmm-transferer/pkg/dump"
+	"pmm-transferer/pkg/encryption"
+	"pmm-transferer/pkg/transferer"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// reencryptDump re-encrypts entries of each dump volume with the new keys. Volumes are replaced in place,
+// unless output is set for a single file dump. Checksum files next to the volumes are updated
+func reencryptDump(dumpPath, output string, oldKeys, newKeys transferer.EntryKeys) error {
+	paths, err := dump.VolumePaths(dumpPath)
+	if err != nil {
+		return err
+	}
+	if output != "" && len(paths) != 1 {
+		return errors.New("output can't be set for dump with volumes")
+	}
+
+	for _, p := range paths {
+		dst := p
+		if output != "" {
+			dst = output
+		}
+		n, err := transferer.ReencryptDump(p, dst, oldKeys, newKeys)
+		if err != nil {
+			return errors.Wrapf(err, "failed to re-encrypt %s", p)
+		}
+		log.Info().Msgf("Re-encrypted %d entries of %s", n, p)
+		if err = updateChecksumFile(p, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reencryptFile re-encrypts dump encrypted before upload with the new key
+func reencryptFile(dumpPath, output string, oldKey, newKey []byte) error {
+	if output == "" {
+		output = dumpPath
+	}
+	if err := encryption.ReencryptFile(dumpPath, output, oldKey, newKey); err != nil {
+		return err
+	}
+	return updateChecksumFile(dumpPath, output)
+}
+
+// updateChecksumFile writes checksum of dst if src has checksum file, so it's not stale after the dump is rewritten
+func updateChecksumFile(src, dst string) error {
+	if _, err := os.Stat(src + dump.ChecksumSuffix); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "failed to check checksum file")
+	}
+	sum, err := dump.WriteChecksumFile(dst)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("SHA-256 of %s is written to %s: %s", dst, dst+dump.ChecksumSuffix, sum)
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"pmm-transferer/pkg/dump"
+	"pmm-transferer/pkg/transferer"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// limitsConfig are export limits of the config file, e.g.
+//
+//	limits:
+//	  max-load: CPU=30,RAM=40
+//	  max-pacing-delay: 10s
+//	  max-vm-requests: 2
+//	  workers: 2
+//
+// They are applied at export start and reloaded on SIGHUP, settings which aren't set are taken from the flags
+type limitsConfig struct {
+	MaxLoad        *string        `yaml:"max-load"`
+	CriticalLoad   *string        `yaml:"critical-load"`
+	MaxPacingDelay *time.Duration `yaml:"max-pacing-delay"`
+	MaxVMRequests  *int           `yaml:"max-vm-requests"`
+	MaxCHRequests  *int           `yaml:"max-ch-requests"`
+	Workers        *int           `yaml:"workers"`
+}
+
+// limitFlags are values of the flags overridden by the config file limits
+type limitFlags struct {
+	maxLoad        string
+	criticalLoad   string
+	maxPacingDelay time.Duration
+	maxVMRequests  int
+	maxCHRequests  int
+	// checkLoad and useSchedule tell if thresholds and the load schedule are applied at all
+	checkLoad   bool
+	useSchedule bool
+}
+
+type exportLimits struct {
+	thresholds     []transferer.Threshold
+	maxPacingDelay time.Duration
+	schedule       []transferer.LoadWindow
+	requests       map[dump.SourceType]int
+	// workers is the number of reading workers, 0 for all of them
+	workers int
+}
+
+// readExportLimits returns limits of the flags overridden by the config file ones
+func readExportLimits(path string, f limitFlags) (exportLimits, error) {
+	c, err := readConfigFile(path)
+	if err != nil {
+		return exportLimits{}, err
+	}
+
+	l := exportLimits{
+		maxPacingDelay: f.maxPacingDelay,
+		requests: map[dump.SourceType]int{
+			dump.VictoriaMetrics: f.maxVMRequests,
+			dump.ClickHouse:      f.maxCHRequests,
+		},
+	}
+	if c.Limits.MaxPacingDelay != nil {
+		l.maxPacingDelay = *c.Limits.MaxPacingDelay
+	}
+	for name, v := range map[string]*int{
+		"max-vm-requests": c.Limits.MaxVMRequests,
+		"max-ch-requests": c.Limits.MaxCHRequests,
+		"workers":         c.Limits.Workers,
+	} {
+		if v != nil && *v < 0 {
+			return exportLimits{}, errors.Errorf("%s of limits should not be negative", name)
+		}
+	}
+	if c.Limits.MaxVMRequests != nil {
+		l.requests[dump.VictoriaMetrics] = *c.Limits.MaxVMRequests
+	}
+	if c.Limits.MaxCHRequests != nil {
+		l.requests[dump.ClickHouse] = *c.Limits.MaxCHRequests
+	}
+	if c.Limits.Workers != nil {
+		l.workers = *c.Limits.Workers
+	}
+
+	if !f.checkLoad {
+		return l, nil
+	}
+	maxLoad, criticalLoad := overrideLoad(f.maxLoad, c.Limits.MaxLoad), overrideLoad(f.criticalLoad, c.Limits.CriticalLoad)
+	if l.thresholds, err = transferer.ParseThresholdList(maxLoad, criticalLoad); err != nil {
+		return exportLimits{}, errors.Wrap(err, "failed to parse max/critical load")
+	}
+	if f.useSchedule {
+		if l.schedule, err = loadSchedule(c, maxLoad, criticalLoad, l.maxPacingDelay); err != nil {
+			return exportLimits{}, errors.Wrap(err, "failed to load schedule")
+		}
+	}
+	return l, nil
+}
+
+// reloadLimitsOnHangup applies limits of the config file to the running export on SIGHUP.
+// Limits are kept as is if the config file is invalid. It returns the function stopping the reload
+func reloadLimitsOnHangup(ctx context.Context, path string, f limitFlags, t *transferer.Transferer, lc *transferer.LoadChecker) func() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-hup:
+				l, err := readExportLimits(path, f)
+				if err != nil {
+					log.Error().Msgf("Failed to reload limits, current ones are kept: %v", err)
+					continue
+				}
+				t.UpdateRequestLimits(l.requests)
+				t.SetActiveWorkers(l.workers)
+				lc.SetLimits(l.thresholds, l.maxPacingDelay, l.schedule)
+				log.Info().Msgf("Reloaded limits from %s: %d thresholds, max pacing delay %v, %d schedule windows, "+
+					"max VM requests %d, max CH requests %d, workers %s", path, len(l.thresholds), l.maxPacingDelay,
+					len(l.schedule), l.requests[dump.VictoriaMetrics], l.requests[dump.ClickHouse], workersString(l.workers))
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(hup)
+		close(done)
+	}
+}
+
+func workersString(n int) string {
+	if n <= 0 {
+		return "all"
+	}
+	return strconv.Itoa(n)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"pmm-transferer/pkg/dump"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+type restoreStep struct {
+	// Path is the base path for multi-volume dumps, so import processes all volumes
+	Path  string
+	ID    string
+	Range dump.TimeRange
+}
+
+func parseRestoreRange(v string) (dump.TimeRange, error) {
+	parts := strings.SplitN(v, "..", 2)
+	if len(parts) != 2 {
+		return dump.TimeRange{}, errors.Errorf("invalid range %q, expected START..END", v)
+	}
+	start, end, err := parseTimeRange(parts[0], parts[1])
+	if err != nil {
+		return dump.TimeRange{}, err
+	}
+	return dump.TimeRange{Start: start, End: end}, nil
+}
+
+// restoreCandidates returns dumps with known time coverage, volumes of the same dump are merged into a single candidate
+func restoreCandidates(entries []catalogEntry) []restoreStep {
+	volumes := make(map[string][]*dump.Meta)
+	var candidates []restoreStep
+	for _, e := range entries {
+		m := e.Meta
+		if m == nil {
+			continue
+		}
+
+		if m.Volumes > 0 {
+			path := dump.VolumeBasePath(e.Path, m.Volume)
+			if _, ok := volumes[path]; !ok {
+				// placeholder keeps the catalog order, its range is set once all volumes are seen
+				candidates = append(candidates, restoreStep{Path: path, ID: m.ID})
+			}
+			volumes[path] = append(volumes[path], m)
+			continue
+		}
+
+		r := m.Range
+		if m.Partial {
+			r = m.CoveredRange
+		}
+		if r == nil {
+			log.Debug().Msgf("Skipped %s: no time range in meta", e.Path)
+			continue
+		}
+		candidates = append(candidates, restoreStep{Path: e.Path, ID: m.ID, Range: *r})
+	}
+
+	result := candidates[:0]
+	for _, c := range candidates {
+		if metas, ok := volumes[c.Path]; ok {
+			r, err := volumesRange(metas)
+			if err != nil {
+				log.Warn().Msgf("Skipped %s: %v", c.Path, err)
+				continue
+			}
+			c.Range = *r
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+// volumesRange returns time coverage of the multi-volume dump. Volumes hold consecutive time slices of the range,
+// so coverage ends where the first partial volume stops
+func volumesRange(metas []*dump.Meta) (*dump.TimeRange, error) {
+	total := metas[0].Volumes
+	if len(metas) != total {
+		return nil, errors.Errorf("%d of %d volumes are found", len(metas), total)
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].Volume < metas[j].Volume
+	})
+
+	r := metas[0].Range
+	if r == nil {
+		return nil, errors.New("no time range in meta")
+	}
+	for _, m := range metas {
+		if !m.Partial {
+			continue
+		}
+		if m.CoveredRange == nil || !m.CoveredRange.End.After(r.Start) {
+			return nil, errors.Errorf("volume %d is partial without covered data", m.Volume)
+		}
+		return &dump.TimeRange{Start: r.Start, End: m.CoveredRange.End}, nil
+	}
+	return r, nil
+}
+
+// planRestore selects the minimal set of dumps covering the requested range, ordered by time.
+// Returns parts of the range not covered by any dump
+func planRestore(candidates []restoreStep, want dump.TimeRange) ([]restoreStep, []dump.TimeRange) {
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Range.Start.Before(candidates[j].Range.Start)
+	})
+
+	var plan []restoreStep
+	var gaps []dump.TimeRange
+
+	cur := want.Start
+	i := 0
+	for cur.Before(want.End) {
+		best := -1
+		for ; i < len(candidates) && !candidates[i].Range.Start.After(cur); i++ {
+			if candidates[i].Range.End.After(cur) && (best == -1 || candidates[i].Range.End.After(candidates[best].Range.End)) {
+				best = i
+			}
+		}
+
+		if best != -1 {
+			plan = append(plan, candidates[best])
+			cur = candidates[best].Range.End
+			continue
+		}
+
+		// nothing covers the current time: skip to the next dump
+		next := want.End
+		for j := i; j < len(candidates); j++ {
+			if candidates[j].Range.End.After(cur) {
+				if candidates[j].Range.Start.Before(next) {
+					next = candidates[j].Range.Start
+				}
+				break
+			}
+		}
+		gaps = append(gaps, dump.TimeRange{Start: cur, End: next})
+		cur = next
+	}
+
+	return plan, gaps
+}
+
+func printRestorePlan(plan []restoreStep, gaps []dump.TimeRange) {
+	if len(plan) == 0 {
+		fmt.Println("No dumps cover the requested range")
+	}
+	for i, s := range plan {
+		fmt.Printf("%d. %s (%s - %s)", i+1, s.Path, s.Range.Start.Format(time.RFC3339), s.Range.End.Format(time.RFC3339))
+		if s.ID != "" {
+			fmt.Printf(", ID %s", s.ID)
+		}
+		fmt.Println()
+	}
+	for _, g := range gaps {
+		fmt.Printf("Not covered: %s - %s\n", g.Start.Format(time.RFC3339), g.End.Format(time.RFC3339))
+	}
+}
+
+// globalArgs returns global flags of the command line except dump path, to be passed to import commands
+func globalArgs(cli *kingpin.Application, args []string) ([]string, error) {
+	ctx, err := cli.ParseContext(args)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, el := range ctx.Elements {
+		f, ok := el.Clause.(*kingpin.FlagClause)
+		if !ok || cli.GetFlag(f.Model().Name) != f || f.Model().Name == "dump-path" {
+			continue
+		}
+		result = append(result, flagArg(f, el.Value))
+	}
+	return result, nil
+}
+
+// flagArg returns the command line argument setting the flag value. Bool flags don't accept values,
+// so they are set by the flag or its negation
+func flagArg(f *kingpin.FlagClause, value *string) string {
+	name := f.Model().Name
+	if value == nil {
+		return "--" + name
+	}
+	if b, ok := f.Model().Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		if *value == "false" {
+			return "--no-" + name
+		}
+		return "--" + name
+	}
+	return fmt.Sprintf("--%s=%s", name, *value)
+}
+
+// executeRestore runs import of each planned dump in order
+func executeRestore(plan []restoreStep, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "failed to get executable path")
+	}
+	for i, s := range plan {
+		log.Info().Msgf("Importing %d/%d: %s...", i+1, len(plan), s.Path)
+
+		cmd := exec.Command(exe, append([]string{"import", "--dump-path=" + s.Path}, args...)...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err = cmd.Run(); err != nil {
+			return errors.Wrapf(err, "failed to import %s", s.Path)
+		}
+	}
+	return nil
+}
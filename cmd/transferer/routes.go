@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"pmm-transferer/pkg/remap"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// executeRoutes runs import of the dump into each route target in turn, each import keeps data of the target origins only.
+// Imports of all targets are run even if some of them fail. The imports are confirmed for all targets by the caller
+func executeRoutes(routes *remap.Routes, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "failed to get executable path")
+	}
+
+	var failed []string
+	for i, t := range routes.Targets {
+		log.Info().Msgf("Importing %d/%d: origins %s into %s...", i+1, len(routes.Targets),
+			strings.Join(t.Origins, ", "), t.Name)
+
+		cmd := exec.Command(exe, append(args, "--route-target="+t.Name, "--yes")...)
+		// dump is read from the file by each import, STDIN isn't passed
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err = cmd.Run(); err != nil {
+			log.Error().Msgf("Failed to import into %s: %v", t.Name, err)
+			failed = append(failed, t.Name)
+		}
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("failed to import into %d of %d targets: %s", len(failed), len(routes.Targets),
+			strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func routeTargetNames(routes *remap.Routes) []string {
+	names := make([]string, 0, len(routes.Targets))
+	for _, t := range routes.Targets {
+		names = append(names, t.Name)
+	}
+	return names
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"pmm-transferer/pkg/clickhouse"
+	"pmm-transferer/pkg/victoriametrics"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+)
+
+// sandboxPrefixRegex keeps the prefix valid for both metric names and ClickHouse database names,
+// and free of regexp metacharacters, so it can be matched by the cleanup selector as is
+var sandboxPrefixRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func validSandboxPrefix(prefix string) bool {
+	return sandboxPrefixRegex.MatchString(prefix)
+}
+
+// sandboxSelector matches all series imported with the prefix, including import markers
+func sandboxSelector(prefix string) string {
+	return fmt.Sprintf(`{__name__=~"%s.*"}`, prefix)
+}
+
+// cleanupSandbox deletes core metrics series and drops QAN database imported with the sandbox prefix.
+// The prefix is refused unless there are sandbox import markers, so it can't match live series by mistake
+func cleanupSandbox(httpC *fasthttp.Client, cfg PMMConfig, prefix string, core, qan bool) error {
+	vm := victoriametrics.NewSource(httpC, victoriametrics.Config{
+		ConnectionURL: cfg.VictoriaMetricsURL,
+		MetricPrefix:  prefix,
+	})
+	imported, err := vm.HasImports()
+	if err != nil {
+		return err
+	}
+	if !imported {
+		return errors.Errorf("no dumps were imported with prefix %s: %s%s series are not found",
+			prefix, prefix, victoriametrics.ImportMarkerMetric)
+	}
+
+	if core {
+		if err := vm.DeleteSeries([]string{sandboxSelector(prefix)}); err != nil {
+			return errors.Wrap(err, "failed to delete sandbox series")
+		}
+		log.Info().Msgf("Deleted core metrics series with prefix %s", prefix)
+	}
+	if qan {
+		database, err := clickhouse.DropSandbox(cfg.ClickHouseURL, prefix)
+		if err != nil {
+			return errors.Wrap(err, "failed to drop sandbox database")
+		}
+		log.Info().Msgf("Dropped QAN sandbox database %s", database)
+	}
+	return nil
+}
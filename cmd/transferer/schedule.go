@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"pmm-transferer/pkg/transferer"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// scheduleWindow is the load schedule window of the config file, e.g.
+//
+//	schedule:
+//	  business-hours:
+//	    days: mon-fri
+//	    hours: 09:00-18:00
+//	    max-load: CPU=30,RAM=40
+//	    max-pacing-delay: 10s
+//
+// Settings which aren't set are taken from the flags, including thresholds of keys missing in the window
+type scheduleWindow struct {
+	Days           string         `yaml:"days"`
+	Hours          string         `yaml:"hours"`
+	MaxLoad        *string        `yaml:"max-load"`
+	CriticalLoad   *string        `yaml:"critical-load"`
+	MaxPacingDelay *time.Duration `yaml:"max-pacing-delay"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// readConfigFile reads the config file, missing config file is empty
+func readConfigFile(path string) (profilesConfig, error) {
+	var c profilesConfig
+	if path == "" {
+		return c, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return c, errors.Wrap(err, "failed to read config file")
+	}
+
+	if err = yaml.Unmarshal(data, &c); err != nil {
+		return c, errors.Wrap(err, "failed to parse config file")
+	}
+	return c, nil
+}
+
+// loadSchedule returns load schedule windows of the config file, ordered by name
+func loadSchedule(c profilesConfig, maxLoad, criticalLoad string, maxPacingDelay time.Duration) ([]transferer.LoadWindow, error) {
+	names := make([]string, 0, len(c.Schedule))
+	for name := range c.Schedule {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	windows := make([]transferer.LoadWindow, 0, len(names))
+	for _, name := range names {
+		w, err := parseScheduleWindow(name, c.Schedule[name], maxLoad, criticalLoad, maxPacingDelay)
+		if err != nil {
+			return nil, errors.Wrapf(err, "schedule %s", name)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func parseScheduleWindow(name string, sw scheduleWindow, maxLoad, criticalLoad string, maxPacingDelay time.Duration) (transferer.LoadWindow, error) {
+	w := transferer.LoadWindow{
+		Name:           name,
+		End:            24 * time.Hour,
+		MaxPacingDelay: maxPacingDelay,
+	}
+
+	var err error
+	if w.Days, err = parseWeekdays(sw.Days); err != nil {
+		return w, err
+	}
+	if sw.Hours != "" {
+		bounds := strings.Split(sw.Hours, "-")
+		if len(bounds) != 2 {
+			return w, errors.Errorf("invalid hours %q: HH:MM-HH:MM is expected", sw.Hours)
+		}
+		if w.Start, err = parseTimeOfDay(bounds[0]); err != nil {
+			return w, err
+		}
+		if w.End, err = parseTimeOfDay(bounds[1]); err != nil {
+			return w, err
+		}
+	}
+
+	if w.Thresholds, err = transferer.ParseThresholdList(overrideLoad(maxLoad, sw.MaxLoad), overrideLoad(criticalLoad, sw.CriticalLoad)); err != nil {
+		return w, err
+	}
+	if sw.MaxPacingDelay != nil {
+		w.MaxPacingDelay = *sw.MaxPacingDelay
+	}
+	return w, nil
+}
+
+// overrideLoad overrides values of the load flag by the window ones, keys missing in the window keep flag values
+func overrideLoad(flag string, window *string) string {
+	switch {
+	case window == nil || strings.TrimSpace(*window) == "":
+		return flag
+	case strings.TrimSpace(flag) == "":
+		return *window
+	default:
+		// later values of the same key win
+		return flag + "," + *window
+	}
+}
+
+// parseWeekdays parses comma-separated days and ranges of days, e.g. "mon-fri" or "sat,sun"
+func parseWeekdays(v string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	for _, part := range strings.Split(v, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part == "" {
+			continue
+		}
+		bounds := strings.Split(part, "-")
+		first, ok := weekdays[bounds[0]]
+		if !ok || len(bounds) > 2 {
+			return nil, errors.Errorf("invalid days %q", part)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[bounds[1]]; !ok {
+				return nil, errors.Errorf("invalid days %q", part)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days = append(days, d)
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseTimeOfDay(v string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(v))
+	if err != nil {
+		return 0, errors.Errorf("invalid time of day %q: HH:MM is expected", v)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const envarPrefix = "PMM_TRANSFERER_"
+
+// serviceSecretFlags carry credentials, so they are moved from the unit command line to the environment file
+var serviceSecretFlags = map[string]struct{}{
+	"pmm-url":              {},
+	"victoria-metrics-url": {},
+	"click-house-url":      {},
+	"ch-replica-url":       {},
+	"grafana-api-key":      {},
+}
+
+type serviceOptions struct {
+	name            string
+	onCalendar      string
+	randomizedDelay time.Duration
+	user            string
+	unitDir         string
+	envFile         string
+}
+
+type serviceFile struct {
+	path    string
+	content string
+	mode    os.FileMode
+}
+
+// serviceEnv returns transferer environment variables of the current environment
+// and the values of the secret flags set on the command line
+func serviceEnv(flags map[string]string) map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, envarPrefix) {
+			parts := strings.SplitN(kv, "=", 2)
+			env[parts[0]] = parts[1]
+		}
+	}
+	for name, value := range flags {
+		if value != "" {
+			env[flagEnvar(name)] = value
+		}
+	}
+	return env
+}
+
+// composeServiceFiles returns systemd service, timer and environment file running the transferer with the args.
+// Credentials of the args are added to env, which goes to the environment file readable by the owner only
+func composeServiceFiles(exe, workDir string, args []string, env map[string]string, o serviceOptions) []serviceFile {
+	cmdline := []string{systemdQuote(exe)}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			for _, a := range args[i:] {
+				cmdline = append(cmdline, systemdQuote(a))
+			}
+			break
+		}
+		parts := strings.SplitN(strings.TrimPrefix(arg, "--"), "=", 2)
+		if _, ok := serviceSecretFlags[parts[0]]; ok && strings.HasPrefix(arg, "--") {
+			value := ""
+			if len(parts) == 2 {
+				value = parts[1]
+			} else if i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			env[flagEnvar(parts[0])] = value
+			continue
+		}
+		cmdline = append(cmdline, systemdQuote(arg))
+	}
+
+	var service bytes.Buffer
+	fmt.Fprintf(&service, "[Unit]\nDescription=PMM Transferer scheduled export (%s)\n", o.name)
+	fmt.Fprintf(&service, "Wants=network-online.target\nAfter=network-online.target\n\n")
+	fmt.Fprintf(&service, "[Service]\nType=oneshot\n")
+	if o.user != "" {
+		fmt.Fprintf(&service, "User=%s\n", o.user)
+	}
+	fmt.Fprintf(&service, "EnvironmentFile=%s\n", o.envFile)
+	fmt.Fprintf(&service, "WorkingDirectory=%s\n", systemdQuote(workDir))
+	fmt.Fprintf(&service, "ExecStart=%s\n", strings.Join(cmdline, " "))
+
+	var timer bytes.Buffer
+	fmt.Fprintf(&timer, "[Unit]\nDescription=Run %s.service on schedule\n\n", o.name)
+	fmt.Fprintf(&timer, "[Timer]\nOnCalendar=%s\nPersistent=true\n", o.onCalendar)
+	if o.randomizedDelay > 0 {
+		fmt.Fprintf(&timer, "RandomizedDelaySec=%d\n", int64(o.randomizedDelay/time.Second))
+	}
+	fmt.Fprintf(&timer, "\n[Install]\nWantedBy=timers.target\n")
+
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var envFile bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&envFile, "%s=%s\n", k, envQuote(env[k]))
+	}
+
+	return []serviceFile{
+		{path: filepath.Join(o.unitDir, o.name+".service"), content: service.String(), mode: 0644},
+		{path: filepath.Join(o.unitDir, o.name+".timer"), content: timer.String(), mode: 0644},
+		{path: o.envFile, content: envFile.String(), mode: 0600},
+	}
+}
+
+// flagEnvar returns the environment variable of the flag, see kingpin DefaultEnvars
+func flagEnvar(name string) string {
+	return envarPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// systemdQuote quotes the ExecStart argument, so it's passed as is: specifiers and variables are escaped
+func systemdQuote(arg string) string {
+	arg = strings.NewReplacer("%", "%%", "$", "$$").Replace(arg)
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\;") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+// envQuote quotes the value of the environment file, characters special in double quotes are escaped
+func envQuote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(value) + `"`
+}
+
+func printServiceFiles(files []serviceFile) {
+	for i, f := range files {
+		if i != 0 {
+			fmt.Println()
+		}
+		fmt.Printf("# %s\n%s", f.path, f.content)
+	}
+}
+
+// installService writes the files and enables the timer if asked
+func installService(files []serviceFile, name string, enable bool) error {
+	for _, f := range files {
+		dirMode := os.FileMode(0755)
+		if f.mode&0077 == 0 {
+			dirMode = 0700
+		}
+		if err := os.MkdirAll(filepath.Dir(f.path), dirMode); err != nil {
+			return errors.Wrapf(err, "failed to create directory of %s", f.path)
+		}
+		if err := writeServiceFile(f); err != nil {
+			return errors.Wrapf(err, "failed to write %s", f.path)
+		}
+		log.Info().Msgf("Written %s", f.path)
+	}
+
+	if !enable {
+		log.Info().Msgf("Run 'systemctl daemon-reload && systemctl enable --now %s.timer' to start scheduled exports", name)
+		return nil
+	}
+	for _, args := range [][]string{{"daemon-reload"}, {"enable", "--now", name + ".timer"}} {
+		out, err := exec.Command("systemctl", args...).CombinedOutput()
+		if err != nil {
+			return errors.Wrapf(err, "systemctl %s: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+		}
+	}
+	log.Info().Msgf("Timer %s.timer is enabled", name)
+	return nil
+}
+
+// writeServiceFile replaces the file by rename, so credentials are never readable with the mode of the existing file
+func writeServiceFile(f serviceFile) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), "."+filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.WriteString(f.content); err == nil {
+		err = tmp.Chmod(f.mode)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
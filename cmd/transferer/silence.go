@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"pmm-transferer/pkg/alerting"
+	"pmm-transferer/pkg/dump"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+)
+
+// importSilence silences alerts of the imported services while import runs and for the given time after it,
+// so backfilled data doesn't fire stale threshold alerts
+type importSilence struct {
+	httpC    *fasthttp.Client
+	pmmURL   string
+	duration time.Duration
+	silence  alerting.Silence
+}
+
+// startImportSilence creates the silence before import. Services are collected from the dump file,
+// alerts of all services are silenced if they can't be collected: for piped dumps and converted files
+func startImportSilence(httpC *fasthttp.Client, pmmURL, dumpPath string, collectServices bool, duration time.Duration) (*importSilence, error) {
+	s := &importSilence{
+		httpC:    httpC,
+		pmmURL:   pmmURL,
+		duration: duration,
+	}
+
+	name := filepath.Base(dumpPath)
+	if dumpPath == "" {
+		name = "from STDIN"
+	}
+	if collectServices {
+		_, services, err := dumpServices(dumpPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to collect dump services")
+		}
+		names := make([]string, 0, len(services))
+		for _, svc := range services {
+			names = append(names, svc.Name)
+		}
+		if len(names) != 0 {
+			s.silence.Matchers = map[string][]string{"service_name": names}
+		}
+	}
+	if s.silence.Matchers == nil {
+		log.Warn().Msg("Services of the dump are unknown: alerts of all services are silenced during import")
+	}
+
+	now := time.Now()
+	s.silence.Start = now
+	s.silence.End = now.Add(duration)
+	s.silence.Comment = fmt.Sprintf("Import of dump %s by pmm-transferer", name)
+
+	id, err := alerting.CreateSilence(pmmURL, s.silence, httpC)
+	if err != nil {
+		return nil, err
+	}
+	s.silence.ID = id
+	log.Info().Msgf("Created alerting silence %s until %s", id, s.silence.End.Format(time.RFC3339))
+	return s, nil
+}
+
+// finish extends the silence for its duration after import, describing the imported range
+func (s *importSilence) finish(metas []dump.Meta) {
+	if ids := dumpIDs(metas); len(ids) != 0 {
+		s.silence.Comment += fmt.Sprintf(" (ID %s)", strings.Join(ids, ", "))
+	}
+	if r := importedRange(metas); r != nil {
+		s.silence.Comment += fmt.Sprintf(", data from %s to %s", r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339))
+	}
+	end := s.silence.End
+	s.silence.End = time.Now().Add(s.duration)
+
+	id, err := alerting.CreateSilence(s.pmmURL, s.silence, s.httpC)
+	if err != nil {
+		log.Warn().Msgf("Failed to extend alerting silence %s, it ends at %s: %v", s.silence.ID, end.Format(time.RFC3339), err)
+		return
+	}
+	s.silence.ID = id
+	log.Info().Msgf("Alerting silence %s is extended until %s", id, s.silence.End.Format(time.RFC3339))
+}
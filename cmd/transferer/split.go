@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"pmm-transferer/pkg/dump"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// splitRunFlags are set for each run by the split export, so they aren't passed from the command line
+var splitRunFlags = map[string]struct{}{
+	"split-runs": {},
+	"start-ts":   {},
+	"end-ts":     {},
+	"dump-path":  {},
+	"journal":    {},
+}
+
+// splitRun is the export of the part of the requested time range
+type splitRun struct {
+	start, end time.Time
+	dumpPath   string
+}
+
+// journalPath returns the journal of the run, written next to its dump
+func (r splitRun) journalPath() string {
+	return r.dumpPath + ".journal"
+}
+
+// planSplitRuns splits the time range into runs of the interval. Run boundaries are aligned to multiples of the interval
+// (e.g. UTC midnight for 24h), so runs and their dump names are the same for overlapping ranges
+func planSplitRuns(start, end time.Time, interval time.Duration, dir string) []splitRun {
+	var runs []splitRun
+	for s := start; s.Before(end); {
+		e := s.Truncate(interval).Add(interval)
+		if e.After(end) {
+			e = end
+		}
+		runs = append(runs, splitRun{
+			start:    s,
+			end:      e,
+			dumpPath: filepath.Join(dir, fmt.Sprintf("pmm-dump-%d-%d.tar.gz", s.Unix(), e.Unix())),
+		})
+		s = e
+	}
+	return runs
+}
+
+// splitRunArgs returns the export command line without the flags set for each run. Credentials are moved
+// to the environment of the runs, so they aren't visible in the process list
+func splitRunArgs(cli *kingpin.Application, args []string) ([]string, map[string]string, error) {
+	ctx, err := cli.ParseContext(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	var result []string
+	env := make(map[string]string)
+	for _, el := range ctx.Elements {
+		switch c := el.Clause.(type) {
+		case *kingpin.CmdClause:
+			result = append(result, c.FullCommand())
+		case *kingpin.FlagClause:
+			name := c.Model().Name
+			if _, ok := splitRunFlags[name]; ok {
+				continue
+			}
+			if _, ok := serviceSecretFlags[name]; ok && el.Value != nil {
+				env[flagEnvar(name)] = *el.Value
+				continue
+			}
+			result = append(result, flagArg(c, el.Value))
+		}
+	}
+	return result, env, nil
+}
+
+// executeSplitRuns runs export of each run in turn and stops on the first failed run. Runs having the dump
+// are skipped, so the failed split export continues from the failed run when the same command is run again
+func executeSplitRuns(runs []splitRun, args []string, env map[string]string, journalStderr bool) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "failed to get executable path")
+	}
+
+	environ := os.Environ()
+	for name, value := range env {
+		environ = append(environ, name+"="+value)
+	}
+
+	for i, r := range runs {
+		if _, err := dump.VolumePaths(r.dumpPath); err == nil {
+			log.Info().Msgf("Skipping run %d/%d: dump %s exists", i+1, len(runs), r.dumpPath)
+			continue
+		}
+		log.Info().Msgf("Exporting run %d/%d: %s - %s...", i+1, len(runs),
+			r.start.Format(time.RFC3339), r.end.Format(time.RFC3339))
+
+		runArgs := append(append([]string(nil), args...),
+			"--start-ts="+r.start.Format(time.RFC3339), "--end-ts="+r.end.Format(time.RFC3339),
+			"--dump-path="+r.dumpPath, "--split-runs=0")
+		if journalStderr {
+			runArgs = append(runArgs, "--journal=stderr")
+		} else {
+			runArgs = append(runArgs, "--journal="+r.journalPath())
+		}
+
+		cmd := exec.Command(exe, runArgs...)
+		cmd.Env = environ
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err = cmd.Run(); err != nil {
+			return errors.Wrapf(err, "run %d/%d (%s - %s) failed, run the same command to continue from it",
+				i+1, len(runs), r.start.Format(time.RFC3339), r.end.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"pmm-transferer/pkg/clickhouse"
+	"pmm-transferer/pkg/dump"
+	"pmm-transferer/pkg/encryption"
+	"pmm-transferer/pkg/inventory"
+	"pmm-transferer/pkg/remap"
+	"pmm-transferer/pkg/transferer"
+	"pmm-transferer/pkg/victoriametrics"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+)
+
+// dumpServices returns ID and services of the dump data. Services of encrypted entries are not collected
+func dumpServices(dumpPath string) (string, []inventory.Service, error) {
+	var dumpID string
+	var encrypted bool
+	services := make(map[string]*inventory.Service)
+	add := func(sets []map[string]string) {
+		for _, set := range sets {
+			s, ok := inventory.ServiceFromLabels(set)
+			if !ok {
+				continue
+			}
+			known, ok := services[s.Name]
+			if !ok {
+				services[s.Name] = &s
+				continue
+			}
+			mergeService(known, s)
+		}
+	}
+
+	err := transferer.WalkDump(dumpPath, func(st dump.SourceType, filename string, r io.Reader) error {
+		if strings.HasSuffix(filename, encryption.FileSuffix) {
+			encrypted = true
+			return nil
+		}
+		switch st {
+		case dump.UndefinedSource:
+			if filename != dump.MetaFilename {
+				return nil
+			}
+			var meta dump.Meta
+			if err := json.NewDecoder(r).Decode(&meta); err != nil {
+				return errors.Wrap(err, "failed to parse meta")
+			}
+			dumpID = meta.ID
+		case dump.VictoriaMetrics:
+			content, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			sets, err := victoriametrics.ChunkLabelSets(filename, content, inventory.ServiceLabels)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read %s", filename)
+			}
+			add(sets)
+		case dump.ClickHouse:
+			sets, err := clickhouse.ChunkColumnSets(filename, r, inventory.ServiceLabels)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read %s", filename)
+			}
+			add(sets)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if encrypted {
+		log.Warn().Msg("Services of encrypted dump entries are not checked for missing stubs")
+	}
+
+	result := make([]inventory.Service, 0, len(services))
+	for _, s := range services {
+		result = append(result, *s)
+	}
+	return dumpID, result, nil
+}
+
+// mergeService fills unknown fields of the service, as some series may miss some labels
+func mergeService(dst *inventory.Service, s inventory.Service) {
+	fields := []struct{ dst, src *string }{
+		{&dst.ID, &s.ID},
+		{&dst.Type, &s.Type},
+		{&dst.NodeID, &s.NodeID},
+		{&dst.NodeName, &s.NodeName},
+		{&dst.Environment, &s.Environment},
+		{&dst.Cluster, &s.Cluster},
+		{&dst.ReplicationSet, &s.ReplicationSet},
+	}
+	for _, f := range fields {
+		if *f.dst == "" {
+			*f.dst = *f.src
+		}
+	}
+}
+
+// createServiceStubs creates stubs of the dump services missing on PMM Server, and maps IDs of the dump services
+// to the IDs of their stubs, so imported data refers to the stubs
+func createServiceStubs(httpC *fasthttp.Client, pmmURL, dumpPath string, mapping remap.Mapping) error {
+	dumpID, services, err := dumpServices(dumpPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to collect dump services")
+	}
+
+	stubs, err := inventory.NewClient(httpC, pmmURL).CreateMissingServices(services, dumpID)
+	for _, s := range stubs {
+		if s.ID != "" {
+			mapping.Set("service_id", s.ID, s.NewID)
+		}
+		if s.NodeID != "" && s.NodeID != s.NewNodeID {
+			mapping.Set("node_id", s.NodeID, s.NewNodeID)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("Created %d stubs of %d dump services", len(stubs), len(services))
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// freeDiskSpace returns bytes available to unprivileged users on the file system of the path
+func freeDiskSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// openFilesLimit returns the soft limit of open file descriptors
+func openFilesLimit() (uint64, error) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, err
+	}
+	return uint64(rl.Cur), nil
+}
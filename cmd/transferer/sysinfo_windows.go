@@ -0,0 +1,12 @@
+package main
+
+import "github.com/pkg/errors"
+
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, errors.New("not supported on Windows")
+}
+
+// openFilesLimit is not checked on Windows, as it has no per-process descriptor limit like ulimit
+func openFilesLimit() (uint64, error) {
+	return 0, errors.New("not supported on Windows")
+}
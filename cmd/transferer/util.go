@@ -1,35 +1,86 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"os/user"
+	"path/filepath"
+	"pmm-transferer/pkg/clickhouse"
 	"pmm-transferer/pkg/dump"
+	"pmm-transferer/pkg/encryption"
+	"pmm-transferer/pkg/grafana"
+	"pmm-transferer/pkg/transferer"
+	"pmm-transferer/pkg/victoriametrics"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/valyala/fasthttp"
 )
 
-func newClientHTTP(insecureSkipVerify bool) *fasthttp.Client {
-	return &fasthttp.Client{
+// httpOptions control connections of the HTTP client
+type httpOptions struct {
+	insecureSkipVerify bool
+	userAgent          string
+	// keepAlive reuses connections between requests
+	keepAlive bool
+	// maxConnDuration closes reused connections after the duration, unlimited if 0
+	maxConnDuration time.Duration
+	dnsRefresh      time.Duration
+	// pinIP resolves backend hosts once per run
+	pinIP bool
+}
+
+func newClientHTTP(opts httpOptions) *fasthttp.Client {
+	c := &fasthttp.Client{
+		Name:                      opts.userAgent,
 		MaxConnsPerHost:           2,
 		MaxIdleConnDuration:       time.Minute,
+		MaxConnDuration:           opts.maxConnDuration,
 		MaxIdemponentCallAttempts: 5,
 		ReadTimeout:               time.Minute,
 		WriteTimeout:              time.Minute,
 		MaxConnWaitTimeout:        time.Second * 30,
 		TLSConfig: &tls.Config{
-			InsecureSkipVerify: insecureSkipVerify,
+			InsecureSkipVerify: opts.insecureSkipVerify,
+		},
+		Dial: newBackendDialer(opts.dnsRefresh, opts.pinIP).Dial,
+	}
+	if !opts.keepAlive {
+		// connections older than max duration are closed after the request, so each request gets its own connection
+		c.MaxConnDuration = time.Nanosecond
+	}
+	return c
+}
+
+// newStorageClientHTTP returns client for object storages, e.g. S3, which are not PMM backends
+func newStorageClientHTTP(insecureSkipVerify bool) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSkipVerify},
 		},
 	}
 }
 
+func defaultUserAgent() string {
+	if GitCommit == "" {
+		return "pmm-transferer"
+	}
+	return "pmm-transferer/" + GitCommit
+}
+
 type goroutineLoggingHook struct{}
 
 func (h goroutineLoggingHook) Run(e *zerolog.Event, level zerolog.Level, msg string) {
@@ -84,6 +135,7 @@ func composeMeta(pmmURL string, c *fasthttp.Client) (*dump.Meta, error) {
 	}
 
 	meta := &dump.Meta{
+		SchemaVersion: dump.MetaSchemaVersion,
 		Version: dump.TransfererVersion{
 			GitBranch: GitBranch,
 			GitCommit: GitCommit,
@@ -91,9 +143,29 @@ func composeMeta(pmmURL string, c *fasthttp.Client) (*dump.Meta, error) {
 		PMMServerVersion: pmmVer,
 	}
 
+	// host only, as URL may contain credentials
+	if u, err := url.Parse(pmmURL); err == nil {
+		meta.PMMServer = u.Host
+	}
+
 	return meta, nil
 }
 
+// composeSourcesMeta describes sources with the amount of chunks planned to export
+func composeSourcesMeta(sources []dump.Source, chunks []dump.ChunkMeta) []dump.SourceMeta {
+	result := make([]dump.SourceMeta, 0, len(sources))
+	for _, s := range sources {
+		m := s.Meta()
+		for _, c := range chunks {
+			if c.Source == s.Type() {
+				m.Chunks++
+			}
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
 func ByteCountDecimal(b int64) string {
 	const unit = 1000
 	if b < unit {
@@ -120,13 +192,567 @@ func ByteCountBinary(b int64) string {
 	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
 }
 
-func checkPiped() (bool, error) {
-	stat, err := os.Stdin.Stat()
+func parseTimeRange(start, end string) (startTime, endTime time.Time, err error) {
+	if end != "" {
+		endTime, err = time.ParseInLocation(time.RFC3339, end, time.UTC)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.Wrap(err, "failed to parse end date-time")
+		}
+	} else {
+		endTime = time.Now().UTC()
+	}
+
+	if start != "" {
+		startTime, err = time.ParseInLocation(time.RFC3339, start, time.UTC)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.Wrap(err, "failed to parse start date-time")
+		}
+	} else {
+		startTime = endTime.Add(-1 * time.Hour * 4)
+	}
+
+	if startTime.After(endTime) {
+		return time.Time{}, time.Time{}, errors.New("start > end")
+	}
+
+	return startTime, endTime, nil
+}
+
+// detectStartTime returns time of the oldest data available in sources within maxRange before end,
+// or fallback if sources have no data
+func detectStartTime(end time.Time, maxRange time.Duration, fallback time.Time,
+	vm *victoriametrics.Source, ch *clickhouse.Source) (time.Time, error) {
+	var oldest time.Time
+	if vm != nil {
+		t, err := vm.OldestSampleTime(end, maxRange)
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "failed to get oldest core metrics sample")
+		}
+		oldest = t
+	}
+	if ch != nil {
+		t, err := ch.OldestPeriodStart()
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "failed to get oldest QAN metrics")
+		}
+		if !t.IsZero() && (oldest.IsZero() || t.Before(oldest)) {
+			oldest = t
+		}
+	}
+
+	if oldest.IsZero() {
+		log.Warn().Msgf("No data found to detect start time, using %s", fallback.Format(time.RFC3339))
+		return fallback, nil
+	}
+	if bound := end.Add(-maxRange); oldest.Before(bound) {
+		oldest = bound
+	}
+	return oldest, nil
+}
+
+func writeErrorReport(path, command string, runErr error, t *transferer.Transferer, lc *transferer.LoadChecker) {
+	if path == "" {
+		return
+	}
+
+	report := transferer.ErrorReport{
+		Time:    time.Now().UTC(),
+		Command: command,
+		Version: dump.TransfererVersion{
+			GitBranch: GitBranch,
+			GitCommit: GitCommit,
+		},
+		Error:    runErr.Error(),
+		Progress: t.Progress(),
+	}
+	if lc != nil {
+		report.LoadStatuses = lc.History()
+	}
+
+	if err := transferer.WriteErrorReport(path, report); err != nil {
+		log.Warn().Err(err).Msg("Failed to write error report")
+		return
+	}
+	log.Info().Msgf("Error report is written to %s, please attach it to the bug report", path)
+}
+
+// stallHandler returns handler of export/import stalls: abort for abort action, nil otherwise, as stalls are logged anyway
+func stallHandler(action string, abort func(err error)) func(err error) {
+	if action != stallActionAbort {
+		return nil
+	}
+	return func(err error) {
+		abort(errors.Wrap(err, "stalled"))
+	}
+}
+
+// loadCheckerNodeAuto is the load-checker-node value to detect the node of PMM Server host
+const loadCheckerNodeAuto = "auto"
+
+// resolveLoadCheckerNode detects the node of PMM Server host if it's set to auto
+func resolveLoadCheckerNode(httpC *fasthttp.Client, cfg *transferer.LoadCheckerConfig) error {
+	if cfg.NodeValue != loadCheckerNodeAuto {
+		return nil
+	}
+	node, err := transferer.DetectLoadCheckerNode(httpC, *cfg)
+	if err != nil {
+		return errors.Wrap(err, "failed to detect load checker node")
+	}
+	log.Info().Msgf("Load checker uses node %s", node)
+	cfg.NodeValue = node
+	return nil
+}
+
+// watchDeadline calls abort once ctx deadline is exceeded and grace period is over, unless stop is called before
+func watchDeadline(ctx context.Context, grace time.Duration, abort func(err error)) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return
+		}
+		select {
+		case <-time.After(grace):
+			abort(errors.Wrap(ctx.Err(), "timeout is exceeded"))
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// verifyDumpChecksums checks each dump volume against its checksum file
+func verifyDumpChecksums(dumpPath string) error {
+	paths, err := dump.VolumePaths(dumpPath)
 	if err != nil {
-		return false, err
+		return err
+	}
+	for _, p := range paths {
+		if err = dump.VerifyChecksumFile(p); err != nil {
+			if os.IsNotExist(err) {
+				return errors.Errorf("checksum file %s is not found", p+dump.ChecksumSuffix)
+			}
+			return err
+		}
+		log.Info().Msgf("Checksum of %s is OK", p)
+	}
+	return nil
+}
+
+// logLimitAdaptations summarizes how export was adapted to VictoriaMetrics query limits
+func logLimitAdaptations(s *victoriametrics.Source) {
+	if s == nil {
+		return
+	}
+	adaptations := s.Adaptations()
+	if len(adaptations) == 0 {
+		return
+	}
+	log.Warn().Msg("Export was adapted to VictoriaMetrics limits, consider raising them or lowering --chunk-time-range and --workers:")
+	for _, a := range adaptations {
+		log.Warn().Msgf("  - %s", a)
+	}
+}
+
+// logChunkTimings summarizes durations of chunk processing stages in verbose mode, so the bottleneck
+// (PMM Server, local CPU or the target) can be told without profiling
+func logChunkTimings(t *transferer.Transferer) {
+	for _, s := range t.Timings() {
+		log.Debug().Msgf("Chunk %s timings: %d chunks, total %v, p50 %v, p90 %v, p99 %v, max %v", s.Stage, s.Chunks,
+			s.Total.Round(time.Millisecond), s.P50.Round(time.Millisecond), s.P90.Round(time.Millisecond),
+			s.P99.Round(time.Millisecond), s.Max.Round(time.Millisecond))
+	}
+}
+
+// readEntryKeys reads keys of the sources, which dump entries are encrypted with
+func readEntryKeys(metricsKeyFile, qanKeyFile string) (transferer.EntryKeys, error) {
+	keys := make(transferer.EntryKeys)
+	files := map[dump.SourceType]string{
+		dump.VictoriaMetrics: metricsKeyFile,
+		dump.ClickHouse:      qanKeyFile,
+	}
+	for st, path := range files {
+		if path == "" {
+			continue
+		}
+		key, err := encryption.ReadKeyFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%v key", st)
+		}
+		keys[st] = key
+	}
+	return keys, nil
+}
+
+// parseChunkCodecs parses codecs of the sources, sources without codec are written as read
+func parseChunkCodecs(metricsCodec, qanCodec string) (transferer.ChunkCodecs, error) {
+	codecs := make(transferer.ChunkCodecs)
+	values := map[dump.SourceType]string{
+		dump.VictoriaMetrics: metricsCodec,
+		dump.ClickHouse:      qanCodec,
+	}
+	for st, v := range values {
+		if v == "" {
+			continue
+		}
+		c, err := transferer.ParseChunkCodec(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%v codec", st)
+		}
+		codecs[st] = c
+	}
+	return codecs, nil
+}
+
+// writeAuditRecord appends the operation record to the audit log, if it's enabled
+func writeAuditRecord(path string, r transferer.AuditRecord, runErr error) {
+	if path == "" {
+		return
+	}
+
+	r.Time = time.Now().UTC()
+	r.Version = dump.TransfererVersion{
+		GitBranch: GitBranch,
+		GitCommit: GitCommit,
+	}
+	if u, err := user.Current(); err == nil {
+		r.User = u.Username
+	} else {
+		r.User = os.Getenv("USER")
+	}
+	r.Host, _ = os.Hostname()
+	if r.PMMServer != "" {
+		// host only, as URL may contain credentials
+		if u, err := url.Parse(r.PMMServer); err == nil {
+			r.PMMServer = u.Host
+		}
+	}
+	if runErr != nil {
+		r.Error = runErr.Error()
+		if r.Status == "" {
+			r.Status = transferer.AuditStatusFailed
+		}
+	}
+	if r.Status == "" {
+		r.Status = transferer.AuditStatusSucceeded
+	}
+
+	if err := transferer.AppendAuditRecord(path, r); err != nil {
+		log.Warn().Err(err).Msg("Failed to write audit record")
+	}
+}
+
+// sourceTypes returns types of the sources for the audit record
+func sourceTypes(sources []dump.Source) []string {
+	types := make([]string, 0, len(sources))
+	for _, s := range sources {
+		types = append(types, s.Type().String())
+	}
+	return types
+}
+
+// importedRange returns the time range covered by the imported dumps, or nil if dumps have no range
+func importedRange(metas []dump.Meta) *dump.TimeRange {
+	var r *dump.TimeRange
+	for _, m := range metas {
+		switch {
+		case m.Partial && m.CoveredRange != nil:
+			r = m.CoveredRange
+		case r == nil && m.Range != nil:
+			r = m.Range
+		}
+	}
+	return r
+}
+
+// dumpIDs returns unique IDs of the dumps, volumes of the same dump share the ID
+func dumpIDs(metas []dump.Meta) []string {
+	var ids []string
+	for _, m := range metas {
+		if m.ID != "" && !containsString(ids, m.ID) {
+			ids = append(ids, m.ID)
+		}
+	}
+	return ids
+}
+
+// previousImports returns ID of the dump and its sources, which were already imported to the target
+// according to the import markers. Dumps created before IDs were assigned can't be checked
+func previousImports(s *victoriametrics.Source, dumpPath string, sources []string) (string, []string, error) {
+	paths, err := dump.VolumePaths(dumpPath)
+	if err != nil {
+		return "", nil, err
+	}
+	meta, err := transferer.ReadMetaFromDump(paths[0], false)
+	if err != nil {
+		return "", nil, err
+	}
+	if meta.ID == "" {
+		log.Debug().Msg("Dump has no ID: skipped check if it was already imported")
+		return "", nil, nil
+	}
+
+	recorded, err := s.ImportedSources(meta.ID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var imported []string
+	for _, st := range recorded {
+		if containsString(sources, st) && !containsString(imported, st) {
+			imported = append(imported, st)
+		}
+	}
+	return meta.ID, imported, nil
+}
+
+// annotateImport creates Grafana annotation marking the time range of the imported dump
+func annotateImport(httpC *fasthttp.Client, pmmURL, apiKey, dumpPath string, metas []dump.Meta) error {
+	var partial bool
+	for _, m := range metas {
+		partial = partial || m.Partial
+	}
+	r := importedRange(metas)
+	if r == nil {
+		return errors.New("dump meta has no time range: dump was created by an older version")
+	}
+
+	name := filepath.Base(dumpPath)
+	if dumpPath == "" {
+		name = "from STDIN"
+	}
+	text := fmt.Sprintf("Imported dump %s", name)
+	if ids := dumpIDs(metas); len(ids) != 0 {
+		text += fmt.Sprintf(" (ID %s)", strings.Join(ids, ", "))
+	}
+	if len(metas) != 0 && metas[0].PMMServerVersion != "" {
+		text += fmt.Sprintf(", exported from PMM %s", metas[0].PMMServerVersion)
+	}
+	if partial {
+		text += " (partial)"
+	}
+
+	err := grafana.CreateAnnotation(pmmURL, apiKey, grafana.Annotation{
+		Start: r.Start,
+		End:   r.End,
+		Tags:  []string{"pmm-transferer", "import"},
+		Text:  text,
+	}, httpC)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Created Grafana annotation for %s - %s", r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339))
+	return nil
+}
+
+func parseEntryAttributes(perms, owner string, preserveTimes bool) (transferer.EntryAttributes, error) {
+	mode, err := strconv.ParseInt(perms, 8, 64)
+	if err != nil || mode < 0 || mode > 0777 {
+		return transferer.EntryAttributes{}, errors.Errorf("invalid file mode: %s", perms)
+	}
+
+	attrs := transferer.EntryAttributes{
+		Mode:          mode,
+		PreserveTimes: preserveTimes,
+	}
+	if owner != "" {
+		parts := strings.SplitN(owner, ":", 2)
+		attrs.Uname = parts[0]
+		if len(parts) == 2 {
+			attrs.Gname = parts[1]
+		}
+	}
+	return attrs, nil
+}
+
+// keptDumps returns files left by the failed export: partial dumps and .part files kept with keep-partial
+func keptDumps(dumpPath string, shards int) []string {
+	files := []string{dump.PartialPath(dumpPath), transferer.PartPath(dumpPath)}
+	for i := 1; i <= shards && shards > 1; i++ {
+		files = append(files, dump.VolumePath(dump.PartialPath(dumpPath), i), transferer.PartPath(dump.VolumePath(dumpPath, i)))
+	}
+
+	var kept []string
+	for _, f := range files {
+		if _, err := os.Stat(f); err == nil {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// consistentEnd returns read point of consistent export: data before it is not expected to change during export,
+// as samples and QAN buckets are ingested with some delay. It's best-effort: data delayed more than the lag still changes
+func consistentEnd(end, now time.Time, lag time.Duration) time.Time {
+	if readPoint := now.Add(-lag); readPoint.Before(end) {
+		return readPoint
+	}
+	return end
+}
+
+// clampChunkEnds limits time range chunks to the end, so nothing after end-ts or the consistent read point is exported.
+// Chunks starting at the end are dropped, as chunk ranges are half-open
+func clampChunkEnds(chunks []dump.ChunkMeta, end time.Time) []dump.ChunkMeta {
+	result := chunks[:0]
+	for _, c := range chunks {
+		if c.Start != nil && !c.Start.Before(end) {
+			continue
+		}
+		if c.End != nil && c.End.After(end) {
+			e := end
+			c.End = &e
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+// alignChunksStart moves start back to a multiple of align, so boundaries of the chunks, which size is a multiple
+// of align, fall on clean intervals
+func alignChunksStart(start time.Time, align, chunkSize time.Duration) (time.Time, error) {
+	if align <= 0 {
+		return start, nil
+	}
+	if chunkSize%align != 0 {
+		return time.Time{}, errors.Errorf("chunk time range %s is not a multiple of alignment %s", chunkSize, align)
+	}
+	return start.Truncate(align), nil
+}
+
+// splitList splits comma-separated list, skipping empty items
+func splitList(v string) []string {
+	var result []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// journalStderr is the journal path writing the journal to STDERR
+const journalStderr = "stderr"
+
+// openJournal opens the export journal for appending, it returns nil journal if path is empty
+func openJournal(path, dumpID string) (*transferer.Journal, func(), error) {
+	switch path {
+	case "":
+		return nil, func() {}, nil
+	case journalStderr:
+		return transferer.NewJournal(os.Stderr, dumpID), func() {}, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	return transferer.NewJournal(f, dumpID), func() { _ = f.Close() }, nil
+}
+
+// recordJournalEnd records the final export status to the journal
+func recordJournalEnd(j *transferer.Journal, p transferer.Progress, err error) {
+	r := transferer.JournalRecord{
+		Event:           transferer.JournalFinished,
+		ChunksTotal:     p.ChunksTotal,
+		ChunksProcessed: p.ChunksProcessed,
+	}
+	if err != nil {
+		r.Event, r.Error = transferer.JournalFailed, err.Error()
+	}
+	j.Record(r)
+}
+
+// readMetricGlobs reads metric name globs from the file, one per line. Empty lines and lines starting with # are skipped
+func readMetricGlobs(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var globs []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err = victoriametrics.ValidateMetricGlob(line); err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, i+1)
+		}
+		globs = append(globs, line)
+	}
+	if len(globs) == 0 {
+		return nil, errors.Errorf("no metric globs in %s", path)
+	}
+	return globs, nil
+}
+
+// describeImportInput returns what is imported for the confirmation prompt
+func describeImportInput(dumpPath, retryQueueFile string, retryQueue bool) string {
+	switch {
+	case retryQueue:
+		return "retry queue " + retryQueueFile
+	case dumpPath == "":
+		return "dump from STDIN"
+	default:
+		return "dump " + dumpPath
+	}
+}
+
+// bootstrapClickHouseSchema creates ClickHouse objects missing on the target from the schema of the dump meta
+func bootstrapClickHouseSchema(chURL, dumpPath string) error {
+	if dumpPath == "" {
+		return errors.New("schema is read from the dump meta, please, specify dump-path")
+	}
+	paths, err := dump.VolumePaths(dumpPath)
+	if err != nil {
+		return err
+	}
+	meta, err := transferer.ReadMetaFromDump(paths[0], false)
+	if err != nil {
+		return errors.Wrap(err, "failed to read dump meta")
+	}
+
+	var schema []dump.SchemaObject
+	for _, s := range meta.Sources {
+		if s.Type == dump.ClickHouse.String() {
+			schema = s.Schema
+		}
+	}
+	if len(schema) == 0 {
+		return errors.New("dump has no ClickHouse schema: it's exported by an older version or without QAN")
+	}
+
+	created, err := clickhouse.BootstrapSchema(chURL, schema)
+	if err != nil {
+		return err
+	}
+	if len(created) == 0 {
+		log.Info().Msg("ClickHouse schema is up to date")
+	} else {
+		log.Info().Msgf("Created ClickHouse objects: %s", strings.Join(created, ", "))
+	}
+	return nil
+}
+
+// formatReasons returns counts by reason ordered by reason, e.g. "failed: 2, transform: 1"
+func formatReasons(reasons map[string]int) string {
+	keys := make([]string, 0, len(reasons))
+	for k := range reasons {
+		keys = append(keys, k)
 	}
-	if (stat.Mode() & os.ModeCharDevice) == 0 {
-		return true, nil
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s: %d", k, reasons[k]))
 	}
-	return false, nil
+	return strings.Join(parts, ", ")
 }
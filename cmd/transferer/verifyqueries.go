@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"pmm-transferer/pkg/clickhouse"
+	"pmm-transferer/pkg/victoriametrics"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+	"gopkg.in/yaml.v3"
+)
+
+// verifyQuery is the query of the verify-queries file, e.g.
+//
+//	queries:
+//	  - name: MySQL QPS
+//	    promql: sum by (service_name) (rate(mysql_global_status_queries[5m]))
+//	  - name: QAN queries per service
+//	    clickhouse: SELECT service_name, sum(num_queries) FROM metrics
+//	      WHERE period_start >= {start} AND period_start < {end} GROUP BY service_name ORDER BY service_name
+//	    tolerance: 0.05
+//
+// Tolerance is the relative difference of values which is still considered a match, the flag value is used if it's not set
+type verifyQuery struct {
+	Name       string   `yaml:"name"`
+	PromQL     string   `yaml:"promql"`
+	ClickHouse string   `yaml:"clickhouse"`
+	Tolerance  *float64 `yaml:"tolerance"`
+}
+
+type verifyQueriesFile struct {
+	Queries []verifyQuery `yaml:"queries"`
+}
+
+type verifyQueriesOptions struct {
+	start     time.Time
+	end       time.Time
+	step      time.Duration
+	tolerance float64
+}
+
+type verifyQueryResult struct {
+	name string
+	kind string
+	// compared is the number of series (PromQL) or rows (ClickHouse) found on both sides
+	compared int
+	points   int
+	// mismatched is the number of values differing more than tolerance
+	mismatched int
+	missing    int
+	extra      int
+	maxDiff    float64
+	notes      []string
+	err        error
+}
+
+func (r verifyQueryResult) ok() bool {
+	return r.err == nil && r.mismatched == 0 && r.missing == 0
+}
+
+func readVerifyQueries(path string) ([]verifyQuery, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read queries file")
+	}
+
+	var f verifyQueriesFile
+	if err = yaml.Unmarshal(data, &f); err != nil {
+		return nil, errors.Wrap(err, "failed to parse queries file")
+	}
+	if len(f.Queries) == 0 {
+		return nil, errors.New("queries file has no queries")
+	}
+
+	for i, q := range f.Queries {
+		if q.Name == "" {
+			f.Queries[i].Name = fmt.Sprintf("query #%d", i+1)
+		}
+		if (q.PromQL == "") == (q.ClickHouse == "") {
+			return nil, errors.Errorf("%s: either promql or clickhouse query should be specified", f.Queries[i].Name)
+		}
+		if q.Tolerance != nil && *q.Tolerance < 0 {
+			return nil, errors.Errorf("%s: tolerance should not be negative", f.Queries[i].Name)
+		}
+	}
+	return f.Queries, nil
+}
+
+// verifyQueries runs the queries against both source and target PMM for the migrated range and compares results
+func verifyQueries(ctx context.Context, httpC *fasthttp.Client, source, target PMMConfig,
+	queries []verifyQuery, opts verifyQueriesOptions) ([]verifyQueryResult, error) {
+	var srcVM, dstVM *victoriametrics.Source
+	var srcCH, dstCH *clickhouse.Source
+	for _, q := range queries {
+		switch {
+		case q.PromQL != "" && srcVM == nil:
+			srcVM = victoriametrics.NewSource(httpC, victoriametrics.Config{ConnectionURL: source.VictoriaMetricsURL})
+			dstVM = victoriametrics.NewSource(httpC, victoriametrics.Config{ConnectionURL: target.VictoriaMetricsURL})
+		case q.ClickHouse != "" && srcCH == nil:
+			var err error
+			if srcCH, err = clickhouse.NewSource(ctx, clickhouse.Config{ConnectionURL: source.ClickHouseURL}); err != nil {
+				return nil, errors.Wrap(err, "failed to connect to source ClickHouse")
+			}
+			if dstCH, err = clickhouse.NewSource(ctx, clickhouse.Config{ConnectionURL: target.ClickHouseURL}); err != nil {
+				return nil, errors.Wrap(err, "failed to connect to target ClickHouse")
+			}
+		}
+	}
+
+	results := make([]verifyQueryResult, 0, len(queries))
+	for _, q := range queries {
+		tolerance := opts.tolerance
+		if q.Tolerance != nil {
+			tolerance = *q.Tolerance
+		}
+
+		var r verifyQueryResult
+		if q.PromQL != "" {
+			r = comparePromQL(srcVM, dstVM, q.PromQL, opts, tolerance)
+		} else {
+			r = compareClickHouse(srcCH, dstCH, q.ClickHouse, opts, tolerance)
+		}
+		r.name = q.Name
+
+		log.Info().
+			Str("query", r.name).
+			Int("mismatched", r.mismatched).
+			Int("missing", r.missing).
+			Msg("Verified query")
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+func comparePromQL(src, dst *victoriametrics.Source, query string, opts verifyQueriesOptions, tolerance float64) verifyQueryResult {
+	r := verifyQueryResult{kind: "promql"}
+
+	srcSeries, err := src.QueryRange(query, opts.start, opts.end, opts.step)
+	if err != nil {
+		r.err = errors.Wrap(err, "source")
+		return r
+	}
+	dstSeries, err := dst.QueryRange(query, opts.start, opts.end, opts.step)
+	if err != nil {
+		r.err = errors.Wrap(err, "target")
+		return r
+	}
+
+	labels := make([]string, 0, len(srcSeries))
+	for l := range srcSeries {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+
+	for _, l := range labels {
+		d, ok := dstSeries[l]
+		if !ok {
+			r.missing++
+			r.notes = append(r.notes, fmt.Sprintf("series %s is missing in the target", l))
+			continue
+		}
+		r.compared++
+
+		var mismatched int
+		for ts, v := range srcSeries[l].Values {
+			dv, ok := d.Values[ts]
+			if !ok {
+				mismatched++
+				continue
+			}
+			r.points++
+			diff := relativeDiff(v, dv)
+			r.maxDiff = math.Max(r.maxDiff, diff)
+			if diff > tolerance {
+				mismatched++
+			}
+		}
+		if mismatched > 0 {
+			r.mismatched += mismatched
+			r.notes = append(r.notes, fmt.Sprintf("series %s has %d mismatched points", l, mismatched))
+		}
+	}
+	for l := range dstSeries {
+		if _, ok := srcSeries[l]; !ok {
+			r.extra++
+		}
+	}
+	return r
+}
+
+func compareClickHouse(src, dst *clickhouse.Source, query string, opts verifyQueriesOptions, tolerance float64) verifyQueryResult {
+	r := verifyQueryResult{kind: "clickhouse"}
+
+	srcRows, err := src.QueryRows(query, opts.start, opts.end)
+	if err != nil {
+		r.err = errors.Wrap(err, "source")
+		return r
+	}
+	dstRows, err := dst.QueryRows(query, opts.start, opts.end)
+	if err != nil {
+		r.err = errors.Wrap(err, "target")
+		return r
+	}
+
+	// rows are compared in order, so queries returning multiple rows should have ORDER BY
+	for i, row := range srcRows {
+		if i >= len(dstRows) {
+			r.missing = len(srcRows) - i
+			r.notes = append(r.notes, fmt.Sprintf("target has %d rows less than source", r.missing))
+			break
+		}
+		r.compared++
+
+		dstRow := dstRows[i]
+		if len(row) != len(dstRow) {
+			r.mismatched++
+			r.notes = append(r.notes, fmt.Sprintf("row %d has different number of columns", i+1))
+			continue
+		}
+		for j, v := range row {
+			r.points++
+			fv, ok1 := toFloat(v)
+			dv, ok2 := toFloat(dstRow[j])
+			if ok1 && ok2 {
+				diff := relativeDiff(fv, dv)
+				r.maxDiff = math.Max(r.maxDiff, diff)
+				if diff <= tolerance {
+					continue
+				}
+			} else if fmt.Sprint(v) == fmt.Sprint(dstRow[j]) {
+				continue
+			}
+			r.mismatched++
+			r.notes = append(r.notes, fmt.Sprintf("row %d column %d: %v in source, %v in target", i+1, j+1, v, dstRow[j]))
+		}
+	}
+	if len(dstRows) > len(srcRows) {
+		r.extra = len(dstRows) - len(srcRows)
+	}
+	return r
+}
+
+// relativeDiff returns difference of values relative to the larger absolute one
+func relativeDiff(a, b float64) float64 {
+	if a == b || (math.IsNaN(a) && math.IsNaN(b)) {
+		return 0
+	}
+	m := math.Max(math.Abs(a), math.Abs(b))
+	if m == 0 || math.IsNaN(m) || math.IsInf(m, 0) {
+		return math.Inf(1)
+	}
+	return math.Abs(a-b) / m
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
+
+func printVerifyQueriesReport(results []verifyQueryResult) bool {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "QUERY\tTYPE\tCOMPARED\tVALUES\tMISMATCHED\tMISSING\tEXTRA\tMAX DIFF\tRESULT")
+
+	var passed int
+	var notes []string
+	for _, r := range results {
+		status := "OK"
+		if r.err != nil {
+			status = "ERROR"
+			notes = append(notes, fmt.Sprintf("%s: %v", r.name, r.err))
+		} else if !r.ok() {
+			status = "FAIL"
+		}
+		if r.ok() {
+			passed++
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%.2f%%\t%s\n", r.name, r.kind, r.compared, r.points,
+			r.mismatched, r.missing, r.extra, r.maxDiff*100, status)
+		for _, n := range r.notes {
+			notes = append(notes, fmt.Sprintf("%s: %s", r.name, n))
+		}
+	}
+	_ = w.Flush()
+
+	const maxNotes = 20
+	for i, n := range notes {
+		if i == maxNotes {
+			fmt.Printf("  ... and %d more\n", len(notes)-maxNotes)
+			break
+		}
+		fmt.Printf("  - %s\n", n)
+	}
+
+	fmt.Printf("\n%d of %d queries match within tolerance\n", passed, len(results))
+	return passed == len(results)
+}
@@ -0,0 +1,109 @@
+// Package alerting manages silences in PMM Alertmanager, so alerts aren't fired by backfilled data
+package alerting
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+const silencesPath = "/alertmanager/api/v2/silences"
+
+// Silence mutes alerts matching the labels between Start and End
+type Silence struct {
+	// ID is set to update the existing silence
+	ID string
+	// Matchers are label values alerts are matched by, a label matches any of its values.
+	// All alerts are matched if there are no matchers
+	Matchers map[string][]string
+	Start    time.Time
+	End      time.Time
+	Comment  string
+}
+
+type matcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+}
+
+type silenceReq struct {
+	ID        string    `json:"id,omitempty"`
+	Matchers  []matcher `json:"matchers"`
+	StartsAt  time.Time `json:"startsAt"`
+	EndsAt    time.Time `json:"endsAt"`
+	CreatedBy string    `json:"createdBy"`
+	Comment   string    `json:"comment"`
+}
+
+// CreateSilence creates or updates the silence and returns its ID. Alertmanager may return new ID on update
+func CreateSilence(pmmURL string, s Silence, c *fasthttp.Client) (string, error) {
+	body, err := json.Marshal(silenceReq{
+		ID:        s.ID,
+		Matchers:  matchers(s.Matchers),
+		StartsAt:  s.Start.UTC(),
+		EndsAt:    s.End.UTC(),
+		CreatedBy: "pmm-transferer",
+		Comment:   s.Comment,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetRequestURI(pmmURL + silencesPath)
+	req.Header.SetContentType("application/json")
+	req.SetBody(body)
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	if err := c.Do(req, resp); err != nil {
+		return "", err
+	}
+	if status := resp.StatusCode(); status != fasthttp.StatusOK {
+		return "", fmt.Errorf("non-ok status: %d: %s", status, string(resp.Body()))
+	}
+
+	var result struct {
+		SilenceID string `json:"silenceID"`
+	}
+	if err = json.Unmarshal(resp.Body(), &result); err != nil {
+		return "", errors.Wrap(err, "failed to parse response")
+	}
+	if result.SilenceID == "" {
+		return "", errors.New("no silence ID in response")
+	}
+	return result.SilenceID, nil
+}
+
+// matchers converts label values to regex matchers, Alertmanager requires at least one matcher,
+// so alerts are matched by any alert name if there are no labels
+func matchers(labels map[string][]string) []matcher {
+	if len(labels) == 0 {
+		return []matcher{{Name: "alertname", Value: ".+", IsRegex: true}}
+	}
+
+	result := make([]matcher, 0, len(labels))
+	for name, values := range labels {
+		quoted := make([]string, 0, len(values))
+		for _, v := range values {
+			quoted = append(quoted, regexp.QuoteMeta(v))
+		}
+		sort.Strings(quoted)
+		result = append(result, matcher{Name: name, Value: strings.Join(quoted, "|"), IsRegex: true})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
@@ -0,0 +1,71 @@
+package clickhouse
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const periodLengthColumn = "period_length"
+
+// aggregation is a query over QAN metrics table grouping rows into longer periods
+type aggregation struct {
+	// exprs are select expressions in the order of table columns
+	exprs   []string
+	groupBy []string
+	orderBy string
+}
+
+// newAggregation groups rows by query, service and other dimension columns within the interval.
+// Metric columns are aggregated by their suffix, query examples and errors are taken from any row
+func newAggregation(columns []string, interval time.Duration) *aggregation {
+	seconds := int64(interval.Seconds())
+	bucket := fmt.Sprintf("toStartOfInterval(%s, INTERVAL %d SECOND)", periodStartColumn, seconds)
+
+	a := &aggregation{
+		groupBy: []string{bucket},
+		orderBy: bucket + ", queryid",
+	}
+	for _, c := range columns {
+		expr, dimension := aggregateColumn(c, bucket, seconds)
+		a.exprs = append(a.exprs, expr)
+		if dimension && c != periodStartColumn {
+			a.groupBy = append(a.groupBy, c)
+		}
+	}
+	return a
+}
+
+func aggregateColumn(name, bucket string, seconds int64) (string, bool) {
+	switch {
+	case name == periodStartColumn:
+		return bucket, true
+	case name == periodLengthColumn:
+		return fmt.Sprintf("toUInt32(%d)", seconds), false
+	case strings.HasPrefix(name, "num_queries"):
+		return fmt.Sprintf("sum(%s)", name), false
+	case strings.HasPrefix(name, "m_"):
+		switch {
+		case strings.HasSuffix(name, "_min"):
+			return fmt.Sprintf("min(%s)", name), false
+		case strings.HasSuffix(name, "_max"), strings.HasSuffix(name, "_p99"):
+			return fmt.Sprintf("max(%s)", name), false
+		default:
+			return fmt.Sprintf("sum(%s)", name), false
+		}
+	case strings.HasPrefix(name, "example"), name == "is_truncated",
+		strings.HasPrefix(name, "errors."), strings.HasPrefix(name, "warnings."):
+		return fmt.Sprintf("any(%s)", name), false
+	default:
+		return name, true
+	}
+}
+
+func (a *aggregation) selectQuery(table, where string) string {
+	return fmt.Sprintf("SELECT %s FROM %s%s GROUP BY %s",
+		strings.Join(a.exprs, ", "), table, where, strings.Join(a.groupBy, ", "))
+}
+
+func (a *aggregation) countQuery(table, where string) string {
+	return fmt.Sprintf("SELECT COUNT(*) FROM (SELECT 1 FROM %s%s GROUP BY %s)", table, where, strings.Join(a.groupBy, ", "))
+}
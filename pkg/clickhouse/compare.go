@@ -0,0 +1,88 @@
+package clickhouse
+
+import (
+	"fmt"
+	"io"
+	"pmm-transferer/pkg/clickhouse/tsv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// rowKeyColumns identify QAN metrics row: one row per query per service per period
+var rowKeyColumns = []string{periodStartColumn, "queryid", "service_id"}
+
+// RowKey identifies metrics table row to check if it exists in the target
+type RowKey struct {
+	PeriodStart time.Time
+	QueryID     string
+	ServiceID   string
+}
+
+func (k RowKey) String() string {
+	return fmt.Sprintf("%s/%s/%s", k.PeriodStart.Format(time.RFC3339), k.QueryID, k.ServiceID)
+}
+
+// ChunkRowKeys returns keys of the metrics table chunk rows. Chunks of other tables and chunks without
+// key columns in the header (exported by older versions or with column projection) have no keys
+func ChunkRowKeys(filename string, r io.Reader) ([]RowKey, error) {
+	if parseChunkTable(filename) != MetricsTable {
+		return nil, nil
+	}
+
+	reader := tsv.NewReader(r)
+	header, err := reader.Reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	idx := make([]int, len(rowKeyColumns))
+	for i, c := range rowKeyColumns {
+		if idx[i] = indexOf(header, c); idx[i] == -1 {
+			return nil, nil
+		}
+	}
+
+	var keys []RowKey
+	for {
+		records, err := reader.Reader.Read()
+		if err == io.EOF {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		periodStart, err := tsv.ParseTime(records[idx[0]])
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse period start")
+		}
+		keys = append(keys, RowKey{
+			PeriodStart: periodStart,
+			QueryID:     records[idx[1]],
+			ServiceID:   records[idx[2]],
+		})
+	}
+}
+
+func indexOf(list []string, v string) int {
+	for i, e := range list {
+		if e == v {
+			return i
+		}
+	}
+	return -1
+}
+
+// RowExists reports if the metrics table has a row with the key
+func (s Source) RowExists(k RowKey) (bool, error) {
+	query := fmt.Sprintf("SELECT count() FROM %s WHERE %s = ? AND %s = ? AND %s = ?",
+		MetricsTable, rowKeyColumns[0], rowKeyColumns[1], rowKeyColumns[2])
+	var count int
+	if err := s.db.QueryRow(query, k.PeriodStart, k.QueryID, k.ServiceID).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
@@ -1,6 +1,30 @@
 package clickhouse
 
+import (
+	"pmm-transferer/pkg/remap"
+	"time"
+)
+
 type Config struct {
-	ConnectionURL string
-	Where         string
+	ConnectionURL   string
+	Where           string
+	ExcludedColumns []string
+	// Columns limits exported metrics table columns, all columns are exported if empty
+	Columns []string
+	// InsertBatchRows commits inserted rows every InsertBatchRows rows, all table rows are inserted in a single batch if 0
+	InsertBatchRows int
+	// InsertFlushInterval commits inserted rows when the batch is older than the interval
+	InsertFlushInterval time.Duration
+	// Aggregate groups QAN metrics rows into periods of the duration on export, raw rows are exported if 0
+	Aggregate time.Duration
+	// Tables to export/import, metrics table only by default
+	Tables []string
+	// Remapping is applied to column values on import
+	Remapping remap.Mapping
+	// PartitionOrder groups rows of the insert batch by partition (period start day) and inserts them partition by partition
+	PartitionOrder bool
+	// Filter keeps only rows of the routed origins on import, before remapping
+	Filter *remap.Filter
+	// Schema adds DDL of the tables and their materialized views to the source meta on export, see BootstrapSchema
+	Schema bool
 }
@@ -0,0 +1,25 @@
+package clickhouse
+
+import (
+	"github.com/pkg/errors"
+)
+
+// PingWrite checks that inserts into all tables are allowed. Inserts are prepared, but rolled back without sending any data
+func (s Source) PingWrite() error {
+	for _, t := range s.tables {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		stmt, err := tx.Prepare("INSERT INTO " + t.name + " VALUES")
+		if err != nil {
+			_ = tx.Rollback()
+			return errors.Wrapf(err, "failed to prepare insert into %s", t.name)
+		}
+		_ = stmt.Close()
+		if err = tx.Rollback(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package clickhouse
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// PurgeFilter selects rows written by an import: rows of the time range with the column values
+type PurgeFilter struct {
+	Start, End time.Time
+	// Columns are values of the columns rows should have, rows are selected if they match all columns
+	Columns map[string][]string
+}
+
+// PurgeResult is the amount of rows selected for deletion in the table
+type PurgeResult struct {
+	Table             string
+	Rows              int
+	DroppedPartitions int
+}
+
+// Purge deletes rows matching the filter from the tables. Partitions of the range having matching rows only
+// are dropped, other matching rows are deleted by mutation, which ClickHouse applies in background
+func (s Source) Purge(f PurgeFilter) ([]PurgeResult, error) {
+	results := make([]PurgeResult, 0, len(s.tables))
+	for _, t := range s.tables {
+		if !t.hasColumn(periodStartColumn) {
+			log.Warn().Msgf("Skipping table %s: it has no %s column to select the time range", t.name, periodStartColumn)
+			continue
+		}
+		cond, args, err := purgeCondition(t, f.Columns)
+		if err != nil {
+			return nil, err
+		}
+		r, err := s.purgeTable(t, f.Start, f.End, cond, args)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to purge %s", t.name)
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+func purgeCondition(t *table, columns map[string][]string) (string, []interface{}, error) {
+	names := make([]string, 0, len(columns))
+	for name := range columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	conds := []string{"1"}
+	var args []interface{}
+	for _, name := range names {
+		if !isIdentifier(name) || !t.hasColumn(name) {
+			return "", nil, errors.Errorf("table %s has no column %s", t.name, name)
+		}
+		placeholders := make([]string, 0, len(columns[name]))
+		for _, v := range columns[name] {
+			placeholders = append(placeholders, "?")
+			args = append(args, v)
+		}
+		conds = append(conds, fmt.Sprintf("%s IN (%s)", name, strings.Join(placeholders, ", ")))
+	}
+	return strings.Join(conds, " AND "), args, nil
+}
+
+func (s Source) purgeTable(t *table, start, end time.Time, cond string, args []interface{}) (PurgeResult, error) {
+	result := PurgeResult{Table: t.name}
+	rangeCond := func(from, to time.Time) string {
+		return fmt.Sprintf("%s >= toDateTime(%d) AND %s < toDateTime(%d)", periodStartColumn, from.Unix(), periodStartColumn, to.Unix())
+	}
+
+	rows, err := s.db.Query("SELECT partition_id, min(min_time), max(max_time) FROM system.parts "+
+		"WHERE database = currentDatabase() AND table = ? AND active GROUP BY partition_id", t.name)
+	if err != nil {
+		return result, errors.Wrap(err, "failed to get partitions")
+	}
+	type partition struct {
+		id       string
+		min, max time.Time
+	}
+	var partitions []partition
+	for rows.Next() {
+		var p partition
+		if err = rows.Scan(&p.id, &p.min, &p.max); err != nil {
+			_ = rows.Close()
+			return result, errors.Wrap(err, "failed to read partitions")
+		}
+		// min and max time are not set if partition key isn't time
+		if !p.min.IsZero() && !p.min.Before(start) && p.max.Before(end) {
+			partitions = append(partitions, p)
+		}
+	}
+	if err = rows.Close(); err != nil {
+		return result, errors.Wrap(err, "failed to read partitions")
+	}
+
+	for _, p := range partitions {
+		// partitions are time ranges, so rows of the partition range are the partition rows
+		var matched, other int
+		row := s.db.QueryRow(fmt.Sprintf("SELECT countIf(%s), countIf(NOT (%s)) FROM %s WHERE %s",
+			cond, cond, t.name, rangeCond(p.min, p.max.Add(time.Second))), append(args, args...)...)
+		if err = row.Scan(&matched, &other); err != nil {
+			return result, errors.Wrapf(err, "failed to count rows of partition %s", p.id)
+		}
+		if matched == 0 || other != 0 {
+			continue
+		}
+		if _, err = s.db.Exec(fmt.Sprintf("ALTER TABLE %s DROP PARTITION ID '%s'", t.name, p.id)); err != nil {
+			return result, errors.Wrapf(err, "failed to drop partition %s", p.id)
+		}
+		log.Debug().Msgf("Dropped partition %s of %s with %d rows", p.id, t.name, matched)
+		result.Rows += matched
+		result.DroppedPartitions++
+	}
+
+	var rest int
+	where := cond + " AND " + rangeCond(start, end)
+	if err = s.db.QueryRow(fmt.Sprintf("SELECT count() FROM %s WHERE %s", t.name, where), args...).Scan(&rest); err != nil {
+		return result, errors.Wrap(err, "failed to count rows")
+	}
+	if rest != 0 {
+		if _, err = s.db.Exec(fmt.Sprintf("ALTER TABLE %s DELETE WHERE %s", t.name, where), args...); err != nil {
+			return result, errors.Wrap(err, "failed to delete rows")
+		}
+		result.Rows += rest
+	}
+	return result, nil
+}
@@ -0,0 +1,51 @@
+package clickhouse
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// QueryRows runs a read-only query and returns all result rows. {start} and {end} placeholders
+// are replaced with the range bounds as DateTime values
+func (s Source) QueryRows(query string, start, end time.Time) ([][]interface{}, error) {
+	query = strings.NewReplacer(
+		"{start}", fmt.Sprintf("toDateTime(%d)", start.Unix()),
+		"{end}", fmt.Sprintf("toDateTime(%d)", end.Unix()),
+	).Replace(query)
+
+	log.Debug().
+		Str("query", query).
+		Msg("Sending query to Click House")
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to run query")
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get columns")
+	}
+
+	var result [][]interface{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		result = append(result, values)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read rows")
+	}
+	return result, nil
+}
@@ -0,0 +1,86 @@
+package clickhouse
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultDatabase = "default"
+
+// SandboxURL returns the connection URL of the sandbox database, named as the database of the URL with the prefix,
+// and the sandbox database name
+func SandboxURL(connectionURL, prefix string) (string, string, error) {
+	u, err := url.Parse(connectionURL)
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to parse ClickHouse URL")
+	}
+	q := u.Query()
+	database := q.Get("database")
+	if database == "" {
+		database = defaultDatabase
+	}
+	sandbox := prefix + database
+	if prefix == "" || !isIdentifier(sandbox) {
+		return "", "", errors.Errorf("invalid sandbox database name %q", sandbox)
+	}
+	q.Set("database", sandbox)
+	u.RawQuery = q.Encode()
+	return u.String(), sandbox, nil
+}
+
+// PrepareSandbox creates the sandbox database with the tables of the same structure as in the database of the URL.
+// It returns the connection URL of the sandbox database
+func PrepareSandbox(connectionURL, prefix string, tables []string) (string, error) {
+	sandboxURL, sandbox, err := SandboxURL(connectionURL, prefix)
+	if err != nil {
+		return "", err
+	}
+
+	db, err := sql.Open("clickhouse", connectionURL)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	if _, err = db.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", sandbox)); err != nil {
+		return "", errors.Wrapf(err, "failed to create database %s", sandbox)
+	}
+	if len(tables) == 0 {
+		tables = []string{MetricsTable}
+	}
+	for _, t := range tables {
+		if !isIdentifier(t) {
+			return "", errors.Errorf("invalid table name %q", t)
+		}
+		// AS copies columns and engine of the table in the current database
+		if _, err = db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s`.`%s` AS `%s`", sandbox, t, t)); err != nil {
+			return "", errors.Wrapf(err, "failed to create table %s.%s", sandbox, t)
+		}
+	}
+
+	log.Info().Msgf("QAN data is imported into sandbox database %s", sandbox)
+	return sandboxURL, nil
+}
+
+// DropSandbox drops the sandbox database of the prefix, the database of the URL is never dropped
+func DropSandbox(connectionURL, prefix string) (string, error) {
+	_, sandbox, err := SandboxURL(connectionURL, prefix)
+	if err != nil {
+		return "", err
+	}
+
+	db, err := sql.Open("clickhouse", connectionURL)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	if _, err = db.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS `%s`", sandbox)); err != nil {
+		return "", errors.Wrapf(err, "failed to drop database %s", sandbox)
+	}
+	return sandbox, nil
+}
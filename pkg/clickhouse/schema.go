@@ -0,0 +1,156 @@
+package clickhouse
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"pmm-transferer/pkg/dump"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const materializedViewEngine = "MaterializedView"
+
+// readSchema returns DDL of the tables and materialized views reading from them. Views go last,
+// as they can be created only after the tables they read from
+func readSchema(db *sql.DB, tables []*table) ([]dump.SchemaObject, error) {
+	var database string
+	if err := db.QueryRow("SELECT currentDatabase()").Scan(&database); err != nil {
+		return nil, errors.Wrap(err, "failed to get current database")
+	}
+
+	var objects, views []dump.SchemaObject
+	seen := make(map[string]struct{})
+	add := func(o dump.SchemaObject) {
+		if _, ok := seen[o.Name]; ok {
+			return
+		}
+		seen[o.Name] = struct{}{}
+		o.Query = unqualify(o.Query, database)
+		if o.Engine == materializedViewEngine {
+			views = append(views, o)
+		} else {
+			objects = append(objects, o)
+		}
+	}
+
+	for _, t := range tables {
+		var o dump.SchemaObject
+		row := db.QueryRow("SELECT name, engine, create_table_query FROM system.tables "+
+			"WHERE database = currentDatabase() AND name = ?", t.name)
+		if err := row.Scan(&o.Name, &o.Engine, &o.Query); err != nil {
+			return nil, errors.Wrapf(err, "failed to get %s table DDL", t.name)
+		}
+		add(o)
+
+		deps, err := dependentViews(db, t.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range deps {
+			add(v)
+		}
+	}
+	return append(objects, views...), nil
+}
+
+func dependentViews(db *sql.DB, table string) ([]dump.SchemaObject, error) {
+	rows, err := db.Query("SELECT name, engine, create_table_query FROM system.tables "+
+		"WHERE database = currentDatabase() AND engine = ? AND name IN "+
+		"(SELECT arrayJoin(dependencies_table) FROM system.tables WHERE database = currentDatabase() AND name = ?)",
+		materializedViewEngine, table)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get views of %s table", table)
+	}
+	defer rows.Close()
+
+	var views []dump.SchemaObject
+	for rows.Next() {
+		var o dump.SchemaObject
+		if err = rows.Scan(&o.Name, &o.Engine, &o.Query); err != nil {
+			return nil, errors.Wrapf(err, "failed to get views of %s table", table)
+		}
+		views = append(views, o)
+	}
+	return views, rows.Err()
+}
+
+// unqualify removes the database qualifiers from the query, so the object is created in the current database
+func unqualify(query, database string) string {
+	name := regexp.QuoteMeta(database)
+	re := regexp.MustCompile("(^|[^\\w.`])(" + name + "|`" + name + "`)\\.")
+	return re.ReplaceAllString(query, "$1")
+}
+
+// BootstrapSchema creates the database of the URL and the objects of the schema missing in it, so QAN data
+// can be imported into ClickHouse without PMM provisioning. Existing objects are kept as is.
+// It returns names of the created objects
+func BootstrapSchema(connectionURL string, schema []dump.SchemaObject) ([]string, error) {
+	u, err := url.Parse(connectionURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse ClickHouse URL")
+	}
+	q := u.Query()
+	database := q.Get("database")
+	if database == "" {
+		database = defaultDatabase
+	}
+	if !isIdentifier(database) {
+		return nil, errors.Errorf("invalid database name %q", database)
+	}
+
+	// connection to the database fails until it's created
+	q.Del("database")
+	u.RawQuery = q.Encode()
+	db, err := sql.Open("clickhouse", u.String())
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", database))
+	db.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create database %s", database)
+	}
+
+	if db, err = sql.Open("clickhouse", connectionURL); err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	existing, err := tableNames(db)
+	if err != nil {
+		return nil, err
+	}
+	var created []string
+	for _, o := range schema {
+		if _, ok := existing[o.Name]; ok {
+			log.Debug().Msgf("ClickHouse %s %s exists, skipping", o.Engine, o.Name)
+			continue
+		}
+		if _, err = db.Exec(o.Query); err != nil {
+			return created, errors.Wrapf(err, "failed to create %s", o.Name)
+		}
+		created = append(created, o.Name)
+	}
+	return created, nil
+}
+
+func tableNames(db *sql.DB) (map[string]struct{}, error) {
+	rows, err := db.Query("SELECT name FROM system.tables WHERE database = currentDatabase()")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list tables")
+	}
+	defer rows.Close()
+
+	names := make(map[string]struct{})
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, errors.Wrap(err, "failed to list tables")
+		}
+		names[name] = struct{}{}
+	}
+	return names, rows.Err()
+}
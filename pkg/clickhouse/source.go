@@ -11,16 +11,19 @@ import (
 	"io"
 	"pmm-transferer/pkg/clickhouse/tsv"
 	"pmm-transferer/pkg/dump"
+	"pmm-transferer/pkg/requestid"
 	"strings"
 	"time"
 )
 
+// QueryExampleColumns contain query texts, which may be prohibited to leave the environment
+var QueryExampleColumns = []string{"fingerprint", "example"}
+
 type Source struct {
-	db   *sql.DB
-	cfg  Config
-	tx   *sql.Tx
-	ct   []*sql.ColumnType
-	stmt *sql.Stmt
+	db     *sql.DB
+	cfg    Config
+	tables []*table
+	schema []dump.SchemaObject
 }
 
 func NewSource(ctx context.Context, cfg Config) (*Source, error) {
@@ -39,67 +42,129 @@ func NewSource(ctx context.Context, cfg Config) (*Source, error) {
 			return nil, err
 		}
 	}
-	tx, err := db.Begin()
-	if err != nil {
-		return nil, err
+
+	if len(cfg.Tables) == 0 {
+		cfg.Tables = []string{MetricsTable}
 	}
 
-	ct, err := columnTypes(db)
-	if err != nil {
-		return nil, err
+	tables := make([]*table, 0, len(cfg.Tables))
+	for _, name := range cfg.Tables {
+		var columns []string
+		// column projection is written for metrics table, like user filter
+		if name == MetricsTable {
+			columns = cfg.Columns
+		}
+		t, err := newTable(db, name, cfg.ExcludedColumns, columns)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get %s table info", name)
+		}
+		if name == MetricsTable && cfg.Aggregate > 0 {
+			t.aggregation = newAggregation(t.columns, cfg.Aggregate)
+			t.orderBy = t.aggregation.orderBy
+		}
+		tables = append(tables, t)
 	}
 
-	stmt, err := prepareInsertStatement(tx, len(ct))
-	if err != nil {
-		return nil, err
+	var schema []dump.SchemaObject
+	if cfg.Schema {
+		// schema is optional for import, so export doesn't fail if it's not readable, e.g. on old ClickHouse
+		if schema, err = readSchema(db, tables); err != nil {
+			log.Warn().Msgf("ClickHouse schema is not added to the dump: %v", err)
+		}
 	}
+
 	return &Source{
-		cfg:  cfg,
-		db:   db,
-		tx:   tx,
-		ct:   ct,
-		stmt: stmt,
+		cfg:    cfg,
+		db:     db,
+		tables: tables,
+		schema: schema,
 	}, nil
 }
 
-func columnTypes(db *sql.DB) ([]*sql.ColumnType, error) {
-	rows, err := db.Query("SELECT * FROM metrics LIMIT 1")
-	if err != nil {
-		return nil, err
+func (s Source) Type() dump.SourceType {
+	return dump.ClickHouse
+}
+
+// ImportOrder requires sequential import: rows of all table chunks are inserted in a single batch.
+// The order of rows doesn't matter for ClickHouse, but the batch statement can't be shared by concurrent writers
+func (s Source) ImportOrder() dump.ImportOrder {
+	return dump.ImportInOrder
+}
+
+// Meta describes the data exported by the source
+func (s Source) Meta() dump.SourceMeta {
+	tables := make([]string, 0, len(s.tables))
+	for _, t := range s.tables {
+		tables = append(tables, t.name)
+	}
+	m := dump.SourceMeta{
+		Type:    dump.ClickHouse.String(),
+		Where:   s.cfg.Where,
+		Tables:  tables,
+		Columns: s.cfg.Columns,
+		Schema:  s.schema,
 	}
-	return rows.ColumnTypes()
+	if s.cfg.Aggregate > 0 {
+		m.Aggregation = s.cfg.Aggregate.String()
+	}
+	return m
 }
 
-func (s Source) Type() dump.SourceType {
-	return dump.ClickHouse
+func (s Source) table(name string) (*table, bool) {
+	for _, t := range s.tables {
+		if t.name == name {
+			return t, true
+		}
+	}
+	return nil, false
 }
 
-func (s Source) ReadChunk(m dump.ChunkMeta) (*dump.Chunk, error) {
-	offset := m.Index * m.RowsLen
-	limit := m.RowsLen
-	query := "SELECT * FROM metrics"
+func (s Source) whereStatement(t *table, start, end *time.Time) string {
 	where := make([]string, 0, 3)
-	if s.cfg.Where != "" {
+	// user filter is written for metrics table columns
+	if s.cfg.Where != "" && t.name == MetricsTable {
 		where = append(where, fmt.Sprintf("(%s)", s.cfg.Where))
 	}
-	if m.Start != nil {
-		where = append(where, fmt.Sprintf("period_start > %d", m.Start.Unix()))
+	// ranges are half-open, so rows at the boundary of adjacent ranges are read once
+	if t.hasColumn(periodStartColumn) {
+		if start != nil {
+			where = append(where, fmt.Sprintf("period_start >= %d", start.Unix()))
+		}
+		if end != nil {
+			where = append(where, fmt.Sprintf("period_start < %d", end.Unix()))
+		}
+	}
+	if len(where) == 0 {
+		return ""
 	}
-	if m.End != nil {
-		where = append(where, fmt.Sprintf("period_start < %d", m.End.Unix()))
+	return " WHERE " + strings.Join(where, " AND ")
+}
+
+func (s Source) ReadChunk(m dump.ChunkMeta) (*dump.Chunk, error) {
+	tableName := m.Table
+	if tableName == "" {
+		tableName = MetricsTable
 	}
-	for i := range where {
-		if i == 0 {
-			query += " WHERE "
-		} else {
-			query += " AND "
-		}
-		query += where[i]
+	t, ok := s.table(tableName)
+	if !ok {
+		return nil, errors.Errorf("unknown table: %s", tableName)
 	}
-	query += fmt.Sprintf(" ORDER BY period_start, queryid LIMIT %d OFFSET %d", limit, offset)
-	rows, err := s.db.Query(query)
+
+	offset := m.Index * m.RowsLen
+	limit := m.RowsLen
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(t.columns, ", "), t.name)
+	query += s.whereStatement(t, m.Start, m.End)
+	if t.aggregation != nil {
+		query = t.aggregation.selectQuery(t.name, s.whereStatement(t, m.Start, m.End))
+	}
+	if t.orderBy != "" {
+		query += " ORDER BY " + t.orderBy
+	}
+	query += fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
+	ctx, queryID := taggedContext()
+	rows, err := s.db.QueryContext(ctx, query)
 	if err != nil {
-		return nil, err
+		return nil, queryError(err, queryID)
 	}
 	defer func(rows *sql.Rows) {
 		_ = rows.Close()
@@ -115,6 +180,14 @@ func (s Source) ReadChunk(m dump.ChunkMeta) (*dump.Chunk, error) {
 	}
 	buf := new(bytes.Buffer)
 	writer := tsv.NewWriter(buf)
+	// aggregated columns are selected by expressions, while header should have column names
+	if t.aggregation != nil {
+		columns = t.columns
+	}
+	// header allows to import chunks having only a subset of columns
+	if err := writer.Write(columns); err != nil {
+		return nil, err
+	}
 	for rows.Next() {
 		if err := rows.Scan(values...); err != nil {
 			return nil, err
@@ -135,7 +208,8 @@ func (s Source) ReadChunk(m dump.ChunkMeta) (*dump.Chunk, error) {
 	return &dump.Chunk{
 		ChunkMeta: m,
 		Content:   buf.Bytes(),
-		Filename:  fmt.Sprintf("%d.tsv", m.Index),
+		Filename:  chunkFilename(t.name, m.Index),
+		Encoding:  dump.EncodingCHTSV,
 	}, err
 }
 
@@ -152,50 +226,183 @@ func toStringSlice(iSlice []interface{}) []string {
 	return values
 }
 
-func (s Source) WriteChunk(_ string, r io.Reader) error {
+// WriteEncodings returns encodings of the chunks written to ClickHouse, rows are parsed from TSV only
+func (s *Source) WriteEncodings() []dump.ChunkEncoding {
+	return []dump.ChunkEncoding{dump.EncodingCHTSV}
+}
+
+// EmptyChunk reports if the chunk has no rows: it's empty or has the header only
+func (s *Source) EmptyChunk(filename string, _ dump.ChunkEncoding, content []byte) bool {
+	if len(bytes.TrimSpace(content)) == 0 {
+		return true
+	}
+	t, ok := s.table(parseChunkTable(filename))
+	if !ok {
+		return false
+	}
+
+	reader := tsv.NewReader(bytes.NewReader(content))
+	records, err := reader.Reader.Read()
+	if err != nil {
+		return false
+	}
+	// chunks exported by older versions have no header, so their first line is a row
+	if _, ok = t.parseHeader(records); !ok {
+		return false
+	}
+	_, err = reader.Reader.Read()
+	return err == io.EOF
+}
+
+// WriteEncodedChunk writes the chunk of supported encoding
+func (s *Source) WriteEncodedChunk(filename string, e dump.ChunkEncoding, r io.Reader) error {
+	if e != dump.EncodingCHTSV {
+		return errors.Errorf("unsupported chunk encoding: %s", e)
+	}
+	return s.WriteChunk(filename, r)
+}
+
+func (s *Source) WriteChunk(filename string, r io.Reader) error {
+	_, err := s.writeChunk(filename, r, nil)
+	return err
+}
+
+// WriteBatchedChunk writes the chunk rows into the insert batch of its table, the chunk is reported
+// when the batch is committed. Chunks of undetermined encoding are written as TSV
+func (s *Source) WriteBatchedChunk(filename string, e dump.ChunkEncoding, r io.Reader, report dump.BatchReport) (bool, error) {
+	if e != dump.EncodingCHTSV && e != dump.EncodingUndetermined {
+		return false, errors.Errorf("unsupported chunk encoding: %s", e)
+	}
+	return s.writeChunk(filename, r, report)
+}
+
+func (s *Source) writeChunk(filename string, r io.Reader, report dump.BatchReport) (bool, error) {
+	tableName := parseChunkTable(filename)
+	t, ok := s.table(tableName)
+	if !ok {
+		log.Warn().Msgf("Found dump data for %s table, but it's not specified - skipped", tableName)
+		return false, nil
+	}
+
 	reader := tsv.NewReader(r)
 
+	records, err := reader.Reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+
+	ct := t.ct
+	var columns []string
+	if header, ok := t.parseHeader(records); ok {
+		// chunks exported by older versions have no header and contain all columns
+		columns, ct = records, header
+		records = nil
+	}
+
+	originIdx := -1
+	if f := s.cfg.Filter; f != nil {
+		for i, c := range ct {
+			if c.Name() == f.Column {
+				originIdx = i
+			}
+		}
+		if originIdx < 0 {
+			return false, errors.Errorf("origin column %s is missing in the chunk", f.Column)
+		}
+	}
+
+	// rows are parsed before insert, so a malformed chunk doesn't leave a part of its rows in the batch
+	var rows [][]interface{}
 	for {
-		records, err := reader.Read(s.ColumnTypes())
+		if records != nil && (originIdx < 0 || (originIdx < len(records) && s.cfg.Filter.Match(records[originIdx]))) {
+			s.remapRecords(records, ct)
+			values, err := tsv.ParseRecords(records, ct)
+			if err != nil {
+				return false, err
+			}
+			rows = append(rows, values)
+		}
+
+		records, err = reader.Reader.Read()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return err
+			return false, err
 		}
-		_, err = s.stmt.Exec(records...)
-		if err != nil {
-			return err
+	}
+
+	if s.cfg.PartitionOrder {
+		t.addPending(columns, ct, rows, report)
+		if t.pendingFull(s.cfg.InsertBatchRows, s.cfg.InsertFlushInterval) {
+			if err = t.flushPending(s.db); err != nil {
+				return false, errors.Wrapf(err, "failed to insert %s table rows", t.name)
+			}
 		}
+		return report != nil, nil
 	}
 
-	return nil
-}
+	if err = t.prepareInsert(s.db, columns, len(ct)); err != nil {
+		return false, err
+	}
 
-func prepareInsertStatement(tx *sql.Tx, columnsCount int) (*sql.Stmt, error) {
-	var query strings.Builder
+	for _, values := range rows {
+		if _, err = t.stmt.Exec(values...); err != nil {
+			// the chunk is retried in a new batch, rows of other chunks of the batch are reported failed
+			t.rollback(err)
+			return false, err
+		}
+	}
+	t.batchRows += len(rows)
+	t.chunks = append(t.chunks, report)
 
-	query.Grow(28 + columnsCount*2)
-	query.WriteString("INSERT INTO metrics VALUES (")
-	for i := 0; i < columnsCount-1; i++ {
-		query.WriteString("?,")
+	if t.batchFull(s.cfg.InsertBatchRows, s.cfg.InsertFlushInterval) {
+		log.Debug().Msgf("Committing %d rows of %s table", t.batchRows, t.name)
+		if err = t.commit(); err != nil {
+			return false, errors.Wrapf(err, "failed to commit %s table writes", t.name)
+		}
 	}
-	query.WriteString("?)")
-	return tx.Prepare(query.String())
+
+	return report != nil, nil
 }
 
-func (s Source) FinalizeWrites() error {
-	if err := s.stmt.Close(); err != nil {
-		return err
+func (s Source) remapRecords(records []string, ct []*sql.ColumnType) {
+	if len(s.cfg.Remapping) == 0 {
+		return
+	}
+	for i, c := range ct {
+		if v, ok := s.cfg.Remapping.Apply(c.Name(), records[i]); ok {
+			records[i] = v
+		}
 	}
-	return s.tx.Commit()
 }
 
-func (s Source) Count(where string) (int, error) {
+func (s *Source) FinalizeWrites() error {
+	return s.FlushBatches()
+}
+
+// FlushBatches inserts pending rows and commits insert batches of all tables. Errors are reported to the chunks,
+// they are returned only if some chunks of the failed batch have no report
+func (s *Source) FlushBatches() error {
+	for _, t := range s.tables {
+		if err := t.flushPending(s.db); err != nil {
+			return errors.Wrapf(err, "failed to insert %s table rows", t.name)
+		}
+		if err := t.commit(); err != nil {
+			return errors.Wrapf(err, "failed to commit %s table writes", t.name)
+		}
+	}
+	return nil
+}
+
+func (s Source) count(t *table, start, end *time.Time) (int, error) {
 	var count int
-	query := "SELECT COUNT(*) FROM metrics"
-	if where != "" {
-		query += fmt.Sprintf(" WHERE %s", where)
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s", t.name) + s.whereStatement(t, start, end)
+	if t.aggregation != nil {
+		query = t.aggregation.countQuery(t.name, s.whereStatement(t, start, end))
 	}
 	row := s.db.QueryRow(query)
 	if err := row.Scan(&count); err != nil {
@@ -204,42 +411,92 @@ func (s Source) Count(where string) (int, error) {
 	return count, nil
 }
 
-func (s Source) ColumnTypes() []*sql.ColumnType {
-	return s.ct
-}
-
 func (s Source) SplitIntoChunks(startTime, endTime time.Time, chunkRowsLen int) ([]dump.ChunkMeta, error) {
 	if chunkRowsLen <= 0 {
 		return nil, errors.Errorf("invalid chunk rows len: %v", chunkRowsLen)
 	}
 
-	totalRows, err := s.Count(s.cfg.Where)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to get amount of ClickHouse records")
-	}
+	var chunks []dump.ChunkMeta
+	for _, t := range s.tables {
+		totalRows, err := s.count(t, &startTime, &endTime)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get amount of ClickHouse records in %s", t.name)
+		}
 
-	rowsCounter := totalRows
-	chunksLen := rowsCounter/chunkRowsLen + 1
-	chunks := make([]dump.ChunkMeta, 0, chunksLen)
-	i := 0
-	for rowsCounter > 0 {
-		newChunk := dump.ChunkMeta{
-			Source:  dump.ClickHouse,
-			RowsLen: chunkRowsLen,
-			Index:   i,
-			Start:   &startTime,
-			End:     &endTime,
+		rowsCounter := totalRows
+		i := 0
+		for rowsCounter > 0 {
+			newChunk := dump.ChunkMeta{
+				Source:  dump.ClickHouse,
+				Table:   t.name,
+				RowsLen: chunkRowsLen,
+				Index:   i,
+				Start:   &startTime,
+				End:     &endTime,
+			}
+			chunks = append(chunks, newChunk)
+			rowsCounter -= chunkRowsLen
+			i++
 		}
-		chunks = append(chunks, newChunk)
-		rowsCounter -= chunkRowsLen
-		i++
-	}
 
-	log.Debug().
-		Int("rows", totalRows).
-		Int("chunk_size", chunkRowsLen).
-		Int("chunks", len(chunks)).
-		Msg("Split Click House rows into chunks")
+		log.Debug().
+			Str("table", t.name).
+			Int("rows", totalRows).
+			Int("chunk_size", chunkRowsLen).
+			Int("chunks", i).
+			Msg("Split Click House rows into chunks")
+	}
 
 	return chunks, nil
 }
+
+// OldestPeriodStart returns the oldest period start in metrics table, or zero time if it's empty
+func (s Source) OldestPeriodStart() (time.Time, error) {
+	t, ok := s.table(MetricsTable)
+	if !ok || !t.hasColumn(periodStartColumn) {
+		return time.Time{}, nil
+	}
+
+	var count int
+	var oldest time.Time
+	query := fmt.Sprintf("SELECT COUNT(*), min(%s) FROM %s", periodStartColumn, t.name) + s.whereStatement(t, nil, nil)
+	if err := s.db.QueryRow(query).Scan(&count, &oldest); err != nil {
+		return time.Time{}, err
+	}
+	if count == 0 {
+		return time.Time{}, nil
+	}
+	return oldest.UTC(), nil
+}
+
+// Columns returns names of the table columns
+func (s Source) Columns(tableName string) ([]string, bool) {
+	t, ok := s.table(tableName)
+	if !ok {
+		return nil, false
+	}
+	columns := make([]string, 0, len(t.ct))
+	for _, c := range t.ct {
+		columns = append(columns, c.Name())
+	}
+	return columns, true
+}
+
+// taggedContext returns context with the next request ID as query ID, so the query can be found in the server query log
+func taggedContext() (context.Context, string) {
+	ctx := context.Background()
+	id := requestid.Next()
+	if id != "" {
+		ctx = clickhouse.WithQueryID(ctx, id)
+		log.Debug().Msgf("Query ID: %s", id)
+	}
+	return ctx, id
+}
+
+// queryError adds query ID to the query failure
+func queryError(err error, queryID string) error {
+	if queryID == "" {
+		return err
+	}
+	return errors.Wrapf(err, "query %s failed", queryID)
+}
@@ -0,0 +1,455 @@
+package clickhouse
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"pmm-transferer/pkg/clickhouse/tsv"
+	"pmm-transferer/pkg/dump"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	MetricsTable = "metrics"
+
+	periodStartColumn = "period_start"
+
+	// defaultPendingRows limits rows kept in memory for partition order inserts, if batch rows are not set
+	defaultPendingRows = 100000
+)
+
+type table struct {
+	name    string
+	ct      []*sql.ColumnType
+	orderBy string
+	// columns to be exported
+	columns []string
+	// aggregation is set when metrics table rows are aggregated on export
+	aggregation *aggregation
+
+	tx   *sql.Tx
+	stmt *sql.Stmt
+	// rows inserted in the current batch and the batch start time
+	batchRows    int
+	batchStarted time.Time
+	// chunks with rows in the current batch, reported on commit or rollback. Chunks written without report are nil
+	chunks []dump.BatchReport
+
+	// pending are rows of the batch by partition, inserted partition by partition on flush, see Config.PartitionOrder
+	pending        map[string][][]interface{}
+	pendingColumns []string
+	pendingCount   int
+	pendingChunks  []pendingChunk
+}
+
+// pendingChunk is the chunk with pending rows and the partitions of its rows
+type pendingChunk struct {
+	report     dump.BatchReport
+	partitions []string
+}
+
+func newTable(db *sql.DB, name string, excludedColumns, projection []string) (*table, error) {
+	ct, err := columnTypes(db, name)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &table{
+		name:    name,
+		ct:      ct,
+		columns: selectColumns(ct, excludedColumns),
+	}
+
+	if len(projection) != 0 {
+		columns := make([]string, 0, len(projection))
+		for _, c := range projection {
+			if !t.hasColumn(c) {
+				return nil, errors.Errorf("unknown column: %s", c)
+			}
+			if contains(t.columns, c) {
+				columns = append(columns, c)
+			}
+		}
+		t.columns = columns
+	}
+
+	if name == MetricsTable {
+		t.orderBy = "period_start, queryid"
+	} else if t.orderBy, err = sortingKey(db, name, t.columns); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func columnTypes(db *sql.DB, table string) ([]*sql.ColumnType, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT * FROM %s LIMIT 1", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return rows.ColumnTypes()
+}
+
+// sortingKey returns table sorting key to get stable order of rows while reading table by chunks.
+// Tables without sorting key (e.g. ORDER BY tuple() or Log engines) are ordered by primary key, or by all columns
+func sortingKey(db *sql.DB, table string, columns []string) (string, error) {
+	var sortingKey, primaryKey string
+	row := db.QueryRow("SELECT sorting_key, primary_key FROM system.tables WHERE database = currentDatabase() AND name = ?", table)
+	if err := row.Scan(&sortingKey, &primaryKey); err != nil {
+		return "", errors.Wrap(err, "failed to get sorting key")
+	}
+	switch {
+	case sortingKey != "":
+		return sortingKey, nil
+	case primaryKey != "":
+		return primaryKey, nil
+	default:
+		return strings.Join(columns, ", "), nil
+	}
+}
+
+func selectColumns(ct []*sql.ColumnType, excluded []string) []string {
+	columns := make([]string, 0, len(ct))
+	for _, c := range ct {
+		if !contains(excluded, c.Name()) {
+			columns = append(columns, c.Name())
+		}
+	}
+	return columns
+}
+
+func contains(list []string, v string) bool {
+	for _, e := range list {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *table) hasColumn(name string) bool {
+	_, ok := t.columnType(name)
+	return ok
+}
+
+func (t *table) columnType(name string) (*sql.ColumnType, bool) {
+	for _, c := range t.ct {
+		if c.Name() == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// parseHeader returns column types for the header, if records is a header
+func (t *table) parseHeader(records []string) ([]*sql.ColumnType, bool) {
+	ct := make([]*sql.ColumnType, 0, len(records))
+	for _, name := range records {
+		c, ok := t.columnType(name)
+		if !ok {
+			return nil, false
+		}
+		ct = append(ct, c)
+	}
+	return ct, true
+}
+
+// prepareInsert starts a transaction for the table on the first write: table inserts are sent in a single batch until commit
+func (t *table) prepareInsert(db *sql.DB, columns []string, columnsCount int) error {
+	if t.stmt != nil {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var query strings.Builder
+
+	query.WriteString("INSERT INTO " + t.name + " ")
+	if len(columns) != 0 {
+		query.WriteString("(" + strings.Join(columns, ", ") + ") ")
+	}
+	query.WriteString("VALUES (")
+	for i := 0; i < columnsCount-1; i++ {
+		query.WriteString("?,")
+	}
+	query.WriteString("?)")
+
+	ctx, queryID := taggedContext()
+	stmt, err := tx.PrepareContext(ctx, query.String())
+	if err != nil {
+		_ = tx.Rollback()
+		return queryError(err, queryID)
+	}
+
+	t.tx, t.stmt = tx, stmt
+	t.batchRows, t.batchStarted = 0, time.Now()
+	return nil
+}
+
+// batchFull reports if the current insert batch should be committed
+func (t *table) batchFull(maxRows int, flushInterval time.Duration) bool {
+	if t.tx == nil {
+		return false
+	}
+	return (maxRows > 0 && t.batchRows >= maxRows) || (flushInterval > 0 && time.Since(t.batchStarted) >= flushInterval)
+}
+
+// commit commits the current batch and reports its chunks. The error is returned only if it's not reported
+// to all chunks of the batch
+func (t *table) commit() error {
+	if t.tx == nil {
+		return nil
+	}
+	err := t.stmt.Close()
+	if err == nil {
+		err = t.tx.Commit()
+	} else {
+		_ = t.tx.Rollback()
+	}
+	t.tx, t.stmt = nil, nil
+	return t.reportChunks(err)
+}
+
+// rollback drops rows of the current batch and reports its chunks failed: rows of a chunk failed to be inserted
+// can't be removed from the batch, so they would be inserted again when the chunk is retried
+func (t *table) rollback(err error) {
+	_ = t.tx.Rollback()
+	t.tx, t.stmt = nil, nil
+	_ = t.reportChunks(err)
+}
+
+func (t *table) reportChunks(err error) error {
+	chunks := t.chunks
+	t.chunks = nil
+	if len(chunks) == 0 {
+		return err
+	}
+	var unreported bool
+	for _, report := range chunks {
+		if report == nil {
+			unreported = true
+			continue
+		}
+		report(err)
+	}
+	if unreported {
+		return err
+	}
+	return nil
+}
+
+// partitionKey returns the day of period start the table is partitioned by, or empty key if the row has no period start
+func partitionKey(ct []*sql.ColumnType, values []interface{}) string {
+	for i, c := range ct {
+		if c.Name() != periodStartColumn {
+			continue
+		}
+		if ts, ok := values[i].(time.Time); ok {
+			return ts.UTC().Format("2006-01-02")
+		}
+	}
+	return ""
+}
+
+// addPending adds rows of the chunk to the batch, grouped by partition
+func (t *table) addPending(columns []string, ct []*sql.ColumnType, rows [][]interface{}, report dump.BatchReport) {
+	if t.pending == nil {
+		t.pending = make(map[string][][]interface{})
+		t.pendingColumns = columns
+		t.batchRows, t.batchStarted = 0, time.Now()
+	}
+	c := pendingChunk{report: report}
+	for _, values := range rows {
+		key := partitionKey(ct, values)
+		if !contains(c.partitions, key) {
+			c.partitions = append(c.partitions, key)
+		}
+		t.pending[key] = append(t.pending[key], values)
+	}
+	t.pendingChunks = append(t.pendingChunks, c)
+	t.pendingCount = len(ct)
+	t.batchRows += len(rows)
+}
+
+// pendingFull reports if the pending rows should be flushed. Unlike rows of an open transaction, pending rows
+// are kept in memory, so they are flushed every defaultPendingRows rows if batch rows are not set
+func (t *table) pendingFull(maxRows int, flushInterval time.Duration) bool {
+	if t.pending == nil {
+		return false
+	}
+	if maxRows <= 0 {
+		maxRows = defaultPendingRows
+	}
+	return (maxRows > 0 && t.batchRows >= maxRows) || (flushInterval > 0 && time.Since(t.batchStarted) >= flushInterval)
+}
+
+// flushPending inserts pending rows partition by partition in period order, committing each partition separately,
+// so each insert creates a single part instead of a part in every partition of the batch. Rows of a failed partition
+// are dropped and the chunks with rows in it are reported failed, so they are inserted again only if retried.
+// The error is returned only if it's not reported to all chunks of the failed partitions
+func (t *table) flushPending(db *sql.DB) error {
+	if t.pending == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(t.pending))
+	for k := range t.pending {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	failed := make(map[string]error)
+	var firstErr error
+	inserted := 0
+	for _, k := range keys {
+		if err := t.insertPartition(db, t.pending[k]); err != nil {
+			failed[k] = err
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		inserted += len(t.pending[k])
+	}
+	log.Debug().Msgf("Inserted %d rows of %s table into %d partitions", inserted, t.name, len(keys)-len(failed))
+
+	chunks := t.pendingChunks
+	t.pending, t.pendingColumns, t.pendingChunks, t.batchRows = nil, nil, nil, 0
+
+	unreported := len(chunks) == 0
+	for _, c := range chunks {
+		var err error
+		for _, k := range c.partitions {
+			if err = failed[k]; err != nil {
+				break
+			}
+		}
+		if c.report == nil {
+			unreported = unreported || err != nil
+			continue
+		}
+		c.report(err)
+	}
+	if unreported {
+		return firstErr
+	}
+	return nil
+}
+
+// insertPartition inserts and commits pending rows of a partition, rows are rolled back on error
+func (t *table) insertPartition(db *sql.DB, rows [][]interface{}) error {
+	if err := t.prepareInsert(db, t.pendingColumns, t.pendingCount); err != nil {
+		return err
+	}
+	for _, values := range rows {
+		if _, err := t.stmt.Exec(values...); err != nil {
+			t.rollback(err)
+			return err
+		}
+	}
+	return t.commit()
+}
+
+func chunkFilename(table string, index int) string {
+	return fmt.Sprintf("%s.%d.tsv", table, index)
+}
+
+// parseChunkTable returns table name of the chunk file. Chunks exported by older versions contain metrics table only
+func parseChunkTable(filename string) string {
+	parts := strings.Split(filename, ".")
+	if len(parts) == 3 {
+		if _, err := strconv.Atoi(parts[1]); err == nil {
+			return parts[0]
+		}
+	}
+	return MetricsTable
+}
+
+// ChunkColumns returns table name and column names of the dump chunk. Chunks exported by older versions
+// have no header, so no columns are returned for them
+func ChunkColumns(filename string, r io.Reader) (string, []string, error) {
+	records, err := tsv.NewReader(r).Reader.Read()
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	table := parseChunkTable(filename)
+	for _, name := range records {
+		// header consists of column names only, which are valid identifiers
+		if !isIdentifier(name) {
+			return table, nil, nil
+		}
+	}
+	return table, records, nil
+}
+
+// ChunkColumnSets returns distinct sets of the columns values of the metrics table chunk rows.
+// Chunks of other tables and chunks without header have no sets, empty values are skipped
+func ChunkColumnSets(filename string, r io.Reader, columns []string) ([]map[string]string, error) {
+	if parseChunkTable(filename) != MetricsTable {
+		return nil, nil
+	}
+
+	reader := tsv.NewReader(r)
+	header, err := reader.Reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range header {
+		if !isIdentifier(name) {
+			return nil, nil
+		}
+	}
+
+	sets := make(map[string]map[string]string)
+	for {
+		records, err := reader.Reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		set := make(map[string]string, len(columns))
+		key := make([]string, 0, len(columns))
+		for _, c := range columns {
+			if i := indexOf(header, c); i != -1 && i < len(records) && records[i] != "" {
+				set[c] = records[i]
+			}
+			key = append(key, set[c])
+		}
+		if len(set) != 0 {
+			sets[strings.Join(key, "\xff")] = set
+		}
+	}
+
+	result := make([]map[string]string, 0, len(sets))
+	for _, set := range sets {
+		result = append(result, set)
+	}
+	return result, nil
+}
+
+func isIdentifier(v string) bool {
+	if v == "" {
+		return false
+	}
+	for i, c := range v {
+		if !(c == '_' || unicode.IsLetter(c) || (i > 0 && unicode.IsDigit(c))) {
+			return false
+		}
+	}
+	return true
+}
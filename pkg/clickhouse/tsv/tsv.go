@@ -38,6 +38,10 @@ func (r *Reader) Read(ct []*sql.ColumnType) ([]interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	return ParseRecords(records, ct)
+}
+
+func ParseRecords(records []string, ct []*sql.ColumnType) ([]interface{}, error) {
 	if len(ct) != len(records) {
 		return nil, errors.New("amount of columns mismatch")
 	}
@@ -72,6 +76,11 @@ func parseSlice(slice string, st reflect.Type) (interface{}, error) {
 	return result, nil
 }
 
+// ParseTime parses time value as it's written by the exporter
+func ParseTime(record string) (time.Time, error) {
+	return time.Parse("2006-01-02 15:04:05 -0700 UTC", record)
+}
+
 func parseElement(record string, st reflect.Type) (value interface{}, err error) {
 	switch st.Kind() {
 	case reflect.Slice:
@@ -141,7 +150,7 @@ func parseElement(record string, st reflect.Type) (value interface{}, err error)
 	default:
 		switch st.Name() {
 		case "Time":
-			value, err = time.Parse("2006-01-02 15:04:05 -0700 UTC", record)
+			value, err = ParseTime(record)
 			if err != nil {
 				return nil, err
 			}
@@ -0,0 +1,232 @@
+package download
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	partFileSuffix       = ".part"
+	checkpointFileSuffix = ".download"
+
+	// downloaded data is synced to disk and checkpointed every checkpointSize bytes
+	checkpointSize = 64 * 1024 * 1024
+
+	maxAttempts = 10
+)
+
+// IsURL reports if the dump path is HTTP(S) URL, e.g. S3 presigned URL
+func IsURL(p string) bool {
+	return strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://")
+}
+
+// Filename returns local file name for the dump URL
+func Filename(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse URL")
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return "", errors.Errorf("failed to get file name from URL: %s", rawURL)
+	}
+	return name, nil
+}
+
+type checkpoint struct {
+	URL    string `json:"url"`
+	ETag   string `json:"etag,omitempty"`
+	Offset int64  `json:"offset"`
+}
+
+// RequestSigner adds authentication to the download requests, e.g. S3 signature
+type RequestSigner func(req *http.Request) error
+
+type Downloader struct {
+	c    *http.Client
+	sign RequestSigner
+}
+
+// New returns downloader, sign may be nil for presigned and public URLs
+func New(insecureSkipVerify bool, sign RequestSigner) *Downloader {
+	return &Downloader{
+		sign: sign,
+		c: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSkipVerify},
+			},
+		},
+	}
+}
+
+// Download saves the file by URL to dst using ranged requests. Downloaded offset is checkpointed, so both
+// dropped connection and restarted download continue from the last synced offset
+func (d Downloader) Download(ctx context.Context, rawURL, dst string) error {
+	partPath, checkpointPath := dst+partFileSuffix, dst+checkpointFileSuffix
+
+	cp, err := readCheckpoint(checkpointPath, rawURL)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+	defer file.Close()
+
+	// data after the checkpoint may be not synced, so it's downloaded again
+	if err = file.Truncate(cp.Offset); err != nil {
+		return errors.Wrap(err, "failed to truncate file")
+	}
+	if cp.Offset > 0 {
+		log.Info().Msgf("Resuming download from %d bytes offset", cp.Offset)
+	}
+
+	attempts := 0
+	for {
+		offset := cp.Offset
+		done, err := d.downloadRange(ctx, file, cp, checkpointPath)
+		if done {
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// attempts are counted in a row without progress, so long downloads over flaky connections are not aborted
+		if cp.Offset > offset {
+			attempts = 0
+		}
+		attempts++
+		if attempts >= maxAttempts {
+			return errors.Wrapf(err, "failed to download after %d attempts", attempts)
+		}
+		log.Warn().Err(err).Msgf("Download interrupted at %d bytes, resuming (%d/%d)...", cp.Offset, attempts, maxAttempts)
+		time.Sleep(time.Duration(attempts) * time.Second)
+	}
+
+	if err = file.Close(); err != nil {
+		return errors.Wrap(err, "failed to close file")
+	}
+	if err = os.Rename(partPath, dst); err != nil {
+		return errors.Wrap(err, "failed to rename downloaded file")
+	}
+	if err = os.Remove(checkpointPath); err != nil && !os.IsNotExist(err) {
+		log.Warn().Err(err).Msg("Failed to remove download checkpoint file")
+	}
+
+	log.Info().Msgf("Successfully downloaded %s (%d bytes)", dst, cp.Offset)
+
+	return nil
+}
+
+// downloadRange downloads the file from the checkpoint offset and returns true when the file is complete
+func (d Downloader) downloadRange(ctx context.Context, file *os.File, cp *checkpoint, checkpointPath string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cp.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	if cp.Offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", cp.Offset))
+		if cp.ETag != "" {
+			// file is sent from the beginning if it has been changed
+			req.Header.Set("If-Range", cp.ETag)
+		}
+	}
+	if d.sign != nil {
+		if err = d.sign(req); err != nil {
+			return false, errors.Wrap(err, "failed to sign request")
+		}
+	}
+
+	resp, err := d.c.Do(req)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to send HTTP request")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if cp.Offset > 0 {
+			log.Warn().Msg("Server doesn't support ranged requests or file was changed: downloading from the beginning")
+			if err = file.Truncate(0); err != nil {
+				return false, errors.Wrap(err, "failed to truncate file")
+			}
+			cp.Offset = 0
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// checkpoint is at the end of the file
+		return true, nil
+	default:
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return false, errors.Errorf("non-OK response: %d: %s", resp.StatusCode, string(body))
+	}
+	cp.ETag = resp.Header.Get("ETag")
+
+	if _, err = file.Seek(cp.Offset, io.SeekStart); err != nil {
+		return false, errors.Wrap(err, "failed to seek file")
+	}
+
+	for {
+		n, err := io.CopyN(file, resp.Body, checkpointSize)
+		if n > 0 {
+			if syncErr := file.Sync(); syncErr != nil {
+				return false, errors.Wrap(syncErr, "failed to sync file")
+			}
+			cp.Offset += n
+			if cpErr := writeCheckpoint(checkpointPath, cp); cpErr != nil {
+				return false, cpErr
+			}
+			log.Info().Msgf("Downloaded %d bytes", cp.Offset)
+		}
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, errors.Wrap(err, "failed to download file")
+		}
+	}
+}
+
+func readCheckpoint(checkpointPath, rawURL string) (*checkpoint, error) {
+	data, err := ioutil.ReadFile(checkpointPath)
+	if os.IsNotExist(err) {
+		return &checkpoint{URL: rawURL}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read download checkpoint")
+	}
+
+	cp := new(checkpoint)
+	if err = json.Unmarshal(data, cp); err != nil || cp.URL != rawURL {
+		log.Warn().Msg("Download checkpoint is invalid or belongs to another URL: downloading from the beginning")
+		return &checkpoint{URL: rawURL}, nil
+	}
+	return cp, nil
+}
+
+func writeCheckpoint(checkpointPath string, cp *checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(checkpointPath, data, 0600); err != nil {
+		return errors.Wrap(err, "failed to write download checkpoint")
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package dump
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ChecksumSuffix is the suffix of the checksum file written next to the dump
+const ChecksumSuffix = ".sha256"
+
+// FileChecksum returns hex SHA-256 sum of the file
+func FileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// WriteChecksumFile writes SHA-256 sum of the dump to the checksum file next to it and returns the sum.
+// The file has sha256sum format, so it can be checked by `sha256sum -c` too
+func WriteChecksumFile(path string) (string, error) {
+	sum, err := FileChecksum(path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to compute dump checksum")
+	}
+	line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(path))
+	if err = ioutil.WriteFile(path+ChecksumSuffix, []byte(line), 0644); err != nil {
+		return "", errors.Wrap(err, "failed to write checksum file")
+	}
+	return sum, nil
+}
+
+// VerifyChecksumFile checks the dump against its checksum file. It returns error satisfying os.IsNotExist
+// if there is no checksum file
+func VerifyChecksumFile(path string) error {
+	data, err := ioutil.ReadFile(path + ChecksumSuffix)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return errors.Errorf("checksum file %s is empty", path+ChecksumSuffix)
+	}
+	expected := strings.ToLower(fields[0])
+
+	sum, err := FileChecksum(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to compute dump checksum")
+	}
+	if sum != expected {
+		return errors.Errorf("checksum mismatch of %s: expected %s, got %s", path, expected, sum)
+	}
+	return nil
+}
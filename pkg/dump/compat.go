@@ -0,0 +1,55 @@
+package dump
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+)
+
+// ForeignTool is the name of Percona dump tool, which dumps are imported too
+const ForeignTool = "pmm-dump"
+
+// sourceDirAliases are source directories named by other dump tools or their versions
+var sourceDirAliases = map[string]SourceType{
+	"victoriametrics": VictoriaMetrics,
+	"clickhouse":      ClickHouse,
+}
+
+// EntrySourceType returns source of the dump entry by its directory. Entries may be nested into the top directory
+// of the archive, e.g. when a dump directory was archived by tar, and source directories may be named by other tools
+func EntrySourceType(dir string) SourceType {
+	dir = strings.Trim(dir, "/")
+	if dir == "" {
+		return UndefinedSource
+	}
+	name := path.Base(dir)
+	if st, ok := sourceDirAliases[name]; ok {
+		return st
+	}
+	return ParseSourceType(name)
+}
+
+// foreignMeta are meta fields of pmm-dump, which are named differently or missing in Meta
+type foreignMeta struct {
+	MaxChunkSize int64   `json:"max-chunk-size"`
+	PMMTimezone  *string `json:"pmm-timezone"`
+	Arguments    *string `json:"arguments"`
+}
+
+// ParseMeta parses meta of the dump and maps fields of pmm-dump meta onto it.
+// It returns name of the tool produced the dump, if it's not the transferer
+func ParseMeta(data []byte) (*Meta, string, error) {
+	m := new(Meta)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, "", err
+	}
+
+	var f foreignMeta
+	if err := json.Unmarshal(data, &f); err != nil || (f.MaxChunkSize == 0 && f.PMMTimezone == nil && f.Arguments == nil) {
+		return m, "", nil
+	}
+	if m.MaxChunkSize == 0 {
+		m.MaxChunkSize = f.MaxChunkSize
+	}
+	return m, ForeignTool, nil
+}
@@ -1,8 +1,12 @@
 package dump
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,12 +15,124 @@ import (
 
 const (
 	MetaFilename = "meta.json"
+
+	// MetaSchemaVersion is incremented on incompatible meta changes. Dumps created before versioning have 0
+	MetaSchemaVersion = 1
 )
 
+// Meta is described by JSON schema in docs/meta.schema.json
 type Meta struct {
+	// ID is unique for each dump, while volumes of the same dump share it
+	ID string `json:"id,omitempty"`
+	// ParentID is ID of the dump this one is derived from
+	ParentID         string            `json:"parent_id,omitempty"`
+	SchemaVersion    int               `json:"schema_version"`
 	Version          TransfererVersion `json:"version"`
 	PMMServerVersion string            `json:"pmm-server-version"`
+	PMMServer        string            `json:"pmm-server,omitempty"`
 	MaxChunkSize     int64             `json:"max_chunk_size"`
+	DroppedMetrics   []DroppedMetric   `json:"dropped_metrics,omitempty"`
+	// Range is the time range requested for export
+	Range *TimeRange `json:"range,omitempty"`
+	// Consistent is set when all chunks were read up to the same read point, see Range end
+	Consistent bool `json:"consistent,omitempty"`
+	// Partial is set when export was aborted: dump contains only chunks written before the abort
+	Partial bool `json:"partial,omitempty"`
+	// CoveredRange of the partial dump ends at the first chunk missing in it, nil if no data from the start is written
+	CoveredRange *TimeRange `json:"covered_range,omitempty"`
+	// Volume and Volumes are set for multi-volume dumps only
+	Volume  int `json:"volume,omitempty"`
+	Volumes int `json:"volumes,omitempty"`
+
+	Sources []SourceMeta `json:"sources,omitempty"`
+	// Checksums are SHA-256 sums of the dump entries by entry name
+	Checksums map[string]string `json:"checksums,omitempty"`
+	// Encodings are payload encodings of the chunk entries by entry name
+	Encodings map[string]ChunkEncoding `json:"encodings,omitempty"`
+	// UserMeta is arbitrary user metadata, e.g. customer or ticket the dump is created for
+	UserMeta map[string]string `json:"user_meta,omitempty"`
+	// EmptyChunks are entry names of the chunks without data, which are not written to the dump
+	EmptyChunks []string `json:"empty_chunks,omitempty"`
+	// SkippedChunks are chunks requested for export, while dropped by transformation or failed to be read
+	SkippedChunks []SkippedChunk `json:"skipped_chunks,omitempty"`
+}
+
+var idRegex = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// NewID returns random (version 4) UUID for the dump
+func NewID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// ValidID reports if id has UUID format
+func ValidID(id string) bool {
+	return idRegex.MatchString(id)
+}
+
+// SourceMeta describes data exported from the source
+type SourceMeta struct {
+	Type      string   `json:"type"`
+	Selectors []string `json:"selectors,omitempty"`
+	Where     string   `json:"where,omitempty"`
+	Tables    []string `json:"tables,omitempty"`
+	Columns   []string `json:"columns,omitempty"`
+	// Aggregation is the period QAN metrics rows are aggregated into, raw rows are exported if empty
+	Aggregation string `json:"aggregation,omitempty"`
+	// Encrypted is set when source entries are encrypted with the key of the source
+	Encrypted bool  `json:"encrypted,omitempty"`
+	Chunks    int   `json:"chunks"`
+	Size      int64 `json:"size"`
+	// Schema is DDL of the exported ClickHouse tables and materialized views reading from them
+	Schema []SchemaObject `json:"schema,omitempty"`
+}
+
+// SchemaObject is the table or view of the source schema. Query has no database qualifiers,
+// so the object is created in the database of the import target
+type SchemaObject struct {
+	Name   string `json:"name"`
+	Engine string `json:"engine"`
+	Query  string `json:"query"`
+}
+
+type TimeRange struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+const (
+	DropReasonRegex       = "regex"
+	DropReasonCardinality = "cardinality"
+	// DropReasonExcludeList is the reason of metrics matching globs of the exclude list
+	DropReasonExcludeList = "exclude-list"
+)
+
+// Reasons of the chunks skipped on export
+const (
+	SkipReasonTransform = "transform"
+	SkipReasonFailed    = "failed"
+)
+
+// SkippedChunk is the chunk requested for export, which has no entry in the dump
+type SkippedChunk struct {
+	Source string     `json:"source"`
+	Chunk  string     `json:"chunk"`
+	Table  string     `json:"table,omitempty"`
+	Range  *TimeRange `json:"range,omitempty"`
+	Reason string     `json:"reason"`
+	Error  string     `json:"error,omitempty"`
+}
+
+type DroppedMetric struct {
+	// Name is either metric name or regex which dropped metrics are matched by
+	Name   string `json:"name"`
+	Series int    `json:"series,omitempty"`
+	Reason string `json:"reason"`
 }
 
 type TransfererVersion struct {
@@ -24,16 +140,35 @@ type TransfererVersion struct {
 	GitCommit string `json:"git-commit"`
 }
 
+// NormalizeEntryName converts dump entry name to slash-separated form:
+// archives created on Windows by third-party tools may contain backslashes
+func NormalizeEntryName(name string) string {
+	return strings.ReplaceAll(name, `\`, "/")
+}
+
 type ChunkMeta struct {
 	Source SourceType
 	Start  *time.Time
 	End    *time.Time
+	// Step is set for downsampled chunks only
+	Step time.Duration
 
 	Index   int
 	RowsLen int
+	// Table is set for ClickHouse chunks only
+	Table string
+	// Name is set for external source chunks only: it's assigned by the source and used as chunk filename
+	Name string
+	// Selector narrows core metrics chunk to a subset of series, e.g. {service_name="mysql-1"}, it's set by chunk planners
+	Selector string
+	// Part tells apart narrowed chunks of the same range, it's added to the chunk filename
+	Part int
 }
 
 func (c ChunkMeta) String() string {
+	if c.Name != "" {
+		return c.Name
+	}
 	var s, e int64
 	if c.Start != nil {
 		s = c.Start.Unix()
@@ -41,13 +176,36 @@ func (c ChunkMeta) String() string {
 	if c.End != nil {
 		e = c.End.Unix()
 	}
+	if c.Part > 0 {
+		return fmt.Sprintf("%d-%d-p%d", s, e, c.Part)
+	}
 	return fmt.Sprintf("%d-%d", s, e)
 }
 
+// SortNewestFirst orders chunks by recency of their data. ClickHouse chunks of the same range
+// are read ordered by period_start, so chunks with higher index are the newer ones
+func SortNewestFirst(chunks []ChunkMeta) {
+	sort.SliceStable(chunks, func(i, j int) bool {
+		ei, ej := chunks[i].End, chunks[j].End
+		if ei != nil && ej != nil && !ei.Equal(*ej) {
+			return ei.After(*ej)
+		}
+		return chunks[i].Index > chunks[j].Index
+	})
+}
+
 type Chunk struct {
 	ChunkMeta
 	Content  []byte
 	Filename string
+	// Encoding is the payload format, it's recorded in the dump, so import picks the matching write method
+	Encoding ChunkEncoding
+	// Empty is set for chunks without samples (rows), they are recorded in the meta instead of being written
+	Empty bool
+	// Skipped is the reason the chunk isn't written, e.g. it's dropped by transformation, see Meta SkippedChunks
+	Skipped string
+	// SkipError is the read error of the chunk skipped as failed
+	SkipError string
 }
 
 type ChunkPool struct {
@@ -83,3 +241,13 @@ func (p *ChunkPool) Next() (ChunkMeta, bool) {
 
 	return m, true
 }
+
+// Len returns the total amount of chunks in the pool
+func (p *ChunkPool) Len() int {
+	return len(p.chunks)
+}
+
+// Chunks returns all chunks of the pool, including already taken ones
+func (p *ChunkPool) Chunks() []ChunkMeta {
+	return p.chunks
+}
@@ -0,0 +1,89 @@
+package dump
+
+import (
+	"io"
+	"strings"
+)
+
+// ChunkEncoding is the format of the chunk payload as the source reads and writes it, e.g. core metrics payloads
+// are gzipped by VictoriaMetrics while QAN rows are plain TSV. Compression of the dump entry is recorded
+// separately, see CodecPAXRecord
+type ChunkEncoding string
+
+const (
+	EncodingVMNative     ChunkEncoding = "vm-native"
+	EncodingVMJSONLines  ChunkEncoding = "vm-jsonl"
+	EncodingOpenMetrics  ChunkEncoding = "openmetrics"
+	EncodingCHTSV        ChunkEncoding = "ch-tsv"
+	EncodingUndetermined ChunkEncoding = ""
+)
+
+// EncodingPAXRecord is the PAX record of the dump entry header with the chunk encoding.
+// Meta is the last dump entry, so the record lets import know the encoding before the chunk is written
+const EncodingPAXRecord = "PMM.encoding"
+
+// CodecPAXRecord is the PAX record of the dump entry header with the codec the entry content is compressed with,
+// entries without it are written as read from the source
+const CodecPAXRecord = "PMM.codec"
+
+// FilenameEncoding returns encoding of the chunk by its filename, for dumps written before encodings were recorded
+func FilenameEncoding(st SourceType, filename string) ChunkEncoding {
+	switch st {
+	case VictoriaMetrics:
+		switch {
+		case strings.HasSuffix(filename, ".bin"):
+			return EncodingVMNative
+		case strings.HasSuffix(filename, ".jsonl"):
+			return EncodingVMJSONLines
+		}
+	case ClickHouse:
+		if strings.HasSuffix(filename, ".tsv") {
+			return EncodingCHTSV
+		}
+	}
+	return EncodingUndetermined
+}
+
+// EncodingWriter is implemented by sources writing chunks of several encodings,
+// the write method is chosen by the chunk encoding
+type EncodingWriter interface {
+	// WriteEncodings returns encodings the target accepts
+	WriteEncodings() []ChunkEncoding
+	WriteEncodedChunk(filename string, e ChunkEncoding, r io.Reader) error
+}
+
+// BatchWriter is implemented by targets merging chunks into batched requests, so a chunk may be sent
+// after its write returns. Batched chunks are reported once all requests with their data are sent,
+// with the error of the first failed request. Chunks of undetermined encoding are written as by WriteChunk
+type BatchWriter interface {
+	// WriteBatchedChunk writes the chunk as EncodingWriter does, it returns true if the chunk is added to a batch
+	// and is reported later
+	WriteBatchedChunk(filename string, e ChunkEncoding, r io.Reader, report BatchReport) (bool, error)
+	// FlushBatches sends partially filled batches
+	FlushBatches() error
+}
+
+// BatchReport is called with the result of sending a batched chunk
+type BatchReport func(err error)
+
+// EmptyChunkDetector is implemented by sources telling chunks without samples (rows), such chunks
+// are not written to the dump on export and not sent to the target on import
+type EmptyChunkDetector interface {
+	EmptyChunk(filename string, e ChunkEncoding, content []byte) bool
+}
+
+// IsEmptyChunk reports if the source tells the chunk has no data. Chunks of other sources are never empty
+func IsEmptyChunk(s Source, filename string, e ChunkEncoding, content []byte) bool {
+	d, ok := s.(EmptyChunkDetector)
+	return ok && d.EmptyChunk(filename, e, content)
+}
+
+// SupportsEncoding reports if the writer accepts chunks of the encoding
+func SupportsEncoding(w EncodingWriter, e ChunkEncoding) bool {
+	for _, we := range w.WriteEncodings() {
+		if we == e {
+			return true
+		}
+	}
+	return false
+}
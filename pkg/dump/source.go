@@ -1,12 +1,43 @@
 package dump
 
-import "io"
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+
+	"github.com/pkg/errors"
+)
 
 type Source interface {
 	Type() SourceType
 	ReadChunk(ChunkMeta) (*Chunk, error)
 	WriteChunk(filename string, r io.Reader) error
 	FinalizeWrites() error
+	Meta() SourceMeta
+}
+
+// ImportOrder is the requirement of a source to the order its chunks are written in on import
+type ImportOrder int
+
+const (
+	// ImportInOrder sources get chunks one by one in the dump order. It's the default for sources not declaring order
+	ImportInOrder ImportOrder = iota
+	// ImportAnyOrder sources may get chunks concurrently in any order
+	ImportAnyOrder
+)
+
+// ImportOrderer is implemented by sources declaring their import order requirement
+type ImportOrderer interface {
+	ImportOrder() ImportOrder
+}
+
+// SourceImportOrder returns import order requirement of the source
+func SourceImportOrder(s Source) ImportOrder {
+	if o, ok := s.(ImportOrderer); ok {
+		return o.ImportOrder()
+	}
+	return ImportInOrder
 }
 
 type SourceType int
@@ -24,6 +55,9 @@ func (s SourceType) String() string {
 	case ClickHouse:
 		return "ch"
 	default:
+		if name, ok := externalSourceName(s); ok {
+			return name
+		}
 		return "undefined"
 	}
 }
@@ -35,6 +69,74 @@ func ParseSourceType(v string) SourceType {
 	case "ch":
 		return ClickHouse
 	default:
+		externalTypes.RLock()
+		defer externalTypes.RUnlock()
+		for st, name := range externalTypes.names {
+			if name == v {
+				return st
+			}
+		}
 		return UndefinedSource
 	}
 }
+
+// externalTypes are types of the sources implemented outside of the tool, e.g. by plugins
+var externalTypes = struct {
+	sync.RWMutex
+	names map[SourceType]string
+}{names: make(map[SourceType]string)}
+
+var externalSourceNameRegex = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+// RegisterSourceType returns a new source type for the external source. The name is used as dump directory of its chunks
+func RegisterSourceType(name string) (SourceType, error) {
+	if !externalSourceNameRegex.MatchString(name) {
+		return UndefinedSource, errors.Errorf("invalid source name %q: lowercase letters, digits, '-' and '_' are allowed", name)
+	}
+	if ParseSourceType(name) != UndefinedSource || name == UndefinedSource.String() {
+		return UndefinedSource, errors.Errorf("source %q is already defined", name)
+	}
+
+	externalTypes.Lock()
+	defer externalTypes.Unlock()
+	st := ClickHouse + SourceType(len(externalTypes.names)) + 1
+	externalTypes.names[st] = name
+	return st, nil
+}
+
+func externalSourceName(st SourceType) (string, bool) {
+	externalTypes.RLock()
+	defer externalTypes.RUnlock()
+	name, ok := externalTypes.names[st]
+	return name, ok
+}
+
+// ResponseError is returned by sources on unsuccessful HTTP responses, so the status could be reported
+type ResponseError struct {
+	Source     SourceType
+	StatusCode int
+	Body       string
+	// RequestID is set if requests are tagged to be found in the server logs
+	RequestID string
+}
+
+func (e *ResponseError) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("non-OK response from %s to request %s: %d: %s", e.Source.name(), e.RequestID, e.StatusCode, e.Body)
+	}
+	return fmt.Sprintf("non-OK response from %s: %d: %s", e.Source.name(), e.StatusCode, e.Body)
+}
+
+func (s SourceType) name() string {
+	switch s {
+	case VictoriaMetrics:
+		return "victoria metrics"
+	case ClickHouse:
+		return "click house"
+	default:
+		if name, ok := externalSourceName(s); ok {
+			return name + " source"
+		}
+		return "undefined source"
+	}
+}
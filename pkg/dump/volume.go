@@ -0,0 +1,67 @@
+package dump
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const dumpExt = ".tar.gz"
+
+// VolumePath returns path of the volume of multi-volume dump, e.g. pmm-dump-1624342596.vol2.tar.gz
+func VolumePath(path string, index int) string {
+	base, ext := splitDumpExt(path)
+	return fmt.Sprintf("%s.vol%d%s", base, index, ext)
+}
+
+// PartialPath returns path the dump of the aborted export is kept at, e.g. pmm-dump-1624342596.partial.tar.gz
+func PartialPath(path string) string {
+	base, ext := splitDumpExt(path)
+	return base + ".partial" + ext
+}
+
+// VolumePaths returns the dump path if it exists, otherwise paths of the dump volumes in order
+func VolumePaths(path string) ([]string, error) {
+	if _, err := os.Stat(path); err == nil || !os.IsNotExist(err) {
+		return []string{path}, err
+	}
+
+	base, ext := splitDumpExt(path)
+	matches, err := filepath.Glob(base + ".vol*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("neither dump file %s nor its volumes are found", path)
+	}
+
+	indexes := make(map[string]int, len(matches))
+	for _, m := range matches {
+		index, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(m, base+".vol"), ext))
+		if err != nil {
+			return nil, fmt.Errorf("invalid volume file name: %s", m)
+		}
+		indexes[m] = index
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return indexes[matches[i]] < indexes[matches[j]]
+	})
+	return matches, nil
+}
+
+func splitDumpExt(path string) (string, string) {
+	if strings.HasSuffix(path, dumpExt) {
+		return strings.TrimSuffix(path, dumpExt), dumpExt
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext), ext
+}
+
+// VolumeBasePath returns path of the multi-volume dump by its volume path, reverse of VolumePath
+func VolumeBasePath(volumePath string, index int) string {
+	base, ext := splitDumpExt(volumePath)
+	return strings.TrimSuffix(base, fmt.Sprintf(".vol%d", index)) + ext
+}
@@ -0,0 +1,318 @@
+// Package encryption implements client-side envelope encryption of dump files: the file is encrypted
+// with a random data key, which is stored in the file header encrypted with the user provided key.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// FileSuffix is appended to the encrypted dump file name
+	FileSuffix = ".enc"
+
+	keySize     = 32
+	segmentSize = 1024 * 1024
+
+	// lastSegmentFlag marks the final segment in the frame length, so truncated files are detected
+	lastSegmentFlag = 1 << 31
+)
+
+var magic = []byte("PMMTENC1")
+
+// ReadKeyFile reads 256-bit key encryption key stored either as raw bytes or hex string
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read key file")
+	}
+	if len(data) == keySize {
+		return data, nil
+	}
+	key, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(key) != keySize {
+		return nil, errors.Errorf("key file should contain %d bytes key, raw or hex encoded", keySize)
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentNonce returns nonce for the segment: data key is unique per file, so counter is never reused with the same key
+func segmentNonce(aead cipher.AEAD, index uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], index)
+	return nonce
+}
+
+func segmentAAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+type writer struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	index uint64
+}
+
+// NewWriter returns writer encrypting data with a new data key wrapped by kek. Close must be called to write the final segment
+func NewWriter(w io.Writer, kek []byte) (io.WriteCloser, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, errors.Wrap(err, "failed to generate data key")
+	}
+
+	kekAEAD, err := newGCM(kek)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid key")
+	}
+	nonce := make([]byte, kekAEAD.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "failed to generate nonce")
+	}
+	wrappedKey := kekAEAD.Seal(nonce, nonce, dataKey, magic)
+
+	header := make([]byte, 0, len(magic)+2+len(wrappedKey))
+	header = append(header, magic...)
+	header = append(header, byte(len(wrappedKey)>>8), byte(len(wrappedKey)))
+	header = append(header, wrappedKey...)
+	if _, err = w.Write(header); err != nil {
+		return nil, errors.Wrap(err, "failed to write header")
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writer{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, segmentSize),
+	}, nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// segment is sealed only when more data comes, so the last one is known on Close
+		if len(w.buf) == segmentSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):segmentSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *writer) Close() error {
+	return w.seal(true)
+}
+
+func (w *writer) seal(last bool) error {
+	ciphertext := w.aead.Seal(nil, segmentNonce(w.aead, w.index), w.buf, segmentAAD(last))
+
+	frame := uint32(len(ciphertext))
+	if last {
+		frame |= lastSegmentFlag
+	}
+	var frameBytes [4]byte
+	binary.BigEndian.PutUint32(frameBytes[:], frame)
+
+	if _, err := w.w.Write(frameBytes[:]); err != nil {
+		return errors.Wrap(err, "failed to write segment")
+	}
+	if _, err := w.w.Write(ciphertext); err != nil {
+		return errors.Wrap(err, "failed to write segment")
+	}
+
+	w.index++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+type reader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	buf   []byte
+	index uint64
+	done  bool
+}
+
+// NewReader returns reader decrypting data written by NewWriter with the same kek
+func NewReader(r io.Reader, kek []byte) (io.Reader, error) {
+	header := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.Wrap(err, "failed to read header")
+	}
+	if !bytes.Equal(header[:len(magic)], magic) {
+		return nil, errors.New("file is not encrypted by pmm-transferer")
+	}
+
+	wrappedKey := make([]byte, int(header[len(magic)])<<8|int(header[len(magic)+1]))
+	if _, err := io.ReadFull(r, wrappedKey); err != nil {
+		return nil, errors.Wrap(err, "failed to read header")
+	}
+
+	kekAEAD, err := newGCM(kek)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid key")
+	}
+	if len(wrappedKey) < kekAEAD.NonceSize() {
+		return nil, errors.New("invalid header")
+	}
+	nonceSize := kekAEAD.NonceSize()
+	dataKey, err := kekAEAD.Open(nil, wrappedKey[:nonceSize], wrappedKey[nonceSize:], magic)
+	if err != nil {
+		return nil, errors.New("failed to decrypt data key: wrong key")
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reader{
+		r:    r,
+		aead: aead,
+	}, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *reader) open() error {
+	var frameBytes [4]byte
+	if _, err := io.ReadFull(r.r, frameBytes[:]); err != nil {
+		if err == io.EOF {
+			return errors.New("encrypted file is truncated")
+		}
+		return errors.Wrap(err, "failed to read segment")
+	}
+	frame := binary.BigEndian.Uint32(frameBytes[:])
+	last := frame&lastSegmentFlag != 0
+	size := frame &^ lastSegmentFlag
+	if size > segmentSize+uint32(r.aead.Overhead()) {
+		return errors.New("invalid segment size")
+	}
+
+	ciphertext := make([]byte, size)
+	if _, err := io.ReadFull(r.r, ciphertext); err != nil {
+		return errors.Wrap(err, "failed to read segment")
+	}
+
+	plaintext, err := r.aead.Open(ciphertext[:0], segmentNonce(r.aead, r.index), ciphertext, segmentAAD(last))
+	if err != nil {
+		return errors.New("failed to decrypt segment: file is corrupted")
+	}
+
+	r.index++
+	r.buf = plaintext
+	r.done = last
+	return nil
+}
+
+// Encrypt returns data encrypted in the same format as written by NewWriter
+func Encrypt(data, kek []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, kek)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decrypt returns data encrypted by Encrypt or NewWriter
+func Decrypt(data, kek []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(data), kek)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// EncryptFile writes encrypted copy of the file to dst
+func EncryptFile(src, dst string, kek []byte) error {
+	return transformFile(src, dst, func(out io.Writer, in io.Reader) error {
+		w, err := NewWriter(out, kek)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(w, in); err != nil {
+			return errors.Wrap(err, "failed to encrypt file")
+		}
+		return w.Close()
+	})
+}
+
+// DecryptFile writes decrypted copy of the file to dst
+func DecryptFile(src, dst string, kek []byte) error {
+	return transformFile(src, dst, func(out io.Writer, in io.Reader) error {
+		r, err := NewReader(in, kek)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(out, r); err != nil {
+			return errors.Wrap(err, "failed to decrypt file")
+		}
+		return nil
+	})
+}
+
+// ReencryptFile writes copy of the file encrypted with newKEK, decrypted data is streamed and never written to disk.
+// The copy has a new data key, so data isn't readable with the data key of the old file
+func ReencryptFile(src, dst string, oldKEK, newKEK []byte) error {
+	return transformFile(src, dst, func(out io.Writer, in io.Reader) error {
+		r, err := NewReader(in, oldKEK)
+		if err != nil {
+			return err
+		}
+		w, err := NewWriter(out, newKEK)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(w, r); err != nil {
+			return errors.Wrap(err, "failed to re-encrypt file")
+		}
+		return w.Close()
+	})
+}
@@ -0,0 +1,83 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// transformFile writes dst through a temporary file, so incomplete output is never left under the dst name
+func transformFile(src, dst string, fn func(out io.Writer, in io.Reader) error) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create file")
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	bw := bufio.NewWriter(out)
+	if err = fn(bw, bufio.NewReader(in)); err != nil {
+		return err
+	}
+	if err = bw.Flush(); err != nil {
+		return errors.Wrap(err, "failed to write file")
+	}
+	if err = out.Close(); err != nil {
+		return errors.Wrap(err, "failed to close file")
+	}
+	return errors.Wrap(os.Rename(tmp, dst), "failed to rename file")
+}
+
+// VerifyFile checks that the encrypted file is decrypted with the key to the content of src.
+// Decryption authenticates each segment, so modified and truncated files are detected as well
+func VerifyFile(encrypted, src string, kek []byte) error {
+	in, err := os.Open(encrypted)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+	defer in.Close()
+
+	r, err := NewReader(bufio.NewReader(in), kek)
+	if err != nil {
+		return err
+	}
+	decryptedSum, err := sha256Sum(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to decrypt file")
+	}
+
+	plain, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+	defer plain.Close()
+
+	srcSum, err := sha256Sum(plain)
+	if err != nil {
+		return errors.Wrap(err, "failed to read file")
+	}
+
+	if !bytes.Equal(decryptedSum, srcSum) {
+		return errors.Errorf("%s doesn't match %s", encrypted, src)
+	}
+	return nil
+}
+
+func sha256Sum(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,58 @@
+package grafana
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+type Annotation struct {
+	Start time.Time
+	End   time.Time
+	Tags  []string
+	Text  string
+}
+
+type annotationReq struct {
+	Time    int64    `json:"time"`
+	TimeEnd int64    `json:"timeEnd"`
+	Tags    []string `json:"tags"`
+	Text    string   `json:"text"`
+}
+
+// CreateAnnotation creates organization wide region annotation, which is shown on all dashboards
+func CreateAnnotation(pmmURL, apiKey string, a Annotation, c *fasthttp.Client) error {
+	body, err := json.Marshal(annotationReq{
+		Time:    a.Start.UnixNano() / int64(time.Millisecond),
+		TimeEnd: a.End.UnixNano() / int64(time.Millisecond),
+		Tags:    a.Tags,
+		Text:    a.Text,
+	})
+	if err != nil {
+		return err
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetRequestURI(fmt.Sprintf("%s/graph/api/annotations", pmmURL))
+	req.Header.SetContentType("application/json")
+	if apiKey != "" {
+		req.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+apiKey)
+	}
+	req.SetBody(body)
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	if err := c.Do(req, resp); err != nil {
+		return err
+	}
+	if status := resp.StatusCode(); status != fasthttp.StatusOK {
+		return fmt.Errorf("non-ok status: %d: %s", status, string(resp.Body()))
+	}
+	return nil
+}
@@ -24,6 +24,39 @@ func getSingleDashboardSelectors(pmmURL, dashboardName string, serviceNames []st
 	if err != nil {
 		return nil, err
 	}
+	exprResp, err := getDashboard(pmmURL, uid, c)
+	if err != nil {
+		return nil, err
+	}
+	selectors, err := exprResp.parseSelectors(serviceNames)
+	if err != nil {
+		return nil, err
+	}
+
+	return selectors, nil
+}
+
+// MetricNames are metric names referenced by dashboard queries: exact names and regexps of name filters
+type MetricNames struct {
+	Names   []string
+	Regexps []string
+}
+
+// GetDashboardMetricNames returns names of the metrics queried by the dashboards with the UIDs
+func GetDashboardMetricNames(pmmURL string, uids []string, c *fasthttp.Client) (MetricNames, error) {
+	names := make(map[string]struct{})
+	regexps := make(map[string]struct{})
+	for _, uid := range uids {
+		d, err := getDashboard(pmmURL, uid, c)
+		if err != nil {
+			return MetricNames{}, fmt.Errorf("failed to retrieve dashboard \"%s\": %v", uid, err)
+		}
+		d.Dashboard.metricNames(names, regexps)
+	}
+	return MetricNames{Names: sortedKeys(names), Regexps: sortedKeys(regexps)}, nil
+}
+
+func getDashboard(pmmURL, uid string, c *fasthttp.Client) (*dashboardExprResp, error) {
 	link := fmt.Sprintf("%s/graph/api/dashboards/uid/%s", pmmURL, uid)
 	status, data, err := c.Get(nil, link)
 	if err != nil {
@@ -37,12 +70,7 @@ func getSingleDashboardSelectors(pmmURL, dashboardName string, serviceNames []st
 	if err = json.Unmarshal(data, exprResp); err != nil {
 		return nil, err
 	}
-	selectors, err := exprResp.parseSelectors(serviceNames)
-	if err != nil {
-		return nil, err
-	}
-
-	return selectors, nil
+	return exprResp, nil
 }
 
 type dashboardExprResp struct {
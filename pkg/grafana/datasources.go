@@ -0,0 +1,48 @@
+package grafana
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/valyala/fasthttp"
+)
+
+type datasourceResp struct {
+	Id   int    `json:"id"`
+	Uid  string `json:"uid"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// GetDatasourceProxyURL returns the URL of Grafana datasource proxy for the datasource with the specified name.
+// It allows to reach VM API when only Grafana is exposed.
+func GetDatasourceProxyURL(pmmURL, name, apiKey string, c *fasthttp.Client) (string, error) {
+	link := fmt.Sprintf("%s/graph/api/datasources/name/%s", pmmURL, url.PathEscape(name))
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.SetMethod(fasthttp.MethodGet)
+	req.SetRequestURI(link)
+	if apiKey != "" {
+		req.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+apiKey)
+	}
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	if err := c.Do(req, resp); err != nil {
+		return "", err
+	}
+	if status := resp.StatusCode(); status != fasthttp.StatusOK {
+		return "", fmt.Errorf("non-ok status: %d", status)
+	}
+
+	ds := new(datasourceResp)
+	if err := json.Unmarshal(resp.Body(), ds); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s/graph/api/datasources/proxy/%d", pmmURL, ds.Id), nil
+}
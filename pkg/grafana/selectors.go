@@ -3,7 +3,11 @@ package grafana
 import (
 	"fmt"
 	"github.com/VictoriaMetrics/metricsql"
+	"regexp"
+	"sort"
 	"strings"
+
+	"github.com/rs/zerolog/log"
 )
 
 func parseQuery(query string, serviceNames []string, templateVars map[string]struct{}, existingSelectors map[string]struct{}) error {
@@ -119,3 +123,68 @@ func (d *dashboardExprResp) parseSelectors(serviceNames []string) (selectors []s
 	}
 	return selectors, nil
 }
+
+// templateVarRegex matches Grafana variables, which metricsql can't parse in durations and function arguments
+var templateVarRegex = regexp.MustCompile(`\$\{?\w+\}?`)
+
+// durationVarRegex matches Grafana variables used as durations
+var durationVarRegex = regexp.MustCompile(`\[\$\{?\w+\}?(:\$?\{?\w+\}?)?\]`)
+
+// metricNames adds names of the metrics queried by the panel and its subpanels. Queries failed to be parsed are skipped,
+// as panels not showing data don't need their metrics
+func (p *panel) metricNames(names, regexps map[string]struct{}) {
+	queries := make([]string, 0, len(p.Targets)+len(p.Templating.List))
+	for _, v := range p.Templating.List {
+		queries = append(queries, removeTemplatingFuncs(v.Query))
+	}
+	for _, target := range p.Targets {
+		queries = append(queries, target.Expr)
+	}
+
+	for _, q := range queries {
+		if q == "" {
+			continue
+		}
+		q = durationVarRegex.ReplaceAllString(q, "[1m]")
+		q = templateVarRegex.ReplaceAllStringFunc(q, func(v string) string {
+			if strings.HasPrefix(v, "$__") {
+				return "1m"
+			}
+			return v
+		})
+		expr, err := metricsql.Parse(q)
+		if err != nil {
+			log.Debug().Msgf("Skipping query %q: %v", q, err)
+			continue
+		}
+		metricsql.VisitAll(expr, func(expr metricsql.Expr) {
+			m, ok := expr.(*metricsql.MetricExpr)
+			if !ok {
+				return
+			}
+			for _, f := range m.LabelFilters {
+				if f.Label != "__name__" || f.IsNegative || strings.Contains(f.Value, "$") {
+					continue
+				}
+				if f.IsRegexp {
+					regexps[f.Value] = struct{}{}
+				} else {
+					names[f.Value] = struct{}{}
+				}
+			}
+		})
+	}
+
+	for _, panel := range p.Panels {
+		panel.metricNames(names, regexps)
+	}
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,246 @@
+// Package inventory creates PMM inventory stubs of the services, which dump data belongs to but which don't exist
+// on the target PMM Server, so imported data is navigable in the UI instead of orphaned
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+)
+
+// StubLabel is the custom label of the created nodes and services, so stubs can be found and removed
+const StubLabel = "pmm_transferer_stub"
+
+// ServiceLabels are core metrics labels and QAN metrics columns describing the service
+var ServiceLabels = []string{"service_id", "service_name", "service_type", "node_id", "node_name",
+	"environment", "cluster", "replication_set"}
+
+// Service is the service of the dump data
+type Service struct {
+	ID             string
+	Name           string
+	Type           string
+	NodeID         string
+	NodeName       string
+	Environment    string
+	Cluster        string
+	ReplicationSet string
+}
+
+// ServiceFromLabels returns service described by ServiceLabels values, if service name is known
+func ServiceFromLabels(labels map[string]string) (Service, bool) {
+	s := Service{
+		ID:             labels["service_id"],
+		Name:           labels["service_name"],
+		Type:           labels["service_type"],
+		NodeID:         labels["node_id"],
+		NodeName:       labels["node_name"],
+		Environment:    labels["environment"],
+		Cluster:        labels["cluster"],
+		ReplicationSet: labels["replication_set"],
+	}
+	return s, s.Name != ""
+}
+
+// Stub is the created service stub
+type Stub struct {
+	Service
+	// NewID and NewNodeID are IDs of the stub on the target, imported data is remapped to them
+	NewID     string
+	NewNodeID string
+}
+
+// serviceTypes map service_type label values to the inventory API methods and response keys.
+// Stubs of unknown types are created as external services
+var serviceTypes = map[string]struct {
+	method string
+	key    string
+	port   int
+}{
+	"mysql":      {method: "AddMySQL", key: "mysql", port: 3306},
+	"mongodb":    {method: "AddMongoDB", key: "mongodb", port: 27017},
+	"postgresql": {method: "AddPostgreSQL", key: "postgresql", port: 5432},
+	"proxysql":   {method: "AddProxySQL", key: "proxysql", port: 6032},
+	"haproxy":    {method: "AddHAProxyService", key: "haproxy"},
+	"external":   {method: "AddExternalService", key: "external"},
+}
+
+// stubAddress is used for services requiring address, as the real one is unknown
+const stubAddress = "127.0.0.1"
+
+type Client struct {
+	c      *fasthttp.Client
+	pmmURL string
+}
+
+func NewClient(c *fasthttp.Client, pmmURL string) *Client {
+	return &Client{c: c, pmmURL: pmmURL}
+}
+
+// CreateMissingServices creates stubs of the services, which names don't exist in the inventory.
+// Stub nodes are created for missing nodes too, while existing nodes are reused by name
+func (c *Client) CreateMissingServices(services []Service, dumpID string) ([]Stub, error) {
+	existing, err := c.serviceNames()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list services")
+	}
+	nodes, err := c.nodeIDs()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list nodes")
+	}
+
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+
+	// stubs are labeled with the dump they were created for
+	labels := map[string]string{StubLabel: dumpID}
+	if dumpID == "" {
+		labels[StubLabel] = "1"
+	}
+
+	var stubs []Stub
+	for _, s := range services {
+		if _, ok := existing[s.Name]; ok {
+			continue
+		}
+
+		nodeName := s.NodeName
+		if nodeName == "" {
+			nodeName = s.Name + "-node"
+		}
+		nodeID, ok := nodes[nodeName]
+		if !ok {
+			if nodeID, err = c.addRemoteNode(nodeName, labels); err != nil {
+				return stubs, errors.Wrapf(err, "failed to create node %s", nodeName)
+			}
+			nodes[nodeName] = nodeID
+			log.Info().Msgf("Created stub node %s", nodeName)
+		}
+
+		id, err := c.addService(s, nodeID, labels)
+		if err != nil {
+			return stubs, errors.Wrapf(err, "failed to create service %s", s.Name)
+		}
+		existing[s.Name] = struct{}{}
+		log.Info().Msgf("Created stub service %s on node %s", s.Name, nodeName)
+
+		stubs = append(stubs, Stub{Service: s, NewID: id, NewNodeID: nodeID})
+	}
+	return stubs, nil
+}
+
+func (c *Client) serviceNames() (map[string]struct{}, error) {
+	var resp map[string][]struct {
+		ServiceName string `json:"service_name"`
+	}
+	if err := c.post("/v1/inventory/Services/List", struct{}{}, &resp); err != nil {
+		return nil, err
+	}
+	names := make(map[string]struct{})
+	for _, services := range resp {
+		for _, s := range services {
+			names[s.ServiceName] = struct{}{}
+		}
+	}
+	return names, nil
+}
+
+func (c *Client) nodeIDs() (map[string]string, error) {
+	var resp map[string][]struct {
+		NodeID   string `json:"node_id"`
+		NodeName string `json:"node_name"`
+	}
+	if err := c.post("/v1/inventory/Nodes/List", struct{}{}, &resp); err != nil {
+		return nil, err
+	}
+	ids := make(map[string]string)
+	for _, nodes := range resp {
+		for _, n := range nodes {
+			ids[n.NodeName] = n.NodeID
+		}
+	}
+	return ids, nil
+}
+
+func (c *Client) addRemoteNode(name string, labels map[string]string) (string, error) {
+	req := map[string]interface{}{
+		"node_name":     name,
+		"address":       stubAddress,
+		"custom_labels": labels,
+	}
+	var resp struct {
+		Remote struct {
+			NodeID string `json:"node_id"`
+		} `json:"remote"`
+	}
+	if err := c.post("/v1/inventory/Nodes/AddRemote", req, &resp); err != nil {
+		return "", err
+	}
+	if resp.Remote.NodeID == "" {
+		return "", errors.New("no node ID in response")
+	}
+	return resp.Remote.NodeID, nil
+}
+
+func (c *Client) addService(s Service, nodeID string, labels map[string]string) (string, error) {
+	t, ok := serviceTypes[s.Type]
+	if !ok {
+		t = serviceTypes["external"]
+	}
+
+	req := map[string]interface{}{
+		"service_name":    s.Name,
+		"node_id":         nodeID,
+		"environment":     s.Environment,
+		"cluster":         s.Cluster,
+		"replication_set": s.ReplicationSet,
+		"custom_labels":   labels,
+	}
+	if t.port != 0 {
+		req["address"] = stubAddress
+		req["port"] = t.port
+	}
+
+	var resp map[string]struct {
+		ServiceID string `json:"service_id"`
+	}
+	if err := c.post("/v1/inventory/Services/"+t.method, req, &resp); err != nil {
+		return "", err
+	}
+	id := resp[t.key].ServiceID
+	if id == "" {
+		return "", errors.New("no service ID in response")
+	}
+	return id, nil
+}
+
+func (c *Client) post(path string, body, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetRequestURI(c.pmmURL + path)
+	req.Header.SetContentType("application/json")
+	req.SetBody(data)
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	if err := c.c.Do(req, resp); err != nil {
+		return err
+	}
+	if status := resp.StatusCode(); status != fasthttp.StatusOK {
+		return fmt.Errorf("non-ok status: %d: %s", status, string(resp.Body()))
+	}
+	return json.Unmarshal(resp.Body(), result)
+}
@@ -0,0 +1,314 @@
+// Package planner implements chunk planners rewriting the list of chunks before export starts. Planners can split
+// core metrics chunks by series, e.g. one chunk per service or per metric, reorder or drop chunks, so custom
+// chunking strategies don't need changes of the export pipeline.
+package planner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"pmm-transferer/pkg/dump"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// maxStderrSize limits the command output reported in errors
+const maxStderrSize = 4096
+
+// Planner returns chunks to be exported instead of the planned ones
+type Planner interface {
+	Name() string
+	Plan(chunks []dump.ChunkMeta) ([]dump.ChunkMeta, error)
+}
+
+// Pipeline applies planners in order
+type Pipeline []Planner
+
+// Plan returns chunks planned by all planners. Chunks of each source should have unique filenames
+func (p Pipeline) Plan(chunks []dump.ChunkMeta) ([]dump.ChunkMeta, error) {
+	for _, pl := range p {
+		planned, err := pl.Plan(chunks)
+		if err != nil {
+			return nil, errors.Wrapf(err, "chunk planner %s failed", pl.Name())
+		}
+		if err = validate(planned); err != nil {
+			return nil, errors.Wrapf(err, "chunk planner %s returned invalid chunks", pl.Name())
+		}
+		log.Debug().Msgf("Chunk planner %s planned %d chunks instead of %d", pl.Name(), len(planned), len(chunks))
+		chunks = planned
+	}
+	return chunks, nil
+}
+
+func validate(chunks []dump.ChunkMeta) error {
+	seen := make(map[string]struct{}, len(chunks))
+	for _, c := range chunks {
+		if c.Source == dump.UndefinedSource {
+			return errors.Errorf("chunk %s has no source", c.String())
+		}
+		if c.Selector != "" && c.Source != dump.VictoriaMetrics {
+			return errors.Errorf("chunk %s of %s has selector, only core metrics chunks can be narrowed", c.String(), c.Source)
+		}
+		key := fmt.Sprintf("%s/%s/%s/%s", c.Source, c.Table, c.Step, c.String())
+		if _, ok := seen[key]; ok {
+			return errors.Errorf("chunk %s of %s is planned twice, set part to tell narrowed chunks apart", c.String(), c.Source)
+		}
+		seen[key] = struct{}{}
+	}
+	return nil
+}
+
+// LabelValuesGetter is the core metrics source listing label values of the exported series
+type LabelValuesGetter interface {
+	LabelValues(label string, start, end time.Time) ([]string, error)
+}
+
+// Label splits each core metrics chunk into chunks of series with the same label value,
+// e.g. by service_name or __name__. Series without the label go to the chunk of the empty value
+type Label struct {
+	label  string
+	values LabelValuesGetter
+}
+
+func NewLabel(label string, values LabelValuesGetter) (*Label, error) {
+	if _, err := parseSelector(labelSelector(label, "")); err != nil {
+		return nil, errors.Errorf("invalid label %q", label)
+	}
+	return &Label{label: label, values: values}, nil
+}
+
+func (l Label) Name() string {
+	return "label " + l.label
+}
+
+func (l Label) Plan(chunks []dump.ChunkMeta) ([]dump.ChunkMeta, error) {
+	var start, end time.Time
+	for _, c := range chunks {
+		if c.Source != dump.VictoriaMetrics || c.Start == nil || c.End == nil {
+			continue
+		}
+		if start.IsZero() || c.Start.Before(start) {
+			start = *c.Start
+		}
+		if c.End.After(end) {
+			end = *c.End
+		}
+	}
+	if start.IsZero() {
+		return chunks, nil
+	}
+
+	values, err := l.values.LabelValues(l.label, start, end)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get values of label %s", l.label)
+	}
+	sort.Strings(values)
+	if l.label != "__name__" {
+		// every series has the name, while other labels may be missing
+		values = append(values, "")
+	}
+	log.Info().Msgf("Splitting core metrics chunks by %d values of label %s", len(values), l.label)
+
+	res := make([]dump.ChunkMeta, 0, len(chunks)+len(values))
+	for _, c := range chunks {
+		if c.Source != dump.VictoriaMetrics || c.Start == nil || c.End == nil {
+			res = append(res, c)
+			continue
+		}
+		for i, v := range values {
+			nc := c
+			if nc.Selector, err = narrow(c.Selector, labelSelector(l.label, v)); err != nil {
+				return nil, err
+			}
+			nc.Part = c.Part*len(values) + i + 1
+			res = append(res, nc)
+		}
+	}
+	return res, nil
+}
+
+func labelSelector(label, value string) string {
+	return fmt.Sprintf("{%s=%s}", label, strconv.Quote(value))
+}
+
+// narrow adds label filters of the selector to the chunk selector
+func narrow(chunkSelector, selector string) (string, error) {
+	if chunkSelector == "" {
+		return selector, nil
+	}
+	me, err := parseSelector(chunkSelector)
+	if err != nil {
+		return "", err
+	}
+	add, err := parseSelector(selector)
+	if err != nil {
+		return "", err
+	}
+	me.LabelFilters = append(me.LabelFilters, add.LabelFilters...)
+	return string(me.AppendString(nil)), nil
+}
+
+func parseSelector(selector string) (*metricsql.MetricExpr, error) {
+	expr, err := metricsql.Parse(selector)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse selector %s", selector)
+	}
+	me, ok := expr.(*metricsql.MetricExpr)
+	if !ok {
+		return nil, errors.Errorf("not a series selector: %s", selector)
+	}
+	return me, nil
+}
+
+// Command is a planner running external command: the command reads JSON array of chunks from stdin
+// and writes JSON array of chunks to be exported to stdout
+type Command struct {
+	path    string
+	args    []string
+	timeout time.Duration
+}
+
+// NewCommand parses command line of the planner, arguments are separated by spaces
+func NewCommand(cmdline string, timeout time.Duration) (*Command, error) {
+	fields := strings.Fields(cmdline)
+	if len(fields) == 0 {
+		return nil, errors.New("empty chunk planner command")
+	}
+	path, err := exec.LookPath(fields[0])
+	if err != nil {
+		return nil, errors.Wrapf(err, "chunk planner command %s is not found", fields[0])
+	}
+	return &Command{
+		path:    path,
+		args:    fields[1:],
+		timeout: timeout,
+	}, nil
+}
+
+func (c Command) Name() string {
+	return strings.Join(append([]string{c.path}, c.args...), " ")
+}
+
+func (c Command) Plan(chunks []dump.ChunkMeta) ([]dump.ChunkMeta, error) {
+	in := make([]Chunk, 0, len(chunks))
+	for _, m := range chunks {
+		in = append(in, newChunk(m))
+	}
+	input, err := json.Marshal(in)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal chunks")
+	}
+
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, c.path, c.args...)
+	cmd.Stdin = bytes.NewReader(input)
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	if err = cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > maxStderrSize {
+			msg = msg[len(msg)-maxStderrSize:]
+		}
+		if msg != "" {
+			return nil, errors.Wrap(err, msg)
+		}
+		return nil, err
+	}
+
+	var out []Chunk
+	if err = json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return nil, errors.Wrap(err, "failed to parse planned chunks")
+	}
+	res := make([]dump.ChunkMeta, 0, len(out))
+	for i, ch := range out {
+		m, err := ch.meta()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid chunk #%d", i+1)
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// Chunk is the chunk passed to planner commands
+type Chunk struct {
+	Source   string     `json:"source"`
+	Start    *time.Time `json:"start,omitempty"`
+	End      *time.Time `json:"end,omitempty"`
+	Step     string     `json:"step,omitempty"`
+	Index    int        `json:"index,omitempty"`
+	RowsLen  int        `json:"rows_len,omitempty"`
+	Table    string     `json:"table,omitempty"`
+	Name     string     `json:"name,omitempty"`
+	Selector string     `json:"selector,omitempty"`
+	Part     int        `json:"part,omitempty"`
+}
+
+func newChunk(m dump.ChunkMeta) Chunk {
+	c := Chunk{
+		Source:   m.Source.String(),
+		Start:    m.Start,
+		End:      m.End,
+		Index:    m.Index,
+		RowsLen:  m.RowsLen,
+		Table:    m.Table,
+		Name:     m.Name,
+		Selector: m.Selector,
+		Part:     m.Part,
+	}
+	if m.Step > 0 {
+		c.Step = m.Step.String()
+	}
+	return c
+}
+
+func (c Chunk) meta() (dump.ChunkMeta, error) {
+	m := dump.ChunkMeta{
+		Source:   dump.ParseSourceType(c.Source),
+		Start:    c.Start,
+		End:      c.End,
+		Index:    c.Index,
+		RowsLen:  c.RowsLen,
+		Table:    c.Table,
+		Name:     c.Name,
+		Selector: c.Selector,
+		Part:     c.Part,
+	}
+	if m.Source == dump.UndefinedSource {
+		return dump.ChunkMeta{}, errors.Errorf("unknown source %q", c.Source)
+	}
+	if c.Step != "" {
+		step, err := time.ParseDuration(c.Step)
+		if err != nil {
+			return dump.ChunkMeta{}, errors.Wrapf(err, "invalid step %q", c.Step)
+		}
+		m.Step = step
+	}
+	if m.Start != nil && m.End != nil && !m.End.After(*m.Start) {
+		return dump.ChunkMeta{}, errors.New("end should be after start")
+	}
+	if m.Part < 0 {
+		return dump.ChunkMeta{}, errors.New("part should not be negative")
+	}
+	if m.Selector != "" {
+		if _, err := parseSelector(m.Selector); err != nil {
+			return dump.ChunkMeta{}, err
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,193 @@
+// Package plugin implements dump sources backed by external executables, so teams can add their own data
+// to the dump without recompiling the tool. The executable is run once per operation:
+//
+//	EXECUTABLE list-chunks START END   prints chunks of the time range (Unix seconds), one per line:
+//	                                   NAME [CHUNK_START CHUNK_END]
+//	EXECUTABLE read-chunk NAME         writes chunk content to stdout
+//	EXECUTABLE write-chunk NAME        reads chunk content from stdin and writes it to the destination
+//
+// Non-zero exit code fails the operation, stderr is reported as the error.
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os/exec"
+	"pmm-transferer/pkg/dump"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	CommandListChunks = "list-chunks"
+	CommandReadChunk  = "read-chunk"
+	CommandWriteChunk = "write-chunk"
+
+	// maxStderrSize limits the plugin output reported in errors
+	maxStderrSize = 4096
+)
+
+var chunkNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+type Config struct {
+	// Name is the source name, it's used as dump directory of the plugin chunks
+	Name string
+	// Path is the plugin executable
+	Path string
+	// Timeout limits a single plugin run, no limit if not set
+	Timeout time.Duration
+}
+
+type Source struct {
+	cfg Config
+	st  dump.SourceType
+}
+
+func NewSource(cfg Config) (*Source, error) {
+	path, err := exec.LookPath(cfg.Path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "plugin %s executable is not found", cfg.Name)
+	}
+	cfg.Path = path
+
+	st, err := dump.RegisterSourceType(cfg.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Source{
+		cfg: cfg,
+		st:  st,
+	}, nil
+}
+
+func (s Source) Type() dump.SourceType {
+	return s.st
+}
+
+// Meta describes the data exported by the source
+func (s Source) Meta() dump.SourceMeta {
+	return dump.SourceMeta{
+		Type: s.cfg.Name,
+	}
+}
+
+// ListChunks returns chunks of the time range as listed by the plugin
+func (s Source) ListChunks(start, end time.Time) ([]dump.ChunkMeta, error) {
+	out, err := s.run(nil, CommandListChunks, strconv.FormatInt(start.Unix(), 10), strconv.FormatInt(end.Unix(), 10))
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks []dump.ChunkMeta
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		c, err := s.parseChunkLine(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "plugin %s listed invalid chunk %q", s.cfg.Name, line)
+		}
+		chunks = append(chunks, c)
+	}
+
+	log.Debug().
+		Str("plugin", s.cfg.Name).
+		Int("chunks", len(chunks)).
+		Msg("Listed plugin chunks")
+
+	return chunks, nil
+}
+
+func (s Source) parseChunkLine(line string) (dump.ChunkMeta, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 1 && len(fields) != 3 {
+		return dump.ChunkMeta{}, errors.New("expected NAME [START END]")
+	}
+	if !chunkNameRegex.MatchString(fields[0]) {
+		return dump.ChunkMeta{}, errors.New("name should consist of letters, digits, '.', '-' and '_'")
+	}
+
+	c := dump.ChunkMeta{
+		Source: s.st,
+		Name:   fields[0],
+	}
+	if len(fields) == 3 {
+		start, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return c, errors.Wrap(err, "invalid start")
+		}
+		end, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return c, errors.Wrap(err, "invalid end")
+		}
+		s, e := time.Unix(start, 0).UTC(), time.Unix(end, 0).UTC()
+		c.Start, c.End = &s, &e
+	}
+	return c, nil
+}
+
+func (s Source) ReadChunk(m dump.ChunkMeta) (*dump.Chunk, error) {
+	content, err := s.run(nil, CommandReadChunk, m.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &dump.Chunk{
+		ChunkMeta: m,
+		Content:   content,
+		Filename:  m.Name,
+	}, nil
+}
+
+func (s Source) WriteChunk(filename string, r io.Reader) error {
+	if !chunkNameRegex.MatchString(filename) {
+		return errors.Errorf("invalid chunk name %q", filename)
+	}
+	_, err := s.run(r, CommandWriteChunk, filename)
+	return err
+}
+
+// FinalizeWrites does nothing: plugins are expected to complete each write before exit
+func (s Source) FinalizeWrites() error {
+	return nil
+}
+
+func (s Source) run(stdin io.Reader, args ...string) ([]byte, error) {
+	ctx := context.Background()
+	if s.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.Timeout)
+		defer cancel()
+	}
+
+	log.Debug().
+		Str("plugin", s.cfg.Name).
+		Strs("args", args).
+		Msg("Running plugin")
+
+	cmd := exec.CommandContext(ctx, s.cfg.Path, args...)
+	cmd.Stdin = stdin
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > maxStderrSize {
+			msg = msg[len(msg)-maxStderrSize:]
+		}
+		if msg != "" {
+			return nil, errors.Wrapf(err, "plugin %s %s failed: %s", s.cfg.Name, args[0], msg)
+		}
+		return nil, errors.Wrapf(err, "plugin %s %s failed", s.cfg.Name, args[0])
+	}
+	return stdout.Bytes(), nil
+}
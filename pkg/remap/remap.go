@@ -0,0 +1,53 @@
+package remap
+
+import (
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Mapping maps label (column) name to the old->new values mapping, e.g.
+//
+//	service_name:
+//	  mongo: mongo-restored
+//	node_id:
+//	  /node_id/old: /node_id/new
+type Mapping map[string]map[string]string
+
+func Load(path string) (Mapping, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read mapping file")
+	}
+
+	var m Mapping
+	if err = yaml.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrap(err, "failed to parse mapping file")
+	}
+
+	return m, nil
+}
+
+// Set maps the old value of the label to the new one
+func (m Mapping) Set(name, oldValue, newValue string) {
+	values, ok := m[name]
+	if !ok {
+		values = make(map[string]string)
+		m[name] = values
+	}
+	values[oldValue] = newValue
+}
+
+// Apply returns new value for the label, if it's mapped
+func (m Mapping) Apply(name, value string) (string, bool) {
+	values, ok := m[name]
+	if !ok {
+		return value, false
+	}
+	newValue, ok := values[value]
+	if !ok {
+		return value, false
+	}
+	return newValue, true
+}
@@ -0,0 +1,41 @@
+// Package requestid generates IDs tagging chunk requests to PMM Server components, so server-side logs
+// can be correlated with transferer logs and failures. IDs are like pmm-transferer-1a2b3c4d-42, where the middle
+// part is random for each run
+package requestid
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+)
+
+const (
+	// Header is HTTP header the ID is sent in
+	Header = "X-Request-ID"
+
+	prefix = "pmm-transferer"
+)
+
+var (
+	runID   string
+	counter uint64
+)
+
+// Enable turns on ID generation, IDs are empty until it's called
+func Enable() error {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	runID = hex.EncodeToString(b)
+	return nil
+}
+
+// Next returns the next request ID, or empty string if IDs are not enabled
+func Next() string {
+	if runID == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s-%s-%d", prefix, runID, atomic.AddUint64(&counter, 1))
+}
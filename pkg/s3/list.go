@@ -0,0 +1,137 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Object is an object listed by prefix
+type Object struct {
+	// URL of the object in s3://bucket/key form
+	URL  string
+	Size int64
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns all objects by s3://bucket/prefix URL, following ListObjectsV2 pagination
+func (c Config) List(ctx context.Context, client *http.Client, rawURL string) ([]Object, error) {
+	bucket, prefix, err := parsePrefixURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	bucketURL, err := c.bucketURL(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []Object
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}}
+		if prefix != "" {
+			q.Set("prefix", prefix)
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+
+		var result listBucketResult
+		if err = c.getXML(ctx, client, bucketURL+"/?"+canonicalQuery(q), &result); err != nil {
+			return nil, errors.Wrap(err, "failed to list objects")
+		}
+		for _, o := range result.Contents {
+			objects = append(objects, Object{URL: scheme + bucket + "/" + o.Key, Size: o.Size})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Open returns body of the object by its s3://bucket/key URL, it's streamed and must be closed by the caller
+func (c Config) Open(ctx context.Context, client *http.Client, rawURL string) (io.ReadCloser, error) {
+	objectURL, err := c.ObjectURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, client, http.MethodGet, objectURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get object")
+	}
+	return resp.Body, nil
+}
+
+func (c Config) getXML(ctx context.Context, client *http.Client, u string, v interface{}) error {
+	return c.doXML(ctx, client, http.MethodGet, u, nil, v)
+}
+
+// doXML sends signed request and parses XML response into v
+func (c Config) doXML(ctx context.Context, client *http.Client, method, u string, body []byte, v interface{}) error {
+	resp, err := c.do(ctx, client, method, u, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err = xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.Wrap(err, "failed to parse response")
+	}
+	return nil
+}
+
+// do sends signed request and returns the response if it's OK
+func (c Config) do(ctx context.Context, client *http.Client, method, u string, body []byte) (*http.Response, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Sign(req); err != nil {
+		return nil, errors.Wrap(err, "failed to sign request")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to send HTTP request")
+	}
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		_ = resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			return nil, ThrottledError{Status: resp.StatusCode, RetryAfter: parseRetryAfter(resp)}
+		}
+		return nil, errors.Errorf("non-OK response: %d: %s", resp.StatusCode, string(respBody))
+	}
+	return resp, nil
+}
+
+func parseRetryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,113 @@
+package s3
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MinPartSize is the minimal size of multipart upload part except the last one
+	MinPartSize = 5 * 1024 * 1024
+	// MaxParts is the maximal number of parts in multipart upload
+	MaxParts = 10000
+)
+
+// ThrottledError is returned when the storage rejects a request because of request rate limits, e.g. SlowDown
+type ThrottledError struct {
+	Status     int
+	RetryAfter time.Duration
+}
+
+func (e ThrottledError) Error() string {
+	return fmt.Sprintf("request is throttled: %d", e.Status)
+}
+
+// Part is an uploaded part of multipart upload
+type Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []Part   `xml:"Part"`
+}
+
+// completeMultipartUploadResult is either result or error, which is sent with OK status once the response has started
+type completeMultipartUploadResult struct {
+	XMLName xml.Name
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// CreateMultipartUpload starts multipart upload of the object by its s3://bucket/key URL and returns upload ID
+func (c Config) CreateMultipartUpload(ctx context.Context, client *http.Client, rawURL string) (string, error) {
+	objectURL, err := c.ObjectURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	var result initiateMultipartUploadResult
+	if err = c.doXML(ctx, client, http.MethodPost, objectURL+"?uploads=", nil, &result); err != nil {
+		return "", errors.Wrap(err, "failed to create multipart upload")
+	}
+	if result.UploadID == "" {
+		return "", errors.New("no upload ID in response")
+	}
+	return result.UploadID, nil
+}
+
+// UploadPart uploads the part of multipart upload and returns its ETag
+func (c Config) UploadPart(ctx context.Context, client *http.Client, rawURL, uploadID string, number int, data []byte) (string, error) {
+	objectURL, err := c.ObjectURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	resp, err := c.do(ctx, client, http.MethodPut, objectURL+"?"+canonicalQuery(q), data)
+	if err != nil {
+		return "", err
+	}
+	_ = resp.Body.Close()
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", errors.New("no ETag in response")
+	}
+	return etag, nil
+}
+
+// CompleteMultipartUpload assembles the object from the parts, which must be sorted by number
+func (c Config) CompleteMultipartUpload(ctx context.Context, client *http.Client, rawURL, uploadID string, parts []Part) error {
+	objectURL, err := c.ObjectURL(rawURL)
+	if err != nil {
+		return err
+	}
+
+	body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal parts")
+	}
+
+	q := url.Values{"uploadId": {uploadID}}
+	var result completeMultipartUploadResult
+	if err = c.doXML(ctx, client, http.MethodPost, objectURL+"?"+canonicalQuery(q), body, &result); err != nil {
+		return errors.Wrap(err, "failed to complete multipart upload")
+	}
+	if result.XMLName.Local == "Error" {
+		return errors.Errorf("failed to complete multipart upload: %s: %s", result.Code, result.Message)
+	}
+	return nil
+}
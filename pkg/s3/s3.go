@@ -0,0 +1,209 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	scheme = "s3://"
+
+	defaultRegion = "us-east-1"
+
+	signAlgorithm   = "AWS4-HMAC-SHA256"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+type Config struct {
+	// Endpoint of S3-compatible storage, e.g. MinIO or Ceph. AWS S3 regional endpoint is used if empty
+	Endpoint string
+	Region   string
+	// PathStyle addresses objects as endpoint/bucket/key instead of bucket.endpoint/key
+	PathStyle bool
+
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// CredentialsFromEnv fills credentials from the standard AWS environment variables
+func (c *Config) CredentialsFromEnv() {
+	c.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	c.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	c.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+}
+
+// IsURL reports if the dump path is S3 object URL: s3://bucket/key
+func IsURL(p string) bool {
+	return strings.HasPrefix(p, scheme)
+}
+
+func parseURL(rawURL string) (bucket, key string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(rawURL, scheme), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.Errorf("invalid S3 URL %q, expected s3://bucket/key", rawURL)
+	}
+	return parts[0], parts[1], nil
+}
+
+// parsePrefixURL parses s3://bucket[/prefix] URL, prefix may be empty to address the whole bucket
+func parsePrefixURL(rawURL string) (bucket, prefix string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(rawURL, scheme), "/", 2)
+	if parts[0] == "" {
+		return "", "", errors.Errorf("invalid S3 URL %q, expected s3://bucket/prefix", rawURL)
+	}
+	if len(parts) == 2 {
+		prefix = parts[1]
+	}
+	return parts[0], prefix, nil
+}
+
+// ObjectURL returns HTTP(S) URL of the object by its s3://bucket/key URL
+func (c Config) ObjectURL(rawURL string) (string, error) {
+	bucket, key, err := parseURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	bucketURL, err := c.bucketURL(bucket)
+	if err != nil {
+		return "", err
+	}
+	return bucketURL + "/" + uriEncode(key, true), nil
+}
+
+// bucketURL returns HTTP(S) URL of the bucket without trailing slash
+func (c Config) bucketURL(bucket string) (string, error) {
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", c.region())
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse S3 endpoint")
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", errors.Errorf("invalid S3 endpoint %q, expected http(s)://host[:port]", endpoint)
+	}
+
+	basePath := strings.TrimSuffix(u.Path, "/")
+	if c.PathStyle {
+		return fmt.Sprintf("%s://%s%s/%s", u.Scheme, u.Host, basePath, uriEncode(bucket, false)), nil
+	}
+	return fmt.Sprintf("%s://%s.%s%s", u.Scheme, bucket, u.Host, basePath), nil
+}
+
+func (c Config) region() string {
+	if c.Region == "" {
+		return defaultRegion
+	}
+	return c.Region
+}
+
+// Sign signs the request with AWS Signature Version 4. Requests are sent anonymously without credentials
+func (c Config) Sign(req *http.Request) error {
+	if c.AccessKey == "" || c.SecretKey == "" {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for _, name := range []string{"X-Amz-Date", "X-Amz-Content-Sha256", "X-Amz-Security-Token"} {
+		if v := req.Header.Get(name); v != "" {
+			headers[strings.ToLower(name)] = v
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, c.region())
+	stringToSign := strings.Join([]string{signAlgorithm, amzDate, scope, hexSHA256(canonicalRequest)}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretKey), date)
+	key = hmacSHA256(key, c.region())
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		signAlgorithm, c.AccessKey, scope, signedHeaders, signature))
+
+	return nil
+}
+
+func canonicalQuery(q url.Values) string {
+	params := make([]string, 0, len(q))
+	for k, vs := range q {
+		for _, v := range vs {
+			params = append(params, uriEncode(k, false)+"="+uriEncode(v, false))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// uriEncode encodes all characters except RFC 3986 unreserved ones, as required by the signature
+func uriEncode(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch >= 'A' && ch <= 'Z', ch >= 'a' && ch <= 'z', ch >= '0' && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~':
+			b.WriteByte(ch)
+		case ch == '/' && keepSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func hexSHA256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,34 @@
+package transferer
+
+import (
+	"archive/tar"
+	"time"
+)
+
+const DefaultEntryMode = 0600
+
+// EntryAttributes are applied to all entries of the dump archive
+type EntryAttributes struct {
+	Mode  int64
+	Uname string
+	Gname string
+	// PreserveTimes sets entry modification time to the time it was written.
+	// Otherwise Unix epoch is used, so the same data results in the same archive
+	PreserveTimes bool
+}
+
+func (a EntryAttributes) header(name string, size int64) *tar.Header {
+	modTime := time.Unix(0, 0)
+	if a.PreserveTimes {
+		modTime = time.Now()
+	}
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     a.Mode,
+		Uname:    a.Uname,
+		Gname:    a.Gname,
+		ModTime:  modTime,
+	}
+}
@@ -0,0 +1,68 @@
+package transferer
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"pmm-transferer/pkg/dump"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	AuditStatusSucceeded = "succeeded"
+	AuditStatusPartial   = "partial"
+	AuditStatusFailed    = "failed"
+)
+
+// AuditRecord describes an export/import operation, it's appended to the audit log as a single JSON line
+type AuditRecord struct {
+	Time      time.Time              `json:"time"`
+	User      string                 `json:"user"`
+	Host      string                 `json:"host"`
+	Command   string                 `json:"command"`
+	Version   dump.TransfererVersion `json:"version"`
+	Status    string                 `json:"status"`
+	PMMServer string                 `json:"pmm_server,omitempty"`
+	// URLs are other endpoints the data is transferred from or to, e.g. dump download URL or vmagent
+	URLs    []string        `json:"urls,omitempty"`
+	Dumps   []string        `json:"dumps,omitempty"`
+	DumpIDs []string        `json:"dump_ids,omitempty"`
+	Sources []string        `json:"sources,omitempty"`
+	Range   *dump.TimeRange `json:"range,omitempty"`
+	// Checksums are SHA-256 sums of the exported dump files by path
+	Checksums map[string]string `json:"checksums,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// AppendAuditRecord appends the record to the audit log. Existing records are never modified
+func AppendAuditRecord(path string, r AuditRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal audit record")
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open audit log")
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		return errors.Wrap(err, "failed to write audit record")
+	}
+	return f.Sync()
+}
+
+// AuditURL returns URL without credentials and query, which may contain signatures
+func AuditURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
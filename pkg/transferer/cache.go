@@ -0,0 +1,183 @@
+package transferer
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"pmm-transferer/pkg/dump"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// cacheSettleTime is how long after the chunk end its data may still change by ingestion, such chunks are not cached
+const cacheSettleTime = 10 * time.Minute
+
+const (
+	cacheFileSuffix = ".chunk"
+	cacheTempPrefix = ".chunk-"
+)
+
+// ChunkCache keeps chunks read from the sources on local disk, so exports of overlapping ranges
+// (e.g. reruns after downstream failures) reuse them instead of reading from PMM Server again.
+// Chunks are cached as read, before transformations and encryption
+type ChunkCache struct {
+	dir string
+	ttl time.Duration
+	// namespace separates chunks of different servers, e.g. their connection strings
+	namespace string
+
+	hits   int64
+	misses int64
+}
+
+// NewChunkCache creates the cache directory if needed and removes chunks older than ttl
+func NewChunkCache(dir, namespace string, ttl time.Duration) (*ChunkCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create cache directory")
+	}
+	c := &ChunkCache{dir: dir, ttl: ttl, namespace: namespace}
+	if err := c.prune(); err != nil {
+		return nil, errors.Wrap(err, "failed to remove expired chunks")
+	}
+	return c, nil
+}
+
+// SetChunkCache sets the cache chunks are read through, chunks are always read from the sources if it's nil
+func (t *Transferer) SetChunkCache(c *ChunkCache) {
+	t.cache = c
+}
+
+// Stats returns the number of chunks read from the cache and from the sources
+func (c *ChunkCache) Stats() (hits, misses int64) {
+	if c == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+}
+
+func (c *ChunkCache) prune() error {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	var removed int
+	for _, f := range files {
+		// temporary files are left by killed exports
+		stale := strings.HasPrefix(f.Name(), cacheTempPrefix) && time.Since(f.ModTime()) > cacheSettleTime
+		if !stale && !(strings.HasSuffix(f.Name(), cacheFileSuffix) && c.expired(f.ModTime())) {
+			continue
+		}
+		if err = os.Remove(filepath.Join(c.dir, f.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+	}
+	if removed != 0 {
+		log.Debug().Msgf("Removed %d expired chunks from the cache", removed)
+	}
+	return nil
+}
+
+func (c *ChunkCache) expired(modTime time.Time) bool {
+	return c.ttl > 0 && time.Since(modTime) > c.ttl
+}
+
+// path returns the cache file of the chunk: its name is the hash of the server, source settings and chunk meta
+func (c *ChunkCache) path(s dump.Source, m dump.ChunkMeta) (string, error) {
+	sm, err := json.Marshal(s.Meta())
+	if err != nil {
+		return "", err
+	}
+	cm, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, part := range [][]byte{[]byte(c.namespace), sm, cm} {
+		h.Write(part)
+		h.Write([]byte{0})
+	}
+	return filepath.Join(c.dir, hex.EncodeToString(h.Sum(nil))+cacheFileSuffix), nil
+}
+
+// cacheable reports if the chunk data is settled: chunks without end or ending recently may still get new data
+func cacheable(m dump.ChunkMeta) bool {
+	return m.End != nil && time.Since(*m.End) > cacheSettleTime
+}
+
+// get returns the cached chunk, if any
+func (c *ChunkCache) get(s dump.Source, m dump.ChunkMeta) (*dump.Chunk, bool) {
+	if c == nil {
+		return nil, false
+	}
+	p, err := c.path(s, m)
+	if err != nil || !cacheable(m) {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn().Err(err).Msgf("Failed to read chunk %s from the cache", m)
+		}
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+	defer f.Close()
+
+	if st, err := f.Stat(); err == nil && c.expired(st.ModTime()) {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+
+	chunk := new(dump.Chunk)
+	if err = gob.NewDecoder(f).Decode(chunk); err != nil {
+		log.Warn().Err(err).Msgf("Failed to decode chunk %s from the cache", m)
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+
+	log.Debug().Msgf("Chunk %s is read from the cache", m)
+	atomic.AddInt64(&c.hits, 1)
+	return chunk, true
+}
+
+// put stores the chunk read from the source. Failures are only logged, as export doesn't depend on the cache
+func (c *ChunkCache) put(s dump.Source, m dump.ChunkMeta, chunk *dump.Chunk) {
+	if c == nil || !cacheable(m) {
+		return
+	}
+	p, err := c.path(s, m)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed to cache chunk %s", m)
+		return
+	}
+
+	f, err := ioutil.TempFile(c.dir, cacheTempPrefix+"*")
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed to cache chunk %s", m)
+		return
+	}
+	err = gob.NewEncoder(f).Encode(chunk)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// rename is atomic, so concurrent exports never read half-written chunks
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		log.Warn().Err(err).Msgf("Failed to cache chunk %s", m)
+	}
+}
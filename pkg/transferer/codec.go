@@ -0,0 +1,186 @@
+package transferer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"pmm-transferer/pkg/dump"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Chunk codecs
+const (
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+	CodecNone = "none"
+)
+
+// codecGzipSuffix of the codec record tells the payload was gzipped by the source,
+// so it's gzipped again after decoding on import
+const codecGzipSuffix = "+gzip"
+
+// ChunkCodec is the compression of the chunk entries content inside the dump. Sources compress payloads differently
+// (core metrics are gzipped by VictoriaMetrics, QAN rows are plain TSV), so the codec is set per source
+type ChunkCodec struct {
+	Name string
+	// Level is the codec compression level, the codec default is used if it's not set (0)
+	Level int
+}
+
+// ChunkCodecs are codecs of the chunk entries by source, entries of other sources are written as read
+type ChunkCodecs map[dump.SourceType]ChunkCodec
+
+// ParseChunkCodec parses codec with optional level, e.g. zstd:3, gzip:9 or none. Level 0 is rejected:
+// for gzip it would mean no compression, while the codec default is used when the level is omitted
+func ParseChunkCodec(v string) (ChunkCodec, error) {
+	parts := strings.SplitN(v, ":", 2)
+	c := ChunkCodec{Name: parts[0]}
+	hasLevel := len(parts) == 2
+	if hasLevel {
+		level, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return ChunkCodec{}, errors.Errorf("invalid level of codec %s", v)
+		}
+		c.Level = level
+	}
+
+	switch c.Name {
+	case CodecGzip:
+		if hasLevel && (c.Level < gzip.BestSpeed || c.Level > gzip.BestCompression) {
+			return ChunkCodec{}, errors.Errorf("gzip level should be %d-%d", gzip.BestSpeed, gzip.BestCompression)
+		}
+	case CodecZstd:
+		if hasLevel && (c.Level < 1 || c.Level > 22) {
+			return ChunkCodec{}, errors.New("zstd level should be 1-22")
+		}
+	case CodecNone:
+		if hasLevel {
+			return ChunkCodec{}, errors.New("codec none has no level")
+		}
+	default:
+		return ChunkCodec{}, errors.Errorf("unknown codec %s: gzip, zstd or none is expected", c.Name)
+	}
+	return c, nil
+}
+
+// SetChunkCodecs sets codecs entries of each source are written with
+func (t *Transferer) SetChunkCodecs(c ChunkCodecs) {
+	t.codecs = c
+}
+
+// encodeEntry returns the content encoded by the source codec and the codec record of the entry header.
+// Gzipped payloads are decompressed first, so they aren't compressed twice. Record is empty if content isn't changed
+func (t Transferer) encodeEntry(st dump.SourceType, content []byte) ([]byte, string, error) {
+	c, ok := t.codecs[st]
+	if !ok {
+		return content, "", nil
+	}
+
+	record := c.Name
+	if isGzip(content) {
+		if c.Name == CodecGzip && c.Level == 0 {
+			return content, "", nil
+		}
+		raw, err := gunzip(content)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "failed to decompress chunk")
+		}
+		content, record = raw, record+codecGzipSuffix
+		if c.Name == CodecGzip {
+			// recompressed payload is still gzipped as the source expects it
+			record = ""
+		}
+	} else if c.Name == CodecNone {
+		return content, "", nil
+	}
+
+	encoded, err := compress(c, content)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to compress chunk with %s", c.Name)
+	}
+	return encoded, record, nil
+}
+
+// decodeEntry restores the content written by the source from the entry encoded with the codec of the record
+func decodeEntry(record string, content []byte) ([]byte, error) {
+	if record == "" {
+		return content, nil
+	}
+	name := strings.TrimSuffix(record, codecGzipSuffix)
+
+	var err error
+	switch name {
+	case CodecGzip:
+		content, err = gunzip(content)
+	case CodecZstd:
+		var d *zstd.Decoder
+		if d, err = zstd.NewReader(nil); err == nil {
+			content, err = d.DecodeAll(content, nil)
+			d.Close()
+		}
+	case CodecNone:
+	default:
+		return nil, errors.Errorf("unknown chunk codec %s, the dump is written by a newer version", name)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode chunk with %s", name)
+	}
+
+	if name != record {
+		// level doesn't matter, as the payload is only read on import
+		return compress(ChunkCodec{Name: CodecGzip, Level: gzip.BestSpeed}, content)
+	}
+	return content, nil
+}
+
+func compress(c ChunkCodec, content []byte) ([]byte, error) {
+	switch c.Name {
+	case CodecGzip:
+		level := c.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		buf := new(bytes.Buffer)
+		gzw, err := gzip.NewWriterLevel(buf, level)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = gzw.Write(content); err != nil {
+			return nil, err
+		}
+		if err = gzw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CodecZstd:
+		var opts []zstd.EOption
+		if c.Level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.Level)))
+		}
+		enc, err := zstd.NewWriter(nil, opts...)
+		if err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+		return enc.EncodeAll(content, make([]byte, 0, len(content)/2)), nil
+	default:
+		return content, nil
+	}
+}
+
+func isGzip(content []byte) bool {
+	return len(content) >= 2 && content[0] == 0x1f && content[1] == 0x8b
+}
+
+func gunzip(content []byte) ([]byte, error) {
+	gzr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+	return ioutil.ReadAll(gzr)
+}
@@ -0,0 +1,61 @@
+package transferer
+
+import (
+	"io/ioutil"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// AvailableCPUs returns the number of CPUs available to the process, respecting cgroup CPU quota
+// so that a container limited to 2 CPUs on a 64-core host doesn't get 64 workers
+func AvailableCPUs() int {
+	n := runtime.NumCPU()
+	quota, ok := cgroupCPUQuota()
+	if !ok {
+		return n
+	}
+	limit := int(math.Ceil(quota))
+	if limit < 1 {
+		limit = 1
+	}
+	if limit < n {
+		return limit
+	}
+	return n
+}
+
+func cgroupCPUQuota() (float64, bool) {
+	// cgroup v2
+	if data, err := ioutil.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0, false
+		}
+		return parseQuota(fields[0], fields[1])
+	}
+
+	// cgroup v1
+	quota, err := ioutil.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	if err != nil {
+		return 0, false
+	}
+	period, err := ioutil.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err != nil {
+		return 0, false
+	}
+	return parseQuota(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+func parseQuota(quota, period string) (float64, bool) {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return q / p, true
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package transferer
+
+import "runtime"
+
+func AvailableCPUs() int {
+	return runtime.NumCPU()
+}
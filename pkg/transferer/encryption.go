@@ -0,0 +1,47 @@
+package transferer
+
+import (
+	"pmm-transferer/pkg/dump"
+	"pmm-transferer/pkg/encryption"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// EntryKeys are key encryption keys of the dump entries by source. Entries of each source are encrypted with its own key,
+// so QAN data containing query texts may be accessible to fewer people than metrics of the same dump
+type EntryKeys map[dump.SourceType][]byte
+
+func (t *Transferer) SetEntryKeys(k EntryKeys) {
+	t.entryKeys = k
+}
+
+// encryptEntry returns encrypted entry name and content, if the source has a key
+func (t Transferer) encryptEntry(st dump.SourceType, name string, content []byte) (string, []byte, error) {
+	key, ok := t.entryKeys[st]
+	if !ok {
+		return name, content, nil
+	}
+	encrypted, err := encryption.Encrypt(content, key)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to encrypt chunk")
+	}
+	return name + encryption.FileSuffix, encrypted, nil
+}
+
+// decryptEntry returns decrypted entry file name and content. It returns false if the entry is encrypted,
+// but there is no key for the source
+func (t Transferer) decryptEntry(st dump.SourceType, filename string, content []byte) (string, []byte, bool, error) {
+	if !strings.HasSuffix(filename, encryption.FileSuffix) {
+		return filename, content, true, nil
+	}
+	key, ok := t.entryKeys[st]
+	if !ok {
+		return "", nil, false, nil
+	}
+	decrypted, err := encryption.Decrypt(content, key)
+	if err != nil {
+		return "", nil, false, errors.Wrapf(err, "failed to decrypt %s", filename)
+	}
+	return strings.TrimSuffix(filename, encryption.FileSuffix), decrypted, true, nil
+}
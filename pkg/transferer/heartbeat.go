@@ -0,0 +1,101 @@
+package transferer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// heartbeatCheckPeriod is how often stalls are checked
+const heartbeatCheckPeriod = 10 * time.Second
+
+type HeartbeatConfig struct {
+	// Interval is the period of heartbeat logging, disabled if 0
+	Interval time.Duration
+	// StallTimeout is the time without any chunk progress export/import is considered stalled after, disabled if 0
+	StallTimeout time.Duration
+	// OnStall is called once per stall with the diagnosis, stall is only logged if not set
+	OnStall func(err error)
+}
+
+// StartHeartbeat logs pipeline stage statistics periodically and detects stalls, until stop is called
+func (t Transferer) StartHeartbeat(c HeartbeatConfig) (stop func()) {
+	if c.Interval <= 0 && c.StallTimeout <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		started := time.Now()
+		lastBeat := started
+		var stalled bool
+
+		ticker := time.NewTicker(heartbeatCheckPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				p := t.progress.snapshot()
+				lastChange := p.LastChange
+				if lastChange.Before(started) {
+					lastChange = started
+				}
+				idle := now.Sub(lastChange)
+
+				if c.Interval > 0 && now.Sub(lastBeat) >= c.Interval {
+					lastBeat = now
+					log.Info().Msgf("Heartbeat: %s chunks processed, %d failed; waiting for load %d, reading %d, queued %d, writing %d; "+
+						"last progress %s ago", processedString(p), len(p.FailedChunks),
+						p.Stages.LoadWait, p.Stages.Reading, p.Stages.Queued, p.Stages.Writing, idle.Round(time.Second))
+				}
+
+				if c.StallTimeout <= 0 {
+					continue
+				}
+				if idle < c.StallTimeout {
+					stalled = false
+					continue
+				}
+				if stalled {
+					continue
+				}
+				stalled = true
+
+				err := errors.Errorf("no progress for %s: %s", idle.Round(time.Second), p.Stages.diagnose())
+				log.Warn().Msgf("Stall detected: %v", err)
+				if c.OnStall != nil {
+					c.OnStall(err)
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+func processedString(p Progress) string {
+	if p.ChunksTotal == 0 {
+		return fmt.Sprint(p.ChunksProcessed)
+	}
+	return fmt.Sprintf("%d/%d", p.ChunksProcessed, p.ChunksTotal)
+}
+
+// diagnose names the blocked stage: chunks stuck at the stage closest to the output block all previous ones
+func (s StageStats) diagnose() string {
+	switch {
+	case s.Writing > 0:
+		return fmt.Sprintf("writing of %d chunks is blocked, check the dump destination or the target server", s.Writing)
+	case s.Queued > 0:
+		return fmt.Sprintf("%d read chunks are not taken by writers", s.Queued)
+	case s.Reading > 0:
+		return fmt.Sprintf("reading of %d chunks is blocked, check the source server or the dump input", s.Reading)
+	case s.LoadWait > 0:
+		return "waiting for PMM Server load to decrease, see load thresholds"
+	default:
+		return "no chunks are in progress, reading of the dump input may be blocked"
+	}
+}
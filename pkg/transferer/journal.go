@@ -0,0 +1,93 @@
+package transferer
+
+import (
+	"encoding/json"
+	"io"
+	"pmm-transferer/pkg/dump"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Journal events
+const (
+	JournalStart    = "start"
+	JournalChunk    = "chunk"
+	JournalFinished = "finished"
+	JournalFailed   = "failed"
+)
+
+// JournalRecord is a JSON line of the export journal
+type JournalRecord struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	DumpID string    `json:"dump_id,omitempty"`
+	// ChunksTotal and ChunksProcessed are the export progress after the event
+	ChunksTotal     int `json:"chunks_total,omitempty"`
+	ChunksProcessed int `json:"chunks_processed"`
+	// Source, Chunk, Range and Size describe the written chunk of chunk event
+	Source string          `json:"source,omitempty"`
+	Chunk  string          `json:"chunk,omitempty"`
+	Range  *dump.TimeRange `json:"range,omitempty"`
+	Size   int64           `json:"size,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Journal writes export progress as JSON lines, so orchestrators wrapping piped export can monitor it
+// and resume the transfer from the chunks already written
+type Journal struct {
+	mu     sync.Mutex
+	w      io.Writer
+	dumpID string
+	failed bool
+}
+
+func NewJournal(w io.Writer, dumpID string) *Journal {
+	return &Journal{w: w, dumpID: dumpID}
+}
+
+// SetJournal sets the journal chunk events are recorded to
+func (t *Transferer) SetJournal(j *Journal) {
+	t.journal = j
+}
+
+// Record writes the record with the current time. Journal write errors don't fail export
+func (j *Journal) Record(r JournalRecord) {
+	if j == nil {
+		return
+	}
+	r.Time = time.Now().UTC()
+	r.DumpID = j.dumpID
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to marshal journal record")
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err = j.w.Write(append(data, '\n')); err != nil && !j.failed {
+		j.failed = true
+		log.Warn().Err(err).Msg("Failed to write journal, following records may be lost")
+	}
+}
+
+func (j *Journal) chunkWritten(c *dump.Chunk, size int64, p Progress) {
+	if j == nil {
+		return
+	}
+	r := JournalRecord{
+		Event:           JournalChunk,
+		ChunksTotal:     p.ChunksTotal,
+		ChunksProcessed: p.ChunksProcessed,
+		Source:          c.Source.String(),
+		Chunk:           c.Filename,
+		Size:            size,
+	}
+	if c.Start != nil && c.End != nil {
+		r.Range = &dump.TimeRange{Start: *c.Start, End: *c.End}
+	}
+	j.Record(r)
+}
@@ -7,7 +7,6 @@ import (
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"github.com/valyala/fasthttp"
-	"net/http"
 	"strconv"
 	"strings"
 	"sync"
@@ -40,49 +39,283 @@ func (s LoadStatus) String() string {
 	}
 }
 
+func (s LoadStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+type LoadStatusRecord struct {
+	Time   time.Time  `json:"time"`
+	Status LoadStatus `json:"status"`
+	Load   float64    `json:"load"`
+}
+
 const (
 	MaxLoadWaitDuration = time.Second
+
+	// amount of latest load statuses kept for the error report
+	loadHistorySize = 20
+
+	// load (relative to max load) from which the pacing delay starts to grow
+	pacingLoadFraction = 0.5
 )
 
+type LoadCheckerConfig struct {
+	ConnectionURL string
+	// APIKey is sent as bearer token, e.g. when VM is reached via Grafana datasource proxy
+	APIKey         string
+	Thresholds     []Threshold
+	MaxPacingDelay time.Duration
+	// Schedule overrides thresholds and pacing by time of day, the first active window applies
+	Schedule []LoadWindow
+	// NodeLabel and NodeValue select node exporter series of the PMM Server host in CPU and RAM queries,
+	// DefaultNodeLabel and DefaultNodeValue if empty
+	NodeLabel string
+	NodeValue string
+	// WarnOnly logs threshold breaches without pausing, pacing or aborting reads
+	WarnOnly bool
+}
+
+const (
+	DefaultNodeLabel = "node_name"
+	DefaultNodeValue = "pmm-server"
+
+	// nodeFilterPlaceholder is replaced by the node label filter in threshold queries
+	nodeFilterPlaceholder = "$node_filter"
+)
+
+// NodeFilter returns the label filter of node exporter series of PMM Server host
+func (cfg LoadCheckerConfig) NodeFilter() string {
+	label, value := cfg.NodeLabel, cfg.NodeValue
+	if label == "" {
+		label = DefaultNodeLabel
+	}
+	if value == "" {
+		value = DefaultNodeValue
+	}
+	return fmt.Sprintf("%s=%q", label, value)
+}
+
+// LoadWindow is the time of day with its own thresholds and pacing, e.g. business hours with lower max load
+type LoadWindow struct {
+	Name string
+	// Days are weekdays the window is active on, every day if empty
+	Days []time.Weekday
+	// Start and End are offsets from the local midnight, window wraps midnight if End is before Start
+	Start          time.Duration
+	End            time.Duration
+	Thresholds     []Threshold
+	MaxPacingDelay time.Duration
+}
+
+// Active reports if the window covers the time
+func (w LoadWindow) Active(t time.Time) bool {
+	day := t.Weekday()
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.End < w.Start {
+		if offset < w.End {
+			// window started the previous day
+			day = (day + 6) % 7
+		} else if offset < w.Start {
+			return false
+		}
+	} else if offset < w.Start || offset >= w.End {
+		return false
+	}
+
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
 type LoadChecker struct {
-	c             *fasthttp.Client
-	connectionURL string
+	c *fasthttp.Client
+	// ctx stops status updates, including ones started by SetLimits
+	ctx context.Context
 
-	thresholds []Threshold
+	// cfg thresholds, pacing and schedule are guarded by m, as they are changed by SetLimits
+	cfg LoadCheckerConfig
 
 	m            sync.RWMutex
 	latestStatus LoadStatus
+	latestLoad   float64
+	history      []LoadStatusRecord
+	// window is the name of the active schedule window, empty for the default thresholds
+	window string
+	// observedStatus is the status by thresholds, latest status is always OK in warn only mode
+	observedStatus LoadStatus
 
 	waitStatusCounter int
+	// updating is set when status updates are running
+	updating bool
+
+	// loadSources are the ways threshold values are retrieved by threshold, see thresholdValue
+	loadSources map[ThresholdKey]string
+	self        selfMetrics
 }
 
-func NewLoadChecker(ctx context.Context, c *fasthttp.Client, url string, thresholds []Threshold) *LoadChecker {
+func NewLoadChecker(ctx context.Context, c *fasthttp.Client, cfg LoadCheckerConfig) *LoadChecker {
 	lc := &LoadChecker{
-		c:             c,
-		connectionURL: url,
-		thresholds:    thresholds,
-		latestStatus:  LoadStatusWait,
+		c:            c,
+		ctx:          ctx,
+		cfg:          cfg,
+		latestStatus: LoadStatusWait,
 	}
 
 	lc.updateStatus()
 
-	if len(thresholds) != 0 { // nothing to check so no status updates
+	if cfg.hasThresholds() { // nothing to check so no status updates
+		lc.updating = true
 		lc.runStatusUpdate(ctx)
 	}
 
 	return lc
 }
 
+// SetLimits replaces thresholds, max pacing delay and schedule of the running checker.
+// Status updates are started if the checker had no thresholds before
+func (c *LoadChecker) SetLimits(thresholds []Threshold, maxPacingDelay time.Duration, schedule []LoadWindow) {
+	c.m.Lock()
+	c.cfg.Thresholds, c.cfg.MaxPacingDelay, c.cfg.Schedule = thresholds, maxPacingDelay, schedule
+	start := !c.updating && c.cfg.hasThresholds()
+	if start {
+		c.updating = true
+	}
+	c.m.Unlock()
+
+	if start {
+		c.runStatusUpdate(c.ctx)
+	}
+}
+
+// PingLoadChecker checks that load checker endpoint is reachable and CPU load threshold can be queried
+func PingLoadChecker(c *fasthttp.Client, cfg LoadCheckerConfig) error {
+	lc := &LoadChecker{
+		c:   c,
+		cfg: cfg,
+	}
+	_, err := lc.thresholdValue(Threshold{
+		Key:   ThresholdCPU,
+		Query: getQueryByThresholdKey(ThresholdCPU),
+	})
+	return err
+}
+
 func (c *LoadChecker) GetLatestStatus() LoadStatus {
 	c.m.RLock()
 	defer c.m.RUnlock()
 	return c.latestStatus
 }
 
-func (c *LoadChecker) setLatestStatus(s LoadStatus) {
+// GetPacingDelay returns the delay to apply before reading the next chunk. It grows proportionally
+// to the load measured by the latest check, so workers slow down smoothly before reaching max load.
+func (c *LoadChecker) GetPacingDelay() time.Duration {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if c.cfg.WarnOnly {
+		return 0
+	}
+	_, maxDelay := c.cfg.limits(c.window)
+	return pacingDelay(c.latestLoad, maxDelay)
+}
+
+func (cfg LoadCheckerConfig) hasThresholds() bool {
+	if len(cfg.Thresholds) != 0 {
+		return true
+	}
+	for _, w := range cfg.Schedule {
+		if len(w.Thresholds) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// activeWindow returns name of the schedule window active at the time, empty if none is
+func (cfg LoadCheckerConfig) activeWindow(t time.Time) string {
+	for _, w := range cfg.Schedule {
+		if w.Active(t) {
+			return w.Name
+		}
+	}
+	return ""
+}
+
+// limits returns thresholds and max pacing delay of the schedule window, defaults if window is empty
+func (cfg LoadCheckerConfig) limits(window string) ([]Threshold, time.Duration) {
+	for _, w := range cfg.Schedule {
+		if w.Name == window {
+			return w.Thresholds, w.MaxPacingDelay
+		}
+	}
+	return cfg.Thresholds, cfg.MaxPacingDelay
+}
+
+// switchWindow makes the schedule window active at the time current and returns its thresholds
+func (c *LoadChecker) switchWindow(t time.Time) []Threshold {
 	c.m.Lock()
 	defer c.m.Unlock()
-	c.latestStatus = s
+
+	window := c.cfg.activeWindow(t)
+	if window != c.window {
+		if window == "" {
+			log.Info().Msg("Load schedule: default thresholds are applied")
+		} else {
+			log.Info().Msgf("Load schedule: thresholds of %s are applied", window)
+		}
+		c.window = window
+	}
+	thresholds, _ := c.cfg.limits(window)
+	return thresholds
+}
+
+func pacingDelay(load float64, maxDelay time.Duration) time.Duration {
+	if maxDelay <= 0 || load <= pacingLoadFraction {
+		return 0
+	}
+	if load >= 1 {
+		return maxDelay
+	}
+	k := (load - pacingLoadFraction) / (1 - pacingLoadFraction)
+	return time.Duration(k * float64(maxDelay))
+}
+
+func (c *LoadChecker) setLatestStatus(s LoadStatus, load float64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.cfg.WarnOnly {
+		if s != c.observedStatus && s != LoadStatusOK {
+			log.Warn().Msgf("Load status is %v (load %.2f of max), export isn't paused in warn mode", s, load)
+		} else if s != c.observedStatus && c.observedStatus != LoadStatusNone {
+			log.Info().Msgf("Load status is back to %v", s)
+		}
+		c.observedStatus = s
+		c.latestStatus = LoadStatusOK
+	} else {
+		c.latestStatus = s
+	}
+	c.latestLoad = load
+
+	c.history = append(c.history, LoadStatusRecord{
+		Time:   time.Now().UTC(),
+		Status: s,
+		Load:   load,
+	})
+	if len(c.history) > loadHistorySize {
+		c.history = c.history[len(c.history)-loadHistorySize:]
+	}
+}
+
+// History returns the latest load statuses, oldest first
+func (c *LoadChecker) History() []LoadStatusRecord {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return append([]LoadStatusRecord(nil), c.history...)
 }
 
 func (c *LoadChecker) runStatusUpdate(ctx context.Context) {
@@ -103,7 +336,7 @@ func (c *LoadChecker) runStatusUpdate(ctx context.Context) {
 }
 
 func (c *LoadChecker) updateStatus() {
-	status, err := c.checkMetricsLoad()
+	status, load, err := c.checkMetricsLoad()
 	if err != nil {
 		status = LoadStatusWait
 		log.Warn().Err(err).Msgf("Error while checking metrics load")
@@ -119,22 +352,32 @@ func (c *LoadChecker) updateStatus() {
 		c.waitStatusCounter = 0
 	}
 
-	c.setLatestStatus(status)
-	log.Debug().Msgf("Load status now is %v", status)
+	c.setLatestStatus(status, load)
+	log.Debug().Msgf("Load status now is %v (load %.2f of max)", status, load)
 }
 
-func (c *LoadChecker) checkMetricsLoad() (LoadStatus, error) {
+// checkMetricsLoad returns the load status along with the highest load relative to the max load
+// across all thresholds (1 means max load is reached)
+func (c *LoadChecker) checkMetricsLoad() (LoadStatus, float64, error) {
 	log.Debug().Msg("Started check load status")
 	loadStatus := LoadStatusOK
-	for _, t := range c.thresholds {
-		value, err := c.getMetricCurrentValue(t)
+	var load float64
+	for _, t := range c.switchWindow(time.Now()) {
+		value, err := c.thresholdValue(t)
+		if errors.Is(err, errNoLoadData) {
+			// missing data doesn't mean the server is loaded, so the threshold doesn't pause reads
+			continue
+		}
 		if err != nil {
-			return LoadStatusNone, fmt.Errorf("failed to retrieve threshold value for %s: %w", t.Key, err)
+			return LoadStatusNone, 0, fmt.Errorf("failed to retrieve threshold value for %s: %w", t.Key, err)
+		}
+		if t.MaxLoad > 0 && value/t.MaxLoad > load {
+			load = value / t.MaxLoad
 		}
 		switch {
 		case value >= t.CriticalLoad:
 			log.Debug().Msgf("Checked %s threshold: it exceeds critical load limit. Terminating", t.Key)
-			return LoadStatusTerminate, nil
+			return LoadStatusTerminate, load, nil
 		case value >= t.MaxLoad:
 			log.Debug().Msgf("Checked %s threshold: it exceeds max load limit. Continue checking", t.Key)
 			loadStatus = LoadStatusWait
@@ -145,41 +388,66 @@ func (c *LoadChecker) checkMetricsLoad() (LoadStatus, error) {
 
 	log.Debug().Msgf("Checked all thresholds: final status is %v", loadStatus)
 
-	return loadStatus, nil
+	return loadStatus, load, nil
 }
 
-func (c *LoadChecker) getMetricCurrentValue(m Threshold) (float64, error) {
+// query runs the instant query against load checker endpoint
+func (c *LoadChecker) query(query string) (*metricResponse, error) {
 	q := fasthttp.AcquireArgs()
 	defer fasthttp.ReleaseArgs(q)
 
-	q.Add("query", m.Query)
-
-	url := fmt.Sprintf("%s/api/v1/query?%s", c.connectionURL, q.String())
+	q.Add("query", query)
 
-	log.Debug().
-		Str("url", url).
-		Msgf("Sending HTTP request to load checker endpoint")
-	status, body, err := c.c.Get(nil, url)
+	body, err := c.get(fmt.Sprintf("%s/api/v1/query?%s", c.cfg.ConnectionURL, q.String()))
 	if err != nil {
-		return 0, errors.Wrap(err, "failed to send req to load checker endpoint")
-	}
-	if status != http.StatusOK {
-		return 0, fmt.Errorf("non-ok response: status %d: %s", status, string(body))
+		return nil, err
 	}
 	log.Debug().Msg("Got HTTP status OK from load checker endpoint")
 
-	var resp metricResponse
-
-	if err = json.Unmarshal(body, &resp); err != nil {
-		return 0, fmt.Errorf("error parsing thresholds: %s", err)
+	metricResp := new(metricResponse)
+	if err = json.Unmarshal(body, metricResp); err != nil {
+		return nil, fmt.Errorf("error parsing thresholds: %s", err)
 	}
+	return metricResp, nil
+}
 
-	value, err := resp.getValidValue()
+// DetectLoadCheckerNode returns the node label value of PMM Server host: the only node reporting CPU metrics,
+// or the default one if it's among several nodes
+func DetectLoadCheckerNode(c *fasthttp.Client, cfg LoadCheckerConfig) (string, error) {
+	label := cfg.NodeLabel
+	if label == "" {
+		label = DefaultNodeLabel
+	}
+	lc := &LoadChecker{
+		c:   c,
+		cfg: cfg,
+	}
+	resp, err := lc.query(fmt.Sprintf(`count by (%s) (node_cpu_seconds_total{mode="idle"})`, label))
 	if err != nil {
-		return 0, fmt.Errorf("error parsing threshold: %s", err)
+		return "", err
+	}
+	if resp.Status != "success" {
+		return "", errors.New("status is not success")
 	}
-	log.Debug().Msgf("Got %f threshold value", value)
-	return value, nil
+
+	var nodes []string
+	for _, r := range resp.Data.Result {
+		if v := r.Metric[label]; v != "" {
+			nodes = append(nodes, v)
+		}
+	}
+	switch {
+	case len(nodes) == 1:
+		return nodes[0], nil
+	case len(nodes) == 0:
+		return "", errors.Errorf("no node reports CPU metrics with %s label", label)
+	}
+	for _, n := range nodes {
+		if n == DefaultNodeValue {
+			return n, nil
+		}
+	}
+	return "", errors.Errorf("can't choose among %d nodes with %s label, please specify the node", len(nodes), label)
 }
 
 type ThresholdKey = string
@@ -187,10 +455,20 @@ type ThresholdKey = string
 const (
 	ThresholdCPU ThresholdKey = "CPU"
 	ThresholdRAM ThresholdKey = "RAM"
+
+	ThresholdVMActiveMerges ThresholdKey = "VM_ACTIVE_MERGES"
+	ThresholdVMPendingRows  ThresholdKey = "VM_PENDING_ROWS"
+	ThresholdVMSlowInserts  ThresholdKey = "VM_SLOW_INSERTS"
 )
 
 func AllThresholdKeys() []ThresholdKey {
-	return []ThresholdKey{ThresholdCPU, ThresholdRAM}
+	return []ThresholdKey{
+		ThresholdCPU,
+		ThresholdRAM,
+		ThresholdVMActiveMerges,
+		ThresholdVMPendingRows,
+		ThresholdVMSlowInserts,
+	}
 }
 
 func IsValidThresholdKey(v string) bool {
@@ -205,9 +483,15 @@ func IsValidThresholdKey(v string) bool {
 func getQueryByThresholdKey(k ThresholdKey) string {
 	switch k {
 	case ThresholdCPU:
-		return `100 - (avg by (instance) (rate(node_cpu_seconds_total{mode="idle",node_name="pmm-server"}[5s])) * 100)`
+		return `100 - (avg by (instance) (rate(node_cpu_seconds_total{mode="idle",$node_filter}[5s])) * 100)`
 	case ThresholdRAM:
-		return `100 * (1 - ((avg_over_time(node_memory_MemFree_bytes{node_name="pmm-server"}[5s]) + avg_over_time(node_memory_Cached_bytes{node_name="pmm-server"}[5s]) + avg_over_time(node_memory_Buffers_bytes{node_name="pmm-server"}[5s])) / avg_over_time(node_memory_MemTotal_bytes{node_name="pmm-server"}[5s])))`
+		return `100 * (1 - ((avg_over_time(node_memory_MemFree_bytes{$node_filter}[5s]) + avg_over_time(node_memory_Cached_bytes{$node_filter}[5s]) + avg_over_time(node_memory_Buffers_bytes{$node_filter}[5s])) / avg_over_time(node_memory_MemTotal_bytes{$node_filter}[5s])))`
+	case ThresholdVMActiveMerges:
+		return `sum(vm_active_merges)`
+	case ThresholdVMPendingRows:
+		return `sum(vm_pending_rows)`
+	case ThresholdVMSlowInserts:
+		return `100 * sum(rate(vm_slow_row_inserts_total[5m])) / (sum(rate(vm_rows_inserted_total[5m])) > 0)`
 	default:
 		panic("BUG: undefined threshold key")
 	}
@@ -225,10 +509,8 @@ type metricResponse struct {
 	Data   struct {
 		ResultType string `json:"resultType"`
 		Result     []struct {
-			Metric struct {
-				Instance string `json:"instance"`
-			} `json:"metric"`
-			Value []interface{} `json:"value"`
+			Metric map[string]string `json:"metric"`
+			Value  []interface{}     `json:"value"`
 		} `json:"result"`
 	} `json:"data"`
 }
@@ -238,20 +520,9 @@ func (r *metricResponse) getValidValue() (float64, error) {
 		return 0, errors.New("status is not success")
 	}
 	if len(r.Data.Result) == 0 {
-		return 0, errors.New("empty result")
-	}
-	if len(r.Data.Result[0].Value) != 2 {
-		return 0, errors.New("unexpected number of values")
-	}
-	str, ok := r.Data.Result[0].Value[1].(string)
-	if !ok {
-		return 0, errors.New("value is not string")
-	}
-	val, err := strconv.ParseFloat(str, 64)
-	if err != nil {
-		return 0, fmt.Errorf("parsing value error: %s", err.Error())
+		return 0, errNoLoadData
 	}
-	return val, nil
+	return parseSampleValue(r.Data.Result[0].Value)
 }
 
 func ParseThresholdList(max, critical string) ([]Threshold, error) {
@@ -0,0 +1,318 @@
+package transferer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+)
+
+// errNoLoadData is returned when neither the threshold query nor its fallbacks return data,
+// e.g. node_exporter series have no node label the queries filter by
+var errNoLoadData = errors.New("no data")
+
+const (
+	// fallbackRangeLookback is the range of query_range fallback, the latest point of the range is used
+	fallbackRangeLookback = 5 * time.Minute
+	fallbackRangeStep     = 15 * time.Second
+
+	loadSourceQuery       = "query"
+	loadSourceRangeQuery  = "query_range"
+	loadSourceFallback    = "fallback query"
+	loadSourceSelfMetrics = "VictoriaMetrics /metrics"
+
+	// selfMetricsMaxAge is the age of /metrics sample reused by thresholds of the same check
+	selfMetricsMaxAge = MaxLoadWaitDuration / 2
+)
+
+// getFallbackQueriesByThresholdKey returns alternative queries of the threshold, used when its query returns no data.
+// They keep the node filter, so other nodes' load never stands in for PMM Server, and VictoriaMetrics own metrics
+// are used instead when the node has no data
+func getFallbackQueriesByThresholdKey(k ThresholdKey) []string {
+	switch k {
+	case ThresholdCPU:
+		return []string{
+			`100 - (avg by (instance) (rate(node_cpu_seconds_total{mode="idle",$node_filter}[1m])) * 100)`,
+		}
+	case ThresholdRAM:
+		return []string{
+			`100 * (1 - node_memory_MemAvailable_bytes{$node_filter} / node_memory_MemTotal_bytes{$node_filter})`,
+		}
+	case ThresholdVMSlowInserts:
+		return []string{
+			`100 * sum(increase(vm_slow_row_inserts_total[15m])) / (sum(increase(vm_rows_inserted_total[15m])) > 0)`,
+		}
+	default:
+		return nil
+	}
+}
+
+// thresholdValue returns the current value of the threshold. If the query returns no data, the latest point
+// of query_range, fallback queries and VictoriaMetrics own metrics are tried in turn
+func (c *LoadChecker) thresholdValue(t Threshold) (float64, error) {
+	type attempt struct {
+		source string
+		get    func() (float64, error)
+	}
+	query := func(q string) func() (float64, error) {
+		return func() (float64, error) {
+			resp, err := c.query(c.withNodeFilter(q))
+			if err != nil {
+				return 0, err
+			}
+			return resp.getValidValue()
+		}
+	}
+	attempts := []attempt{
+		{source: loadSourceQuery, get: query(t.Query)},
+		{source: loadSourceRangeQuery, get: func() (float64, error) { return c.rangeQueryLatest(c.withNodeFilter(t.Query)) }},
+	}
+	// custom queries have no fallbacks
+	if t.Query == getQueryByThresholdKey(t.Key) {
+		for _, q := range getFallbackQueriesByThresholdKey(t.Key) {
+			attempts = append(attempts, attempt{source: loadSourceFallback + " " + q, get: query(q)})
+		}
+		attempts = append(attempts, attempt{source: loadSourceSelfMetrics, get: func() (float64, error) { return c.selfMetricValue(t.Key) }})
+	}
+
+	for _, a := range attempts {
+		value, err := a.get()
+		switch {
+		case err == nil:
+			c.setLoadSource(t.Key, a.source)
+			log.Debug().Msgf("Got %f threshold value of %s by %s", value, t.Key, a.source)
+			return value, nil
+		case errors.Is(err, errNoLoadData):
+			continue
+		default:
+			return 0, err
+		}
+	}
+	c.setLoadSource(t.Key, "")
+	return 0, errNoLoadData
+}
+
+func (c *LoadChecker) withNodeFilter(q string) string {
+	return strings.ReplaceAll(q, nodeFilterPlaceholder, c.cfg.NodeFilter())
+}
+
+// setLoadSource logs changes of the way threshold value is retrieved, so degraded load checks are visible
+func (c *LoadChecker) setLoadSource(k ThresholdKey, source string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.loadSources == nil {
+		c.loadSources = make(map[ThresholdKey]string)
+	}
+	prev, known := c.loadSources[k]
+	if known && prev == source {
+		return
+	}
+	c.loadSources[k] = source
+	switch {
+	case source == "":
+		log.Warn().Msgf("Load checker: no data for %s threshold, it's skipped until data appears", k)
+	case source != loadSourceQuery:
+		log.Warn().Msgf("Load checker: %s threshold query returns no data, using %s", k, source)
+	case known:
+		log.Info().Msgf("Load checker: %s threshold query returns data again", k)
+	}
+}
+
+type rangeResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		Result []struct {
+			Values [][]interface{} `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// rangeQueryLatest returns the latest point of the query over the recent range, it's found when instant query
+// has no point at the moment, e.g. the rate window is shorter than the scrape interval
+func (c *LoadChecker) rangeQueryLatest(query string) (float64, error) {
+	now := time.Now()
+	q := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(q)
+	q.Add("query", query)
+	q.Add("start", strconv.FormatInt(now.Add(-fallbackRangeLookback).Unix(), 10))
+	q.Add("end", strconv.FormatInt(now.Unix(), 10))
+	q.Add("step", strconv.FormatInt(int64(fallbackRangeStep/time.Second), 10))
+
+	body, err := c.get(fmt.Sprintf("%s/api/v1/query_range?%s", c.cfg.ConnectionURL, q.String()))
+	if err != nil {
+		return 0, err
+	}
+	resp := new(rangeResponse)
+	if err = json.Unmarshal(body, resp); err != nil {
+		return 0, fmt.Errorf("error parsing thresholds: %s", err)
+	}
+	if resp.Status != "success" {
+		return 0, errors.New("status is not success")
+	}
+	if len(resp.Data.Result) == 0 || len(resp.Data.Result[0].Values) == 0 {
+		return 0, errNoLoadData
+	}
+	values := resp.Data.Result[0].Values
+	return parseSampleValue(values[len(values)-1])
+}
+
+func (c *LoadChecker) get(url string) ([]byte, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.Header.SetMethod(fasthttp.MethodGet)
+	req.SetRequestURI(url)
+	if c.cfg.APIKey != "" {
+		req.Header.Set(fasthttp.HeaderAuthorization, "Bearer "+c.cfg.APIKey)
+	}
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	log.Debug().
+		Str("url", url).
+		Msgf("Sending HTTP request to load checker endpoint")
+	if err := c.c.Do(req, resp); err != nil {
+		return nil, errors.Wrap(err, "failed to send req to load checker endpoint")
+	}
+	status, body := resp.StatusCode(), resp.Body()
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("non-ok response: status %d: %s", status, string(body))
+	}
+	return append([]byte(nil), body...), nil
+}
+
+// selfMetrics keeps the latest and the previous samples of VictoriaMetrics process metrics,
+// so rates of counters can be calculated
+type selfMetrics struct {
+	mu                sync.Mutex
+	cur, prev         map[string]float64
+	curTime, prevTime time.Time
+}
+
+// selfMetricValue returns threshold value calculated from VictoriaMetrics process metrics. CPU and RAM are
+// of the VictoriaMetrics process only, not of the whole host. Rates have no data until the second check
+func (c *LoadChecker) selfMetricValue(k ThresholdKey) (float64, error) {
+	c.self.mu.Lock()
+	defer c.self.mu.Unlock()
+	if time.Since(c.self.curTime) >= selfMetricsMaxAge {
+		body, err := c.get(c.cfg.ConnectionURL + "/metrics")
+		if err != nil {
+			// the endpoint isn't exposed, e.g. VM is reached by Grafana datasource proxy
+			log.Debug().Msgf("Failed to get VictoriaMetrics metrics: %v", err)
+			return 0, errNoLoadData
+		}
+		c.self.prev, c.self.prevTime = c.self.cur, c.self.curTime
+		c.self.cur, c.self.curTime = parseMetricSums(body), time.Now()
+	}
+	cur, prev := c.self.cur, c.self.prev
+
+	has := func(names ...string) bool {
+		for _, n := range names {
+			if _, ok := cur[n]; !ok {
+				return false
+			}
+		}
+		return true
+	}
+	delta := func(name string) (float64, bool) {
+		p, ok := prev[name]
+		if !ok || cur[name] < p {
+			return 0, false
+		}
+		return cur[name] - p, true
+	}
+
+	switch k {
+	case ThresholdCPU:
+		if !has("process_cpu_seconds_total", "process_cpu_cores_available") || cur["process_cpu_cores_available"] == 0 {
+			return 0, errNoLoadData
+		}
+		d, ok := delta("process_cpu_seconds_total")
+		elapsed := c.self.curTime.Sub(c.self.prevTime).Seconds()
+		if !ok || elapsed <= 0 {
+			return 0, errNoLoadData
+		}
+		return 100 * d / elapsed / cur["process_cpu_cores_available"], nil
+	case ThresholdRAM:
+		if !has("process_resident_memory_bytes", "vm_available_memory_bytes") || cur["vm_available_memory_bytes"] == 0 {
+			return 0, errNoLoadData
+		}
+		return 100 * cur["process_resident_memory_bytes"] / cur["vm_available_memory_bytes"], nil
+	case ThresholdVMActiveMerges:
+		if !has("vm_active_merges") {
+			return 0, errNoLoadData
+		}
+		return cur["vm_active_merges"], nil
+	case ThresholdVMPendingRows:
+		if !has("vm_pending_rows") {
+			return 0, errNoLoadData
+		}
+		return cur["vm_pending_rows"], nil
+	case ThresholdVMSlowInserts:
+		slow, ok1 := delta("vm_slow_row_inserts_total")
+		inserted, ok2 := delta("vm_rows_inserted_total")
+		if !ok1 || !ok2 {
+			return 0, errNoLoadData
+		}
+		if inserted == 0 {
+			return 0, nil
+		}
+		return 100 * slow / inserted, nil
+	default:
+		return 0, errNoLoadData
+	}
+}
+
+// parseMetricSums parses Prometheus text exposition format and returns the sum of all series of each metric
+func parseMetricSums(body []byte) map[string]float64 {
+	sums := make(map[string]float64)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// the value follows the name and labels, optional timestamp follows the value
+		var name string
+		var fields []string
+		if i := strings.IndexByte(line, '{'); i != -1 {
+			name, fields = line[:i], strings.Fields(line[strings.LastIndexByte(line, '}')+1:])
+		} else {
+			fields = strings.Fields(line)
+			name, fields = fields[0], fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		sums[name] += value
+	}
+	return sums
+}
+
+func parseSampleValue(v []interface{}) (float64, error) {
+	if len(v) != 2 {
+		return 0, errors.New("unexpected number of values")
+	}
+	str, ok := v[1].(string)
+	if !ok {
+		return 0, errors.New("value is not string")
+	}
+	val, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing value error: %s", err.Error())
+	}
+	return val, nil
+}
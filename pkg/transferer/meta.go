@@ -27,7 +27,13 @@ func ReadMetaFromDump(dumpPath string, piped bool) (*dump.Meta, error) {
 	}
 	defer file.Close()
 
-	gzr, err := gzip.NewReader(file)
+	return ReadMetaFromReader(file)
+}
+
+// ReadMetaFromReader reads meta from the dump stream. Meta is written after the chunks,
+// so the whole dump is read and decompressed to find it
+func ReadMetaFromReader(r io.Reader) (*dump.Meta, error) {
+	gzr, err := gzip.NewReader(r)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to open as gzip")
 	}
@@ -49,7 +55,7 @@ func ReadMetaFromDump(dumpPath string, piped bool) (*dump.Meta, error) {
 			return nil, errors.Wrap(err, "failed to read a file from dump")
 		}
 
-		_, filename := path.Split(header.Name)
+		_, filename := path.Split(dump.NormalizeEntryName(header.Name))
 
 		if filename != dump.MetaFilename {
 			continue
@@ -66,7 +72,7 @@ func ReadMetaFromDump(dumpPath string, piped bool) (*dump.Meta, error) {
 	}
 }
 
-func writeMetafile(tw *tar.Writer, meta dump.Meta) error {
+func writeMetafile(tw *tar.Writer, meta dump.Meta, attrs EntryAttributes) error {
 	log.Debug().Msg("Writing dump meta")
 
 	metaContent, err := json.Marshal(meta)
@@ -74,12 +80,7 @@ func writeMetafile(tw *tar.Writer, meta dump.Meta) error {
 		return fmt.Errorf("failed to marshal dump meta: %s", err)
 	}
 
-	err = tw.WriteHeader(&tar.Header{
-		Typeflag: tar.TypeReg,
-		Name:     dump.MetaFilename,
-		Size:     int64(len(metaContent)),
-		Mode:     0600,
-	})
+	err = tw.WriteHeader(attrs.header(dump.MetaFilename, int64(len(metaContent))))
 	if err != nil {
 		return errors.Wrap(err, "failed to write dump meta")
 	}
@@ -97,20 +98,39 @@ func readMetafile(r io.Reader) (*dump.Meta, error) {
 		return nil, errors.Wrap(err, "failed to read bytes")
 	}
 
-	meta := &dump.Meta{}
-
-	if err := json.Unmarshal(metaBytes, meta); err != nil {
+	meta, tool, err := dump.ParseMeta(metaBytes)
+	if err != nil {
 		return nil, errors.Wrap(err, "failed to unmarshal")
 	}
+	if tool != "" {
+		log.Info().Msgf("Dump is produced by %s %s: its data is mapped onto the transferer sources", tool, meta.Version.GitCommit)
+	}
 
 	return meta, nil
 }
 
-func readAndCompareDumpMeta(r io.Reader, runtimeMeta dump.Meta) {
+func readAndCompareDumpMeta(r io.Reader, runtimeMeta dump.Meta) *dump.Meta {
 	dumpMeta, err := readMetafile(r)
 	if err != nil {
 		log.Err(err).Msgf("Failed to read meta file. No version checks could be performed")
-		return
+		return nil
+	}
+
+	if dumpMeta.Partial {
+		log.Warn().Msg("Dump is partial: export was aborted before all chunks were written")
+	}
+
+	// chunks failed on export are missing data, while dropped and empty ones were not requested or had no data
+	for _, c := range dumpMeta.SkippedChunks {
+		if c.Reason == dump.SkipReasonFailed {
+			log.Warn().Msgf("Chunk %s of %s is missing in the dump: it failed to be read on export: %s", c.Chunk, c.Source, c.Error)
+		}
+	}
+
+	for _, s := range dumpMeta.Sources {
+		if s.Aggregation != "" {
+			log.Info().Msgf("QAN metrics in the dump are aggregated by %s: imported rows have period length of the aggregation", s.Aggregation)
+		}
 	}
 
 	if dumpMeta.PMMServerVersion != runtimeMeta.PMMServerVersion {
@@ -122,4 +142,6 @@ func readAndCompareDumpMeta(r io.Reader, runtimeMeta dump.Meta) {
 		log.Warn().Msgf("Transferer version mismatch\nExported:\t%v\nCurrent:\t%v",
 			dumpMeta.Version.GitCommit, runtimeMeta.Version.GitCommit)
 	}
+
+	return dumpMeta
 }
@@ -0,0 +1,91 @@
+package transferer
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// PartSuffix is the suffix of the dump file while it's written
+const PartSuffix = ".part"
+
+// PartPath returns path of the dump file while it's written
+func PartPath(path string) string {
+	return path + PartSuffix
+}
+
+// partialDumpError is returned when export is aborted, while the dump is finalized with the chunks read before it
+// and its meta has Partial flag set
+type partialDumpError struct {
+	err error
+}
+
+func (e partialDumpError) Error() string {
+	return e.err.Error()
+}
+
+func (e partialDumpError) Unwrap() error {
+	return e.err
+}
+
+// SetKeepPartial keeps .part files of the failed export without meta for inspection, otherwise they are removed
+func (t *Transferer) SetKeepPartial(keep bool) {
+	t.keepPartial = keep
+}
+
+// SetIgnoreReadErrors continues export when a chunk fails to be read, failed chunks are recorded in the dump meta
+func (t *Transferer) SetIgnoreReadErrors(ignore bool) {
+	t.ignoreReadErrors = ignore
+}
+
+// finishParts renames .part files of the given dump paths on success of the export, errs are export errors by path.
+// On failure dumps finalized with meta are renamed to partialPaths, so they can be imported, while the other
+// .part files are removed, unless they are kept
+func (t Transferer) finishParts(paths, partialPaths []string, errs []error) error {
+	var exportErr error
+	for _, err := range errs {
+		if err != nil && exportErr == nil {
+			exportErr = err
+		}
+	}
+
+	if exportErr != nil {
+		var kept []string
+		for i, p := range paths {
+			var partial partialDumpError
+			// volume exported completely is still kept, as the dump is of no use without it
+			if errs[i] == nil || errors.As(errs[i], &partial) {
+				if err := os.Rename(PartPath(p), partialPaths[i]); err != nil {
+					log.Warn().Err(err).Msgf("Failed to rename partial dump %s", PartPath(p))
+					kept = append(kept, PartPath(p))
+					continue
+				}
+				kept = append(kept, partialPaths[i])
+				continue
+			}
+			if t.keepPartial {
+				kept = append(kept, PartPath(p))
+				continue
+			}
+			if err := os.Remove(PartPath(p)); err != nil && !os.IsNotExist(err) {
+				log.Warn().Err(err).Msgf("Failed to remove dump %s", PartPath(p))
+				continue
+			}
+			log.Debug().Msgf("Removed dump %s", PartPath(p))
+		}
+		if len(kept) == 0 {
+			return errors.Wrap(exportErr, "dump is removed")
+		}
+		return errors.Wrapf(exportErr, "partial dump is kept in %s", strings.Join(kept, ", "))
+	}
+
+	for _, p := range paths {
+		if err := os.Rename(PartPath(p), p); err != nil {
+			return errors.Wrapf(err, "failed to rename %s", PartPath(p))
+		}
+		log.Debug().Msgf("Renamed %s to %s", PartPath(p), p)
+	}
+	return nil
+}
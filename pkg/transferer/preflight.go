@@ -0,0 +1,42 @@
+package transferer
+
+import (
+	"os"
+	"pmm-transferer/pkg/dump"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// dumpDiskUsageRatio is a rough ratio of the data size on disk after import to the dump file size:
+// VM chunks are already compressed and take about 1.2 of their size, while QAN rows compressed by gzip
+// take about twice more in ClickHouse
+const dumpDiskUsageRatio = 2
+
+// EstimateImportDiskUsage estimates disk space required to import the dump by the size of its files.
+// Sizes of the sources are known from the meta only, which is the last entry, so the dump is not read
+// and the estimate doesn't depend on the imported sources
+func (t Transferer) EstimateImportDiskUsage() (int64, error) {
+	if t.piped {
+		return 0, errors.New("can't estimate disk usage of piped dump")
+	}
+
+	paths, err := dump.VolumePaths(t.dumpPath)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to find dump file")
+	}
+
+	var size int64
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to get dump file info")
+		}
+		size += info.Size()
+	}
+	required := size * dumpDiskUsageRatio
+
+	log.Debug().Msgf("Estimated %d bytes required to import the dump of %d bytes", required, size)
+
+	return required, nil
+}
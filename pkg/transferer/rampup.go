@@ -0,0 +1,202 @@
+package transferer
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// rampUpLatencyFactor is the growth of the median chunk read latency, relative to the single worker one,
+// at which no more workers are started
+const rampUpLatencyFactor = 2
+
+// SetWorkerRampUp makes export start with one reading worker and add one more every interval while the load status
+// is OK and the source latency doesn't grow, up to the number of workers. All workers start at once if interval is 0
+func (t *Transferer) SetWorkerRampUp(interval time.Duration) {
+	t.rampUpInterval = interval
+}
+
+// SetActiveWorkers limits the number of reading workers of the running export, 0 lets all of them read.
+// Workers aren't added above the number the transferer is created with
+func (t *Transferer) SetActiveWorkers(n int) {
+	t.workerLimit.set(n)
+}
+
+// workerLimit is the limit of reading workers changeable during export, see SetActiveWorkers
+type workerLimit struct {
+	mu    sync.Mutex
+	limit int
+	// changed is closed and replaced when the limit changes, waking up the waiting workers
+	changed chan struct{}
+}
+
+func newWorkerLimit() *workerLimit {
+	return &workerLimit{changed: make(chan struct{})}
+}
+
+func (l *workerLimit) set(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n != l.limit {
+		l.limit = n
+		close(l.changed)
+		l.changed = make(chan struct{})
+	}
+}
+
+func (l *workerLimit) get() (int, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit, l.changed
+}
+
+// workerRamp limits the number of reading workers during export start, so the server doesn't get
+// the burst of concurrent heavy queries. Workers with index not less than the limit wait for it to grow
+type workerRamp struct {
+	max int
+	// limit is the workers limit set during export, it's applied on top of the ramp-up
+	limit *workerLimit
+
+	mu       sync.Mutex
+	allowed  int
+	finished bool
+	// changed is closed and replaced when the limit grows, waking up the waiting workers
+	changed   chan struct{}
+	latencies []time.Duration
+	baseline  time.Duration
+}
+
+// newWorkerRamp returns nil for a single worker, nil ramp lets all workers read. All workers are allowed
+// from the start if ramp-up is disabled
+func newWorkerRamp(workers int, interval time.Duration, limit *workerLimit) *workerRamp {
+	if workers <= 1 {
+		return nil
+	}
+	allowed := workers
+	if interval > 0 {
+		allowed = 1
+	}
+	return &workerRamp{
+		max:     workers,
+		limit:   limit,
+		allowed: allowed,
+		changed: make(chan struct{}),
+	}
+}
+
+// wait blocks the worker until it's allowed to read. It returns false if the context is done
+func (r *workerRamp) wait(ctx context.Context, worker int) bool {
+	if r == nil {
+		return true
+	}
+	for {
+		r.mu.Lock()
+		allowed, changed, finished := r.allowed, r.changed, r.finished
+		r.mu.Unlock()
+		limit, limitChanged := r.limit.get()
+		if finished || worker < allowed && (limit <= 0 || worker < limit) {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-limitChanged:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// observe records the chunk read latency
+func (r *workerRamp) observe(d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latencies = append(r.latencies, d)
+}
+
+// finish lets all workers read, e.g. when the pool is empty, so the waiting workers see it and exit
+func (r *workerRamp) finish() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.finished {
+		r.finished = true
+		close(r.changed)
+		r.changed = make(chan struct{})
+	}
+}
+
+// run adjusts the number of workers every interval until all of them are started
+func (r *workerRamp) run(ctx context.Context, interval time.Duration, lc LoadStatusGetter) {
+	if r == nil || interval <= 0 {
+		return
+	}
+	log.Info().Msgf("Worker ramp-up: starting with 1 of %d workers", r.max)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if r.step(lc) {
+				log.Debug().Msg("Worker ramp-up is finished")
+				return
+			}
+		}
+	}
+}
+
+// step starts one more worker if the server is fine, or stops one if the load is high.
+// It returns true when all workers are started
+func (r *workerRamp) step(lc LoadStatusGetter) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	latency := medianDuration(r.latencies)
+	r.latencies = r.latencies[:0]
+	if r.baseline == 0 && r.allowed == 1 {
+		r.baseline = latency
+	}
+
+	allowed := r.allowed
+	switch {
+	case lc.GetLatestStatus() != LoadStatusOK || lc.GetPacingDelay() > 0:
+		if allowed > 1 {
+			allowed--
+		}
+	case latency == 0:
+		// no chunks read in the interval, e.g. workers are waiting for the load to go down
+	case r.baseline > 0 && latency > rampUpLatencyFactor*r.baseline:
+		log.Debug().Msgf("Worker ramp-up: chunk read latency %v exceeds %d times %v, holding %d workers",
+			latency, rampUpLatencyFactor, r.baseline, allowed)
+	default:
+		allowed++
+	}
+
+	if allowed != r.allowed {
+		log.Info().Msgf("Worker ramp-up: %d of %d workers reading", allowed, r.max)
+		if allowed > r.allowed {
+			close(r.changed)
+			r.changed = make(chan struct{})
+		}
+		r.allowed = allowed
+	}
+	return r.allowed >= r.max
+}
+
+func medianDuration(d []time.Duration) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), d...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
@@ -0,0 +1,86 @@
+package transferer
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	readaheadBlockSize = 4 * 1024 * 1024
+	readaheadBlocks    = 4
+)
+
+type readaheadBlock struct {
+	data []byte
+	err  error
+}
+
+// readaheadReader reads the underlying reader in a separate goroutine by big blocks,
+// so disk reads overlap with decompression and chunk writes instead of being blocked by them
+type readaheadReader struct {
+	blocks    chan readaheadBlock
+	done      chan struct{}
+	closeOnce sync.Once
+
+	cur []byte
+	err error
+}
+
+func newReadaheadReader(r io.Reader) *readaheadReader {
+	rr := &readaheadReader{
+		blocks: make(chan readaheadBlock, readaheadBlocks),
+		done:   make(chan struct{}),
+	}
+	go rr.run(r)
+	return rr
+}
+
+func (rr *readaheadReader) run(r io.Reader) {
+	defer close(rr.blocks)
+	for {
+		// the reader may be closed while the block is sent, so the next read is not started
+		select {
+		case <-rr.done:
+			return
+		default:
+		}
+
+		buf := make([]byte, readaheadBlockSize)
+		n, err := io.ReadFull(r, buf)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		select {
+		case rr.blocks <- readaheadBlock{data: buf[:n], err: err}:
+		case <-rr.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (rr *readaheadReader) Read(p []byte) (int, error) {
+	for len(rr.cur) == 0 {
+		if rr.err != nil {
+			return 0, rr.err
+		}
+		b, ok := <-rr.blocks
+		if !ok {
+			return 0, io.EOF
+		}
+		rr.cur, rr.err = b.data, b.err
+	}
+	n := copy(p, rr.cur)
+	rr.cur = rr.cur[n:]
+	return n, nil
+}
+
+// Close stops the reading goroutine, it may be called several times
+func (rr *readaheadReader) Close() error {
+	rr.closeOnce.Do(func() {
+		close(rr.done)
+	})
+	return nil
+}
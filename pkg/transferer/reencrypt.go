@@ -0,0 +1,177 @@
+package transferer
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"pmm-transferer/pkg/dump"
+	"pmm-transferer/pkg/encryption"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// ReencryptDump writes copy of the dump file with encrypted entries of the sources re-encrypted from old keys
+// to new ones. Entries are decrypted in memory one by one, other entries are copied as is. Checksums of
+// the re-encrypted entries are updated in the meta, which keeps all other fields. It returns the number
+// of re-encrypted entries. dst may be the same as src, it's replaced only when the copy is complete
+func ReencryptDump(src, dst string, oldKeys, newKeys EntryKeys) (int, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to open dump")
+	}
+	defer in.Close()
+
+	gzr, err := gzip.NewReader(bufio.NewReader(in))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to open as gzip")
+	}
+	defer gzr.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create dump")
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	bw := bufio.NewWriter(out)
+	gzw, err := gzip.NewWriterLevel(bw, gzip.BestCompression)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create gzip writer")
+	}
+	tw := tar.NewWriter(gzw)
+
+	tr := tar.NewReader(gzr)
+	checksums := make(map[string]string)
+	var metaHeader *tar.Header
+	var metaContent []byte
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to read file from dump")
+		}
+
+		dir, filename := path.Split(dump.NormalizeEntryName(header.Name))
+		if filename == dump.MetaFilename && dir == "" {
+			// meta goes last, as checksums of all entries are known then
+			metaHeader = header
+			if metaContent, err = ioutil.ReadAll(tr); err != nil {
+				return 0, errors.Wrap(err, "failed to read dump meta")
+			}
+			continue
+		}
+
+		st := dump.EntrySourceType(dir)
+		oldKey, hasOld := oldKeys[st]
+		newKey, hasNew := newKeys[st]
+		if !strings.HasSuffix(filename, encryption.FileSuffix) || !hasNew {
+			if err = copyEntry(tw, header, tr); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if !hasOld {
+			return 0, errors.Errorf("no key to decrypt %s entries", st)
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to read %s", header.Name)
+		}
+		if content, err = encryption.Decrypt(content, oldKey); err != nil {
+			return 0, errors.Wrapf(err, "failed to decrypt %s", header.Name)
+		}
+		if content, err = encryption.Encrypt(content, newKey); err != nil {
+			return 0, errors.Wrapf(err, "failed to encrypt %s", header.Name)
+		}
+		header.Size = int64(len(content))
+		if err = tw.WriteHeader(header); err != nil {
+			return 0, errors.Wrapf(err, "failed to write %s", header.Name)
+		}
+		if _, err = tw.Write(content); err != nil {
+			return 0, errors.Wrapf(err, "failed to write %s", header.Name)
+		}
+		sum := sha256.Sum256(content)
+		checksums[dump.NormalizeEntryName(header.Name)] = hex.EncodeToString(sum[:])
+		log.Debug().Msgf("Re-encrypted %s", header.Name)
+	}
+
+	if metaHeader != nil {
+		if metaContent, err = updateMetaChecksums(metaContent, checksums); err != nil {
+			return 0, err
+		}
+		metaHeader.Size = int64(len(metaContent))
+		if err = tw.WriteHeader(metaHeader); err != nil {
+			return 0, errors.Wrap(err, "failed to write dump meta")
+		}
+		if _, err = tw.Write(metaContent); err != nil {
+			return 0, errors.Wrap(err, "failed to write dump meta")
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return 0, errors.Wrap(err, "failed to finalize tar stream")
+	}
+	if err = gzw.Close(); err != nil {
+		return 0, errors.Wrap(err, "failed to finalize gzip stream")
+	}
+	if err = bw.Flush(); err != nil {
+		return 0, errors.Wrap(err, "failed to write dump")
+	}
+	if err = out.Close(); err != nil {
+		return 0, errors.Wrap(err, "failed to close dump")
+	}
+	return len(checksums), errors.Wrap(os.Rename(tmp, dst), "failed to rename dump")
+}
+
+func copyEntry(tw *tar.Writer, header *tar.Header, r io.Reader) error {
+	if err := tw.WriteHeader(header); err != nil {
+		return errors.Wrapf(err, "failed to write %s", header.Name)
+	}
+	if _, err := io.Copy(tw, r); err != nil {
+		return errors.Wrapf(err, "failed to copy %s", header.Name)
+	}
+	return nil
+}
+
+// updateMetaChecksums replaces checksums of the entries in the meta. Meta is patched as JSON object,
+// so fields unknown to this version are kept
+func updateMetaChecksums(content []byte, checksums map[string]string) ([]byte, error) {
+	if len(checksums) == 0 {
+		return content, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return nil, errors.Wrap(err, "failed to parse dump meta")
+	}
+	current := make(map[string]string)
+	if raw, ok := fields["checksums"]; ok {
+		if err := json.Unmarshal(raw, &current); err != nil {
+			return nil, errors.Wrap(err, "failed to parse dump meta checksums")
+		}
+	}
+	for name, sum := range checksums {
+		if _, ok := current[name]; ok {
+			current[name] = sum
+		}
+	}
+	raw, err := json.Marshal(current)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal dump meta checksums")
+	}
+	fields["checksums"] = raw
+	return json.Marshal(fields)
+}
@@ -0,0 +1,165 @@
+package transferer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"pmm-transferer/pkg/dump"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const DefaultErrorReportPath = "pmm-transferer-error-report.json"
+
+// ErrorReport is written on failed export/import to be attached to a bug report
+type ErrorReport struct {
+	Time         time.Time              `json:"time"`
+	Command      string                 `json:"command"`
+	Version      dump.TransfererVersion `json:"version"`
+	Error        string                 `json:"error"`
+	Progress     Progress               `json:"progress"`
+	LoadStatuses []LoadStatusRecord     `json:"load_statuses,omitempty"`
+}
+
+type Progress struct {
+	// ChunksTotal is known for export only
+	ChunksTotal     int `json:"chunks_total,omitempty"`
+	ChunksProcessed int `json:"chunks_processed"`
+	// ChunksEmpty are processed chunks without data, which are not written
+	ChunksEmpty  int           `json:"chunks_empty,omitempty"`
+	FailedChunks []FailedChunk `json:"failed_chunks,omitempty"`
+	// Stages are amounts of chunks at each stage of the pipeline at the moment
+	Stages StageStats `json:"stages"`
+	// LastChange is the time any chunk has been processed or failed. Stage moves don't count as progress,
+	// e.g. readers cycling through load waits while writers are blocked
+	LastChange time.Time `json:"last_change"`
+}
+
+// StageStats are amounts of chunks at each stage of export/import pipeline
+type StageStats struct {
+	// LoadWait is the amount of export readers waiting for PMM Server load to decrease
+	LoadWait int `json:"load_wait"`
+	// Reading chunks are being read from the source on export, or from the dump on import
+	Reading int `json:"reading"`
+	// Queued chunks are read and wait for a writer
+	Queued int `json:"queued"`
+	// Writing chunks are being written to the dump on export, or to the target on import
+	Writing int `json:"writing"`
+}
+
+type pipelineStage int
+
+const (
+	stageNone pipelineStage = iota
+	stageLoadWait
+	stageReading
+	stageQueued
+	stageWriting
+)
+
+func (s *StageStats) add(stage pipelineStage, n int) {
+	switch stage {
+	case stageLoadWait:
+		s.LoadWait += n
+	case stageReading:
+		s.Reading += n
+	case stageQueued:
+		s.Queued += n
+	case stageWriting:
+		s.Writing += n
+	}
+}
+
+type FailedChunk struct {
+	Source     string        `json:"source"`
+	Filename   string        `json:"filename,omitempty"`
+	Start      *time.Time    `json:"start,omitempty"`
+	End        *time.Time    `json:"end,omitempty"`
+	Step       time.Duration `json:"step,omitempty"`
+	Table      string        `json:"table,omitempty"`
+	Index      int           `json:"index,omitempty"`
+	HTTPStatus int           `json:"http_status,omitempty"`
+	RequestID  string        `json:"request_id,omitempty"`
+	Error      string        `json:"error"`
+}
+
+func newFailedChunk(m dump.ChunkMeta, filename string, err error) FailedChunk {
+	fc := FailedChunk{
+		Source:   m.Source.String(),
+		Filename: filename,
+		Start:    m.Start,
+		End:      m.End,
+		Step:     m.Step,
+		Table:    m.Table,
+		Index:    m.Index,
+		Error:    err.Error(),
+	}
+	var respErr *dump.ResponseError
+	if errors.As(err, &respErr) {
+		fc.HTTPStatus = respErr.StatusCode
+		fc.RequestID = respErr.RequestID
+	}
+	return fc
+}
+
+type progressTracker struct {
+	m sync.Mutex
+	p Progress
+}
+
+func (t *progressTracker) addTotal(total int) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.p.ChunksTotal += total
+}
+
+func (t *progressTracker) chunkProcessed() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.p.ChunksProcessed++
+	t.p.LastChange = time.Now()
+}
+
+// chunkEmpty counts the chunk without data as processed
+func (t *progressTracker) chunkEmpty() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.p.ChunksProcessed++
+	t.p.ChunksEmpty++
+	t.p.LastChange = time.Now()
+}
+
+func (t *progressTracker) chunkFailed(fc FailedChunk) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.p.FailedChunks = append(t.p.FailedChunks, fc)
+	t.p.LastChange = time.Now()
+}
+
+// move records the chunk has moved from one pipeline stage to another
+func (t *progressTracker) move(from, to pipelineStage) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.p.Stages.add(from, -1)
+	t.p.Stages.add(to, 1)
+}
+
+func (t *progressTracker) snapshot() Progress {
+	t.m.Lock()
+	defer t.m.Unlock()
+	p := t.p
+	p.FailedChunks = append([]FailedChunk(nil), t.p.FailedChunks...)
+	return p
+}
+
+func WriteErrorReport(path string, r ErrorReport) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal error report")
+	}
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		return errors.Wrap(err, "failed to write error report")
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package transferer
+
+import (
+	"pmm-transferer/pkg/dump"
+	"sync"
+)
+
+// requestLimiter limits concurrent chunk requests to each source backend independently of the number of workers,
+// so memory usage (workers) and server protection (requests) are tuned separately
+type requestLimiter map[dump.SourceType]*requestSemaphore
+
+// requestSemaphore is the semaphore with the limit changeable while requests are running, 0 means no limit
+type requestSemaphore struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int
+	used  int
+}
+
+func newRequestSemaphore(limit int) *requestSemaphore {
+	s := &requestSemaphore{limit: limit}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// SetRequestLimits sets max concurrent chunk reads and writes of the sources by type, sources without positive limit
+// are limited by the number of workers only. Only sources set here can be limited by UpdateRequestLimits
+func (t *Transferer) SetRequestLimits(limits map[dump.SourceType]int) {
+	l := make(requestLimiter)
+	for st, n := range limits {
+		l[st] = newRequestSemaphore(n)
+	}
+	t.requests = l
+}
+
+// UpdateRequestLimits changes limits of the running transfer: requests above the new limit finish as usual,
+// while new ones wait for a free slot
+func (t *Transferer) UpdateRequestLimits(limits map[dump.SourceType]int) {
+	for st, n := range limits {
+		if s, ok := t.requests[st]; ok {
+			s.setLimit(n)
+		}
+	}
+}
+
+// acquire waits for a free request slot of the source and returns the function releasing it
+func (l requestLimiter) acquire(st dump.SourceType) (release func()) {
+	s, ok := l[st]
+	if !ok {
+		return func() {}
+	}
+	s.mu.Lock()
+	for s.limit > 0 && s.used >= s.limit {
+		s.cond.Wait()
+	}
+	s.used++
+	s.mu.Unlock()
+	return s.release
+}
+
+func (s *requestSemaphore) release() {
+	s.mu.Lock()
+	s.used--
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+func (s *requestSemaphore) setLimit(limit int) {
+	s.mu.Lock()
+	s.limit = limit
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
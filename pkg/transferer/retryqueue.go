@@ -0,0 +1,210 @@
+package transferer
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"pmm-transferer/pkg/dump"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// RetryQueueEntry is a JSON line of the retry queue file: the chunk failed to be written with its content
+// as it was sent to the target, i.e. decrypted and transformed
+type RetryQueueEntry struct {
+	Time     time.Time          `json:"time"`
+	Dump     string             `json:"dump,omitempty"`
+	Entry    string             `json:"entry"`
+	Source   string             `json:"source"`
+	Filename string             `json:"filename"`
+	Encoding dump.ChunkEncoding `json:"encoding,omitempty"`
+	Error    string             `json:"error"`
+	Content  []byte             `json:"content"`
+}
+
+// RetryQueue persists chunks failed to be written during import, so they can be imported again
+// with ImportRetryQueue after target issues are fixed. The file is created on the first failed chunk
+type RetryQueue struct {
+	mu   sync.Mutex
+	path string
+	// replace writes entries to a temporary file replacing the queue on Close, see ReplaceRetryQueue
+	replace bool
+	f       *os.File
+	w       *bufio.Writer
+	added   int
+}
+
+// OpenRetryQueue returns the queue appending failed chunks to the file
+func OpenRetryQueue(path string) *RetryQueue {
+	return &RetryQueue{path: path}
+}
+
+// ReplaceRetryQueue returns the queue replacing the file on Close with the chunks failed again,
+// the file is removed if all of them are imported. The file is kept as is if Close isn't called
+func ReplaceRetryQueue(path string) *RetryQueue {
+	return &RetryQueue{path: path, replace: true}
+}
+
+// SetRetryQueue sets the queue failed chunks are persisted to. Import continues on chunk failures
+// if they are persisted, even if errors are not ignored
+func (t *Transferer) SetRetryQueue(q *RetryQueue) {
+	t.retryQueue = q
+}
+
+// ReadRetryQueue reads chunks of the retry queue file
+func ReadRetryQueue(path string) ([]RetryQueueEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open retry queue")
+	}
+	defer f.Close()
+
+	var entries []RetryQueueEntry
+	d := json.NewDecoder(bufio.NewReader(f))
+	for d.More() {
+		var e RetryQueueEntry
+		if err = d.Decode(&e); err != nil {
+			return nil, errors.Wrapf(err, "failed to read retry queue entry #%d", len(entries)+1)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Len returns the number of chunks added to the queue
+func (q *RetryQueue) Len() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.added
+}
+
+// add persists the chunk, import fails as usual if it can't be persisted
+func (q *RetryQueue) add(e RetryQueueEntry) error {
+	if q == nil {
+		return errors.New("no retry queue")
+	}
+	e.Time = time.Now().UTC()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal retry queue entry")
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.f == nil {
+		if err = q.open(); err != nil {
+			return errors.Wrap(err, "failed to open retry queue")
+		}
+	}
+	if _, err = q.w.Write(append(data, '\n')); err == nil {
+		// entries are flushed one by one, so they survive the process being killed
+		err = q.w.Flush()
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write retry queue")
+	}
+	q.added++
+	return nil
+}
+
+func (q *RetryQueue) open() (err error) {
+	// chunks are decrypted, so the queue is readable by the owner only
+	if q.replace {
+		q.f, err = ioutil.TempFile(filepath.Dir(q.path), filepath.Base(q.path)+".*")
+		if err == nil {
+			err = q.f.Chmod(0600)
+		}
+	} else {
+		q.f, err = os.OpenFile(q.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	q.w = bufio.NewWriter(q.f)
+	return nil
+}
+
+// Close closes the queue file, replacing queue replaces the file with the chunks added
+func (q *RetryQueue) Close() error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.f == nil {
+		if q.replace {
+			if err := os.Remove(q.path); err != nil && !os.IsNotExist(err) {
+				return errors.Wrap(err, "failed to remove retry queue")
+			}
+			log.Info().Msgf("All chunks of retry queue %s are imported, the queue is removed", q.path)
+		}
+		return nil
+	}
+
+	err := q.f.Close()
+	if err == nil && q.replace {
+		err = os.Rename(q.f.Name(), q.path)
+	}
+	q.f = nil
+	if err != nil {
+		return errors.Wrap(err, "failed to close retry queue")
+	}
+	return nil
+}
+
+// ImportRetryQueue writes chunks of the retry queue to the sources, chunks failed again are added to the transferer queue
+func (t Transferer) ImportRetryQueue(entries []RetryQueueEntry) error {
+	log.Info().Msgf("Importing %d chunks of the retry queue...", len(entries))
+
+	scheduler := newImportScheduler(t.importOpts, t.progress, t.timings, t.requests, t.retryQueue)
+	skipped := make(map[string]int)
+	used := make(map[dump.Source]struct{})
+	for _, e := range entries {
+		s, ok := t.sourceByType(dump.ParseSourceType(e.Source))
+		if !ok {
+			skipped[e.Source]++
+			continue
+		}
+		used[s] = struct{}{}
+
+		log.Info().Msgf("Processing chunk '%s' of %s...", e.Entry, e.Dump)
+		c := importChunk{dump: e.Dump, name: e.Entry, filename: e.Filename, encoding: e.Encoding, content: e.Content}
+		if err := scheduler.schedule(s, c); err != nil {
+			_ = scheduler.wait()
+			return err
+		}
+	}
+	if err := scheduler.wait(); err != nil {
+		return err
+	}
+
+	for st, n := range skipped {
+		log.Warn().Msgf("Skipped %d chunks of %s: the source is not specified", n, st)
+		// skipped chunks are kept in the queue
+		for _, e := range entries {
+			if e.Source == st {
+				if err := t.retryQueue.add(e); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for s := range used {
+		if err := s.FinalizeWrites(); err != nil {
+			return errors.Wrap(err, "failed to finalize import")
+		}
+	}
+
+	log.Info().Msg("Retry queue is processed")
+	return nil
+}
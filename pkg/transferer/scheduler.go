@@ -0,0 +1,201 @@
+package transferer
+
+import (
+	"bytes"
+	"io"
+	"pmm-transferer/pkg/dump"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+type importChunk struct {
+	// dump is the path of the dump the chunk is read from, empty for piped dumps
+	dump     string
+	name     string
+	filename string
+	encoding dump.ChunkEncoding
+	content  []byte
+}
+
+// importScheduler writes chunks of each source by its own writers, so sources are imported concurrently.
+// Sources importing in order get a single writer, others get the configured number of writers
+type importScheduler struct {
+	opts     ImportOptions
+	progress *progressTracker
+	timings  *timingTracker
+	requests requestLimiter
+	// retryQueue persists failed chunks, see Transferer.SetRetryQueue
+	retryQueue *RetryQueue
+
+	queues map[dump.Source]chan importChunk
+	wg     sync.WaitGroup
+
+	errOnce sync.Once
+	err     error
+	failed  chan struct{}
+}
+
+func newImportScheduler(opts ImportOptions, progress *progressTracker, timings *timingTracker, requests requestLimiter,
+	retryQueue *RetryQueue) *importScheduler {
+	return &importScheduler{
+		opts:       opts,
+		progress:   progress,
+		timings:    timings,
+		requests:   requests,
+		retryQueue: retryQueue,
+		queues:     make(map[dump.Source]chan importChunk),
+		failed:     make(chan struct{}),
+	}
+}
+
+// schedule queues the chunk for writing, it returns error if any chunk has failed to be written
+func (s *importScheduler) schedule(src dump.Source, c importChunk) error {
+	q, ok := s.queues[src]
+	if !ok {
+		writers := 1
+		if dump.SourceImportOrder(src) == dump.ImportAnyOrder {
+			writers = s.opts.Workers
+		}
+		q = make(chan importChunk, writers)
+		s.queues[src] = q
+
+		log.Debug().Msgf("Starting %d chunk writers for %v", writers, src.Type())
+		for i := 0; i < writers; i++ {
+			s.wg.Add(1)
+			go s.write(src, q)
+		}
+	}
+
+	s.progress.move(stageNone, stageQueued)
+	select {
+	case q <- c:
+		return nil
+	case <-s.failed:
+		s.progress.move(stageQueued, stageNone)
+		return s.err
+	}
+}
+
+func (s *importScheduler) write(src dump.Source, q <-chan importChunk) {
+	defer s.wg.Done()
+
+	for c := range q {
+		select {
+		case <-s.failed:
+			// chunks queued before the failure are dropped
+			s.progress.move(stageQueued, stageNone)
+			continue
+		default:
+		}
+
+		s.progress.move(stageQueued, stageWriting)
+		start := time.Now()
+		batched, err := s.writeChunk(src, c)
+		s.timings.record(TimingWrite, start)
+		s.progress.move(stageWriting, stageNone)
+		if batched {
+			// the chunk is reported once its batch is sent
+			continue
+		}
+		s.chunkWritten(src, c, err)
+	}
+}
+
+// chunkWritten counts the written chunk, failed chunk is added to the retry queue, skipped or fails the import
+func (s *importScheduler) chunkWritten(src dump.Source, c importChunk, err error) {
+	if err == nil {
+		s.progress.chunkProcessed()
+		log.Info().Msgf("Successfully processed '%v'", c.name)
+		return
+	}
+
+	s.progress.chunkFailed(newFailedChunk(dump.ChunkMeta{Source: src.Type()}, c.filename, err))
+	if s.retryQueue != nil {
+		qerr := s.retryQueue.add(RetryQueueEntry{
+			Dump:     c.dump,
+			Entry:    c.name,
+			Source:   src.Type().String(),
+			Filename: c.filename,
+			Encoding: c.encoding,
+			Error:    err.Error(),
+			Content:  c.content,
+		})
+		if qerr == nil {
+			log.Error().Err(err).Msgf("Failed to process '%v', added to the retry queue", c.name)
+			return
+		}
+		log.Error().Err(qerr).Msgf("Failed to add '%v' to the retry queue", c.name)
+	}
+	if s.opts.IgnoreErrors {
+		log.Error().Err(err).Msgf("Failed to process '%v', skipped", c.name)
+		return
+	}
+	s.fail(errors.Wrap(err, "failed to write chunk"))
+}
+
+// writeChunk writes the chunk retrying it with backoff, as transient server errors fail a single chunk only.
+// It returns true if the chunk is added to a batch, such chunk is reported by chunkWritten once the batch is sent
+func (s *importScheduler) writeChunk(src dump.Source, c importChunk) (bool, error) {
+	report := func(err error) {
+		s.chunkWritten(src, c, err)
+	}
+	for attempt := 1; ; attempt++ {
+		release := s.requests.acquire(src.Type())
+		batched, err := writeEncodedChunk(src, c.filename, c.encoding, bytes.NewReader(c.content), report)
+		release()
+		if err == nil || attempt >= s.opts.ChunkAttempts {
+			return batched, err
+		}
+		log.Warn().Err(err).Msgf("Failed to process '%v', retrying (%d/%d)...", c.name, attempt, s.opts.ChunkAttempts)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// writeEncodedChunk writes the chunk by the source write method matching the chunk encoding.
+// Sources writing a single encoding and chunks of undetermined encoding are written as before encodings were recorded,
+// unless the source batches chunks
+func writeEncodedChunk(src dump.Source, filename string, e dump.ChunkEncoding, r io.Reader,
+	report dump.BatchReport) (bool, error) {
+	if b, ok := src.(dump.BatchWriter); ok {
+		return b.WriteBatchedChunk(filename, e, r, report)
+	}
+	w, ok := src.(dump.EncodingWriter)
+	if !ok || e == dump.EncodingUndetermined {
+		return false, src.WriteChunk(filename, r)
+	}
+	if !dump.SupportsEncoding(w, e) {
+		return false, errors.Errorf("%s chunk encoding is not supported by %v target", e, src.Type())
+	}
+	return false, w.WriteEncodedChunk(filename, e, r)
+}
+
+func (s *importScheduler) fail(err error) {
+	s.errOnce.Do(func() {
+		s.err = err
+		close(s.failed)
+	})
+}
+
+// wait stops accepting chunks, waits for queued chunks to be written and returns the first write error.
+// Partially filled batches are sent, so their chunks are reported before it returns
+func (s *importScheduler) wait() error {
+	sources := make([]dump.Source, 0, len(s.queues))
+	for src, q := range s.queues {
+		close(q)
+		sources = append(sources, src)
+	}
+	s.queues = make(map[dump.Source]chan importChunk)
+	s.wg.Wait()
+
+	for _, src := range sources {
+		if b, ok := src.(dump.BatchWriter); ok {
+			if err := b.FlushBatches(); err != nil {
+				s.fail(errors.Wrap(err, "failed to send import batch"))
+			}
+		}
+	}
+	return s.err
+}
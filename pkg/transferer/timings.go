@@ -0,0 +1,95 @@
+package transferer
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Chunk processing stages timed for the summary
+const (
+	// TimingFetch is reading the chunk from PMM Server on export, or reading and decrypting the dump entry on import
+	TimingFetch = "fetch"
+	// TimingCompress is encrypting and compressing the chunk into the dump on export, including the dump file write
+	TimingCompress = "compress"
+	// TimingWrite is writing the chunk to PMM Server on import, including retries
+	TimingWrite = "write"
+)
+
+var timingStages = []string{TimingFetch, TimingCompress, TimingWrite}
+
+// TimingStats are durations of a stage over all chunks
+type TimingStats struct {
+	Stage  string
+	Chunks int
+	Total  time.Duration
+	P50    time.Duration
+	P90    time.Duration
+	P99    time.Duration
+	Max    time.Duration
+}
+
+type timingTracker struct {
+	mu        sync.Mutex
+	durations map[string][]time.Duration
+}
+
+// Timings returns stats of the stages chunks have passed, in the pipeline order
+func (t Transferer) Timings() []TimingStats {
+	return t.timings.stats()
+}
+
+// record adds the duration since start to the stage, it's safe to call on nil tracker
+func (t *timingTracker) record(stage string, start time.Time) {
+	if t == nil {
+		return
+	}
+	d := time.Since(start)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.durations == nil {
+		t.durations = make(map[string][]time.Duration)
+	}
+	t.durations[stage] = append(t.durations[stage], d)
+}
+
+func (t *timingTracker) stats() []TimingStats {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var stats []TimingStats
+	for _, stage := range timingStages {
+		ds := append([]time.Duration(nil), t.durations[stage]...)
+		if len(ds) == 0 {
+			continue
+		}
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+
+		s := TimingStats{
+			Stage:  stage,
+			Chunks: len(ds),
+			P50:    percentile(ds, 50),
+			P90:    percentile(ds, 90),
+			P99:    percentile(ds, 99),
+			Max:    ds[len(ds)-1],
+		}
+		for _, d := range ds {
+			s.Total += d
+		}
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// percentile returns the nearest-rank percentile of the sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p + 99) / 100
+	if i < 1 {
+		i = 1
+	}
+	return sorted[i-1]
+}
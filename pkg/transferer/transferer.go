@@ -6,11 +6,14 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"pmm-transferer/pkg/dump"
-	"runtime"
+	"pmm-transferer/pkg/transform"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -21,7 +24,34 @@ type Transferer struct {
 	dumpPath         string
 	sources          []dump.Source
 	readWorkersCount int
-	piped            bool
+	// writeWorkersCount is the number of goroutines compressing chunks, see SetWriteWorkers
+	writeWorkersCount int
+	importOpts        ImportOptions
+	piped             bool
+	progress          *progressTracker
+	entryAttrs        EntryAttributes
+	entryKeys         EntryKeys
+	transforms        transform.Pipeline
+	// requests limits concurrent requests to the source backends, see SetRequestLimits
+	requests requestLimiter
+	// keepPartial keeps .part files of the failed export, see SetKeepPartial
+	keepPartial bool
+	// ignoreReadErrors skips chunks failed to be read on export, see SetIgnoreReadErrors
+	ignoreReadErrors bool
+	// journal records written chunks, see SetJournal
+	journal *Journal
+	// cache keeps chunks read from the sources, see SetChunkCache
+	cache *ChunkCache
+	// retryQueue persists chunks failed to be imported, see SetRetryQueue
+	retryQueue *RetryQueue
+	// timings are durations of chunk processing stages, see Timings
+	timings *timingTracker
+	// codecs compress entries of the sources, see SetChunkCodecs
+	codecs ChunkCodecs
+	// rampUpInterval is the period of starting one more reading worker, see SetWorkerRampUp
+	rampUpInterval time.Duration
+	// workerLimit limits reading workers of the running export, see SetActiveWorkers
+	workerLimit *workerLimit
 }
 
 func New(dumpPath string, piped bool, s []dump.Source, workersCount int) (*Transferer, error) {
@@ -30,31 +60,76 @@ func New(dumpPath string, piped bool, s []dump.Source, workersCount int) (*Trans
 	}
 
 	if workersCount <= 0 {
-		workersCount = runtime.NumCPU()
+		workersCount = AvailableCPUs()
+		log.Debug().Msgf("Using %d workers by default", workersCount)
 	}
 
 	return &Transferer{
-		dumpPath:         dumpPath,
-		sources:          s,
-		readWorkersCount: workersCount,
-		piped:            piped,
+		dumpPath:          dumpPath,
+		sources:           s,
+		readWorkersCount:  workersCount,
+		writeWorkersCount: 1,
+		importOpts:        ImportOptions{Workers: 1, ChunkAttempts: 1},
+		piped:             piped,
+		progress:          new(progressTracker),
+		timings:           new(timingTracker),
+		entryAttrs:        EntryAttributes{Mode: DefaultEntryMode},
+		workerLimit:       newWorkerLimit(),
 	}, nil
 }
 
+func (t *Transferer) SetEntryAttributes(a EntryAttributes) {
+	t.entryAttrs = a
+}
+
+// SetTransforms sets stages applied to each chunk: on export after it's read, on import before it's written
+func (t *Transferer) SetTransforms(p transform.Pipeline) {
+	t.transforms = p
+}
+
+// ImportOptions control how chunks are written on import
+type ImportOptions struct {
+	// Workers is the number of concurrent chunk writers for sources accepting chunks in any order
+	Workers int
+	// ChunkAttempts is the number of attempts to write a chunk before it's considered failed
+	ChunkAttempts int
+	// IgnoreErrors continues import when a chunk fails, failed chunks are recorded in the progress
+	IgnoreErrors bool
+}
+
+func (t *Transferer) SetImportOptions(o ImportOptions) {
+	if o.Workers <= 0 {
+		o.Workers = 1
+	}
+	if o.ChunkAttempts <= 0 {
+		o.ChunkAttempts = 1
+	}
+	t.importOpts = o
+}
+
 type ChunkPool interface {
 	Next() (dump.ChunkMeta, bool)
+	Len() int
+	Chunks() []dump.ChunkMeta
 }
 
 type LoadStatusGetter interface {
 	GetLatestStatus() LoadStatus
+	GetPacingDelay() time.Duration
 }
 
 const maxChunksInMem = 4
 
-func (t Transferer) readChunksFromSource(ctx context.Context, lc LoadStatusGetter, p ChunkPool, chunkC chan<- *dump.Chunk) error {
+func (t Transferer) readChunksFromSource(ctx context.Context, lc LoadStatusGetter, p ChunkPool, chunkC chan<- *dump.Chunk,
+	worker int, ramp *workerRamp) error {
 	for {
 		log.Debug().Msg("New chunks reading loop iteration has been started")
 
+		if !ramp.wait(ctx, worker) {
+			log.Debug().Msg("Context is done, stopping chunks reading")
+			return ctx.Err()
+		}
+
 		select {
 		case <-ctx.Done():
 			log.Debug().Msg("Context is done, stopping chunks reading")
@@ -62,8 +137,15 @@ func (t Transferer) readChunksFromSource(ctx context.Context, lc LoadStatusGette
 		default:
 			switch lc.GetLatestStatus() {
 			case LoadStatusWait:
-				time.Sleep(MaxLoadWaitDuration)
 				log.Debug().Msgf("Got wait load status: putting chunks reading to sleep for %v", MaxLoadWaitDuration)
+				t.progress.move(stageNone, stageLoadWait)
+				select {
+				case <-time.After(MaxLoadWaitDuration):
+				case <-ctx.Done():
+					t.progress.move(stageLoadWait, stageNone)
+					return ctx.Err()
+				}
+				t.progress.move(stageLoadWait, stageNone)
 				continue
 			case LoadStatusTerminate:
 				log.Debug().Msg("Got terminate load status: stopping chunks reading")
@@ -73,9 +155,22 @@ func (t Transferer) readChunksFromSource(ctx context.Context, lc LoadStatusGette
 				return errors.New("unknown load status")
 			}
 
+			if d := lc.GetPacingDelay(); d > 0 {
+				log.Debug().Msgf("Pacing chunks reading: sleeping for %v", d)
+				t.progress.move(stageNone, stageLoadWait)
+				select {
+				case <-time.After(d):
+				case <-ctx.Done():
+					t.progress.move(stageLoadWait, stageNone)
+					return ctx.Err()
+				}
+				t.progress.move(stageLoadWait, stageNone)
+			}
+
 			chMeta, ok := p.Next()
 			if !ok {
 				log.Debug().Msg("Pool is empty: stopping chunks reading")
+				ramp.finish()
 				return nil
 			}
 
@@ -84,9 +179,17 @@ func (t Transferer) readChunksFromSource(ctx context.Context, lc LoadStatusGette
 				return errors.New("failed to find source to read chunk")
 			}
 
-			c, err := s.ReadChunk(chMeta)
+			t.progress.move(stageNone, stageReading)
+			readStart := time.Now()
+			c, err := t.readChunk(s, chMeta)
+			ramp.observe(time.Since(readStart))
+			if err != nil && t.ignoreReadErrors {
+				log.Error().Err(err).Msgf("Failed to read chunk %s of %s, skipped", chMeta.String(), chMeta.Source)
+				c, err = &dump.Chunk{ChunkMeta: chMeta, Skipped: dump.SkipReasonFailed, SkipError: err.Error()}, nil
+			}
 			if err != nil {
-				return errors.Wrap(err, "failed to read chunk")
+				t.progress.move(stageReading, stageNone)
+				return err
 			}
 
 			log.Debug().
@@ -94,12 +197,55 @@ func (t Transferer) readChunksFromSource(ctx context.Context, lc LoadStatusGette
 				Str("filename", c.Filename).
 				Msg("Successfully read chunk. Sending to chunks channel...")
 
-			chunkC <- c
+			t.progress.move(stageReading, stageQueued)
+			select {
+			case chunkC <- c:
+			case <-ctx.Done():
+				t.progress.move(stageQueued, stageNone)
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// readChunk reads the chunk from the source and transforms it. Chunk dropped by transformation is marked as skipped
+func (t Transferer) readChunk(s dump.Source, m dump.ChunkMeta) (*dump.Chunk, error) {
+	start := time.Now()
+	c, ok := t.cache.get(s, m)
+	if !ok {
+		release := t.requests.acquire(s.Type())
+		var err error
+		c, err = s.ReadChunk(m)
+		release()
+		if err != nil {
+			t.progress.chunkFailed(newFailedChunk(m, "", err))
+			return nil, errors.Wrap(err, "failed to read chunk")
 		}
+		t.cache.put(s, m, c)
 	}
+	t.timings.record(TimingFetch, start)
+
+	if dump.IsEmptyChunk(s, c.Filename, c.Encoding, c.Content) {
+		// empty chunks go to the writer, so they are recorded in the meta
+		c.Empty = true
+		return c, nil
+	}
+
+	var err error
+
+	c.Content, err = t.transforms.Apply(c.Source, c.Filename, c.Content)
+	if err != nil {
+		t.progress.chunkFailed(newFailedChunk(m, "", err))
+		return nil, errors.Wrap(err, "failed to transform chunk")
+	}
+	if c.Content == nil {
+		// dropped chunks go to the writer, so they are recorded in the meta
+		c.Skipped = dump.SkipReasonTransform
+	}
+	return c, nil
 }
 
-func getDumpFilepath(customPath string, ts time.Time) (string, error) {
+func GetDumpFilepath(customPath string, ts time.Time) (string, error) {
 	autoFilename := fmt.Sprintf("pmm-dump-%v.tar.gz", ts.Unix())
 	if customPath == "" {
 		return autoFilename, nil
@@ -112,111 +258,66 @@ func getDumpFilepath(customPath string, ts time.Time) (string, error) {
 
 	if (err == nil && customPathInfo.IsDir()) || os.IsPathSeparator(customPath[len(customPath)-1]) {
 		// file exists and it's directory
-		return path.Join(customPath, autoFilename), nil
+		return filepath.Join(customPath, autoFilename), nil
 	}
 
 	return customPath, nil
 }
 
-func (t Transferer) writeChunksToFile(ctx context.Context, meta dump.Meta, chunkC <-chan *dump.Chunk) error {
-	var file *os.File
+// Export writes the dump. Dump file is written as .part file and renamed on success,
+// so watchers of the dump directory never get incomplete dumps
+func (t Transferer) Export(ctx context.Context, lc LoadStatusGetter, meta dump.Meta, pool ChunkPool) error {
 	if t.piped {
-		file = os.Stdout
-	} else {
-		exportTS := time.Now().UTC()
-		log.Debug().Msgf("Trying to determine filepath")
-		filepath, err := getDumpFilepath(t.dumpPath, exportTS)
-		if err != nil {
+		if err := t.export(ctx, lc, meta, pool); err != nil {
 			return err
 		}
-
-		log.Debug().Msgf("Preparing dump file: %s", filepath)
-		if err := os.MkdirAll(path.Dir(filepath), 0777); err != nil {
-			return errors.Wrap(err, "failed to create folders for the dump file")
-		}
-		file, err = os.Create(filepath)
-		if err != nil {
-			return errors.Wrapf(err, "failed to create %s", filepath)
-		}
+		log.Info().Msg("Successfully exported!")
+		return nil
 	}
-	defer file.Close()
 
-	gzw, err := gzip.NewWriterLevel(file, gzip.BestCompression)
-	if err != nil {
-		return errors.Wrap(err, "failed to create gzip writer")
-	}
-	defer gzw.Close()
-
-	tw := tar.NewWriter(gzw)
-	defer tw.Close()
-
-	for {
-		log.Debug().Msg("New chunks writing loop iteration has been started")
-
-		select {
-		case <-ctx.Done():
-			log.Debug().Msg("Context is done, stopping chunks writing")
-			return ctx.Err()
-		default:
-			c, ok := <-chunkC
-			if !ok {
-				if err := writeMetafile(tw, meta); err != nil {
-					return err
-				}
-
-				log.Debug().Msg("Chunks channel is closed: stopping chunks writing")
-				return nil
-			}
-
-			s, ok := t.sourceByType(c.Source)
-			if !ok {
-				return errors.New("failed to find source to write chunk")
-			}
-
-			log.Info().
-				Stringer("source", c.Source).
-				Str("filename", c.Filename).
-				Msg("Writing chunk to the dump...")
-
-			chunkSize := int64(len(c.Content))
-			if chunkSize > meta.MaxChunkSize {
-				meta.MaxChunkSize = chunkSize
-			}
-
-			err = tw.WriteHeader(&tar.Header{
-				Typeflag: tar.TypeReg,
-				Name:     path.Join(s.Type().String(), c.Filename),
-				Size:     chunkSize,
-				Mode:     0600,
-			})
-			if err != nil {
-				return errors.Wrap(err, "failed to write file header")
-			}
-
-			if _, err = tw.Write(c.Content); err != nil {
-				return errors.Wrap(err, "failed to write chunk content")
-			}
-		}
+	pt := t
+	pt.dumpPath = PartPath(t.dumpPath)
+	exportErr := pt.export(ctx, lc, meta, pool)
+	if err := t.finishParts([]string{t.dumpPath}, []string{dump.PartialPath(t.dumpPath)}, []error{exportErr}); err != nil {
+		return err
 	}
+	log.Info().Msg("Successfully exported!")
+	return nil
 }
 
-func (t Transferer) Export(ctx context.Context, lc LoadStatusGetter, meta dump.Meta, pool ChunkPool) error {
+func (t Transferer) export(ctx context.Context, lc LoadStatusGetter, meta dump.Meta, pool ChunkPool) error {
 	log.Info().Msg("Exporting metrics...")
 
+	t.progress.addTotal(pool.Len())
+
 	chunksCh := make(chan *dump.Chunk, maxChunksInMem)
 	log.Debug().
 		Int("size", maxChunksInMem).
 		Msg("Created chunks channel")
 
-	errCh := make(chan error)
+	// readers are stopped on the first read error, while already read chunks are still written
+	readCtx, abortRead := context.WithCancel(ctx)
+	defer abortRead()
+
+	var aborted int32
+	readErrCh := make(chan error, t.readWorkersCount)
 
 	readWG := &sync.WaitGroup{}
 
+	ramp := newWorkerRamp(t.readWorkersCount, t.rampUpInterval, t.workerLimit)
+	go ramp.run(readCtx, t.rampUpInterval, lc)
+
 	log.Debug().Msgf("Starting %d goroutines to read chunks from sources...", t.readWorkersCount)
 	readWG.Add(t.readWorkersCount)
 	for i := 0; i < t.readWorkersCount; i++ {
+		worker := i
 		go func() {
-			errCh <- t.readChunksFromSource(ctx, lc, pool, chunksCh)
+			err := t.readChunksFromSource(readCtx, lc, pool, chunksCh, worker, ramp)
+			if err != nil {
+				atomic.StoreInt32(&aborted, 1)
+				abortRead()
+			}
+			readErrCh <- err
 			readWG.Done()
 			log.Debug().Msgf("Exiting from read chunks goroutine")
 		}()
@@ -230,54 +331,186 @@ func (t Transferer) Export(ctx context.Context, lc LoadStatusGetter, meta dump.M
 	}()
 
 	log.Debug().Msg("Starting single goroutine for writing chunks to the dump...")
+	writeErrCh := make(chan error)
 	go func() {
-		errCh <- t.writeChunksToFile(ctx, meta, chunksCh)
+		// writer isn't stopped with the readers, so chunks read before the deadline are still written into partial dump
+		writeErrCh <- t.writeChunksToFile(context.Background(), meta, pool.Chunks(), chunksCh, &aborted)
 		log.Debug().Msgf("Exiting from write chunks goroutine")
 	}()
 
 	log.Debug().Msg("Waiting for all chunks to be processed...")
-	for i := 0; i < t.readWorkersCount+1; i++ {
-		log.Debug().Msgf("Waiting for #%d status to be reported...", i)
-		if err := <-errCh; err != nil {
-			log.Debug().Msg("Got error, finishing export")
-			return err
+	if err := <-writeErrCh; err != nil {
+		log.Debug().Msg("Got error, finishing export")
+		return err
+	}
+
+	// chunks channel is closed by now, so all readers have reported their status
+	var readErr error
+	for i := 0; i < t.readWorkersCount; i++ {
+		// errors of the readers stopped by abort are not the reason of it
+		if err := <-readErrCh; err != nil && (readErr == nil || errors.Is(readErr, context.Canceled)) {
+			readErr = err
 		}
 	}
 
-	log.Info().Msg("Successfully exported!")
+	if readErr != nil {
+		if t.piped {
+			return errors.Wrap(readErr, "export is aborted, partial dump is written")
+		}
+		return partialDumpError{err: errors.Wrap(readErr, "export is aborted")}
+	}
 
 	return nil
 }
 
-func (t Transferer) Import(runtimeMeta dump.Meta) error {
+// ExportVolumes splits chunks into the given number of shards, which are exported concurrently
+// by independent pipelines into separate volume files. Returns paths of the volumes
+func (t Transferer) ExportVolumes(ctx context.Context, lc LoadStatusGetter, meta dump.Meta, chunks []dump.ChunkMeta, volumes int) ([]string, error) {
+	if t.piped {
+		return nil, errors.New("multi-volume dump can't be written to STDOUT")
+	}
+	if len(chunks) == 0 {
+		return nil, errors.New("no chunks to export")
+	}
+	if volumes > len(chunks) {
+		volumes = len(chunks)
+	}
+
+	workersCount := t.readWorkersCount / volumes
+	if workersCount < 1 {
+		workersCount = 1
+	}
+
+	paths := make([]string, 0, volumes)
+	partialPaths := make([]string, 0, volumes)
+	errs := make([]error, volumes)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < volumes; i++ {
+		// each volume gets a contiguous slice of chunks, which are grouped by source and ordered by time within it,
+		// so a volume may hold the end of one source and the beginning of another
+		pool, err := dump.NewChunkPool(chunks[i*len(chunks)/volumes : (i+1)*len(chunks)/volumes])
+		if err != nil {
+			return nil, err
+		}
+
+		vt := t
+		vt.dumpPath = PartPath(dump.VolumePath(t.dumpPath, i+1))
+		vt.readWorkersCount = workersCount
+		paths = append(paths, dump.VolumePath(t.dumpPath, i+1))
+		partialPaths = append(partialPaths, dump.VolumePath(dump.PartialPath(t.dumpPath), i+1))
+
+		vMeta := meta
+		vMeta.Volume, vMeta.Volumes = i+1, volumes
+
+		log.Debug().Msgf("Starting export of volume %s...", vt.dumpPath)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := vt.export(ctx, lc, vMeta, pool); err != nil {
+				errs[i] = errors.Wrap(err, "failed to export volume")
+			}
+		}(i)
+	}
+
+	// volumes are not cancelled on failure of another one, so each of them is finalized
+	wg.Wait()
+	// volumes are renamed only when all of them are exported, so the dump is never seen incomplete
+	if err := t.finishParts(paths, partialPaths, errs); err != nil {
+		return nil, err
+	}
+	log.Info().Msg("Successfully exported!")
+
+	return paths, nil
+}
+
+// Import writes dump chunks to the sources and returns meta of the imported dump files
+func (t Transferer) Import(runtimeMeta dump.Meta) ([]dump.Meta, error) {
 	log.Info().Msg("Importing metrics...")
 
-	var file *os.File
+	var metas []dump.Meta
 	if t.piped {
-		file = os.Stdin
+		meta, err := t.importFile(os.Stdin, runtimeMeta)
+		if err != nil {
+			return nil, err
+		}
+		if meta != nil {
+			metas = append(metas, *meta)
+		}
 	} else {
-		var err error
-		log.Info().
-			Str("path", t.dumpPath).
-			Msg("Opening dump file...")
-
-		file, err = os.Open(t.dumpPath)
+		paths, err := dump.VolumePaths(t.dumpPath)
 		if err != nil {
-			return errors.Wrap(err, "failed to open file")
+			return nil, errors.Wrap(err, "failed to find dump file")
+		}
+		for _, p := range paths {
+			log.Info().
+				Str("path", p).
+				Msg("Opening dump file...")
+
+			file, err := os.Open(p)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to open file")
+			}
+			meta, err := t.importFile(file, runtimeMeta)
+			file.Close()
+			if err != nil {
+				return nil, err
+			}
+			if meta != nil {
+				metas = append(metas, *meta)
+			}
+		}
+	}
+
+	log.Debug().Msg("Finalizing writes...")
+
+	for _, s := range t.sources {
+		if err := s.FinalizeWrites(); err != nil {
+			return nil, errors.Wrap(err, "failed to finalize import")
 		}
 	}
-	defer file.Close()
 
-	gzr, err := gzip.NewReader(file)
+	log.Info().Msg("Successfully imported!")
+
+	return metas, nil
+}
+
+// ImportPriority imports the dump file twice: first into the priority sources, e.g. writing series of the most
+// important metrics only, then into the transferer sources writing the rest. Metas of the second import are returned
+func (t Transferer) ImportPriority(runtimeMeta dump.Meta, priority []dump.Source) ([]dump.Meta, error) {
+	if t.piped {
+		return nil, errors.New("piped dump can't be imported twice")
+	}
+
+	p := t
+	p.sources = priority
+	log.Info().Msg("Importing priority data...")
+	if _, err := p.Import(runtimeMeta); err != nil {
+		return nil, errors.Wrap(err, "failed to import priority data")
+	}
+
+	log.Info().Msg("Importing the rest of data...")
+	return t.Import(runtimeMeta)
+}
+
+func (t Transferer) importFile(file *os.File, runtimeMeta dump.Meta) (*dump.Meta, error) {
+	rr := newReadaheadReader(file)
+	defer rr.Close()
+
+	gzr, err := gzip.NewReader(rr)
 	if err != nil {
-		return errors.Wrap(err, "failed to open as gzip")
+		return nil, errors.Wrap(err, "failed to open as gzip")
 	}
 	defer gzr.Close()
 
 	tr := tar.NewReader(gzr)
 
+	var meta *dump.Meta
 	var metafileExists bool
 
+	scheduler := newImportScheduler(t.importOpts, t.progress, t.timings, t.requests, t.retryQueue)
+	// sources, which encrypted entries are skipped for, as there is no key
+	noKeySources := make(map[dump.SourceType]int)
+
 	for {
 		log.Debug().Msg("Reading file from dump...")
 
@@ -289,22 +522,30 @@ func (t Transferer) Import(runtimeMeta dump.Meta) error {
 		}
 
 		if err != nil {
-			return errors.Wrap(err, "failed to read file from dump")
+			_ = scheduler.wait()
+			return nil, errors.Wrap(err, "failed to read file from dump")
 		}
 
-		dir, filename := path.Split(header.Name)
+		dir, filename := path.Split(dump.NormalizeEntryName(header.Name))
 
 		if filename == dump.MetaFilename {
-			readAndCompareDumpMeta(tr, runtimeMeta)
+			meta = readAndCompareDumpMeta(tr, runtimeMeta)
 			metafileExists = true
 			continue
 		}
 
+		if dir == "" {
+			log.Debug().Msgf("Skipping '%s': it's not a chunk", header.Name)
+			continue
+		}
+
 		log.Info().Msgf("Processing chunk '%s'...", header.Name)
 
-		st := dump.ParseSourceType(dir[:len(dir)-1])
+		st := dump.EntrySourceType(dir)
 		if st == dump.UndefinedSource {
-			return errors.Errorf("corrupted dump: found undefined source: %s", dir)
+			// data of external sources can be imported by their plugins only
+			log.Warn().Msgf("Found dump data of unknown source %s, specify its plugin with --plugin to import it - skipped", dir)
+			continue
 		}
 
 		s, ok := t.sourceByType(st)
@@ -313,23 +554,135 @@ func (t Transferer) Import(runtimeMeta dump.Meta) error {
 			continue
 		}
 
-		if err = s.WriteChunk(filename, tr); err != nil {
-			return errors.Wrap(err, "failed to write chunk")
+		t.progress.move(stageNone, stageReading)
+		start := time.Now()
+		filename, content, err := t.readEntry(tr, header, st, filename, noKeySources)
+		t.timings.record(TimingFetch, start)
+		t.progress.move(stageReading, stageNone)
+		if err != nil {
+			_ = scheduler.wait()
+			return nil, err
 		}
+		if content == nil {
+			continue
+		}
+
+		encoding := dump.ChunkEncoding(header.PAXRecords[dump.EncodingPAXRecord])
+		if encoding == dump.EncodingUndetermined {
+			encoding = dump.FilenameEncoding(st, filename)
+		}
+		if dump.IsEmptyChunk(s, filename, encoding, content) {
+			log.Info().Msgf("Chunk '%s' has no data, skipped", header.Name)
+			t.progress.chunkEmpty()
+			continue
+		}
+		c := importChunk{dump: t.dumpOrigin(), name: header.Name, filename: filename, encoding: encoding, content: content}
+		if err = scheduler.schedule(s, c); err != nil {
+			_ = scheduler.wait()
+			return nil, err
+		}
+	}
+
+	if err = scheduler.wait(); err != nil {
+		return nil, err
+	}
 
-		log.Info().Msgf("Successfully processed '%v'", header.Name)
+	for st, skipped := range noKeySources {
+		log.Warn().Msgf("Skipped %d encrypted chunks of %v: no key is specified for the source", skipped, st)
 	}
 
 	if !metafileExists {
 		log.Error().Msg("No meta file found in dump. No version checks performed")
 	}
 
-	log.Debug().Msg("Finalizing writes...")
+	return meta, nil
+}
 
-	for _, s := range t.sources {
-		if err = s.FinalizeWrites(); err != nil {
-			return errors.Wrap(err, "failed to finalize import")
+// readEntry reads chunk entry of the dump, decrypts, decodes and transforms it. It returns nil content if the chunk is skipped
+func (t Transferer) readEntry(r io.Reader, header *tar.Header, st dump.SourceType, filename string, noKeySources map[dump.SourceType]int) (string, []byte, error) {
+	name := header.Name
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to read chunk content")
+	}
+
+	filename, content, ok, err := t.decryptEntry(st, filename, content)
+	if err != nil {
+		return "", nil, err
+	}
+	if !ok {
+		noKeySources[st]++
+		return "", nil, nil
+	}
+
+	if content, err = decodeEntry(header.PAXRecords[dump.CodecPAXRecord], content); err != nil {
+		return "", nil, errors.Wrapf(err, "failed to read %s", name)
+	}
+
+	content, err = t.transforms.Apply(st, filename, content)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "failed to transform %s", name)
+	}
+	if content == nil {
+		log.Info().Msgf("Chunk '%s' is dropped by transformation", name)
+	}
+	return filename, content, nil
+}
+
+// ChunkReader reads input of other format than the dump, passing each chunk in the dump format to emit
+type ChunkReader func(r io.Reader, emit func(filename string, content []byte) error) error
+
+// ImportConverted writes chunks of the input file converted by cr to the source of type st,
+// so backups made by other tools are imported the same way as dumps
+func (t Transferer) ImportConverted(st dump.SourceType, cr ChunkReader) error {
+	log.Info().Msgf("Importing %v data converted from %s...", st, t.dumpPath)
+
+	s, ok := t.sourceByType(st)
+	if !ok {
+		return errors.Errorf("%v source is not specified", st)
+	}
+
+	file := os.Stdin
+	if !t.piped {
+		var err error
+		if file, err = os.Open(t.dumpPath); err != nil {
+			return errors.Wrap(err, "failed to open file")
 		}
+		defer file.Close()
+	}
+
+	rr := newReadaheadReader(file)
+	defer rr.Close()
+
+	scheduler := newImportScheduler(t.importOpts, t.progress, t.timings, t.requests, t.retryQueue)
+	err := cr(rr, func(filename string, content []byte) error {
+		content, err := t.transforms.Apply(st, filename, content)
+		if err != nil {
+			return errors.Wrapf(err, "failed to transform %s", filename)
+		}
+		if content == nil {
+			log.Info().Msgf("Chunk '%s' is dropped by transformation", filename)
+			return nil
+		}
+
+		log.Info().Msgf("Processing chunk '%s'...", filename)
+		return scheduler.schedule(s, importChunk{
+			dump:     t.dumpOrigin(),
+			name:     filename,
+			filename: filename,
+			encoding: dump.FilenameEncoding(st, filename),
+			content:  content,
+		})
+	})
+	if werr := scheduler.wait(); err == nil {
+		err = werr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = s.FinalizeWrites(); err != nil {
+		return errors.Wrap(err, "failed to finalize import")
 	}
 
 	log.Info().Msg("Successfully imported!")
@@ -337,6 +690,59 @@ func (t Transferer) Import(runtimeMeta dump.Meta) error {
 	return nil
 }
 
+// dumpOrigin returns the dump path chunks are read from, as recorded in the retry queue
+func (t Transferer) dumpOrigin() string {
+	if t.piped {
+		return "stdin"
+	}
+	return t.dumpPath
+}
+
+// coveredRange returns the time range from the start of the planned chunks up to the first chunk, which isn't done.
+// Chunks are finished by workers in any order, so data after a missing chunk isn't counted as covered even if
+// later chunks are done. Returns nil if the first chunk isn't done
+func coveredRange(planned []dump.ChunkMeta, done map[string]struct{}) *dump.TimeRange {
+	var r *dump.TimeRange
+	var missing *time.Time
+	for _, m := range planned {
+		if m.Start == nil || m.End == nil {
+			continue
+		}
+		if r == nil {
+			r = &dump.TimeRange{Start: *m.Start, End: *m.End}
+		}
+		if m.Start.Before(r.Start) {
+			r.Start = *m.Start
+		}
+		if m.End.After(r.End) {
+			r.End = *m.End
+		}
+		if _, ok := done[chunkKey(m)]; !ok && (missing == nil || m.Start.Before(*missing)) {
+			missing = m.Start
+		}
+	}
+	if r == nil {
+		return nil
+	}
+	if missing != nil {
+		if !missing.After(r.Start) {
+			return nil
+		}
+		r.End = *missing
+	}
+	return r
+}
+
+// chunkKey identifies the planned chunk among chunks of all sources
+func chunkKey(m dump.ChunkMeta) string {
+	return fmt.Sprintf("%v/%s/%d/%s/%v/%s", m.Source, m.String(), m.Index, m.Table, m.Step, m.Selector)
+}
+
+// Progress returns amount of processed chunks and failed chunks details
+func (t Transferer) Progress() Progress {
+	return t.progress.snapshot()
+}
+
 func (t Transferer) sourceByType(st dump.SourceType) (dump.Source, bool) {
 	for _, s := range t.sources {
 		if s.Type() == st {
@@ -0,0 +1,78 @@
+package transferer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"pmm-transferer/pkg/dump"
+	"pmm-transferer/pkg/encryption"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// WalkDump calls fn for each entry of the dump and all of its volumes. Meta file is passed with undefined source type.
+// Entries are passed decoded as written by the source, encrypted ones are passed as is
+func WalkDump(dumpPath string, fn func(st dump.SourceType, filename string, r io.Reader) error) error {
+	paths, err := dump.VolumePaths(dumpPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to find dump file")
+	}
+	for _, p := range paths {
+		if err = walkDumpFile(p, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkDumpFile(dumpPath string, fn func(st dump.SourceType, filename string, r io.Reader) error) error {
+	file, err := os.Open(dumpPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+	defer file.Close()
+
+	rr := newReadaheadReader(file)
+	defer rr.Close()
+
+	gzr, err := gzip.NewReader(rr)
+	if err != nil {
+		return errors.Wrap(err, "failed to open as gzip")
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read file from dump")
+		}
+
+		dir, filename := path.Split(dump.NormalizeEntryName(header.Name))
+		st := dump.EntrySourceType(dir)
+
+		var r io.Reader = tr
+		if codec := header.PAXRecords[dump.CodecPAXRecord]; codec != "" && !strings.HasSuffix(filename, encryption.FileSuffix) {
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read %s", header.Name)
+			}
+			if content, err = decodeEntry(codec, content); err != nil {
+				return errors.Wrapf(err, "failed to read %s", header.Name)
+			}
+			r = bytes.NewReader(content)
+		}
+
+		if err = fn(st, filename, r); err != nil {
+			return errors.Wrapf(err, "failed to process %s", header.Name)
+		}
+	}
+}
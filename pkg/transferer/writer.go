@@ -0,0 +1,365 @@
+package transferer
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"pmm-transferer/pkg/dump"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// SetWriteWorkers sets the number of goroutines compressing chunks into the dump. Each of them writes
+// its own gzip stream to a temporary file, and the streams are concatenated into the dump in the end:
+// concatenated gzip streams are a valid gzip file, and only the last stream has the tar end marker
+func (t *Transferer) SetWriteWorkers(n int) {
+	if n <= 0 {
+		n = 1
+	}
+	t.writeWorkersCount = n
+}
+
+// dumpWriter collects meta of the chunks written by all archive writers
+type dumpWriter struct {
+	t Transferer
+
+	mu   sync.Mutex
+	meta dump.Meta
+	// planned are the chunks requested for export, done are keys of those written, empty or dropped by transformation
+	planned []dump.ChunkMeta
+	done    map[string]struct{}
+}
+
+func newDumpWriter(t Transferer, meta dump.Meta, planned []dump.ChunkMeta) *dumpWriter {
+	// sources are shared with the meta of other volumes
+	meta.Sources = append([]dump.SourceMeta(nil), meta.Sources...)
+	meta.Checksums = make(map[string]string)
+	meta.Encodings = make(map[string]dump.ChunkEncoding)
+	for i := range meta.Sources {
+		meta.Sources[i].Chunks, meta.Sources[i].Size = 0, 0
+		_, meta.Sources[i].Encrypted = t.entryKeys[dump.ParseSourceType(meta.Sources[i].Type)]
+	}
+	return &dumpWriter{
+		t:       t,
+		meta:    meta,
+		planned: planned,
+		done:    make(map[string]struct{}),
+	}
+}
+
+func (t Transferer) writeChunksToFile(ctx context.Context, meta dump.Meta, planned []dump.ChunkMeta, chunkC <-chan *dump.Chunk,
+	aborted *int32) error {
+	var file *os.File
+	if t.piped {
+		file = os.Stdout
+	} else {
+		log.Debug().Msgf("Preparing dump file: %s", t.dumpPath)
+		if err := os.MkdirAll(filepath.Dir(t.dumpPath), 0777); err != nil {
+			return errors.Wrap(err, "failed to create folders for the dump file")
+		}
+		var err error
+		file, err = os.Create(t.dumpPath)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create %s", t.dumpPath)
+		}
+	}
+	defer file.Close()
+
+	w := newDumpWriter(t, meta, planned)
+
+	if t.writeWorkersCount > 1 {
+		if err := w.writeParts(ctx, file, chunkC); err != nil {
+			return err
+		}
+		// meta goes to the last stream, which ends the archive
+		return w.writeStream(file, func(tw *tar.Writer) error {
+			return w.writeMeta(tw, aborted)
+		}, true)
+	}
+
+	return w.writeStream(file, func(tw *tar.Writer) error {
+		if err := w.writeChunks(ctx, tw, chunkC); err != nil {
+			return err
+		}
+		return w.writeMeta(tw, aborted)
+	}, true)
+}
+
+// writeStream writes tar entries by fn as a single gzip stream. Tar end marker is written if last is set,
+// otherwise the stream is expected to be followed by other streams of the same archive
+func (w *dumpWriter) writeStream(out io.Writer, fn func(tw *tar.Writer) error, last bool) error {
+	gzw, err := gzip.NewWriterLevel(out, gzip.BestCompression)
+	if err != nil {
+		return errors.Wrap(err, "failed to create gzip writer")
+	}
+
+	tw := tar.NewWriter(gzw)
+	if err = fn(tw); err != nil {
+		return err
+	}
+
+	if last {
+		err = tw.Close()
+	} else {
+		err = tw.Flush()
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to finalize tar stream")
+	}
+	return errors.Wrap(gzw.Close(), "failed to finalize gzip stream")
+}
+
+// writeParts compresses chunks by write workers into temporary files, then copies them to out.
+// Workers are stopped on the first failure
+func (w *dumpWriter) writeParts(ctx context.Context, out io.Writer, chunkC <-chan *dump.Chunk) error {
+	dir := os.TempDir()
+	if !w.t.piped {
+		dir = filepath.Dir(w.t.dumpPath)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	log.Debug().Msgf("Starting %d goroutines to write chunks to the dump...", w.t.writeWorkersCount)
+
+	parts := make([]*os.File, 0, w.t.writeWorkersCount)
+	defer func() {
+		for _, f := range parts {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	for i := 0; i < w.t.writeWorkersCount; i++ {
+		f, err := ioutil.TempFile(dir, ".pmm-transferer-part-*")
+		if err != nil {
+			return errors.Wrap(err, "failed to create temporary dump part")
+		}
+		parts = append(parts, f)
+	}
+
+	errCh := make(chan error, len(parts))
+	for _, f := range parts {
+		f := f
+		go func() {
+			err := w.writeStream(f, func(tw *tar.Writer) error {
+				return w.writeChunks(ctx, tw, chunkC)
+			}, false)
+			if err != nil {
+				cancel()
+			}
+			errCh <- err
+		}()
+	}
+
+	var writeErr error
+	for range parts {
+		// errors of the workers stopped by cancel are not the reason of it
+		if err := <-errCh; err != nil && (writeErr == nil || errors.Is(writeErr, context.Canceled)) {
+			writeErr = err
+		}
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+
+	log.Debug().Msg("Concatenating dump parts...")
+	for _, f := range parts {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return errors.Wrap(err, "failed to read dump part")
+		}
+		if _, err := io.Copy(out, f); err != nil {
+			return errors.Wrap(err, "failed to copy dump part to the dump")
+		}
+	}
+	return nil
+}
+
+// writeChunks writes chunks as tar entries until chunks channel is closed
+func (w *dumpWriter) writeChunks(ctx context.Context, tw *tar.Writer, chunkC <-chan *dump.Chunk) error {
+	for {
+		log.Debug().Msg("New chunks writing loop iteration has been started")
+
+		select {
+		case <-ctx.Done():
+			log.Debug().Msg("Context is done, stopping chunks writing")
+			return ctx.Err()
+		default:
+			c, ok := <-chunkC
+			if !ok {
+				log.Debug().Msg("Chunks channel is closed: stopping chunks writing")
+				return nil
+			}
+
+			w.t.progress.move(stageQueued, stageWriting)
+			start := time.Now()
+			err := w.writeChunk(tw, c)
+			w.t.timings.record(TimingCompress, start)
+			w.t.progress.move(stageWriting, stageNone)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (w *dumpWriter) writeChunk(tw *tar.Writer, c *dump.Chunk) error {
+	s, ok := w.t.sourceByType(c.Source)
+	if !ok {
+		return errors.New("failed to find source to write chunk")
+	}
+
+	if c.Skipped != "" {
+		log.Info().
+			Stringer("source", c.Source).
+			Str("chunk", c.ChunkMeta.String()).
+			Str("reason", c.Skipped).
+			Msg("Chunk is skipped, it's recorded in the meta only")
+		if c.Skipped != dump.SkipReasonFailed {
+			// failed chunks are already recorded in the progress
+			w.t.progress.chunkProcessed()
+		}
+		w.chunkSkipped(c)
+		return nil
+	}
+
+	if c.Empty {
+		log.Info().
+			Stringer("source", c.Source).
+			Str("filename", c.Filename).
+			Msg("Chunk has no data, it's recorded in the meta only")
+		w.t.progress.chunkEmpty()
+		w.chunkEmpty(c, path.Join(s.Type().String(), c.Filename))
+		w.t.journal.chunkWritten(c, 0, w.t.Progress())
+		return nil
+	}
+
+	log.Info().
+		Stringer("source", c.Source).
+		Str("filename", c.Filename).
+		Msg("Writing chunk to the dump...")
+
+	// entries are compressed before encryption, as encrypted content doesn't compress
+	content, codec, err := w.t.encodeEntry(s.Type(), c.Content)
+	if err != nil {
+		return err
+	}
+	entryName, content, err := w.t.encryptEntry(s.Type(), path.Join(s.Type().String(), c.Filename), content)
+	if err != nil {
+		return err
+	}
+
+	header := w.t.entryAttrs.header(entryName, int64(len(content)))
+	if c.Encoding != dump.EncodingUndetermined || codec != "" {
+		header.PAXRecords = make(map[string]string)
+	}
+	if c.Encoding != dump.EncodingUndetermined {
+		header.PAXRecords[dump.EncodingPAXRecord] = string(c.Encoding)
+	}
+	if codec != "" {
+		header.PAXRecords[dump.CodecPAXRecord] = codec
+	}
+	err = tw.WriteHeader(header)
+	if err != nil {
+		return errors.Wrap(err, "failed to write file header")
+	}
+
+	if _, err = tw.Write(content); err != nil {
+		return errors.Wrap(err, "failed to write chunk content")
+	}
+
+	w.t.progress.chunkProcessed()
+	w.chunkWritten(c, entryName, content)
+	w.t.journal.chunkWritten(c, int64(len(c.Content)), w.t.Progress())
+	return nil
+}
+
+func (w *dumpWriter) chunkWritten(c *dump.Chunk, entryName string, content []byte) {
+	sum := sha256.Sum256(content)
+	chunkSize := int64(len(c.Content))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if chunkSize > w.meta.MaxChunkSize {
+		w.meta.MaxChunkSize = chunkSize
+	}
+	w.done[chunkKey(c.ChunkMeta)] = struct{}{}
+	w.meta.Checksums[entryName] = hex.EncodeToString(sum[:])
+	if c.Encoding != dump.EncodingUndetermined {
+		w.meta.Encodings[entryName] = c.Encoding
+	}
+	for i := range w.meta.Sources {
+		if w.meta.Sources[i].Type == c.Source.String() {
+			w.meta.Sources[i].Chunks++
+			w.meta.Sources[i].Size += chunkSize
+		}
+	}
+}
+
+// chunkEmpty records the chunk without data: its range is covered, while there is no entry
+func (w *dumpWriter) chunkEmpty(c *dump.Chunk, entryName string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.done[chunkKey(c.ChunkMeta)] = struct{}{}
+	w.meta.EmptyChunks = append(w.meta.EmptyChunks, entryName)
+}
+
+// chunkSkipped records the chunk requested for export, while not written to the dump
+func (w *dumpWriter) chunkSkipped(c *dump.Chunk) {
+	sc := dump.SkippedChunk{
+		Source: c.Source.String(),
+		Chunk:  c.Filename,
+		Table:  c.Table,
+		Reason: c.Skipped,
+		Error:  c.SkipError,
+	}
+	if sc.Chunk == "" {
+		sc.Chunk = c.ChunkMeta.String()
+	}
+	if c.Start != nil && c.End != nil {
+		sc.Range = &dump.TimeRange{Start: *c.Start, End: *c.End}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// data dropped by transformation isn't expected in the dump, so its range is covered unlike the failed chunk
+	if c.Skipped == dump.SkipReasonTransform {
+		w.done[chunkKey(c.ChunkMeta)] = struct{}{}
+	}
+	w.meta.SkippedChunks = append(w.meta.SkippedChunks, sc)
+}
+
+func (w *dumpWriter) writeMeta(tw *tar.Writer, aborted *int32) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if atomic.LoadInt32(aborted) != 0 {
+		log.Warn().Msg("Export is aborted: finalizing partial dump")
+		w.meta.Partial = true
+		w.meta.CoveredRange = coveredRange(w.planned, w.done)
+	}
+	// chunks are written by concurrent workers, so they are sorted to keep meta of the same data the same
+	sort.Strings(w.meta.EmptyChunks)
+	sort.Slice(w.meta.SkippedChunks, func(i, j int) bool {
+		a, b := w.meta.SkippedChunks[i], w.meta.SkippedChunks[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.Chunk < b.Chunk
+	})
+	return writeMetafile(tw, w.meta, w.t.entryAttrs)
+}
@@ -0,0 +1,115 @@
+// Package transform implements stages applied to each chunk between read and write: on export after the chunk
+// is read from the source, on import before it's written to the target. Stages get chunk content in the dump format
+// (VM native or gzipped JSON lines, ClickHouse TSV, plugin data), so they can filter series, rewrite labels
+// or scrub query texts.
+package transform
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"pmm-transferer/pkg/dump"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// EnvSource and EnvChunk pass the chunk being transformed to the commands
+	EnvSource = "PMM_TRANSFERER_SOURCE"
+	EnvChunk  = "PMM_TRANSFERER_CHUNK"
+
+	// maxStderrSize limits the command output reported in errors
+	maxStderrSize = 4096
+)
+
+// Stage transforms chunk content. It returns nil content to drop the chunk
+type Stage interface {
+	Name() string
+	Transform(st dump.SourceType, filename string, content []byte) ([]byte, error)
+}
+
+// Pipeline applies stages in order
+type Pipeline []Stage
+
+// Apply returns chunk content transformed by all stages, or nil if a stage dropped the chunk
+func (p Pipeline) Apply(st dump.SourceType, filename string, content []byte) ([]byte, error) {
+	for _, s := range p {
+		out, err := s.Transform(st, filename, content)
+		if err != nil {
+			return nil, errors.Wrapf(err, "transformation %s failed", s.Name())
+		}
+		if out == nil {
+			log.Debug().
+				Str("stage", s.Name()).
+				Str("filename", filename).
+				Msg("Chunk is dropped by transformation")
+			return nil, nil
+		}
+		content = out
+	}
+	return content, nil
+}
+
+// Command is a stage running external command for each chunk: the command reads chunk content from stdin
+// and writes transformed content to stdout, empty output drops the chunk
+type Command struct {
+	path    string
+	args    []string
+	timeout time.Duration
+}
+
+// NewCommand parses command line of the stage, arguments are separated by spaces
+func NewCommand(cmdline string, timeout time.Duration) (*Command, error) {
+	fields := strings.Fields(cmdline)
+	if len(fields) == 0 {
+		return nil, errors.New("empty transformation command")
+	}
+	path, err := exec.LookPath(fields[0])
+	if err != nil {
+		return nil, errors.Wrapf(err, "transformation command %s is not found", fields[0])
+	}
+	return &Command{
+		path:    path,
+		args:    fields[1:],
+		timeout: timeout,
+	}, nil
+}
+
+func (c Command) Name() string {
+	return strings.Join(append([]string{c.path}, c.args...), " ")
+}
+
+func (c Command) Transform(st dump.SourceType, filename string, content []byte) ([]byte, error) {
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, c.path, c.args...)
+	cmd.Env = append(os.Environ(), EnvSource+"="+st.String(), EnvChunk+"="+filename)
+	cmd.Stdin = bytes.NewReader(content)
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > maxStderrSize {
+			msg = msg[len(msg)-maxStderrSize:]
+		}
+		if msg != "" {
+			return nil, errors.Wrap(err, msg)
+		}
+		return nil, err
+	}
+
+	if stdout.Len() == 0 {
+		return nil, nil
+	}
+	return stdout.Bytes(), nil
+}
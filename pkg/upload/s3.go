@@ -0,0 +1,369 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"pmm-transferer/pkg/s3"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// s3State is the resumable state of S3 multipart upload
+type s3State struct {
+	URL      string     `json:"url"`
+	UploadID string     `json:"upload_id"`
+	Size     int64      `json:"size"`
+	Parts    []s3Upload `json:"parts"`
+}
+
+// s3Upload is an uploaded part with the file range it holds
+type s3Upload struct {
+	Number int    `json:"number"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	ETag   string `json:"etag"`
+}
+
+type S3Uploader struct {
+	c     *http.Client
+	s3Cfg s3.Config
+	cfg   Config
+}
+
+// NewS3 returns uploader to s3://bucket/key URL, the dump file name is appended to the key ending with slash
+func NewS3(c *http.Client, s3Cfg s3.Config, cfg Config) (*S3Uploader, error) {
+	if !s3.IsURL(cfg.URL) {
+		return nil, errors.Errorf("invalid S3 upload URL %q, expected s3://bucket/key", cfg.URL)
+	}
+	if cfg.ChunkSize <= 0 {
+		return nil, errors.Errorf("invalid upload chunk size: %d", cfg.ChunkSize)
+	}
+	if cfg.ChunkSize < s3.MinPartSize {
+		cfg.ChunkSize = s3.MinPartSize
+	}
+	if cfg.MinChunkSize < s3.MinPartSize || cfg.MinChunkSize > cfg.ChunkSize {
+		cfg.MinChunkSize = s3.MinPartSize
+	}
+	if cfg.MaxBandwidth < 0 {
+		return nil, errors.Errorf("invalid upload bandwidth limit: %d", cfg.MaxBandwidth)
+	}
+	if cfg.Concurrency <= 0 {
+		return nil, errors.Errorf("invalid upload concurrency: %d", cfg.Concurrency)
+	}
+
+	return &S3Uploader{
+		c:     c,
+		s3Cfg: s3Cfg,
+		cfg:   cfg,
+	}, nil
+}
+
+// Upload sends the file using S3 multipart upload with concurrent parts. Uploaded parts are kept
+// in a state file next to the dump, so an interrupted upload continues after the last contiguous uploaded part.
+func (u S3Uploader) Upload(ctx context.Context, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to get file info")
+	}
+	size := info.Size()
+
+	objectURL := u.cfg.URL
+	if strings.HasSuffix(objectURL, "/") {
+		objectURL += path.Base(filePath)
+	}
+
+	statePath := filePath + StateFileSuffix
+	state := u.resume(statePath, objectURL, size)
+	if state.UploadID == "" {
+		state.UploadID, err = u.s3Cfg.CreateMultipartUpload(ctx, u.c, objectURL)
+		if err != nil {
+			return err
+		}
+		if err = writeS3State(statePath, state); err != nil {
+			return err
+		}
+		log.Debug().Str("upload_id", state.UploadID).Msg("Created new multipart upload")
+	}
+
+	offset := int64(0)
+	for _, p := range state.Parts {
+		offset += p.Size
+	}
+	if offset > 0 {
+		log.Info().Msgf("Resuming upload from %d bytes offset", offset)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := &s3Writer{
+		u:         u,
+		file:      file,
+		objectURL: objectURL,
+		statePath: statePath,
+		state:     state,
+		planner:   newPartPlanner(size, offset, len(state.Parts)+1, u.cfg.ChunkSize, u.cfg.MinChunkSize),
+		limiter:   newBandwidthLimiter(u.cfg.MaxBandwidth),
+		uploaded:  offset,
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, u.cfg.Concurrency)
+	for i := 0; i < u.cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := w.run(ctx); err != nil {
+				errs <- err
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	if err = <-errs; err != nil {
+		return err
+	}
+
+	// parts are uploaded concurrently, so they are recorded out of order
+	sort.Slice(w.state.Parts, func(i, j int) bool {
+		return w.state.Parts[i].Number < w.state.Parts[j].Number
+	})
+	parts := make([]s3.Part, 0, len(w.state.Parts))
+	for _, p := range w.state.Parts {
+		parts = append(parts, s3.Part{Number: p.Number, ETag: p.ETag})
+	}
+	if err = u.s3Cfg.CompleteMultipartUpload(ctx, u.c, objectURL, state.UploadID, parts); err != nil {
+		return err
+	}
+
+	if err = os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+		log.Warn().Err(err).Msg("Failed to remove upload state file")
+	}
+
+	log.Info().Msgf("Successfully uploaded %s to %s", path.Base(filePath), objectURL)
+
+	return nil
+}
+
+// resume returns the state of the previous upload of the file, keeping only parts uploaded contiguously from the
+// beginning: parts after a gap are uploaded again, as part numbers must follow the file order
+func (u S3Uploader) resume(statePath, objectURL string, size int64) s3State {
+	newState := s3State{URL: objectURL, Size: size}
+
+	data, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return newState
+	}
+	var state s3State
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("Can't resume previous upload, starting a new one")
+		return newState
+	}
+	if state.URL != objectURL || state.Size != size || state.UploadID == "" {
+		log.Warn().Msg("Previous upload was started for another destination or file, starting a new one")
+		return newState
+	}
+
+	sort.Slice(state.Parts, func(i, j int) bool {
+		return state.Parts[i].Number < state.Parts[j].Number
+	})
+	offset := int64(0)
+	for i, p := range state.Parts {
+		if p.Number != i+1 || p.Offset != offset {
+			state.Parts = state.Parts[:i]
+			break
+		}
+		offset += p.Size
+	}
+	return state
+}
+
+func writeS3State(statePath string, state s3State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal upload state")
+	}
+	if err = ioutil.WriteFile(statePath, data, 0600); err != nil {
+		return errors.Wrap(err, "failed to save upload state")
+	}
+	return nil
+}
+
+// s3Writer uploads parts of the file by concurrent workers
+type s3Writer struct {
+	u         S3Uploader
+	file      *os.File
+	objectURL string
+	statePath string
+	planner   *partPlanner
+	limiter   *bandwidthLimiter
+
+	mu       sync.Mutex
+	state    s3State
+	uploaded int64
+}
+
+func (w *s3Writer) run(ctx context.Context) error {
+	for {
+		p, ok := w.planner.next()
+		if !ok {
+			return nil
+		}
+
+		data := make([]byte, p.Size)
+		if _, err := w.file.ReadAt(data, p.Offset); err != nil && err != io.EOF {
+			return errors.Wrap(err, "failed to read file")
+		}
+
+		etag, err := w.uploadPart(ctx, p, data)
+		if err != nil {
+			return err
+		}
+		p.ETag = etag
+		w.limiter.wait(p.Size)
+
+		if err = w.partUploaded(p); err != nil {
+			return err
+		}
+	}
+}
+
+// uploadPart sends the part, retrying failed requests. Throttled requests reduce size of the next parts
+func (w *s3Writer) uploadPart(ctx context.Context, p s3Upload, data []byte) (string, error) {
+	attempts := 0
+	for {
+		log.Debug().
+			Int("part", p.Number).
+			Int64("offset", p.Offset).
+			Int64("size", p.Size).
+			Msg("Sending upload part")
+
+		etag, err := w.u.s3Cfg.UploadPart(ctx, w.u.c, w.objectURL, w.state.UploadID, p.Number, data)
+		if err == nil {
+			return etag, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
+		var throttled s3.ThrottledError
+		if errors.As(err, &throttled) {
+			if partSize, reduced := w.planner.shrink(); reduced {
+				log.Warn().Msgf("Upload is throttled (%d), reducing part size to %d bytes", throttled.Status, partSize)
+				sleep(ctx, throttled.RetryAfter)
+				continue
+			}
+		}
+
+		attempts++
+		if attempts >= maxChunkAttempts {
+			return "", errors.Wrapf(err, "failed to upload part %d after %d attempts", p.Number, attempts)
+		}
+		log.Warn().Err(err).Msgf("Failed to upload part %d, retrying (%d/%d)...", p.Number, attempts, maxChunkAttempts)
+		if throttled.RetryAfter > 0 {
+			sleep(ctx, throttled.RetryAfter)
+		} else {
+			sleep(ctx, time.Duration(attempts)*time.Second)
+		}
+	}
+}
+
+func (w *s3Writer) partUploaded(p s3Upload) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.state.Parts = append(w.state.Parts, p)
+	w.uploaded += p.Size
+	log.Info().Msgf("Uploaded %d/%d bytes", w.uploaded, w.state.Size)
+
+	return writeS3State(w.statePath, w.state)
+}
+
+// partPlanner splits the file into parts in the file order, part size is reduced on throttling
+type partPlanner struct {
+	mu          sync.Mutex
+	size        int64
+	offset      int64
+	number      int
+	partSize    int64
+	minPartSize int64
+}
+
+func newPartPlanner(size, offset int64, number int, partSize, minPartSize int64) *partPlanner {
+	return &partPlanner{
+		size:        size,
+		offset:      offset,
+		number:      number,
+		partSize:    partSize,
+		minPartSize: minPartSize,
+	}
+}
+
+// next returns the next part to upload, an empty file is uploaded as a single empty part
+func (p *partPlanner) next() (s3Upload, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.offset >= p.size && (p.size > 0 || p.number > 1) {
+		return s3Upload{}, false
+	}
+
+	size := p.partSize
+	// parts are enlarged when the rest of the file doesn't fit into the remaining part numbers
+	if remainingParts := int64(s3.MaxParts - p.number + 1); remainingParts > 0 {
+		if fit := (p.size - p.offset + remainingParts - 1) / remainingParts; fit > size {
+			size = fit
+		}
+	}
+	if p.offset+size > p.size {
+		size = p.size - p.offset
+	}
+
+	part := s3Upload{Number: p.number, Offset: p.offset, Size: size}
+	p.offset += size
+	p.number++
+	return part, true
+}
+
+// shrink halves size of the next parts and reports if it was reduced
+func (p *partPlanner) shrink() (int64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.partSize <= p.minPartSize {
+		return p.partSize, false
+	}
+	p.partSize /= 2
+	if p.partSize < p.minPartSize {
+		p.partSize = p.minPartSize
+	}
+	return p.partSize, true
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
@@ -0,0 +1,354 @@
+package upload
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	tusVersion = "1.0.0"
+
+	// StateFileSuffix is appended to the uploaded file name to keep the resumable upload state
+	StateFileSuffix = ".upload"
+
+	maxChunkAttempts = 5
+	requestTimeout   = time.Minute * 5
+)
+
+type Config struct {
+	URL       string
+	Ticket    string
+	ChunkSize int64
+	// MinChunkSize is the lower bound chunk size is reduced to when the endpoint throttles uploads
+	MinChunkSize int64
+	// MaxBandwidth limits upload rate in bytes per second, 0 means no limit
+	MaxBandwidth int64
+	// Concurrency is the number of parts uploaded at once by S3 multipart upload, tus chunks are sent one by one
+	Concurrency int
+}
+
+// throttledError is returned when the endpoint rejects a chunk because of rate or size limits
+type throttledError struct {
+	status     int
+	retryAfter time.Duration
+}
+
+func (e throttledError) Error() string {
+	return fmt.Sprintf("upload is throttled: %d", e.status)
+}
+
+type Uploader struct {
+	c   *fasthttp.Client
+	cfg Config
+}
+
+func New(c *fasthttp.Client, cfg Config) (*Uploader, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("upload endpoint URL is not specified")
+	}
+	if cfg.Ticket == "" {
+		return nil, errors.New("support ticket is not specified")
+	}
+	if cfg.ChunkSize <= 0 {
+		return nil, errors.Errorf("invalid upload chunk size: %d", cfg.ChunkSize)
+	}
+	if cfg.MinChunkSize <= 0 || cfg.MinChunkSize > cfg.ChunkSize {
+		cfg.MinChunkSize = cfg.ChunkSize
+	}
+	if cfg.MaxBandwidth < 0 {
+		return nil, errors.Errorf("invalid upload bandwidth limit: %d", cfg.MaxBandwidth)
+	}
+
+	return &Uploader{
+		c:   c,
+		cfg: cfg,
+	}, nil
+}
+
+// Upload sends the file using the tus resumable upload protocol. The upload location is kept
+// in a state file next to the dump, so an interrupted upload continues from the last acknowledged offset.
+func (u Uploader) Upload(ctx context.Context, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to get file info")
+	}
+	size := info.Size()
+
+	statePath := path + StateFileSuffix
+
+	location, offset, err := u.resume(statePath)
+	if err != nil {
+		return err
+	}
+
+	if location == "" {
+		location, err = u.create(filepath.Base(path), size)
+		if err != nil {
+			return errors.Wrap(err, "failed to create upload")
+		}
+		if err = ioutil.WriteFile(statePath, []byte(location), 0600); err != nil {
+			return errors.Wrap(err, "failed to save upload state")
+		}
+		log.Debug().Str("location", location).Msg("Created new upload")
+	} else {
+		log.Info().Msgf("Resuming upload from %d bytes offset", offset)
+	}
+
+	buf := make([]byte, u.cfg.ChunkSize)
+	chunkSize := u.cfg.ChunkSize
+	limiter := newBandwidthLimiter(u.cfg.MaxBandwidth)
+	attempts := 0
+	// offset acknowledged by the endpoint is unknown after a failed chunk, it's requested before the next one
+	resync := false
+	for resync || offset < size {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		var newOffset int64
+		if resync {
+			newOffset, err = u.offset(location)
+			if err == nil {
+				offset, resync = newOffset, false
+				continue
+			}
+			err = errors.Wrap(err, "failed to get upload offset")
+		} else {
+			n, readErr := file.ReadAt(buf[:chunkSize], offset)
+			if readErr != nil && readErr != io.EOF {
+				return errors.Wrap(readErr, "failed to read file")
+			}
+			newOffset, err = u.patch(location, offset, buf[:n])
+		}
+
+		var throttled throttledError
+		if errors.As(err, &throttled) && chunkSize > u.cfg.MinChunkSize {
+			chunkSize /= 2
+			if chunkSize < u.cfg.MinChunkSize {
+				chunkSize = u.cfg.MinChunkSize
+			}
+			log.Warn().Msgf("Upload is throttled (%d), reducing chunk size to %d bytes", throttled.status, chunkSize)
+			time.Sleep(throttled.retryAfter)
+			resync = true
+			continue
+		}
+
+		if err != nil {
+			attempts++
+			if attempts >= maxChunkAttempts {
+				return errors.Wrapf(err, "failed to upload chunk after %d attempts", attempts)
+			}
+			log.Warn().Err(err).Msgf("Failed to upload chunk, retrying (%d/%d)...", attempts, maxChunkAttempts)
+			if throttled.retryAfter > 0 {
+				time.Sleep(throttled.retryAfter)
+			} else {
+				time.Sleep(time.Duration(attempts) * time.Second)
+			}
+			resync = true
+			continue
+		}
+		attempts = 0
+		limiter.wait(newOffset - offset)
+		offset = newOffset
+
+		log.Info().Msgf("Uploaded %d/%d bytes", offset, size)
+	}
+
+	if err = os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+		log.Warn().Err(err).Msg("Failed to remove upload state file")
+	}
+
+	log.Info().Msgf("Successfully uploaded %s for ticket %s", filepath.Base(path), u.cfg.Ticket)
+
+	return nil
+}
+
+func (u Uploader) resume(statePath string) (string, int64, error) {
+	state, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, errors.Wrap(err, "failed to read upload state")
+	}
+
+	location := strings.TrimSpace(string(state))
+	offset, err := u.offset(location)
+	if err != nil {
+		log.Warn().Err(err).Msg("Can't resume previous upload, starting a new one")
+		return "", 0, nil
+	}
+
+	return location, offset, nil
+}
+
+func (u Uploader) create(filename string, size int64) (string, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetRequestURI(u.cfg.URL)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+	req.Header.Set("Upload-Metadata", fmt.Sprintf("filename %s,ticket %s",
+		base64.StdEncoding.EncodeToString([]byte(filename)),
+		base64.StdEncoding.EncodeToString([]byte(u.cfg.Ticket))))
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	if err := u.c.DoTimeout(req, resp, requestTimeout); err != nil {
+		return "", errors.Wrap(err, "failed to send HTTP request")
+	}
+
+	if status := resp.StatusCode(); status != fasthttp.StatusCreated {
+		return "", errors.Errorf("non-created response: %d: %s", status, string(resp.Body()))
+	}
+
+	location := string(resp.Header.Peek(fasthttp.HeaderLocation))
+	if location == "" {
+		return "", errors.New("no upload location in response")
+	}
+
+	return resolveLocation(u.cfg.URL, location), nil
+}
+
+func (u Uploader) offset(location string) (int64, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.SetMethod(fasthttp.MethodHead)
+	req.SetRequestURI(location)
+	req.Header.Set("Tus-Resumable", tusVersion)
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	if err := u.c.DoTimeout(req, resp, requestTimeout); err != nil {
+		return 0, errors.Wrap(err, "failed to send HTTP request")
+	}
+
+	if status := resp.StatusCode(); status != fasthttp.StatusOK && status != fasthttp.StatusNoContent {
+		return 0, errors.Errorf("non-OK response: %d", status)
+	}
+
+	return parseOffset(resp)
+}
+
+func (u Uploader) patch(location string, offset int64, data []byte) (int64, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.SetMethod(fasthttp.MethodPatch)
+	req.SetRequestURI(location)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	req.Header.SetContentType("application/offset+octet-stream")
+	req.SetBody(data)
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	log.Debug().
+		Int64("offset", offset).
+		Int("size", len(data)).
+		Msg("Sending upload chunk")
+
+	if err := u.c.DoTimeout(req, resp, requestTimeout); err != nil {
+		return 0, errors.Wrap(err, "failed to send HTTP request")
+	}
+
+	switch status := resp.StatusCode(); status {
+	case fasthttp.StatusNoContent, fasthttp.StatusOK:
+	case fasthttp.StatusTooManyRequests, fasthttp.StatusServiceUnavailable, fasthttp.StatusRequestEntityTooLarge:
+		return 0, throttledError{status: status, retryAfter: parseRetryAfter(resp)}
+	default:
+		return 0, errors.Errorf("non-OK response: %d: %s", status, string(resp.Body()))
+	}
+
+	return parseOffset(resp)
+}
+
+func parseRetryAfter(resp *fasthttp.Response) time.Duration {
+	seconds, err := strconv.Atoi(string(resp.Header.Peek(fasthttp.HeaderRetryAfter)))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// bandwidthLimiter sleeps so the average upload rate since start doesn't exceed the limit.
+// It's shared by concurrent uploads, so the limit is for all of them
+type bandwidthLimiter struct {
+	limit int64
+	start time.Time
+
+	mu   sync.Mutex
+	sent int64
+}
+
+func newBandwidthLimiter(limit int64) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		limit: limit,
+		start: time.Now(),
+	}
+}
+
+func (l *bandwidthLimiter) wait(n int64) {
+	if l.limit == 0 {
+		return
+	}
+	l.mu.Lock()
+	l.sent += n
+	expected := time.Duration(float64(l.sent) / float64(l.limit) * float64(time.Second))
+	l.mu.Unlock()
+	if d := expected - time.Since(l.start); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func parseOffset(resp *fasthttp.Response) (int64, error) {
+	v := string(resp.Header.Peek("Upload-Offset"))
+	if v == "" {
+		return 0, errors.New("no upload offset in response")
+	}
+	offset, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid upload offset")
+	}
+	return offset, nil
+}
+
+func resolveLocation(base, location string) string {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return location
+	}
+	locationURL, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	return baseURL.ResolveReference(locationURL).String()
+}
@@ -0,0 +1,260 @@
+package victoriametrics
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math"
+	"pmm-transferer/pkg/dump"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// importBatch accumulates series blocks (or JSON lines) of imported chunks into requests of the fixed size:
+// big chunks are split, small ones are merged to send fewer requests
+type importBatch struct {
+	size          int
+	flushInterval time.Duration
+	native        bool
+
+	m       sync.Mutex
+	buf     bytes.Buffer
+	items   int
+	started time.Time
+	// time range of native blocks in the batch, written to the header
+	minTs, maxTs int64
+	// chunks with data in the buffer
+	chunks []*batchedChunk
+}
+
+// batchedChunk is the chunk with data in the batch, it's reported when all requests with its data are sent
+type batchedChunk struct {
+	report dump.BatchReport
+	// buffered is set while the chunk has data in the batch buffer
+	buffered bool
+	// requests with the chunk data taken from the batch and not sent yet
+	requests int
+	err      error
+}
+
+// batchRequest is the gzipped request taken from the batch and the chunks with data in it
+type batchRequest struct {
+	body   []byte
+	chunks []*batchedChunk
+}
+
+func newImportBatch(size int, flushInterval time.Duration, native bool) *importBatch {
+	return &importBatch{
+		size:          size,
+		flushInterval: flushInterval,
+		native:        native,
+	}
+}
+
+// add appends items of the gzipped chunk to the batch and returns requests ready to be sent.
+// Partially filled batch is returned if it's older than flush interval. The chunk is parsed before its items
+// are appended, so a malformed chunk leaves nothing in the batch. It returns false if the chunk has no items,
+// such chunk is not reported
+func (b *importBatch) add(content []byte, report dump.BatchReport) ([]batchRequest, bool, error) {
+	gzr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to open chunk as gzip")
+	}
+	defer gzr.Close()
+
+	var items [][]byte
+	minTs, maxTs := int64(math.MinInt64), int64(math.MaxInt64)
+	if b.native {
+		minTs, maxTs, items, err = readNativeItems(gzr)
+	} else {
+		items, err = readJSONLineItems(gzr)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(items) == 0 {
+		return nil, false, nil
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	c := &batchedChunk{report: report}
+	var ready []batchRequest
+	for _, item := range items {
+		if b.items == 0 {
+			b.started = time.Now()
+		}
+		if b.items == 0 || minTs < b.minTs {
+			b.minTs = minTs
+		}
+		if b.items == 0 || maxTs > b.maxTs {
+			b.maxTs = maxTs
+		}
+		if !c.buffered {
+			c.buffered = true
+			b.chunks = append(b.chunks, c)
+		}
+		b.buf.Write(item)
+		b.items++
+		if b.items >= b.size {
+			req, err := b.take()
+			if err != nil {
+				return nil, false, err
+			}
+			ready = append(ready, req)
+		}
+	}
+
+	if b.items > 0 && b.flushInterval > 0 && time.Since(b.started) >= b.flushInterval {
+		req, err := b.take()
+		if err != nil {
+			return nil, false, err
+		}
+		ready = append(ready, req)
+	}
+
+	return ready, true, nil
+}
+
+// readNativeItems returns time range of the native chunk and its series blocks
+func readNativeItems(r io.Reader) (int64, int64, [][]byte, error) {
+	nr, err := newNativeReader(r)
+	if errors.Cause(err) == io.EOF {
+		return 0, 0, nil, nil
+	}
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	minTs, maxTs := unmarshalTimeRange(nr.header)
+
+	var items [][]byte
+	for {
+		block, err := nr.next()
+		if err == io.EOF {
+			return minTs, maxTs, items, nil
+		}
+		if err != nil {
+			return 0, 0, nil, err
+		}
+
+		item := new(bytes.Buffer)
+		if err = writeNativePart(item, block.metricName); err != nil {
+			return 0, 0, nil, err
+		}
+		if err = writeNativePart(item, block.data); err != nil {
+			return 0, 0, nil, err
+		}
+		items = append(items, item.Bytes())
+	}
+}
+
+func readJSONLineItems(r io.Reader) ([][]byte, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024)
+	var items [][]byte
+	for scanner.Scan() {
+		// scanner reuses the buffer, so the line is copied
+		line := scanner.Bytes()
+		item := make([]byte, len(line)+1)
+		copy(item, line)
+		item[len(line)] = '\n'
+		items = append(items, item)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read json lines")
+	}
+	return items, nil
+}
+
+// flush returns request of the partially filled batch, or false if the batch is empty
+func (b *importBatch) flush() (batchRequest, bool, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.items == 0 {
+		return batchRequest{}, false, nil
+	}
+	req, err := b.take()
+	return req, err == nil, err
+}
+
+func (b *importBatch) take() (batchRequest, error) {
+	out := new(bytes.Buffer)
+	gzw := gzip.NewWriter(out)
+	if b.native {
+		if _, err := gzw.Write(marshalTimeRange(b.minTs, b.maxTs)); err != nil {
+			return batchRequest{}, err
+		}
+	}
+	if _, err := gzw.Write(b.buf.Bytes()); err != nil {
+		return batchRequest{}, err
+	}
+	if err := gzw.Close(); err != nil {
+		return batchRequest{}, errors.Wrap(err, "failed to compress batch")
+	}
+
+	req := batchRequest{body: out.Bytes(), chunks: b.chunks}
+	for _, c := range b.chunks {
+		c.buffered = false
+		c.requests++
+	}
+	b.buf.Reset()
+	b.items = 0
+	b.chunks = nil
+	return req, nil
+}
+
+// sent records the result of sending the request and reports chunks having all their requests sent.
+// A chunk fails if any of its requests fails. It returns false if some chunks of the request have no report,
+// so the error is returned to the caller instead
+func (b *importBatch) sent(req batchRequest, err error) bool {
+	var done []*batchedChunk
+	reported := true
+	b.m.Lock()
+	for _, c := range req.chunks {
+		if c.report == nil {
+			reported = false
+		}
+		c.requests--
+		if err != nil && c.err == nil {
+			c.err = err
+		}
+		if c.requests == 0 && !c.buffered {
+			done = append(done, c)
+		}
+	}
+	b.m.Unlock()
+
+	// reports may block, e.g. writing to the retry queue, so they are called without the lock
+	for _, c := range done {
+		if c.report != nil {
+			c.report(c.err)
+		}
+	}
+	return reported
+}
+
+// native header is min and max timestamps, each zig-zag encoded big-endian int64
+func unmarshalTimeRange(header []byte) (int64, int64) {
+	if len(header) < nativeHeaderSize {
+		return math.MinInt64, math.MaxInt64
+	}
+	return unmarshalInt64(header[:8]), unmarshalInt64(header[8:16])
+}
+
+func marshalTimeRange(minTs, maxTs int64) []byte {
+	header := make([]byte, nativeHeaderSize)
+	binary.BigEndian.PutUint64(header[:8], uint64((minTs<<1)^(minTs>>63)))
+	binary.BigEndian.PutUint64(header[8:], uint64((maxTs<<1)^(maxTs>>63)))
+	return header
+}
+
+func unmarshalInt64(b []byte) int64 {
+	u := binary.BigEndian.Uint64(b)
+	return int64(u>>1) ^ (int64(u<<63) >> 63)
+}
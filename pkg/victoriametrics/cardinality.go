@@ -0,0 +1,129 @@
+package victoriametrics
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"pmm-transferer/pkg/dump"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+type CardinalityLimits struct {
+	MaxSeriesPerMetric int
+	DropMetricsRegex   string
+}
+
+// ApplyCardinalityLimits excludes metrics having too many series or matching drop regex from source selectors
+// and returns the list of excluded metrics
+func (s *Source) ApplyCardinalityLimits(start, end time.Time, limits CardinalityLimits) ([]dump.DroppedMetric, error) {
+	var dropped []dump.DroppedMetric
+	var exclude []string
+
+	if limits.DropMetricsRegex != "" {
+		if _, err := regexp.Compile(limits.DropMetricsRegex); err != nil {
+			return nil, errors.Wrap(err, "invalid drop metrics regex")
+		}
+		exclude = append(exclude, limits.DropMetricsRegex)
+		dropped = append(dropped, dump.DroppedMetric{
+			Name:   limits.DropMetricsRegex,
+			Reason: dump.DropReasonRegex,
+		})
+	}
+
+	if limits.MaxSeriesPerMetric > 0 {
+		series, err := s.Series(start, end)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get series")
+		}
+
+		counts := SeriesCountByMetric(series)
+		var names []string
+		for name, count := range counts {
+			if count > limits.MaxSeriesPerMetric {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			exclude = append(exclude, regexp.QuoteMeta(name))
+			dropped = append(dropped, dump.DroppedMetric{
+				Name:   name,
+				Series: counts[name],
+				Reason: dump.DropReasonCardinality,
+			})
+		}
+	}
+
+	if len(exclude) == 0 {
+		return nil, nil
+	}
+
+	selectors, err := addLabelFilter(s.cfg.TimeSeriesSelectors, metricsql.LabelFilter{
+		Label:      "__name__",
+		Value:      strings.Join(exclude, "|"),
+		IsNegative: true,
+		IsRegexp:   true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.cfg.TimeSeriesSelectors = selectors
+
+	for _, d := range dropped {
+		log.Warn().
+			Str("reason", d.Reason).
+			Int("series", d.Series).
+			Msgf("Dropping metric %s from export", d.Name)
+	}
+
+	return dropped, nil
+}
+
+func addLabelFilter(selectors []string, f metricsql.LabelFilter) ([]string, error) {
+	res := make([]string, 0, len(selectors))
+	for _, sel := range selectors {
+		expr, err := metricsql.Parse(sel)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse selector %s", sel)
+		}
+		me, ok := expr.(*metricsql.MetricExpr)
+		if !ok {
+			return nil, errors.Errorf("not a series selector: %s", sel)
+		}
+		me.LabelFilters = append(me.LabelFilters, f)
+		res = append(res, string(me.AppendString(nil)))
+	}
+	return res, nil
+}
+
+// chunkSelectors returns source selectors narrowed by the chunk selector, if it's set
+func (s Source) chunkSelectors(m dump.ChunkMeta) ([]string, error) {
+	if m.Selector == "" {
+		return s.cfg.TimeSeriesSelectors, nil
+	}
+	if len(s.cfg.TimeSeriesSelectors) == 0 {
+		return []string{m.Selector}, nil
+	}
+
+	expr, err := metricsql.Parse(m.Selector)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse chunk selector %s", m.Selector)
+	}
+	me, ok := expr.(*metricsql.MetricExpr)
+	if !ok {
+		return nil, errors.Errorf("chunk selector is not a series selector: %s", m.Selector)
+	}
+	selectors := s.cfg.TimeSeriesSelectors
+	for _, f := range me.LabelFilters {
+		if selectors, err = addLabelFilter(selectors, f); err != nil {
+			return nil, err
+		}
+	}
+	return selectors, nil
+}
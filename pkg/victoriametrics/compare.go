@@ -0,0 +1,117 @@
+package victoriametrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ChunkSeries is a series of the dump chunk with the amount of its samples in the chunk
+type ChunkSeries struct {
+	Selector string
+	Samples  int64
+}
+
+// NativeChunkSeries returns series of the gzipped native chunk. Blocks of the same series are summed up
+func NativeChunkSeries(content []byte) ([]ChunkSeries, error) {
+	gzr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open chunk as gzip")
+	}
+	defer gzr.Close()
+
+	nr, err := newNativeReader(gzr)
+	if errors.Cause(err) == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make(map[string]int64)
+	for {
+		b, err := nr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		mn, err := unmarshalMetricName(b.metricName)
+		if err != nil {
+			return nil, err
+		}
+		rows, err := blockRows(b.data)
+		if err != nil {
+			return nil, err
+		}
+		samples[mn.selector()] += rows
+	}
+
+	series := make([]ChunkSeries, 0, len(samples))
+	for sel, n := range samples {
+		series = append(series, ChunkSeries{Selector: sel, Samples: n})
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].Selector < series[j].Selector
+	})
+	return series, nil
+}
+
+// selector returns series selector matching the metric name exactly
+func (mn *metricName) selector() string {
+	matchers := make([]string, 0, len(mn.labels)+1)
+	matchers = append(matchers, fmt.Sprintf("%s=%s", metricNameLabel, strconv.Quote(mn.group)))
+	for _, l := range mn.labels {
+		matchers = append(matchers, fmt.Sprintf("%s=%s", l.name, strconv.Quote(l.value)))
+	}
+	return "{" + strings.Join(matchers, ",") + "}"
+}
+
+// NativeChunkRange returns time range of the native chunk by its filename.
+// It returns false for downsampled chunks, as their points don't match raw samples
+func NativeChunkRange(filename string) (time.Time, time.Time, bool) {
+	if isDownsampledChunk(filename) {
+		return time.Time{}, time.Time{}, false
+	}
+	parts := strings.Split(strings.TrimSuffix(filename, ".bin"), "-")
+	// chunks narrowed by planners have the part suffix
+	if len(parts) == 3 && strings.HasPrefix(parts[2], "p") {
+		parts = parts[:2]
+	}
+	if len(parts) != 2 {
+		return time.Time{}, time.Time{}, false
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || end <= start {
+		return time.Time{}, time.Time{}, false
+	}
+	return time.Unix(start, 0).UTC(), time.Unix(end, 0).UTC(), true
+}
+
+// CountSeriesSamples returns the amount of samples of the series within half-open time range
+func (s Source) CountSeriesSamples(selector string, start, end time.Time) (int64, error) {
+	window := end.Sub(start).Milliseconds()
+	if window <= 0 {
+		return 0, nil
+	}
+	// rollup window is left-open, so evaluating it just before the end covers [start, end)
+	query := fmt.Sprintf("count_over_time(%s[%dms])", selector, window)
+	v, err := s.queryValue(query, end.Add(-time.Millisecond))
+	if err != nil {
+		return 0, err
+	}
+	return int64(v), nil
+}
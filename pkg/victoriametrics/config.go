@@ -1,6 +1,37 @@
 package victoriametrics
 
+import (
+	"pmm-transferer/pkg/remap"
+	"time"
+)
+
 type Config struct {
 	ConnectionURL       string
 	TimeSeriesSelectors []string
+	// ImportDownsampled enables import of downsampled chunks instead of raw ones
+	ImportDownsampled bool
+	// Remapping is applied to series labels on import
+	Remapping remap.Mapping
+	// Filter keeps only series of the routed origins on import, before remapping
+	Filter *remap.Filter
+	// MetricPrefix is prepended to metric names on import, so sandbox restores don't mix with live series
+	MetricPrefix string
+	// NameFilter keeps only series of the selected metrics on import, before remapping
+	NameFilter *NameFilter
+	// ExportAttempts is the number of attempts to read a chunk, when the response is broken or server fails
+	ExportAttempts int
+	// SampleCheck is the mode of comparing samples of the read chunk with the amount counted by VictoriaMetrics,
+	// chunks with less samples are read again
+	SampleCheck string
+	// ExportParams are passed to the native export API as is, e.g. extra_filters[] to narrow down exported series
+	ExportParams map[string]string
+	// Agent is set when chunks are imported to vmagent, which replays them to its remote write targets
+	Agent bool
+	// ImportBatchSize is the number of series blocks (or JSON lines) sent in a single import request,
+	// chunks are sent as is if 0
+	ImportBatchSize int
+	// ImportEncoding is Content-Encoding of import requests, gzip by default
+	ImportEncoding string
+	// ImportFlushInterval is the max time partially filled batch waits for more chunks
+	ImportFlushInterval time.Duration
 }
@@ -0,0 +1,87 @@
+package victoriametrics
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// DropCoveredSelectors removes selectors, all series of which are matched by the other selectors. Returns removed selectors.
+// Series are not deduplicated: partially overlapping selectors are kept as they are
+func (s *Source) DropCoveredSelectors(start, end time.Time) ([]string, error) {
+	selectors := s.cfg.TimeSeriesSelectors
+	if len(selectors) < 2 {
+		return nil, nil
+	}
+
+	sets := make([]map[string]struct{}, len(selectors))
+	for i, sel := range selectors {
+		series, err := s.series([]string{sel}, start, end)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get series of %s", sel)
+		}
+		sets[i] = make(map[string]struct{}, len(series))
+		for _, labels := range series {
+			sets[i][seriesFingerprint(labels)] = struct{}{}
+		}
+	}
+
+	removed := make([]bool, len(selectors))
+	for i := range selectors {
+		if isCovered(sets, removed, i) {
+			removed[i] = true
+		}
+	}
+
+	var kept, dropped []string
+	for i, sel := range selectors {
+		if removed[i] {
+			dropped = append(dropped, sel)
+			log.Debug().Str("selector", sel).Msg("Removed selector: its series are matched by other selectors")
+			continue
+		}
+		kept = append(kept, sel)
+	}
+	s.cfg.TimeSeriesSelectors = kept
+
+	return dropped, nil
+}
+
+// isCovered reports if all series of i-th set are contained in the other not removed sets
+func isCovered(sets []map[string]struct{}, removed []bool, i int) bool {
+	for fp := range sets[i] {
+		found := false
+		for j := range sets {
+			if j == i || removed[j] {
+				continue
+			}
+			if _, ok := sets[j][fp]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	// at least one selector is kept
+	for j := range sets {
+		if j != i && !removed[j] {
+			return true
+		}
+	}
+	return false
+}
+
+// seriesFingerprint returns a string identifying the series by its labels
+func seriesFingerprint(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\x00")
+}
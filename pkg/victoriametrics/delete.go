@@ -0,0 +1,45 @@
+package victoriametrics
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+)
+
+// DeleteSeries deletes all samples of the series matching the selectors. VictoriaMetrics deletes series
+// for the whole retention, the time range can't be limited
+func (s Source) DeleteSeries(selectors []string) error {
+	if len(selectors) == 0 {
+		return errors.New("no series selectors to delete")
+	}
+
+	q := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(q)
+	for _, v := range selectors {
+		q.Add("match[]", v)
+	}
+
+	url := fmt.Sprintf("%s/api/v1/admin/tsdb/delete_series?%s", s.cfg.ConnectionURL, q.String())
+
+	log.Debug().
+		Str("url", url).
+		Msg("Sending delete series request to Victoria Metrics endpoint")
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetRequestURI(url)
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	if err := s.c.DoTimeout(req, resp, requestTimeout); err != nil {
+		return errors.Wrap(err, "failed to send HTTP request to victoria metrics")
+	}
+	if status := resp.StatusCode(); status != fasthttp.StatusOK && status != fasthttp.StatusNoContent {
+		return errors.Errorf("non-OK response from victoria metrics: %d: %s", status, string(resp.Body()))
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package victoriametrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"math"
+	"pmm-transferer/pkg/dump"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	downsampledChunkExt = ".jsonl"
+
+	// amount of points per series to fit into a single downsampled chunk
+	downsampledChunkPoints = 1000
+)
+
+type queryRangeResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Values [][]interface{}   `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// jsonLine is a single line of VM JSON line format accepted by /api/v1/import
+type jsonLine struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []sampleValue     `json:"values"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+// readDownsampledChunk reads the last sample of each step by range query of the selectors. Samples are not aggregated
+// by *_over_time functions, as their type is unknown: averaged counters would break rate(), so gauge spikes are lost instead
+func (s Source) readDownsampledChunk(m dump.ChunkMeta) (*dump.Chunk, error) {
+	buf := new(bytes.Buffer)
+	gzw := gzip.NewWriter(buf)
+	enc := json.NewEncoder(gzw)
+
+	// selectors may overlap, while each series should be written once
+	written := make(map[string]struct{})
+	selectors, err := s.chunkSelectors(m)
+	if err != nil {
+		return nil, err
+	}
+	for _, selector := range selectors {
+		// the point at the end belongs to the next chunk
+		resp, err := s.queryRange(selector, *m.Start, m.End.Add(-time.Millisecond), m.Step)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range resp.Data.Result {
+			fp := seriesFingerprint(r.Metric)
+			if _, ok := written[fp]; ok {
+				continue
+			}
+			written[fp] = struct{}{}
+
+			line, err := toJSONLine(r.Metric, r.Values, m.Step, *m.End)
+			if err != nil {
+				return nil, err
+			}
+			if err = enc.Encode(line); err != nil {
+				return nil, errors.Wrap(err, "failed to encode json line")
+			}
+		}
+	}
+
+	if err := gzw.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to compress chunk")
+	}
+
+	return &dump.Chunk{
+		ChunkMeta: m,
+		Content:   buf.Bytes(),
+		Filename:  fmt.Sprintf("%s-%s%s", m.String(), m.Step, downsampledChunkExt),
+		Encoding:  dump.EncodingVMJSONLines,
+	}, nil
+}
+
+func (s Source) queryRange(query string, start, end time.Time, step time.Duration) (*queryRangeResponse, error) {
+	q := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(q)
+
+	q.Add("query", query)
+	q.Add("start", formatTimestamp(start))
+	q.Add("end", formatTimestamp(end))
+	q.Add("step", strconv.FormatInt(int64(step.Seconds()), 10))
+
+	url := fmt.Sprintf("%s/api/v1/query_range?%s", s.cfg.ConnectionURL, q.String())
+
+	log.Debug().
+		Str("url", url).
+		Msg("Sending query range request to Victoria Metrics endpoint")
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.SetMethod(fasthttp.MethodGet)
+	req.SetRequestURI(url)
+	requestID := tagRequest(req)
+
+	httpResp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(httpResp)
+
+	if err := s.c.DoTimeout(req, httpResp, requestTimeout); err != nil {
+		return nil, sendError(err, requestID)
+	}
+
+	body := httpResp.Body()
+	if status := httpResp.StatusCode(); status != fasthttp.StatusOK {
+		return nil, newResponseError(status, string(body), requestID)
+	}
+
+	resp := new(queryRangeResponse)
+	if err := json.Unmarshal(body, resp); err != nil {
+		return nil, errors.Wrap(err, "failed to parse query range response")
+	}
+	if resp.Status != "success" {
+		return nil, errors.Errorf("query range failed: %s", resp.Error)
+	}
+
+	return resp, nil
+}
+
+// toJSONLine converts query range values into JSON line. Query results have no staleness markers, while
+// series having no points at some steps are stale there, so the markers are added after the last point before
+// each gap and the end of the series, to get the same rate() results on the imported data
+func toJSONLine(metric map[string]string, values [][]interface{}, step time.Duration, end time.Time) (*jsonLine, error) {
+	line := &jsonLine{
+		Metric:     metric,
+		Values:     make([]sampleValue, 0, len(values)),
+		Timestamps: make([]int64, 0, len(values)),
+	}
+
+	stepMs := step.Milliseconds()
+	markStale := func(lastTs int64) {
+		line.Values = append(line.Values, sampleValue(staleNaN))
+		line.Timestamps = append(line.Timestamps, lastTs+stepMs)
+	}
+
+	for _, v := range values {
+		if len(v) != 2 {
+			return nil, errors.New("unexpected number of values")
+		}
+		ts, ok := v[0].(float64)
+		if !ok {
+			return nil, errors.New("timestamp is not a number")
+		}
+		str, ok := v[1].(string)
+		if !ok {
+			return nil, errors.New("value is not string")
+		}
+		val, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse value")
+		}
+		// NaN results are not staleness markers and can't be told apart from them in JSON lines
+		if math.IsNaN(val) {
+			continue
+		}
+
+		tsMs := int64(ts * 1000)
+		if n := len(line.Timestamps); n != 0 && stepMs > 0 && tsMs-line.Timestamps[n-1] > stepMs {
+			markStale(line.Timestamps[n-1])
+		}
+		line.Values = append(line.Values, sampleValue(val))
+		line.Timestamps = append(line.Timestamps, tsMs)
+	}
+
+	if n := len(line.Timestamps); n != 0 && stepMs > 0 && line.Timestamps[n-1]+stepMs < end.UnixNano()/int64(time.Millisecond) {
+		markStale(line.Timestamps[n-1])
+	}
+
+	return line, nil
+}
+
+func SplitTimeRangeIntoDownsampledChunks(start, end time.Time, step time.Duration) []dump.ChunkMeta {
+	chunks := SplitTimeRangeIntoChunks(start, end, step*downsampledChunkPoints)
+	for i := range chunks {
+		chunks[i].Step = step
+	}
+	return chunks
+}
+
+func isDownsampledChunk(filename string) bool {
+	return strings.HasSuffix(filename, downsampledChunkExt)
+}
@@ -0,0 +1,49 @@
+package victoriametrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Content encodings of import requests. Dump chunks are gzipped, so gzip requests reuse chunk content as is
+const (
+	EncodingGzip     = "gzip"
+	EncodingZstd     = "zstd"
+	EncodingIdentity = "identity"
+)
+
+// encodeImportBody converts gzipped chunk content to the import request encoding
+func encodeImportBody(content []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", EncodingGzip:
+		return content, nil
+	case EncodingZstd, EncodingIdentity:
+	default:
+		return nil, errors.Errorf("unsupported import encoding: %s", encoding)
+	}
+
+	gzr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open chunk as gzip")
+	}
+	defer gzr.Close()
+
+	raw, err := ioutil.ReadAll(gzr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decompress chunk")
+	}
+	if encoding == EncodingIdentity {
+		return raw, nil
+	}
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer enc.Close()
+	return enc.EncodeAll(raw, make([]byte, 0, len(content))), nil
+}
@@ -0,0 +1,153 @@
+package victoriametrics
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ExportFormatNative is the format of /api/v1/export/native responses, also used by vmctl native mode
+	ExportFormatNative = "vm-native"
+	// ExportFormatJSONLines is the format of /api/v1/export responses
+	ExportFormatJSONLines = "vm-jsonl"
+
+	// amount of series blocks or JSON lines per chunk of the export file
+	exportFileChunkItems = 1000
+)
+
+// ReadExportFile splits VictoriaMetrics export file into chunks of the dump format, so the file is imported
+// the same way as dump chunks: native blocks go to *.bin chunks, JSON lines go to *.jsonl chunks.
+// Gzipped files are decompressed
+func ReadExportFile(r io.Reader, format string, fn func(filename string, content []byte) error) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			return errors.Wrap(err, "failed to open export file as gzip")
+		}
+		defer gzr.Close()
+		r = gzr
+	} else {
+		r = br
+	}
+
+	switch format {
+	case ExportFormatNative:
+		return readNativeExportFile(r, fn)
+	case ExportFormatJSONLines:
+		return readJSONLinesExportFile(r, fn)
+	default:
+		return errors.Errorf("unsupported export file format: %s", format)
+	}
+}
+
+func readNativeExportFile(r io.Reader, fn func(filename string, content []byte) error) error {
+	nr, err := newNativeReader(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to read native export file")
+	}
+
+	s := newExportFileSplitter(nr.header, ".bin", fn)
+	for {
+		block, err := nr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read native export file")
+		}
+		err = s.add(func(w io.Writer) error {
+			if err := writeNativePart(w, block.metricName); err != nil {
+				return err
+			}
+			return writeNativePart(w, block.data)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return s.flush()
+}
+
+func readJSONLinesExportFile(r io.Reader, fn func(filename string, content []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024)
+
+	s := newExportFileSplitter(nil, downsampledChunkExt, fn)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		err := s.add(func(w io.Writer) error {
+			_, err := w.Write(append(line, '\n'))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "failed to read json lines export file")
+	}
+	return s.flush()
+}
+
+// exportFileSplitter accumulates items of the export file into gzipped chunks
+type exportFileSplitter struct {
+	header []byte
+	ext    string
+	fn     func(filename string, content []byte) error
+
+	index int
+	buf   bytes.Buffer
+	gzw   *gzip.Writer
+	items int
+}
+
+func newExportFileSplitter(header []byte, ext string, fn func(filename string, content []byte) error) *exportFileSplitter {
+	return &exportFileSplitter{
+		header: header,
+		ext:    ext,
+		fn:     fn,
+	}
+}
+
+func (s *exportFileSplitter) add(write func(w io.Writer) error) error {
+	if s.items == 0 {
+		s.buf.Reset()
+		s.gzw = gzip.NewWriter(&s.buf)
+		if _, err := s.gzw.Write(s.header); err != nil {
+			return err
+		}
+	}
+	if err := write(s.gzw); err != nil {
+		return err
+	}
+	s.items++
+	if s.items >= exportFileChunkItems {
+		return s.flush()
+	}
+	return nil
+}
+
+// flush passes the filled chunk to the callback, it does nothing if the chunk is empty
+func (s *exportFileSplitter) flush() error {
+	if s.items == 0 {
+		return nil
+	}
+	if err := s.gzw.Close(); err != nil {
+		return errors.Wrap(err, "failed to compress chunk")
+	}
+	content := append([]byte(nil), s.buf.Bytes()...)
+	filename := fmt.Sprintf("export-%d%s", s.index, s.ext)
+
+	s.index++
+	s.items = 0
+	return s.fn(filename, content)
+}
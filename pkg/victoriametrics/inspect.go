@@ -0,0 +1,112 @@
+package victoriametrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+)
+
+// ChunkMetricNames returns names of the metrics stored in the dump chunk
+func ChunkMetricNames(filename string, content []byte) ([]string, error) {
+	names := make(map[string]struct{})
+
+	var err error
+	if isDownsampledChunk(filename) {
+		_, err = rewriteJSONLinesGzip(content, func(metric map[string]string) bool {
+			names[metric[metricNameLabel]] = struct{}{}
+			return false
+		})
+	} else {
+		_, err = rewriteNativeGzip(content, func(mn *metricName) bool {
+			names[mn.group] = struct{}{}
+			return false
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, len(names))
+	for name := range names {
+		result = append(result, name)
+	}
+	return result, nil
+}
+
+// ChunkLabelSets returns distinct sets of the labels values of the dump chunk series. Series having none of the labels are skipped
+func ChunkLabelSets(filename string, content []byte, labels []string) ([]map[string]string, error) {
+	sets := make(map[string]map[string]string)
+	add := func(get func(name string) (string, bool)) {
+		set := make(map[string]string, len(labels))
+		key := make([]string, 0, len(labels))
+		for _, name := range labels {
+			if v, ok := get(name); ok && v != "" {
+				set[name] = v
+			}
+			key = append(key, set[name])
+		}
+		if len(set) != 0 {
+			sets[strings.Join(key, "\xff")] = set
+		}
+	}
+
+	var err error
+	if isDownsampledChunk(filename) {
+		_, err = rewriteJSONLinesGzip(content, func(metric map[string]string) bool {
+			add(func(name string) (string, bool) {
+				v, ok := metric[name]
+				return v, ok
+			})
+			return false
+		})
+	} else {
+		_, err = rewriteNativeGzip(content, func(mn *metricName) bool {
+			add(mn.label)
+			return false
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]map[string]string, 0, len(sets))
+	for _, set := range sets {
+		result = append(result, set)
+	}
+	return result, nil
+}
+
+// MetricNames returns names of all metrics stored in VM
+func (s Source) MetricNames() ([]string, error) {
+	url := fmt.Sprintf("%s/api/v1/label/__name__/values", s.cfg.ConnectionURL)
+
+	log.Debug().
+		Str("url", url).
+		Msg("Sending label values request to Victoria Metrics endpoint")
+
+	status, body, err := s.c.GetTimeout(nil, url, requestTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to send HTTP request to victoria metrics")
+	}
+
+	if status != fasthttp.StatusOK {
+		return nil, newResponseError(status, string(body), "")
+	}
+
+	var resp struct {
+		Status string   `json:"status"`
+		Data   []string `json:"data"`
+		Error  string   `json:"error"`
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return nil, errors.Wrap(err, "failed to parse label values response")
+	}
+	if resp.Status != "success" {
+		return nil, errors.Errorf("label values request failed: %s", resp.Error)
+	}
+	return resp.Data, nil
+}
@@ -0,0 +1,239 @@
+package victoriametrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"pmm-transferer/pkg/dump"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// chunk windows are not shrunk below this duration
+const minLimitWindow = time.Minute
+
+type limitKind int
+
+const (
+	noLimit limitKind = iota
+	// windowLimit errors are solved by querying shorter time ranges
+	windowLimit
+	// concurrencyLimit errors are solved by sending fewer concurrent requests
+	concurrencyLimit
+)
+
+// limit errors mention the flag of the exceeded limit
+var limitFlags = map[string]limitKind{
+	"search.maxQueryDuration":      windowLimit,
+	"search.maxExportDuration":     windowLimit,
+	"search.maxSamplesPerQuery":    windowLimit,
+	"search.maxSamplesPerSeries":   windowLimit,
+	"search.maxUniqueTimeseries":   windowLimit,
+	"search.maxConcurrentRequests": concurrencyLimit,
+}
+
+func limitErrorKind(err error) (limitKind, string) {
+	var respErr *dump.ResponseError
+	if !errors.As(err, &respErr) {
+		return noLimit, ""
+	}
+	for flag, kind := range limitFlags {
+		if strings.Contains(respErr.Body, flag) {
+			return kind, flag
+		}
+	}
+	return noLimit, ""
+}
+
+// limitAdapter shrinks chunk windows and export concurrency when VictoriaMetrics rejects queries by its limits,
+// so export continues instead of failing. Decisions apply to all following chunks
+type limitAdapter struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// splits is the power of 2 chunks are split into windows by
+	splits int
+	// maxActive limits concurrent exports, no limit if 0
+	maxActive int
+	active    int
+	decisions []string
+}
+
+func newLimitAdapter() *limitAdapter {
+	a := new(limitAdapter)
+	a.cond = sync.NewCond(&a.mu)
+	return a
+}
+
+// acquire waits until export may be started and returns the current splits
+func (a *limitAdapter) acquire() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for a.maxActive > 0 && a.active >= a.maxActive {
+		a.cond.Wait()
+	}
+	a.active++
+	return a.splits
+}
+
+func (a *limitAdapter) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.active--
+	a.cond.Signal()
+}
+
+// adapt changes windows or concurrency on limit error of the export done with the given splits.
+// It returns false if the error isn't caused by limits or nothing can be reduced anymore
+func (a *limitAdapter) adapt(err error, m dump.ChunkMeta, splits int) bool {
+	kind, flag := limitErrorKind(err)
+	if kind == noLimit {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch kind {
+	case windowLimit:
+		if a.splits > splits {
+			// already adapted by another reader
+			return true
+		}
+		if m.Start == nil || m.End == nil || m.End.Sub(*m.Start)>>uint(a.splits+1) < minLimitWindow {
+			return false
+		}
+		a.splits++
+		a.decide(fmt.Sprintf("chunks are read by %d windows of %s on -%s",
+			1<<uint(a.splits), m.End.Sub(*m.Start)>>uint(a.splits), flag))
+	case concurrencyLimit:
+		// the failed export isn't released yet, so it's counted in active
+		limit := a.active - 1
+		if limit < 1 {
+			limit = 1
+		}
+		if a.maxActive != 0 && a.maxActive <= limit {
+			if a.maxActive == 1 {
+				return false
+			}
+			limit = a.maxActive - 1
+		}
+		a.maxActive = limit
+		a.decide(fmt.Sprintf("concurrent exports are reduced to %d on -%s", limit, flag))
+	}
+	return true
+}
+
+func (a *limitAdapter) decide(d string) {
+	log.Warn().Msgf("Adapting to VictoriaMetrics limits: %s", d)
+	a.decisions = append(a.decisions, d)
+}
+
+// Adaptations returns decisions made to fit chunk exports into VictoriaMetrics limits
+func (s Source) Adaptations() []string {
+	if s.limits == nil {
+		return nil
+	}
+	s.limits.mu.Lock()
+	defer s.limits.mu.Unlock()
+	return append([]string(nil), s.limits.decisions...)
+}
+
+// readNativeWindows reads native chunk by windows of the current size and merges them into the single chunk.
+// It returns splits used to read the chunk
+func (s Source) readNativeWindows(m dump.ChunkMeta) (*dump.Chunk, int, error) {
+	splits := s.limits.acquire()
+	defer s.limits.release()
+
+	if splits == 0 || m.Start == nil || m.End == nil {
+		chunk, err := s.readNativeChunk(m)
+		return chunk, splits, err
+	}
+
+	windows := 1 << uint(splits)
+	size := m.End.Sub(*m.Start) / time.Duration(windows)
+	parts := make([][]byte, 0, windows)
+	for i := 0; i < windows; i++ {
+		start := m.Start.Add(time.Duration(i) * size)
+		end := start.Add(size)
+		if i == windows-1 {
+			end = *m.End
+		}
+		wm := m
+		wm.Start, wm.End = &start, &end
+
+		c, err := s.readNativeChunk(wm)
+		if err != nil {
+			return nil, splits, err
+		}
+		parts = append(parts, c.Content)
+	}
+
+	content, err := mergeNative(parts)
+	if err != nil {
+		return nil, splits, errors.Wrap(err, "failed to merge chunk windows")
+	}
+	return &dump.Chunk{
+		ChunkMeta: m,
+		Content:   content,
+		Filename:  m.String() + ".bin",
+		Encoding:  dump.EncodingVMNative,
+	}, splits, nil
+}
+
+// mergeNative merges gzipped native exports into one with the time range covering all of them
+func mergeNative(parts [][]byte) ([]byte, error) {
+	minTs, maxTs := int64(math.MaxInt64), int64(math.MinInt64)
+	blocks := new(bytes.Buffer)
+	for _, p := range parts {
+		gzr, err := gzip.NewReader(bytes.NewReader(p))
+		if err == io.EOF {
+			// nothing is exported for the window
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(gzr)
+		gzr.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			continue
+		}
+		if len(data) < nativeHeaderSize {
+			return nil, errors.New("native export is too short")
+		}
+
+		pMin, pMax := unmarshalTimeRange(data[:nativeHeaderSize])
+		if pMin < minTs {
+			minTs = pMin
+		}
+		if pMax > maxTs {
+			maxTs = pMax
+		}
+		blocks.Write(data[nativeHeaderSize:])
+	}
+
+	out := new(bytes.Buffer)
+	gzw := gzip.NewWriter(out)
+	if minTs <= maxTs {
+		if _, err := gzw.Write(marshalTimeRange(minTs, maxTs)); err != nil {
+			return nil, err
+		}
+		if _, err := gzw.Write(blocks.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,68 @@
+package victoriametrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+// ImportMarkerMetric is the series recording imports of dumps on the target:
+// one series per dump ID and imported source, the value is the time of import.
+// Markers of sandbox imports have the metric prefix, so they don't block imports into live series
+const ImportMarkerMetric = "pmm_transferer_import"
+
+// ImportedSources returns sources of the dump recorded by import markers
+func (s Source) ImportedSources(dumpID string) ([]string, error) {
+	selector := fmt.Sprintf("%s%s{dump_id=%s}", s.cfg.MetricPrefix, ImportMarkerMetric, strconv.Quote(dumpID))
+	series, err := s.series([]string{selector}, time.Unix(0, 0), time.Now())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get import markers")
+	}
+
+	sources := make([]string, 0, len(series))
+	for _, labels := range series {
+		sources = append(sources, labels["source"])
+	}
+	return sources, nil
+}
+
+// HasImports reports whether any dump was imported, i.e. there are import markers with the metric prefix
+func (s Source) HasImports() (bool, error) {
+	selector := fmt.Sprintf("{__name__=%s}", strconv.Quote(s.cfg.MetricPrefix+ImportMarkerMetric))
+	series, err := s.series([]string{selector}, time.Unix(0, 0), time.Now())
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get import markers")
+	}
+	return len(series) > 0, nil
+}
+
+// RecordImport writes import markers of the dump sources
+func (s Source) RecordImport(dumpID string, sources []string, ts time.Time) error {
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	for _, src := range sources {
+		line := jsonLine{
+			Metric: map[string]string{
+				"__name__": s.cfg.MetricPrefix + ImportMarkerMetric,
+				"dump_id":  dumpID,
+				"source":   src,
+			},
+			Values:     []sampleValue{sampleValue(ts.Unix())},
+			Timestamps: []int64{ts.UnixNano() / int64(time.Millisecond)},
+		}
+		if err := enc.Encode(line); err != nil {
+			return errors.Wrap(err, "failed to encode import marker")
+		}
+	}
+
+	url := fmt.Sprintf("%s/api/v1/import", s.cfg.ConnectionURL)
+	err := s.sendImport(url, EncodingIdentity, func(req *fasthttp.Request) {
+		req.SetBody(buf.Bytes())
+	})
+	return errors.Wrap(err, "failed to write import markers")
+}
@@ -0,0 +1,92 @@
+package victoriametrics
+
+import (
+	"regexp"
+	"strings"
+
+	"pmm-transferer/pkg/dump"
+
+	"github.com/VictoriaMetrics/metricsql"
+	"github.com/pkg/errors"
+)
+
+// ApplyMetricLists restricts source selectors to the metrics matching include globs, if any, and excludes metrics
+// matching exclude globs. Globs support * and ? wildcards. It returns excluded globs to be recorded in the meta
+func (s *Source) ApplyMetricLists(include, exclude []string) ([]dump.DroppedMetric, error) {
+	selectors := s.cfg.TimeSeriesSelectors
+	var err error
+	if len(include) != 0 {
+		selectors, err = addLabelFilter(selectors, metricsql.LabelFilter{
+			Label:    "__name__",
+			Value:    globsRegex(include),
+			IsRegexp: true,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var dropped []dump.DroppedMetric
+	if len(exclude) != 0 {
+		selectors, err = addLabelFilter(selectors, metricsql.LabelFilter{
+			Label:      "__name__",
+			Value:      globsRegex(exclude),
+			IsNegative: true,
+			IsRegexp:   true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range exclude {
+			dropped = append(dropped, dump.DroppedMetric{
+				Name:   g,
+				Reason: dump.DropReasonExcludeList,
+			})
+		}
+	}
+
+	s.cfg.TimeSeriesSelectors = selectors
+	return dropped, nil
+}
+
+// globsRegex converts metric name globs to the regex matching any of them
+func globsRegex(globs []string) string {
+	parts := make([]string, 0, len(globs))
+	for _, g := range globs {
+		r := regexp.QuoteMeta(g)
+		r = strings.ReplaceAll(r, `\*`, ".*")
+		r = strings.ReplaceAll(r, `\?`, ".")
+		parts = append(parts, r)
+	}
+	return strings.Join(parts, "|")
+}
+
+// recordingRuleGlob matches names of the level:metric:operations form recommended for recording rules
+const recordingRuleGlob = "*:*"
+
+// RecordingRuleGlobs returns globs matching series produced by recording rules: names starting with any of prefixes,
+// or names of the recording rule naming convention if there are no prefixes
+func RecordingRuleGlobs(prefixes []string) ([]string, error) {
+	if len(prefixes) == 0 {
+		return []string{recordingRuleGlob}, nil
+	}
+	globs := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		g := p + "*"
+		if err := ValidateMetricGlob(g); err != nil {
+			return nil, err
+		}
+		globs = append(globs, g)
+	}
+	return globs, nil
+}
+
+var metricGlobRegex = regexp.MustCompile(`^[a-zA-Z0-9_:*?]+$`)
+
+// ValidateMetricGlob checks that the glob may match metric names
+func ValidateMetricGlob(g string) error {
+	if !metricGlobRegex.MatchString(g) {
+		return errors.Errorf("invalid metric name glob %q: letters, digits, '_', ':' and wildcards * and ? are allowed", g)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package victoriametrics
+
+import (
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// NameFilter selects series by metric name on import, e.g. series of the dashboards imported first
+type NameFilter struct {
+	names   map[string]struct{}
+	regexps []*regexp.Regexp
+	// exclude selects series of the metrics not matching the names
+	exclude bool
+}
+
+// NewNameFilter returns filter selecting metrics with the names or names matching the regexps
+func NewNameFilter(names, regexps []string) (*NameFilter, error) {
+	f := &NameFilter{names: make(map[string]struct{}, len(names))}
+	for _, n := range names {
+		f.names[n] = struct{}{}
+	}
+	for _, r := range regexps {
+		// label filter regexps are anchored, see VictoriaMetrics docs
+		re, err := regexp.Compile("^(?:" + r + ")$")
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid metric name regexp %q", r)
+		}
+		f.regexps = append(f.regexps, re)
+	}
+	return f, nil
+}
+
+// Inverted returns filter selecting the metrics this one doesn't select
+func (f NameFilter) Inverted() *NameFilter {
+	f.exclude = !f.exclude
+	return &f
+}
+
+// Match reports if series of the metric are selected
+func (f *NameFilter) Match(name string) bool {
+	if f == nil {
+		return true
+	}
+	return f.matchName(name) != f.exclude
+}
+
+func (f *NameFilter) matchName(name string) bool {
+	if _, ok := f.names[name]; ok {
+		return true
+	}
+	for _, re := range f.regexps {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,313 @@
+package victoriametrics
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// VictoriaMetrics native export format is a time range header followed by pairs of
+// marshaled metric name and data block, each prefixed by big-endian uint32 length.
+// Metric name is a metric group followed by label name/value pairs, each value is
+// escaped and terminated by tagSeparatorChar.
+
+const (
+	nativeHeaderSize = 16
+
+	escapeChar       = 0
+	tagSeparatorChar = 1
+	kvSeparatorChar  = 2
+
+	metricNameLabel = "__name__"
+)
+
+type nativeBlock struct {
+	metricName []byte
+	data       []byte
+}
+
+type label struct {
+	name  string
+	value string
+}
+
+type metricName struct {
+	group  string
+	labels []label
+}
+
+// label returns metric label value, including metric name
+func (mn *metricName) label(name string) (string, bool) {
+	if name == metricNameLabel {
+		return mn.group, true
+	}
+	for _, l := range mn.labels {
+		if l.name == name {
+			return l.value, true
+		}
+	}
+	return "", false
+}
+
+func (mn *metricName) setLabel(name, value string) {
+	if name == metricNameLabel {
+		mn.group = value
+		return
+	}
+	for i := range mn.labels {
+		if mn.labels[i].name == name {
+			mn.labels[i].value = value
+			return
+		}
+	}
+	mn.labels = append(mn.labels, label{name: name, value: value})
+}
+
+func (mn *metricName) marshal(dst []byte) []byte {
+	dst = marshalTagValue(dst, mn.group)
+	for _, l := range mn.labels {
+		dst = marshalTagValue(dst, l.name)
+		dst = marshalTagValue(dst, l.value)
+	}
+	return dst
+}
+
+func unmarshalMetricName(src []byte) (*metricName, error) {
+	mn := new(metricName)
+
+	var err error
+	if src, mn.group, err = unmarshalTagValue(src); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal metric group")
+	}
+
+	for len(src) > 0 {
+		var l label
+		if src, l.name, err = unmarshalTagValue(src); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal label name")
+		}
+		if src, l.value, err = unmarshalTagValue(src); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal label value")
+		}
+		mn.labels = append(mn.labels, l)
+	}
+
+	return mn, nil
+}
+
+func marshalTagValue(dst []byte, v string) []byte {
+	for i := 0; i < len(v); i++ {
+		switch ch := v[i]; ch {
+		case escapeChar:
+			dst = append(dst, escapeChar, '0')
+		case tagSeparatorChar:
+			dst = append(dst, escapeChar, '1')
+		case kvSeparatorChar:
+			dst = append(dst, escapeChar, '2')
+		default:
+			dst = append(dst, ch)
+		}
+	}
+	return append(dst, tagSeparatorChar)
+}
+
+func unmarshalTagValue(src []byte) ([]byte, string, error) {
+	n := bytes.IndexByte(src, tagSeparatorChar)
+	if n < 0 {
+		return src, "", errors.New("cannot find the end of tag value")
+	}
+	b, src := src[:n], src[n+1:]
+
+	var v []byte
+	for {
+		n := bytes.IndexByte(b, escapeChar)
+		if n < 0 {
+			v = append(v, b...)
+			return src, string(v), nil
+		}
+		v = append(v, b[:n]...)
+		b = b[n+1:]
+		if len(b) == 0 {
+			return src, "", errors.New("missing escaped char")
+		}
+		switch b[0] {
+		case '0':
+			v = append(v, escapeChar)
+		case '1':
+			v = append(v, tagSeparatorChar)
+		case '2':
+			v = append(v, kvSeparatorChar)
+		default:
+			return src, "", errors.Errorf("unsupported escaped char: %c", b[0])
+		}
+		b = b[1:]
+	}
+}
+
+type nativeReader struct {
+	r      *bufio.Reader
+	header []byte
+}
+
+func newNativeReader(r io.Reader) (*nativeReader, error) {
+	nr := &nativeReader{
+		r:      bufio.NewReader(r),
+		header: make([]byte, nativeHeaderSize),
+	}
+	if _, err := io.ReadFull(nr.r, nr.header); err != nil {
+		return nil, errors.Wrap(err, "failed to read time range header")
+	}
+	return nr, nil
+}
+
+// next returns the next block or io.EOF if there are no blocks left
+func (nr *nativeReader) next() (*nativeBlock, error) {
+	mn, err := nr.readPart()
+	if err != nil {
+		return nil, err
+	}
+	data, err := nr.readPart()
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &nativeBlock{
+		metricName: mn,
+		data:       data,
+	}, nil
+}
+
+func (nr *nativeReader) readPart() ([]byte, error) {
+	sizeBuf := make([]byte, 4)
+	if _, err := io.ReadFull(nr.r, sizeBuf); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint32(sizeBuf))
+	if _, err := io.ReadFull(nr.r, buf); err != nil {
+		return nil, errors.Wrap(err, "failed to read native block")
+	}
+	return buf, nil
+}
+
+func writeNativePart(w io.Writer, part []byte) error {
+	sizeBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(sizeBuf, uint32(len(part)))
+	if _, err := w.Write(sizeBuf); err != nil {
+		return err
+	}
+	_, err := w.Write(part)
+	return err
+}
+
+// rewriteNative passes native format data through fn, which may change metric name of each block
+// or skip the block completely by returning false
+func rewriteNative(dst io.Writer, src io.Reader, fn func(mn *metricName) bool) error {
+	nr, err := newNativeReader(src)
+	if err != nil {
+		return err
+	}
+	if _, err = dst.Write(nr.header); err != nil {
+		return err
+	}
+
+	for {
+		b, err := nr.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		mn, err := unmarshalMetricName(b.metricName)
+		if err != nil {
+			return err
+		}
+		if !fn(mn) {
+			continue
+		}
+
+		if err = writeNativePart(dst, mn.marshal(nil)); err != nil {
+			return err
+		}
+		if err = writeNativePart(dst, b.data); err != nil {
+			return err
+		}
+	}
+}
+
+// rewriteNativeGzip is rewriteNative for gzipped content as it's stored in the dump
+func rewriteNativeGzip(content []byte, fn func(mn *metricName) bool) ([]byte, error) {
+	gzr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open chunk as gzip")
+	}
+	defer gzr.Close()
+
+	buf := new(bytes.Buffer)
+	gzw := gzip.NewWriter(buf)
+	if err = rewriteNative(gzw, gzr, fn); err != nil {
+		return nil, errors.Wrap(err, "failed to rewrite native chunk")
+	}
+	if err = gzw.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to compress chunk")
+	}
+	return buf.Bytes(), nil
+}
+
+// countNativeSamples reads the whole gzipped native content and returns the amount of samples in it.
+// Each data block starts with min timestamp, first value and rows count varints
+func countNativeSamples(content []byte) (int64, error) {
+	gzr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to open chunk as gzip")
+	}
+	defer gzr.Close()
+
+	nr, err := newNativeReader(gzr)
+	if errors.Cause(err) == io.EOF {
+		// empty export has no header
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var samples int64
+	for {
+		b, err := nr.next()
+		if err == io.EOF {
+			return samples, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		rows, err := blockRows(b.data)
+		if err != nil {
+			return 0, err
+		}
+		samples += rows
+	}
+}
+
+// blockRows returns the amount of samples in the data block
+func blockRows(data []byte) (int64, error) {
+	for i := 0; i < 2; i++ {
+		_, n := binary.Varint(data)
+		if n <= 0 {
+			return 0, errors.New("failed to read block header")
+		}
+		data = data[n:]
+	}
+	rows, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, errors.New("failed to read block rows count")
+	}
+	return int64(rows), nil
+}
@@ -0,0 +1,49 @@
+package victoriametrics
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+// selector which matches no series, so pings don't transfer any data
+const pingSelector = `{__name__="pmm_transferer_ping"}`
+
+// PingExport checks that export endpoint is reachable
+func (s Source) PingExport() error {
+	q := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(q)
+
+	now := time.Now().Unix()
+	q.Add("match[]", pingSelector)
+	q.Add("start", strconv.FormatInt(now-60, 10))
+	q.Add("end", strconv.FormatInt(now, 10))
+
+	url := fmt.Sprintf("%s/api/v1/export/native?%s", s.cfg.ConnectionURL, q.String())
+
+	status, body, err := s.c.GetTimeout(nil, url, requestTimeout)
+	if err != nil {
+		return errors.Wrap(err, "failed to send HTTP request to victoria metrics")
+	}
+	if status != fasthttp.StatusOK {
+		return newResponseError(status, string(body), "")
+	}
+	return nil
+}
+
+// PingImport checks that import endpoint is reachable by sending empty import request
+func (s Source) PingImport() error {
+	url := fmt.Sprintf("%s/api/v1/import", s.cfg.ConnectionURL)
+
+	status, body, err := s.c.Post(nil, url, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to send HTTP request to victoria metrics")
+	}
+	if status != fasthttp.StatusOK && status != fasthttp.StatusNoContent {
+		return newResponseError(status, string(body), "")
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package victoriametrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+)
+
+// RangeSeries is a single series of a range query result
+type RangeSeries struct {
+	Labels string
+	Values map[int64]float64
+}
+
+type rangeQueryResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Values [][]interface{}   `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// QueryRange runs a range query and returns result series keyed by their labels, values are keyed by unix timestamp
+func (s Source) QueryRange(query string, start, end time.Time, step time.Duration) (map[string]RangeSeries, error) {
+	q := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(q)
+
+	q.Add("query", query)
+	q.Add("start", formatTimestamp(start))
+	q.Add("end", formatTimestamp(end))
+	q.Add("step", fmt.Sprintf("%ds", int64(step.Seconds())))
+
+	url := fmt.Sprintf("%s/api/v1/query_range?%s", s.cfg.ConnectionURL, q.String())
+
+	log.Debug().
+		Str("url", url).
+		Msg("Sending range query request to Victoria Metrics endpoint")
+
+	status, body, err := s.c.GetTimeout(nil, url, requestTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to send HTTP request to victoria metrics")
+	}
+
+	if status != fasthttp.StatusOK {
+		return nil, errors.Errorf("non-OK response from victoria metrics: %d: %s", status, string(body))
+	}
+
+	resp := new(rangeQueryResponse)
+	if err = json.Unmarshal(body, resp); err != nil {
+		return nil, errors.Wrap(err, "failed to parse query response")
+	}
+	if resp.Status != "success" {
+		return nil, errors.Errorf("query failed: %s", resp.Error)
+	}
+
+	result := make(map[string]RangeSeries, len(resp.Data.Result))
+	for _, r := range resp.Data.Result {
+		series := RangeSeries{
+			Labels: formatLabels(r.Metric),
+			Values: make(map[int64]float64, len(r.Values)),
+		}
+		for _, v := range r.Values {
+			if len(v) != 2 {
+				return nil, errors.New("unexpected number of values")
+			}
+			ts, ok := v[0].(float64)
+			if !ok {
+				return nil, errors.New("timestamp is not number")
+			}
+			str, ok := v[1].(string)
+			if !ok {
+				return nil, errors.New("value is not string")
+			}
+			val, err := strconv.ParseFloat(str, 64)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to parse value")
+			}
+			series.Values[int64(ts)] = val
+		}
+		result[series.Labels] = series
+	}
+	return result, nil
+}
+
+func formatLabels(metric map[string]string) string {
+	names := make([]string, 0, len(metric))
+	for name := range metric {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, metric[name]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
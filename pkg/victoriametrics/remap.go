@@ -0,0 +1,90 @@
+package victoriametrics
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+func (s Source) remapChunk(content []byte, downsampled bool) ([]byte, error) {
+	if downsampled {
+		return rewriteJSONLinesGzip(content, func(metric map[string]string) bool {
+			if f := s.cfg.Filter; f != nil && !f.Match(metric[f.Label]) {
+				return false
+			}
+			if !s.cfg.NameFilter.Match(metric[metricNameLabel]) {
+				return false
+			}
+			for name, value := range metric {
+				if v, ok := s.cfg.Remapping.Apply(name, value); ok {
+					metric[name] = v
+				}
+			}
+			if s.cfg.MetricPrefix != "" {
+				metric[metricNameLabel] = s.cfg.MetricPrefix + metric[metricNameLabel]
+			}
+			return true
+		})
+	}
+
+	return rewriteNativeGzip(content, func(mn *metricName) bool {
+		if f := s.cfg.Filter; f != nil {
+			if origin, _ := mn.label(f.Label); !f.Match(origin) {
+				return false
+			}
+		}
+		if !s.cfg.NameFilter.Match(mn.group) {
+			return false
+		}
+		if v, ok := s.cfg.Remapping.Apply(metricNameLabel, mn.group); ok {
+			mn.group = v
+		}
+		for i, l := range mn.labels {
+			if v, ok := s.cfg.Remapping.Apply(l.name, l.value); ok {
+				mn.labels[i].value = v
+			}
+		}
+		mn.group = s.cfg.MetricPrefix + mn.group
+		return true
+	})
+}
+
+// rewriteJSONLinesGzip passes each line of gzipped VM JSON lines content through fn,
+// which may change metric labels or skip the line completely by returning false
+func rewriteJSONLinesGzip(content []byte, fn func(metric map[string]string) bool) ([]byte, error) {
+	gzr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open chunk as gzip")
+	}
+	defer gzr.Close()
+
+	buf := new(bytes.Buffer)
+	gzw := gzip.NewWriter(buf)
+	enc := json.NewEncoder(gzw)
+
+	scanner := bufio.NewScanner(gzr)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var line jsonLine
+		if err = json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, errors.Wrap(err, "failed to parse json line")
+		}
+		if !fn(line.Metric) {
+			continue
+		}
+		if err = enc.Encode(line); err != nil {
+			return nil, errors.Wrap(err, "failed to encode json line")
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read json lines")
+	}
+
+	if err = gzw.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to compress chunk")
+	}
+	return buf.Bytes(), nil
+}
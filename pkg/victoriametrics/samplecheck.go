@@ -0,0 +1,75 @@
+package victoriametrics
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"pmm-transferer/pkg/dump"
+
+	"github.com/pkg/errors"
+)
+
+// Modes of comparing samples of the read chunk with the amount counted by VictoriaMetrics
+const (
+	SampleCheckFail = "fail"
+	SampleCheckWarn = "warn"
+	SampleCheckOff  = "off"
+)
+
+// sampleCheckLatency skips the check of recent chunks: instant queries close to current time are shifted back
+// by VictoriaMetrics latency offset, so the count doesn't match the chunk range
+const sampleCheckLatency = time.Minute
+
+// sampleCountError is returned when the chunk has less samples than counted before reading it
+type sampleCountError struct {
+	read     int64
+	expected int64
+}
+
+func (e sampleCountError) Error() string {
+	return fmt.Sprintf("broken export stream: %d samples read, %d expected", e.read, e.expected)
+}
+
+// expectedSamples counts samples of the chunk range before it's read, or returns -1 if the chunk is not checked.
+// Selectors may overlap, so the counts are united by series, keeping metric names to tell series apart
+func (s Source) expectedSamples(m dump.ChunkMeta) (int64, error) {
+	if s.cfg.SampleCheck == "" || s.cfg.SampleCheck == SampleCheckOff || m.Start == nil || m.End == nil {
+		return -1, nil
+	}
+	if m.End.After(time.Now().Add(-sampleCheckLatency)) {
+		return -1, nil
+	}
+
+	selectors, err := s.chunkSelectors(m)
+	if err != nil || len(selectors) == 0 {
+		return -1, err
+	}
+
+	window := m.End.Sub(*m.Start).Milliseconds()
+	counts := make([]string, 0, len(selectors))
+	for _, sel := range selectors {
+		counts = append(counts, fmt.Sprintf("count_over_time(%s[%dms]) keep_metric_names", sel, window))
+	}
+	query := fmt.Sprintf("sum(%s)", strings.Join(counts, " or "))
+
+	// lookbehind window is left-open, so samples at the chunk start are counted, and those at the end are not
+	v, err := s.queryValue(query, m.End.Add(-time.Millisecond))
+	if err != nil {
+		return -1, errors.Wrap(err, "failed to count chunk samples")
+	}
+	return int64(v), nil
+}
+
+// validateChunk checks that the native chunk is readable to the end and has at least the expected amount of samples.
+// Samples ingested after they were counted may only increase the amount
+func validateChunk(c *dump.Chunk, expected int64) (int64, error) {
+	samples, err := countNativeSamples(c.Content)
+	if err != nil {
+		return 0, errors.Wrap(err, "broken export stream")
+	}
+	if expected >= 0 && samples < expected {
+		return samples, sampleCountError{read: samples, expected: expected}
+	}
+	return samples, nil
+}
@@ -0,0 +1,212 @@
+package victoriametrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+)
+
+type seriesResponse struct {
+	Status string              `json:"status"`
+	Error  string              `json:"error"`
+	Data   []map[string]string `json:"data"`
+}
+
+// Series returns label sets of all series matching source selectors within the time range
+func (s Source) Series(start, end time.Time) ([]map[string]string, error) {
+	return s.series(s.cfg.TimeSeriesSelectors, start, end)
+}
+
+func (s Source) series(selectors []string, start, end time.Time) ([]map[string]string, error) {
+	q := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(q)
+
+	for _, v := range selectors {
+		q.Add("match[]", v)
+	}
+	q.Add("start", strconv.FormatInt(start.Unix(), 10))
+	q.Add("end", strconv.FormatInt(end.Unix(), 10))
+
+	url := fmt.Sprintf("%s/api/v1/series?%s", s.cfg.ConnectionURL, q.String())
+
+	log.Debug().
+		Str("url", url).
+		Msg("Sending series request to Victoria Metrics endpoint")
+
+	status, body, err := s.c.GetTimeout(nil, url, requestTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to send HTTP request to victoria metrics")
+	}
+
+	if status != fasthttp.StatusOK {
+		return nil, errors.Errorf("non-OK response from victoria metrics: %d: %s", status, string(body))
+	}
+
+	resp := new(seriesResponse)
+	if err = json.Unmarshal(body, resp); err != nil {
+		return nil, errors.Wrap(err, "failed to parse series response")
+	}
+	if resp.Status != "success" {
+		return nil, errors.Errorf("series request failed: %s", resp.Error)
+	}
+
+	return resp.Data, nil
+}
+
+type labelValuesResponse struct {
+	Status string   `json:"status"`
+	Error  string   `json:"error"`
+	Data   []string `json:"data"`
+}
+
+// LabelValues returns values of the label of series matching source selectors within the time range
+func (s Source) LabelValues(label string, start, end time.Time) ([]string, error) {
+	q := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(q)
+
+	for _, v := range s.cfg.TimeSeriesSelectors {
+		q.Add("match[]", v)
+	}
+	q.Add("start", strconv.FormatInt(start.Unix(), 10))
+	q.Add("end", strconv.FormatInt(end.Unix(), 10))
+
+	url := fmt.Sprintf("%s/api/v1/label/%s/values?%s", s.cfg.ConnectionURL, label, q.String())
+
+	log.Debug().
+		Str("url", url).
+		Msg("Sending label values request to Victoria Metrics endpoint")
+
+	status, body, err := s.c.GetTimeout(nil, url, requestTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to send HTTP request to victoria metrics")
+	}
+
+	if status != fasthttp.StatusOK {
+		return nil, errors.Errorf("non-OK response from victoria metrics: %d: %s", status, string(body))
+	}
+
+	resp := new(labelValuesResponse)
+	if err = json.Unmarshal(body, resp); err != nil {
+		return nil, errors.Wrap(err, "failed to parse label values response")
+	}
+	if resp.Status != "success" {
+		return nil, errors.Errorf("label values request failed: %s", resp.Error)
+	}
+
+	return resp.Data, nil
+}
+
+// SeriesCountByMetric groups series by metric name
+func SeriesCountByMetric(series []map[string]string) map[string]int {
+	res := make(map[string]int)
+	for _, labels := range series {
+		res[labels["__name__"]]++
+	}
+	return res
+}
+
+// SamplesCount returns the amount of samples of series matching source selectors within the time range
+func (s Source) SamplesCount(start, end time.Time) (int64, error) {
+	rangeSeconds := int64(end.Sub(start).Seconds())
+	if rangeSeconds <= 0 {
+		return 0, nil
+	}
+
+	var total int64
+	for _, sel := range s.cfg.TimeSeriesSelectors {
+		query := fmt.Sprintf("sum(count_over_time(%s[%ds]))", sel, rangeSeconds)
+		v, err := s.queryValue(query, end)
+		if err != nil {
+			return 0, err
+		}
+		total += int64(v)
+	}
+	return total, nil
+}
+
+type queryResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Value  []interface{}     `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// queryValue runs an instant query and returns the value of the first result, or 0 if the result is empty
+func (s Source) queryValue(query string, ts time.Time) (float64, error) {
+	q := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(q)
+
+	q.Add("query", query)
+	q.Add("time", formatTimestamp(ts))
+
+	url := fmt.Sprintf("%s/api/v1/query?%s", s.cfg.ConnectionURL, q.String())
+
+	log.Debug().
+		Str("url", url).
+		Msg("Sending query request to Victoria Metrics endpoint")
+
+	status, body, err := s.c.GetTimeout(nil, url, requestTimeout)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to send HTTP request to victoria metrics")
+	}
+
+	if status != fasthttp.StatusOK {
+		return 0, errors.Errorf("non-OK response from victoria metrics: %d: %s", status, string(body))
+	}
+
+	resp := new(queryResponse)
+	if err = json.Unmarshal(body, resp); err != nil {
+		return 0, errors.Wrap(err, "failed to parse query response")
+	}
+	if resp.Status != "success" {
+		return 0, errors.Errorf("query failed: %s", resp.Error)
+	}
+	if len(resp.Data.Result) == 0 {
+		return 0, nil
+	}
+	if len(resp.Data.Result[0].Value) != 2 {
+		return 0, errors.New("unexpected number of values")
+	}
+	str, ok := resp.Data.Result[0].Value[1].(string)
+	if !ok {
+		return 0, errors.New("value is not string")
+	}
+	return strconv.ParseFloat(str, 64)
+}
+
+// FreeDiskSpace returns available bytes of PMM Server data volume as reported by node exporter of the node
+// selected by the label filter, or 0 if it's unknown
+func (s Source) FreeDiskSpace(nodeFilter string) (float64, error) {
+	query := fmt.Sprintf(`min(node_filesystem_avail_bytes{%s,mountpoint=~"/srv|/"})`, nodeFilter)
+	return s.queryValue(query, time.Now())
+}
+
+// OldestSampleTime returns time of the oldest sample of series matching source selectors within lookback window
+// before end, or zero time if there are no samples
+func (s Source) OldestSampleTime(end time.Time, lookback time.Duration) (time.Time, error) {
+	var oldest float64
+	for _, sel := range s.cfg.TimeSeriesSelectors {
+		query := fmt.Sprintf("min(tfirst_over_time(%s[%ds]))", sel, int64(lookback.Seconds()))
+		v, err := s.queryValue(query, end)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if v > 0 && (oldest == 0 || v < oldest) {
+			oldest = v
+		}
+	}
+	if oldest == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(int64(oldest), 0).UTC(), nil
+}
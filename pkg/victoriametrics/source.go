@@ -7,7 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 	"pmm-transferer/pkg/dump"
-	"strconv"
+	"pmm-transferer/pkg/requestid"
 	"time"
 
 	"github.com/pkg/errors"
@@ -18,6 +18,36 @@ import (
 type Source struct {
 	c   *fasthttp.Client
 	cfg Config
+
+	// import batches are set if ImportBatchSize is set
+	nativeBatch *importBatch
+	jsonBatch   *importBatch
+
+	// limits adapts chunk exports to VictoriaMetrics query limits
+	limits *limitAdapter
+}
+
+// reservedExportParams are set from chunk meta and source selectors, so they can't be overridden by export params
+var reservedExportParams = []string{"match[]", "start", "end"}
+
+// jsonExportParams are supported by JSON lines export only, while chunks are read by native export, which ignores them
+var jsonExportParams = []string{"reduce_mem_usage", "max_rows_per_line"}
+
+// ValidateExportParams checks that export params don't override the parameters set by transferer
+// and are supported by native export
+func ValidateExportParams(params map[string]string) error {
+	for _, p := range reservedExportParams {
+		if _, ok := params[p]; ok {
+			return errors.Errorf("export param %q is set by transferer and can't be overridden", p)
+		}
+	}
+	for _, p := range jsonExportParams {
+		if _, ok := params[p]; ok {
+			return errors.Errorf("export param %q is not supported by native export, "+
+				"reduce chunk-time-range to lower memory usage of VictoriaMetrics", p)
+		}
+	}
+	return nil
 }
 
 func NewSource(c *fasthttp.Client, cfg Config) *Source {
@@ -25,32 +55,115 @@ func NewSource(c *fasthttp.Client, cfg Config) *Source {
 		cfg.TimeSeriesSelectors = []string{`{__name__=~".*"}`}
 	}
 
-	return &Source{
-		c:   c,
-		cfg: cfg,
+	s := &Source{
+		c:      c,
+		cfg:    cfg,
+		limits: newLimitAdapter(),
+	}
+	if cfg.ImportBatchSize > 0 {
+		s.nativeBatch = newImportBatch(cfg.ImportBatchSize, cfg.ImportFlushInterval, true)
+		s.jsonBatch = newImportBatch(cfg.ImportBatchSize, cfg.ImportFlushInterval, false)
 	}
+	return s
 }
 
 func (s Source) Type() dump.SourceType {
 	return dump.VictoriaMetrics
 }
 
+// ImportOrder allows concurrent import: each chunk is a separate import request
+func (s Source) ImportOrder() dump.ImportOrder {
+	return dump.ImportAnyOrder
+}
+
+// Meta describes the data exported by the source
+func (s Source) Meta() dump.SourceMeta {
+	return dump.SourceMeta{
+		Type:      dump.VictoriaMetrics.String(),
+		Selectors: s.cfg.TimeSeriesSelectors,
+	}
+}
+
 const requestTimeout = time.Second * 30
 
 func (s Source) ReadChunk(m dump.ChunkMeta) (*dump.Chunk, error) {
+	if m.Step > 0 {
+		return s.readDownsampledChunk(m)
+	}
+
+	attempts := s.cfg.ExportAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	expected, err := s.expectedSamples(m)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Samples of chunk %s are not checked", m.String())
+		expected = -1
+	}
+
+	for attempt := 1; ; attempt++ {
+		chunk, splits, err := s.readNativeWindows(m)
+		if err == nil {
+			var samples int64
+			if samples, err = validateChunk(chunk, expected); err == nil {
+				log.Debug().Msgf("Read chunk %s with %d samples", chunk.Filename, samples)
+				return chunk, nil
+			}
+			var mismatch sampleCountError
+			if errors.As(err, &mismatch) && attempt >= attempts && s.cfg.SampleCheck == SampleCheckWarn {
+				log.Warn().Msgf("Chunk %s is read with %d of %d expected samples", chunk.Filename, mismatch.read, mismatch.expected)
+				return chunk, nil
+			}
+		}
+
+		// limit errors are solved by adaptation, so they don't consume attempts
+		if s.limits.adapt(err, m, splits) {
+			attempt--
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if attempt >= attempts || !isRetryable(err) {
+			return nil, err
+		}
+		log.Warn().Err(err).Msgf("Failed to read chunk %s, retrying (%d/%d)...", m.String(), attempt, attempts)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// isRetryable reports if reading chunk again may succeed: client errors like bad selectors are not retried
+func isRetryable(err error) bool {
+	var respErr *dump.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode >= fasthttp.StatusInternalServerError || respErr.StatusCode == fasthttp.StatusTooManyRequests
+	}
+	return true
+}
+
+func (s Source) readNativeChunk(m dump.ChunkMeta) (*dump.Chunk, error) {
 	q := fasthttp.AcquireArgs()
 	defer fasthttp.ReleaseArgs(q)
 
-	for _, v := range s.cfg.TimeSeriesSelectors {
+	selectors, err := s.chunkSelectors(m)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range selectors {
 		q.Add("match[]", v)
 	}
 
 	if m.Start != nil {
-		q.Add("start", strconv.FormatInt(m.Start.Unix(), 10))
+		q.Add("start", formatTimestamp(*m.Start))
 	}
 
+	// chunk ranges are half-open, while export end is inclusive: sample at the boundary belongs to the next chunk
 	if m.End != nil {
-		q.Add("end", strconv.FormatInt(m.End.Unix(), 10))
+		q.Add("end", formatTimestamp(m.End.Add(-time.Millisecond)))
+	}
+
+	for k, v := range s.cfg.ExportParams {
+		q.Add(k, v)
 	}
 
 	url := fmt.Sprintf("%s/api/v1/export/native?%s", s.cfg.ConnectionURL, q.String())
@@ -66,18 +179,19 @@ func (s Source) ReadChunk(m dump.ChunkMeta) (*dump.Chunk, error) {
 	req.Header.SetMethod(fasthttp.MethodGet)
 	req.SetRequestURI(url)
 	req.Header.Set(fasthttp.HeaderAcceptEncoding, "gzip")
+	requestID := tagRequest(req)
 
 	resp := fasthttp.AcquireResponse()
 	defer fasthttp.ReleaseResponse(resp)
 
 	if err := s.c.DoTimeout(req, resp, requestTimeout); err != nil {
-		return nil, errors.Wrap(err, "failed to send HTTP request to victoria metrics")
+		return nil, sendError(err, requestID)
 	}
 
 	body := copyBytesArr(resp.Body())
 
 	if status := resp.StatusCode(); status != fasthttp.StatusOK {
-		return nil, errors.Errorf("non-OK response from victoria metrics: %d: %s", status, gzipDecode(body))
+		return nil, newResponseError(status, gzipDecode(body), requestID)
 	}
 
 	log.Debug().Msg("Got successful response from Victoria Metrics")
@@ -86,11 +200,18 @@ func (s Source) ReadChunk(m dump.ChunkMeta) (*dump.Chunk, error) {
 		ChunkMeta: m,
 		Content:   body,
 		Filename:  m.String() + ".bin",
+		Encoding:  dump.EncodingVMNative,
 	}
 
 	return chunk, nil
 }
 
+// formatTimestamp formats time as Unix seconds with milliseconds, which is the precision of VM timestamps
+func formatTimestamp(t time.Time) string {
+	ms := t.UnixNano() / int64(time.Millisecond)
+	return fmt.Sprintf("%d.%03d", ms/1000, ms%1000)
+}
+
 func gzipDecode(data []byte) string {
 	r, err := gzip.NewReader(bytes.NewReader(data))
 	if err != nil {
@@ -103,27 +224,231 @@ func gzipDecode(data []byte) string {
 	return string(result)
 }
 
+func newResponseError(status int, body, requestID string) error {
+	return &dump.ResponseError{
+		Source:     dump.VictoriaMetrics,
+		StatusCode: status,
+		Body:       body,
+		RequestID:  requestID,
+	}
+}
+
+// tagRequest sets request ID header, if request IDs are enabled, and returns the ID
+func tagRequest(req *fasthttp.Request) string {
+	id := requestid.Next()
+	if id != "" {
+		req.Header.Set(requestid.Header, id)
+		log.Debug().Msgf("Request ID: %s", id)
+	}
+	return id
+}
+
+// sendError wraps failure of the request, request ID allows to find it in the server logs on timeouts
+func sendError(err error, requestID string) error {
+	if requestID == "" {
+		return errors.Wrap(err, "failed to send HTTP request to victoria metrics")
+	}
+	return errors.Wrapf(err, "failed to send HTTP request %s to victoria metrics", requestID)
+}
+
 func copyBytesArr(a []byte) []byte {
 	c := make([]byte, len(a))
 	copy(c, a)
 	return c
 }
 
-func (s Source) WriteChunk(_ string, r io.Reader) error {
-	chunkContent, err := ioutil.ReadAll(r)
+func (s Source) WriteChunk(filename string, r io.Reader) error {
+	_, err := s.writeChunk(filename, isDownsampledChunk(filename), r, nil)
+	return err
+}
+
+// WriteEncodings returns encodings of the chunks VictoriaMetrics has import API for
+func (s Source) WriteEncodings() []dump.ChunkEncoding {
+	return []dump.ChunkEncoding{dump.EncodingVMNative, dump.EncodingVMJSONLines, dump.EncodingOpenMetrics}
+}
+
+// WriteEncodedChunk writes the chunk by the import API of its encoding
+func (s Source) WriteEncodedChunk(filename string, e dump.ChunkEncoding, r io.Reader) error {
+	_, err := s.WriteBatchedChunk(filename, e, r, nil)
+	return err
+}
+
+// WriteBatchedChunk writes the chunk by the import API of its encoding, adding it to the import batch
+// if import-batch-size is set. Without the report, errors of the batch requests are returned
+func (s Source) WriteBatchedChunk(filename string, e dump.ChunkEncoding, r io.Reader, report dump.BatchReport) (bool, error) {
+	switch e {
+	case dump.EncodingVMNative:
+		return s.writeChunk(filename, false, r, report)
+	case dump.EncodingVMJSONLines:
+		return s.writeChunk(filename, true, r, report)
+	case dump.EncodingOpenMetrics:
+		return false, s.writePrometheusChunk(filename, r)
+	case dump.EncodingUndetermined:
+		return s.writeChunk(filename, isDownsampledChunk(filename), r, report)
+	default:
+		return false, errors.Errorf("unsupported chunk encoding: %s", e)
+	}
+}
+
+// EmptyChunk reports if the chunk has no series: payload of empty export is empty after decompression
+func (s Source) EmptyChunk(_ string, _ dump.ChunkEncoding, content []byte) bool {
+	gzr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return false
+	}
+	defer gzr.Close()
+
+	var b [1]byte
+	_, err = io.ReadFull(gzr, b[:])
+	return err == io.EOF
+}
+
+// writePrometheusChunk writes chunk of Prometheus text exposition format. Such chunks are not remapped and batched
+func (s Source) writePrometheusChunk(filename string, r io.Reader) error {
+	if s.cfg.ImportDownsampled {
+		log.Debug().Msgf("Skipping chunk %s: resolution is not selected for import", filename)
+		return nil
+	}
+	if len(s.cfg.Remapping) != 0 || s.cfg.Filter != nil || s.cfg.MetricPrefix != "" {
+		return errors.Errorf("labels of %s chunks can't be remapped, routed or prefixed", dump.EncodingOpenMetrics)
+	}
+	// series of the chunk can't be selected by name, so the chunk is imported as a whole by the excluding filter
+	if f := s.cfg.NameFilter; f != nil && !f.exclude {
+		log.Debug().Msgf("Skipping chunk %s: %s chunks aren't filtered by metric name", filename, dump.EncodingOpenMetrics)
+		return nil
+	}
+
+	content, err := ioutil.ReadAll(r)
 	if err != nil {
 		return errors.Wrap(err, "failed to read chunk content")
 	}
+	return s.postChunk(fmt.Sprintf("%s/api/v1/import/prometheus", s.cfg.ConnectionURL), content)
+}
+
+func (s Source) writeChunk(filename string, downsampled bool, r io.Reader, report dump.BatchReport) (bool, error) {
+	if downsampled != s.cfg.ImportDownsampled {
+		log.Debug().Msgf("Skipping chunk %s: resolution is not selected for import", filename)
+		return false, nil
+	}
 
 	url := fmt.Sprintf("%s/api/v1/import/native", s.cfg.ConnectionURL)
+	if downsampled {
+		url = fmt.Sprintf("%s/api/v1/import", s.cfg.ConnectionURL)
+	}
+
+	if s.passthrough() {
+		log.Debug().Msgf("Streaming chunk %s as is", filename)
+		return false, s.sendImport(url, EncodingGzip, func(req *fasthttp.Request) {
+			req.SetBodyStream(r, readerSize(r))
+		})
+	}
+
+	chunkContent, err := ioutil.ReadAll(r)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read chunk content")
+	}
+
+	if len(s.cfg.Remapping) != 0 || s.cfg.Filter != nil || s.cfg.MetricPrefix != "" || s.cfg.NameFilter != nil {
+		if chunkContent, err = s.remapChunk(chunkContent, downsampled); err != nil {
+			return false, errors.Wrap(err, "failed to remap chunk labels")
+		}
+	}
+
+	if s.cfg.ImportBatchSize <= 0 {
+		return false, s.postChunk(url, chunkContent)
+	}
+
+	batch := s.nativeBatch
+	if downsampled {
+		batch = s.jsonBatch
+	}
+	requests, batched, err := batch.add(chunkContent, report)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to add chunk to import batch")
+	}
+
+	log.Debug().Msgf("Chunk %s is added to import batch, sending %d requests", filename, len(requests))
+
+	for _, req := range requests {
+		if err = s.postChunk(url, req.body); !batch.sent(req, err) && err != nil {
+			return false, err
+		}
+	}
+	return batched && report != nil, nil
+}
+
+// FlushBatches sends partially filled import batches. Errors are reported to the chunks of failed requests,
+// they are returned only if some chunks of the request have no report
+func (s Source) FlushBatches() error {
+	if s.cfg.ImportBatchSize <= 0 {
+		return nil
+	}
+
+	batches := []struct {
+		b   *importBatch
+		url string
+	}{
+		{s.nativeBatch, fmt.Sprintf("%s/api/v1/import/native", s.cfg.ConnectionURL)},
+		{s.jsonBatch, fmt.Sprintf("%s/api/v1/import", s.cfg.ConnectionURL)},
+	}
+	for _, b := range batches {
+		req, ok, err := b.b.flush()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err = s.postChunk(b.url, req.body); !b.b.sent(req, err) && err != nil {
+			return errors.Wrap(err, "failed to send import batch")
+		}
+	}
+	return nil
+}
 
+// passthrough reports if gzipped dump content is accepted by the import API as is,
+// so it can be streamed to the request without reading, decompressing and compressing it again
+func (s Source) passthrough() bool {
+	return len(s.cfg.Remapping) == 0 && s.cfg.Filter == nil && s.cfg.MetricPrefix == "" && s.cfg.NameFilter == nil &&
+		s.cfg.ImportBatchSize <= 0 &&
+		(s.cfg.ImportEncoding == "" || s.cfg.ImportEncoding == EncodingGzip)
+}
+
+// readerSize returns the amount of unread bytes if it's known, -1 otherwise
+func readerSize(r io.Reader) int {
+	if l, ok := r.(interface{ Len() int }); ok {
+		return l.Len()
+	}
+	return -1
+}
+
+func (s Source) postChunk(url string, content []byte) error {
+	body, err := encodeImportBody(content, s.cfg.ImportEncoding)
+	if err != nil {
+		return err
+	}
+
+	encoding := s.cfg.ImportEncoding
+	if encoding == "" {
+		encoding = EncodingGzip
+	}
+
+	return s.sendImport(url, encoding, func(req *fasthttp.Request) {
+		req.SetBody(body)
+	})
+}
+
+func (s Source) sendImport(url, encoding string, setBody func(req *fasthttp.Request)) error {
 	req := fasthttp.AcquireRequest()
 	defer fasthttp.ReleaseRequest(req)
 
-	req.SetBody(chunkContent)
+	setBody(req)
 	req.Header.SetMethod(fasthttp.MethodPost)
-	req.Header.Set(fasthttp.HeaderContentEncoding, "gzip")
+	if encoding != EncodingIdentity {
+		req.Header.Set(fasthttp.HeaderContentEncoding, encoding)
+	}
 	req.SetRequestURI(url)
+	requestID := tagRequest(req)
 
 	resp := fasthttp.AcquireResponse()
 	defer fasthttp.ReleaseResponse(resp)
@@ -132,12 +457,12 @@ func (s Source) WriteChunk(_ string, r io.Reader) error {
 		Str("url", url).
 		Msg("Sending POST chunk request to Victoria Metrics endpoint")
 
-	if err = s.c.DoTimeout(req, resp, requestTimeout); err != nil {
-		return errors.Wrap(err, "failed to send HTTP request to victoria metrics")
+	if err := s.c.DoTimeout(req, resp, requestTimeout); err != nil {
+		return sendError(err, requestID)
 	}
 
 	if s := resp.StatusCode(); s != fasthttp.StatusOK && s != fasthttp.StatusNoContent {
-		return errors.Errorf("non-OK response from victoria metrics: %d: %s", s, gzipDecode(resp.Body()))
+		return newResponseError(s, gzipDecode(resp.Body()), requestID)
 	}
 
 	log.Debug().Msg("Got successful response from Victoria Metrics")
@@ -146,6 +471,16 @@ func (s Source) WriteChunk(_ string, r io.Reader) error {
 }
 
 func (s Source) FinalizeWrites() error {
+	if err := s.FlushBatches(); err != nil {
+		return err
+	}
+
+	if s.cfg.Agent {
+		// vmagent has no rollup cache, the data gets to the storage after it's replayed from remote write buffer
+		log.Info().Msg("Chunks are sent to vmagent, the data appears after vmagent replays it to remote write targets")
+		return nil
+	}
+
 	url := fmt.Sprintf("%s/internal/resetRollupResultCache", s.cfg.ConnectionURL)
 
 	log.Debug().
@@ -0,0 +1,48 @@
+package victoriametrics
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// staleNaNBits is the bit pattern of the staleness marker: a special NaN written when a series disappears,
+// so rate() and other rollup functions don't extend the series over the lookback window
+const staleNaNBits = 0x7ff0000000000002
+
+var staleNaN = math.Float64frombits(staleNaNBits)
+
+// sampleValue is a value of VM JSON line format. Staleness markers are written as null and infinities as strings,
+// the same way as by /api/v1/export, since JSON has no representation for them
+type sampleValue float64
+
+func (v sampleValue) MarshalJSON() ([]byte, error) {
+	f := float64(v)
+	switch {
+	case math.IsNaN(f):
+		return []byte("null"), nil
+	case math.IsInf(f, 1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Infinity"`), nil
+	}
+	return strconv.AppendFloat(nil, f, 'g', -1, 64), nil
+}
+
+func (v *sampleValue) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if s == "null" {
+		*v = sampleValue(staleNaN)
+		return nil
+	}
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return errors.Wrapf(err, "invalid sample value %s", string(b))
+	}
+	*v = sampleValue(f)
+	return nil
+}
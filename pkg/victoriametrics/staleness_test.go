@@ -0,0 +1,151 @@
+package victoriametrics
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSampleValueJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		value float64
+		json  string
+	}{
+		{name: "number", value: 1.5, json: `1.5`},
+		{name: "staleness marker", value: staleNaN, json: `null`},
+		{name: "positive infinity", value: math.Inf(1), json: `"Infinity"`},
+		{name: "negative infinity", value: math.Inf(-1), json: `"-Infinity"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(sampleValue(tt.value))
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			if string(b) != tt.json {
+				t.Fatalf("marshaled %s, expected %s", b, tt.json)
+			}
+
+			var v sampleValue
+			if err = json.Unmarshal(b, &v); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if math.Float64bits(float64(v)) != math.Float64bits(tt.value) {
+				t.Fatalf("unmarshaled %x, expected %x", math.Float64bits(float64(v)), math.Float64bits(tt.value))
+			}
+		})
+	}
+}
+
+func TestSampleValueUnmarshalInvalid(t *testing.T) {
+	var v sampleValue
+	if err := json.Unmarshal([]byte(`"abc"`), &v); err == nil {
+		t.Fatal("expected error for invalid value")
+	}
+}
+
+func TestToJSONLineStaleness(t *testing.T) {
+	const step = 15 * time.Second
+	point := func(sec float64, value string) []interface{} {
+		return []interface{}{sec, value}
+	}
+
+	tests := []struct {
+		name       string
+		values     [][]interface{}
+		end        time.Time
+		timestamps []int64
+		// stale marks values expected to be staleness markers
+		stale []bool
+		want  []float64
+	}{
+		{
+			name:       "continuous series ending at the range end",
+			values:     [][]interface{}{point(0, "1"), point(15, "2"), point(30, "3")},
+			end:        time.Unix(30, 0),
+			timestamps: []int64{0, 15000, 30000},
+			stale:      []bool{false, false, false},
+			want:       []float64{1, 2, 3},
+		},
+		{
+			name:       "gap is marked after the last point before it",
+			values:     [][]interface{}{point(0, "1"), point(15, "2"), point(60, "3")},
+			end:        time.Unix(60, 0),
+			timestamps: []int64{0, 15000, 30000, 60000},
+			stale:      []bool{false, false, true, false},
+			want:       []float64{1, 2, 0, 3},
+		},
+		{
+			name:       "series disappearing before the range end is marked",
+			values:     [][]interface{}{point(0, "1"), point(15, "2")},
+			end:        time.Unix(60, 0),
+			timestamps: []int64{0, 15000, 30000},
+			stale:      []bool{false, false, true},
+			want:       []float64{1, 2, 0},
+		},
+		{
+			name:       "NaN results are skipped, infinities are kept",
+			values:     [][]interface{}{point(0, "NaN"), point(15, "+Inf"), point(30, "-Inf")},
+			end:        time.Unix(30, 0),
+			timestamps: []int64{15000, 30000},
+			stale:      []bool{false, false},
+			want:       []float64{math.Inf(1), math.Inf(-1)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line, err := toJSONLine(map[string]string{"__name__": "up"}, tt.values, step, tt.end)
+			if err != nil {
+				t.Fatalf("toJSONLine: %v", err)
+			}
+			if len(line.Timestamps) != len(tt.timestamps) || len(line.Values) != len(tt.timestamps) {
+				t.Fatalf("got timestamps %v and %d values, expected timestamps %v", line.Timestamps, len(line.Values), tt.timestamps)
+			}
+			for i, ts := range tt.timestamps {
+				if line.Timestamps[i] != ts {
+					t.Fatalf("timestamp #%d is %d, expected %d", i, line.Timestamps[i], ts)
+				}
+				v := float64(line.Values[i])
+				if tt.stale[i] {
+					if math.Float64bits(v) != staleNaNBits {
+						t.Fatalf("value #%d is %v, expected staleness marker", i, v)
+					}
+					continue
+				}
+				if v != tt.want[i] {
+					t.Fatalf("value #%d is %v, expected %v", i, v, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestToJSONLineRoundTrip(t *testing.T) {
+	values := [][]interface{}{{float64(0), "1"}, {float64(60), "+Inf"}}
+	line, err := toJSONLine(map[string]string{"__name__": "up"}, values, 15*time.Second, time.Unix(60, 0))
+	if err != nil {
+		t.Fatalf("toJSONLine: %v", err)
+	}
+
+	b, err := json.Marshal(line)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	expected := `{"metric":{"__name__":"up"},"values":[1,null,"Infinity"],"timestamps":[0,15000,60000]}`
+	if string(b) != expected {
+		t.Fatalf("marshaled %s, expected %s", b, expected)
+	}
+
+	var parsed jsonLine
+	if err = json.Unmarshal(b, &parsed); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if math.Float64bits(float64(parsed.Values[1])) != staleNaNBits {
+		t.Fatalf("staleness marker is lost: %v", parsed.Values[1])
+	}
+	if !math.IsInf(float64(parsed.Values[2]), 1) {
+		t.Fatalf("infinity is lost: %v", parsed.Values[2])
+	}
+}